@@ -0,0 +1,154 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/asips/sdtp-client/internal"
+	"github.com/asips/sdtp-client/internal/log"
+)
+
+// ackQueueSize is how many verified files may wait to be acked before
+// downloads block.
+const ackQueueSize = 1024
+
+// ackQueue acks verified files in the background, with its own workers, so
+// ack latency does not hold up downloads. Failed acks are retried with
+// exponential backoff. Files not acked by the time the queue is closed are
+// recorded in the run state so the next run acks them first.
+type ackQueue struct {
+	sdtp    internal.FileDownloader
+	stats   *ingestStats
+	state   *runState
+	retries int
+	backoff time.Duration
+
+	files chan unackedFile
+	wg    sync.WaitGroup
+}
+
+func newAckQueue(ctx context.Context, sdtp internal.FileDownloader, opts ingestOptions, stats *ingestStats, state *runState) *ackQueue {
+	q := &ackQueue{
+		sdtp:    sdtp,
+		stats:   stats,
+		state:   state,
+		retries: opts.ackRetries,
+		backoff: opts.ackBackoff,
+		files:   make(chan unackedFile, ackQueueSize),
+	}
+	for range max(opts.ackConcurrency, 1) {
+		q.wg.Add(1)
+		go q.worker(ctx)
+	}
+	return q
+}
+
+// add queues file, written to p or piped if p is empty, to be acked. If ctx is
+// done first the file is recorded as unacked.
+func (q *ackQueue) add(ctx context.Context, file internal.FileInfo, p string) {
+	item := unackedFile{FileInfo: file, Path: p}
+	q.stats.ackPending.Add(1)
+	if ctx.Err() != nil {
+		q.unacked(item)
+		return
+	}
+	select {
+	case q.files <- item:
+	case <-ctx.Done():
+		q.unacked(item)
+	}
+}
+
+// close waits for the queued files to be acked, or ctx to be done, recording
+// any left over as unacked.
+func (q *ackQueue) close() {
+	close(q.files)
+	q.wg.Wait()
+	for item := range q.files {
+		q.unacked(item)
+	}
+}
+
+// unacked records item as left unacked, along with the providers it still has
+// to be acked on.
+func (q *ackQueue) unacked(item unackedFile) {
+	if tracker, ok := q.sdtp.(internal.OriginTracker); ok {
+		if origins := tracker.Origins(item.FileInfo); len(origins) > 0 {
+			item.Providers = origins
+		}
+	}
+	q.state.addUnacked(item)
+}
+
+func (q *ackQueue) worker(ctx context.Context) {
+	defer q.wg.Done()
+	for {
+		select {
+		case item, more := <-q.files:
+			if !more {
+				return
+			}
+			if ctx.Err() != nil {
+				q.unacked(item)
+				return
+			}
+			q.ack(ctx, item)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (q *ackQueue) ack(ctx context.Context, item unackedFile) {
+	file := item.FileInfo
+	for attempt := 0; ; attempt++ {
+		err := q.sdtp.Ack(ctx, file)
+		if err == nil {
+			q.stats.ackPending.Add(-1)
+			q.stats.acked.Add(1)
+			metricFilesAcked.Inc()
+			return
+		}
+		if ctx.Err() != nil {
+			// left pending for the next run
+			q.unacked(item)
+			return
+		}
+		if attempt >= q.retries || !retryableAck(err) {
+			log.Printf("failed to ack fileid=%d(%s); %s", file.ID, file.Name, err)
+			q.stats.ackPending.Add(-1)
+			q.stats.ackFailed.Add(1)
+			metricAcksFailed.Inc()
+			// a file the server no longer has can never be acked
+			if !errors.Is(err, internal.ErrNotFound) {
+				q.unacked(item)
+			}
+			return
+		}
+
+		delay := q.backoff << attempt
+		log.Debug("retrying ack of fileid=%d(%s) in %s; %s", file.ID, file.Name, delay, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			q.unacked(item)
+			return
+		}
+	}
+}
+
+// retryableAck returns true if an ack that failed with err may succeed if
+// sent again.
+func retryableAck(err error) bool {
+	switch {
+	case errors.Is(err, internal.ErrNotFound),
+		errors.Is(err, internal.ErrNotAuthorized),
+		errors.Is(err, internal.ErrForbidden):
+		return false
+	}
+	return true
+}
@@ -0,0 +1,151 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/asips/sdtp-client/internal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyAcker fails the first failures acks of each file with err.
+type flakyAcker struct {
+	*mockSDTP
+	failures int
+	err      error
+
+	mu       sync.Mutex
+	attempts map[int64]int
+	acked    []int64
+}
+
+func (a *flakyAcker) Ack(ctx context.Context, file internal.FileInfo) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.attempts[file.ID]++
+	if a.attempts[file.ID] <= a.failures {
+		return a.err
+	}
+	a.acked = append(a.acked, file.ID)
+	return nil
+}
+
+func Test_ackQueue(t *testing.T) {
+	newQueue := func(ctx context.Context, acker *flakyAcker, retries int) (*ackQueue, *ingestStats, *runState) {
+		stats, state := &ingestStats{}, newRunState()
+		opts := ingestOptions{ackConcurrency: 2, ackRetries: retries}
+		return newAckQueue(ctx, acker, opts, stats, state), stats, state
+	}
+
+	t.Run("retries", func(t *testing.T) {
+		acker := &flakyAcker{mockSDTP: createMockSDTP(t), failures: 2, err: errors.New("connection reset"), attempts: map[int64]int{}}
+		q, stats, state := newQueue(t.Context(), acker, 2)
+		q.add(t.Context(), internal.FileInfo{ID: 1}, "")
+		q.add(t.Context(), internal.FileInfo{ID: 2}, "")
+		q.close()
+
+		assert.ElementsMatch(t, []int64{1, 2}, acker.acked)
+		assert.Equal(t, int64(2), stats.acked.Load())
+		assert.Equal(t, int64(0), stats.ackPending.Load())
+		assert.Empty(t, state.unacked)
+	})
+
+	t.Run("retries exhausted", func(t *testing.T) {
+		acker := &flakyAcker{mockSDTP: createMockSDTP(t), failures: 5, err: errors.New("connection reset"), attempts: map[int64]int{}}
+		q, stats, state := newQueue(t.Context(), acker, 2)
+		q.add(t.Context(), internal.FileInfo{ID: 1}, "/data/a.dat")
+		q.close()
+
+		assert.Equal(t, 3, acker.attempts[1])
+		assert.Equal(t, int64(1), stats.ackFailed.Load())
+		assert.Equal(t, int64(0), stats.ackPending.Load())
+		assert.Equal(t, unackedFile{FileInfo: internal.FileInfo{ID: 1}, Path: "/data/a.dat"}, state.unacked[internal.FileKey(internal.FileInfo{ID: 1})])
+	})
+
+	t.Run("not found is not retried or saved", func(t *testing.T) {
+		acker := &flakyAcker{mockSDTP: createMockSDTP(t), failures: 5, err: internal.ErrNotFound, attempts: map[int64]int{}}
+		q, stats, state := newQueue(t.Context(), acker, 2)
+		q.add(t.Context(), internal.FileInfo{ID: 1}, "")
+		q.close()
+
+		assert.Equal(t, 1, acker.attempts[1])
+		assert.Equal(t, int64(1), stats.ackFailed.Load())
+		assert.Empty(t, state.unacked)
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		acker := &flakyAcker{mockSDTP: createMockSDTP(t), attempts: map[int64]int{}}
+		ctx, cancel := context.WithCancel(t.Context())
+		cancel()
+		q, stats, state := newQueue(ctx, acker, 2)
+		q.add(ctx, internal.FileInfo{ID: 1}, "")
+		q.close()
+
+		assert.Empty(t, acker.acked)
+		assert.Equal(t, int64(1), stats.ackPending.Load())
+		assert.Contains(t, state.unacked, internal.FileKey(internal.FileInfo{ID: 1}))
+	})
+}
+
+func Test_doIngest_resumeAcksFirst(t *testing.T) {
+	dir := t.TempDir()
+	prev := &ingestState{
+		Status:  runAborted,
+		Unacked: []unackedFile{{FileInfo: internal.FileInfo{ID: 7, Name: "old.dat"}}},
+	}
+	require.NoError(t, prev.save(dir, ""))
+
+	sdtp := &recordingSDTP{mockSDTP: createMockSDTP(t)}
+	sdtp.listing = []internal.FileInfo{{ID: 7, Name: "old.dat"}, {ID: 8, Name: "new.dat"}}
+
+	err := doIngest(t.Context(), nil, sdtp, ingestOptions{
+		destDir:        dir,
+		stateDir:       dir,
+		concurrency:    1,
+		ackConcurrency: 1,
+		onExists:       existsOverwrite,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{8}, sdtp.downloaded, "the resumed file is not downloaded again")
+	assert.Equal(t, []int64{7, 8}, sdtp.acked)
+}
+
+func Test_doIngest_resumeAcksOnProvider(t *testing.T) {
+	dir := t.TempDir()
+	prev := &ingestState{
+		Status: runInterrupted,
+		Unacked: []unackedFile{{
+			FileInfo:  internal.FileInfo{ID: 17, Name: "old.dat", Checksum: "md5:old"},
+			Providers: []internal.FileOrigin{{Provider: "backup", ID: 17}},
+		}},
+	}
+	require.NoError(t, prev.save(dir, ""))
+
+	// the primary has a different file with the same id
+	primary := &recordingSDTP{mockSDTP: createMockSDTP(t)}
+	primary.listing = []internal.FileInfo{{ID: 17, Name: "other.dat", Checksum: "md5:other"}}
+	backup := &recordingSDTP{mockSDTP: createMockSDTP(t), ackErr: internal.ErrForbidden}
+	sdtp, err := internal.NewMultiClient(internal.ProviderFailover,
+		internal.Provider{Name: "primary", Client: primary}, internal.Provider{Name: "backup", Client: backup})
+	require.NoError(t, err)
+
+	opts := ingestOptions{destDir: dir, stateDir: dir, concurrency: 1, ackConcurrency: 1, onExists: existsOverwrite}
+	require.NoError(t, doIngest(t.Context(), nil, sdtp, opts))
+	assert.Equal(t, []int64{17}, primary.acked, "only the file the primary listed")
+
+	// the failed ack is left for the next run, still on the backup
+	state, err := loadIngestState(dir, "")
+	require.NoError(t, err)
+	require.Len(t, state.Unacked, 1)
+	assert.Equal(t, "old.dat", state.Unacked[0].Name)
+	assert.Equal(t, []internal.FileOrigin{{Provider: "backup", ID: 17}}, state.Unacked[0].Providers)
+
+	backup.ackErr = nil
+	primary.listing = nil
+	require.NoError(t, doIngest(t.Context(), nil, sdtp, opts))
+	assert.Equal(t, []int64{17}, primary.acked)
+	assert.Equal(t, []int64{17}, backup.acked)
+}
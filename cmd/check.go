@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"os"
 	"os/signal"
@@ -11,12 +12,21 @@ import (
 	"github.com/asips/sdtp-client/internal"
 	"github.com/asips/sdtp-client/internal/log"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 var checkCmd = &cobra.Command{
 	Use:   "check",
 	Short: "check a new client certificate with the server",
-	Long:  "check a new client certificate with the server",
+	Long: `check a new client certificate with the server.
+
+Exits 3 if the certificate is expired, 2 if it expires within --check-cert-days and the
+server check passed, and 1 if the server check failed.
+
+With --monitoring a single status line with performance data is printed instead, and the
+exit code is 0 (OK), 1 (WARNING), 2 (CRITICAL) or 3 (UNKNOWN), for use as a Nagios
+compatible monitoring plugin.
+`,
 	Run: func(cmd *cobra.Command, args []string) {
 		flags := cmd.Flags()
 		certPath, err := flags.GetString("cert")
@@ -25,29 +35,99 @@ var checkCmd = &cobra.Command{
 		cobra.CheckErr(err)
 		checkCertDays, err := flags.GetInt("check-cert-days")
 		cobra.CheckErr(err)
-		httpTimeout, err := flags.GetDuration("http-timeout")
-		cobra.CheckErr(err)
 		apiUrlStr, err := flags.GetString("api-url")
 		cobra.CheckErr(err)
 		apiUrl := parseApiUrl(apiUrlStr)
-		sdtp, err := internal.NewDefaultSDTP(apiUrl, certPath, keyPath, httpTimeout)
+		monitoring, err := flags.GetBool("monitoring")
+		cobra.CheckErr(err)
+
+		var monitorOpts monitorOptions
+		if monitoring {
+			monitorOpts = monitorOptionsFromFlags(flags)
+			if err := monitorOpts.validate(); err != nil {
+				fmt.Printf("SDTP %s - %s\n", statusUnknown, err)
+				log.Exit(int(statusUnknown))
+			}
+		}
+
+		sdtp, err := internal.NewDefaultSDTP(apiUrl, certPath, keyPath, clientOptionsFromFlags(flags))
 		if err != nil {
+			if monitoring {
+				fmt.Printf("SDTP %s - failed to create SDTP client: %s\n", statusUnknown, err)
+				log.Exit(int(statusUnknown))
+			}
 			log.Fatal("Failed to create SDTP client: %s", err)
 		}
 
-		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		ctx, cancel := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
 		defer cancel()
 
+		if monitoring {
+			res := doMonitor(ctx, sdtp, certPath, keyPath, getCertificateInfo, monitorOpts)
+			fmt.Println(res)
+			log.Exit(int(res.status))
+		}
+
 		err = doCheck(ctx, sdtp, certPath, keyPath, checkCertDays, getCertificateInfo)
-		if err == errCertExpired {
-			os.Exit(3)
-		} else if err != nil {
-			os.Exit(1)
+		switch {
+		case err == errCertExpired:
+			log.Exit(3)
+		case err == errCertExpiringSoon:
+			log.Exit(2)
+		case err != nil:
+			log.Printf("ERROR: %s", err)
+			log.Exit(1)
 		}
 	},
 }
 
-var errCertExpired = fmt.Errorf("certificate expired")
+func init() {
+	flags := checkCmd.Flags()
+
+	flags.Bool("monitoring", false, "Print a single monitoring plugin status line with performance data and "+
+		"exit 0 (OK), 1 (WARNING), 2 (CRITICAL) or 3 (UNKNOWN)")
+	flags.StringToStringP("tag", "t", map[string]string{}, "<key>=<value> tags used to list the backlog with --monitoring")
+	flags.Int("warning-days", 30, "With --monitoring, WARNING if the certificate expires within this many days")
+	flags.Int("critical-days", 7, "With --monitoring, CRITICAL if the certificate expires within this many days")
+	flags.Int("backlog-warning", 0, "With --monitoring, WARNING if at least this many files are waiting. 0 disables")
+	flags.Int("backlog-critical", 0, "With --monitoring, CRITICAL if at least this many files are waiting. 0 disables")
+	flags.Duration("retention", 0, "How long the provider keeps files, used to work out the age of the oldest file from its expiration")
+	flags.Duration("age-warning", 0, "With --monitoring, WARNING if the oldest file is at least this old. Requires --retention")
+	flags.Duration("age-critical", 0, "With --monitoring, CRITICAL if the oldest file is at least this old. Requires --retention")
+}
+
+func monitorOptionsFromFlags(flags *pflag.FlagSet) monitorOptions {
+	var opts monitorOptions
+	var err error
+	opts.tags, err = flags.GetStringToString("tag")
+	cobra.CheckErr(err)
+	opts.warningDays, err = flags.GetInt("warning-days")
+	cobra.CheckErr(err)
+	opts.criticalDays, err = flags.GetInt("critical-days")
+	cobra.CheckErr(err)
+	opts.backlogWarning, err = flags.GetInt("backlog-warning")
+	cobra.CheckErr(err)
+	opts.backlogCritical, err = flags.GetInt("backlog-critical")
+	cobra.CheckErr(err)
+	opts.retention, err = flags.GetDuration("retention")
+	cobra.CheckErr(err)
+	opts.ageWarning, err = flags.GetDuration("age-warning")
+	cobra.CheckErr(err)
+	opts.ageCritical, err = flags.GetDuration("age-critical")
+	cobra.CheckErr(err)
+	return opts
+}
+
+var (
+	errCertExpired      = fmt.Errorf("certificate expired")
+	errCertExpiringSoon = fmt.Errorf("certificate expires soon")
+)
+
+// tlsChecker is implemented by clients that can report the negotiated TLS
+// connection state when checking the server.
+type tlsChecker interface {
+	CheckTLS(ctx context.Context) (*tls.ConnectionState, error)
+}
 
 func doCheck(ctx context.Context, sdtp internal.SDTPClient, certPath, keyPath string, checkCertDays int, certParser certParserFunc) error {
 
@@ -87,7 +167,15 @@ WARNING:
 `, certInfo.DN, certInfo.Expiration.Format(time.RFC3339), certInfo.DaysLeft, certInfo.Issuer)
 	}
 
-	err = sdtp.Check(ctx)
+	if tc, ok := sdtp.(tlsChecker); ok {
+		var state *tls.ConnectionState
+		state, err = tc.CheckTLS(ctx)
+		if state != nil {
+			log.Printf("Negotiated %s using cipher suite %s", tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite))
+		}
+	} else {
+		err = sdtp.Check(ctx)
+	}
 	if err != nil {
 		switch err {
 		case internal.ErrNotAuthorized:
@@ -99,5 +187,8 @@ WARNING:
 	}
 	log.Printf("Successfully connected to server and performed a HEAD request to the /files endpoint.")
 
+	if certInfo.DaysLeft > 0 && certInfo.DaysLeft <= checkCertDays {
+		return errCertExpiringSoon
+	}
 	return nil
 }
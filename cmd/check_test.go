@@ -55,3 +55,16 @@ func Test_doCheck(t *testing.T) {
 		assert.Contains(t, err.Error(), "some other error")
 	})
 }
+
+func Test_doCheck_expiringSoon(t *testing.T) {
+	fakeCertParser := func(certPath, keyPath string) (CertInfo, error) {
+		return CertInfo{Expiration: time.Now().Add(5 * 24 * time.Hour), DaysLeft: 5}, nil
+	}
+	sdtp := createMockSDTP(t)
+
+	err := doCheck(t.Context(), sdtp, "path/to/cert", "path/to/key", 10, fakeCertParser)
+	assert.Equal(t, errCertExpiringSoon, err)
+
+	err = doCheck(t.Context(), sdtp, "path/to/cert", "path/to/key", 3, fakeCertParser)
+	assert.NoError(t, err)
+}
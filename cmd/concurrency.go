@@ -0,0 +1,176 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/asips/sdtp-client/internal"
+	"github.com/asips/sdtp-client/internal/log"
+)
+
+// parseConcurrency parses a --concurrency value, either a number of workers or
+// auto.
+func parseConcurrency(s string) (n uint, auto bool, err error) {
+	if s == "auto" {
+		return 0, true, nil
+	}
+	v, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || v == 0 {
+		return 0, false, fmt.Errorf("expected a positive number or auto, got %q", s)
+	}
+	return uint(v), false, nil
+}
+
+const (
+	// concurrencyInterval is how often the concurrency limit is adjusted.
+	concurrencyInterval = 10 * time.Second
+	// overloadThreshold is the fraction of requests in a window failing with
+	// 429 or 5xx statuses above which the limit is halved.
+	overloadThreshold = 0.05
+	// latencyThreshold is how many times the baseline latency a window's
+	// latency must be to be treated as congestion.
+	latencyThreshold = 2.0
+	// throughputDrop is the fraction throughput must fall by after an increase
+	// for the increase to be reverted.
+	throughputDrop = 0.1
+)
+
+// adaptiveLimiter decides how many transfers the dispatcher lets run at once,
+// adjusting the limit between min and max once per interval in the manner of
+// TCP congestion control: the limit is increased by one while transfers are
+// using all the slots and throughput is not falling, halved when the server
+// rate limits or fails, and decreased by one when latency rises or an
+// increase did not pay off. A nil *adaptiveLimiter does not limit.
+type adaptiveLimiter struct {
+	min, max int
+	interval time.Duration
+
+	mu    sync.Mutex
+	limit int
+	// active is the number of files taken by workers, so idle workers waiting
+	// for a file do not count towards saturation.
+	active int
+
+	// the current window
+	start     time.Time
+	bytes     int64
+	requests  int
+	overloads int
+	latency   float64
+	saturated bool
+
+	// baseline is the lowest window latency seen, in seconds per MiB.
+	baseline   float64
+	throughput float64
+	increased  bool
+}
+
+func newAdaptiveLimiter(min, max int, interval time.Duration) *adaptiveLimiter {
+	l := &adaptiveLimiter{
+		min:      min,
+		max:      max,
+		interval: interval,
+		limit:    min,
+		start:    time.Now(),
+	}
+	metricConcurrencyLimit.Set(float64(l.limit))
+	return l
+}
+
+// acquire records that a worker has taken a file, which the dispatcher only
+// allows while fewer than the limit are active.
+func (l *adaptiveLimiter) acquire() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active++
+	if l.active >= l.limit {
+		l.saturated = true
+	}
+}
+
+// release records that a worker is done with its file. If n bytes were
+// downloaded, or the download failed with err, the download's duration d is
+// included in the current window.
+func (l *adaptiveLimiter) release(n int64, d time.Duration, err error) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	if n > 0 || err != nil {
+		l.requests++
+		l.bytes += n
+		// normalized by size so small and large files are comparable, with a
+		// floor so the latency of small files is not inflated
+		l.latency += d.Seconds() / max(float64(n)/(1<<20), 1)
+		if internal.IsOverloaded(err) {
+			l.overloads++
+		}
+	}
+	if now := time.Now(); now.Sub(l.start) >= l.interval {
+		l.adjust(now)
+	}
+}
+
+// adjust ends the current window, updating the limit from its samples.
+func (l *adaptiveLimiter) adjust(now time.Time) {
+	elapsed := now.Sub(l.start).Seconds()
+	throughput := float64(l.bytes) / elapsed
+	latency := 0.0
+	if l.requests > 0 {
+		latency = l.latency / float64(l.requests)
+	}
+	requests, overloads, saturated := l.requests, l.overloads, l.saturated
+	l.start, l.bytes, l.requests, l.overloads, l.latency = now, 0, 0, 0, 0
+	l.saturated = l.active >= l.limit
+	if requests == 0 {
+		return
+	}
+
+	limit, reason := l.limit, ""
+	switch {
+	case float64(overloads)/float64(requests) > overloadThreshold:
+		limit = l.limit / 2
+		reason = fmt.Sprintf("%d of %d requests rate limited or failed by the server", overloads, requests)
+	case l.increased && throughput < l.throughput*(1-throughputDrop):
+		limit = l.limit - 1
+		reason = fmt.Sprintf("throughput fell to %s/s from %s/s", humanSize(int64(throughput)), humanSize(int64(l.throughput)))
+	case l.baseline > 0 && latency > l.baseline*latencyThreshold:
+		limit = l.limit - 1
+		reason = fmt.Sprintf("latency rose to %.2fs/MiB from %.2fs/MiB", latency, l.baseline)
+	case saturated:
+		limit = l.limit + 1
+		reason = fmt.Sprintf("all workers busy at %s/s", humanSize(int64(throughput)))
+	}
+	if l.baseline == 0 || latency < l.baseline {
+		l.baseline = latency
+	}
+	l.throughput = throughput
+	limit = min(max(limit, l.min), l.max)
+	l.increased = limit > l.limit
+	if limit == l.limit {
+		return
+	}
+
+	log.Printf("concurrency %d -> %d; %s", l.limit, limit, reason)
+	if limit > l.limit {
+		metricConcurrencyAdjustments.With("increase").Inc()
+	} else {
+		metricConcurrencyAdjustments.With("decrease").Inc()
+	}
+	l.limit = limit
+	metricConcurrencyLimit.Set(float64(limit))
+}
+
+// current returns the current limit.
+func (l *adaptiveLimiter) current() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
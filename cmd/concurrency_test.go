@@ -0,0 +1,120 @@
+package cmd
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/asips/sdtp-client/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseConcurrency(t *testing.T) {
+	n, auto, err := parseConcurrency("8")
+	assert.NoError(t, err)
+	assert.Equal(t, uint(8), n)
+	assert.False(t, auto)
+
+	_, auto, err = parseConcurrency("auto")
+	assert.NoError(t, err)
+	assert.True(t, auto)
+
+	for _, s := range []string{"0", "-1", "many", ""} {
+		_, _, err := parseConcurrency(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func Test_adaptiveLimiter_acquire(t *testing.T) {
+	l := newAdaptiveLimiter(2, 4, time.Hour)
+
+	l.acquire()
+	assert.False(t, l.saturated)
+	l.acquire()
+	assert.True(t, l.saturated, "all slots in use")
+	l.release(0, 0, nil)
+	l.release(0, 0, nil)
+	assert.Equal(t, 0, l.active)
+	assert.Equal(t, 0, l.requests, "no transfer, no sample")
+
+	var nilLimiter *adaptiveLimiter
+	nilLimiter.acquire()
+	nilLimiter.release(0, 0, nil)
+}
+
+func Test_adaptiveLimiter_adjust(t *testing.T) {
+	const mib = 1 << 20
+	window := func(l *adaptiveLimiter, requests int, bytes int64, latency float64, overloads int, saturated bool) {
+		l.requests, l.bytes, l.overloads, l.saturated = requests, bytes, overloads, saturated
+		l.latency = latency * float64(requests)
+		l.adjust(l.start.Add(time.Second))
+	}
+
+	t.Run("increase while saturated", func(t *testing.T) {
+		l := newAdaptiveLimiter(2, 4, time.Second)
+		window(l, 10, 10*mib, 1, 0, true)
+		assert.Equal(t, 3, l.current())
+		window(l, 10, 20*mib, 1, 0, true)
+		assert.Equal(t, 4, l.current())
+		window(l, 10, 30*mib, 1, 0, true)
+		assert.Equal(t, 4, l.current(), "capped at max")
+	})
+
+	t.Run("hold while not saturated", func(t *testing.T) {
+		l := newAdaptiveLimiter(2, 4, time.Second)
+		window(l, 10, 10*mib, 1, 0, false)
+		assert.Equal(t, 2, l.current())
+	})
+
+	t.Run("revert increase when throughput falls", func(t *testing.T) {
+		l := newAdaptiveLimiter(2, 8, time.Second)
+		window(l, 10, 10*mib, 1, 0, true)
+		assert.Equal(t, 3, l.current())
+		window(l, 10, 5*mib, 1, 0, true)
+		assert.Equal(t, 2, l.current())
+	})
+
+	t.Run("decrease when latency rises", func(t *testing.T) {
+		l := newAdaptiveLimiter(1, 8, time.Second)
+		l.limit = 4
+		window(l, 10, 10*mib, 1, 0, false)
+		window(l, 10, 10*mib, 3, 0, true)
+		assert.Equal(t, 3, l.current())
+	})
+
+	t.Run("halve when overloaded", func(t *testing.T) {
+		l := newAdaptiveLimiter(1, 16, time.Second)
+		l.limit = 8
+		window(l, 10, 10*mib, 1, 2, true)
+		assert.Equal(t, 4, l.current())
+	})
+
+	t.Run("server errors are overloads", func(t *testing.T) {
+		l := newAdaptiveLimiter(1, 16, time.Second)
+		l.acquire()
+		l.release(0, time.Second, &internal.StatusError{Code: http.StatusTooManyRequests, Status: "429 Too Many Requests"})
+		l.acquire()
+		l.release(0, time.Second, &internal.StatusError{Code: http.StatusNotFound, Status: "404 Not Found"})
+		assert.Equal(t, 2, l.requests)
+		assert.Equal(t, 1, l.overloads)
+	})
+}
+
+func Test_doIngest_autoConcurrency(t *testing.T) {
+	dir := t.TempDir()
+	sdtp := &recordingSDTP{mockSDTP: createMockSDTP(t)}
+	for i := range 5 {
+		sdtp.listing = append(sdtp.listing, internal.FileInfo{ID: int64(i), Name: "file.dat", Size: 10})
+	}
+
+	err := doIngest(t.Context(), nil, sdtp, ingestOptions{
+		destDir:         dir,
+		concurrency:     1,
+		autoConcurrency: true,
+		maxConcurrency:  3,
+		onExists:        existsOverwrite,
+	})
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []int64{0, 1, 2, 3, 4}, sdtp.downloaded)
+	assert.ElementsMatch(t, []int64{0, 1, 2, 3, 4}, sdtp.acked)
+}
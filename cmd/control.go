@@ -0,0 +1,344 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/asips/sdtp-client/internal"
+	"github.com/asips/sdtp-client/internal/log"
+)
+
+// maxControlRequest is the largest control API request body accepted.
+const maxControlRequest = 1 << 20
+
+// controller lets the control API inspect and steer a running ingest, or the
+// runs of a scheduler. Every run registers its dispatcher so the settings
+// apply to runs in progress as well as those started later. A nil *controller
+// does nothing.
+type controller struct {
+	certPath, keyPath string
+	transfers         *transferTracker
+	autoConcurrency   bool
+	maxConcurrency    int
+	started           time.Time
+	// stop is closed once the ingest is draining, and drain starts draining
+	// it, as on interrupt.
+	stop  <-chan struct{}
+	drain func()
+
+	mu          sync.Mutex
+	schedule    *scheduler
+	paused      bool
+	concurrency int
+	dispatchers []*dispatcher
+}
+
+func newController(opts ingestOptions, certPath, keyPath string, stop <-chan struct{}, drain func()) *controller {
+	return &controller{
+		certPath:        certPath,
+		keyPath:         keyPath,
+		transfers:       opts.transfers,
+		autoConcurrency: opts.autoConcurrency,
+		maxConcurrency:  int(max(opts.concurrency, opts.maxConcurrency)),
+		started:         time.Now(),
+		stop:            stop,
+		drain:           drain,
+		concurrency:     int(opts.concurrency),
+	}
+}
+
+// attach applies the current settings to d, and any later changes until it is
+// detached.
+func (c *controller) attach(d *dispatcher) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dispatchers = append(c.dispatchers, d)
+	d.setPaused(c.paused)
+	if !c.autoConcurrency {
+		d.setLimit(c.concurrency)
+	}
+}
+
+func (c *controller) detach(d *dispatcher) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dispatchers = slices.DeleteFunc(c.dispatchers, func(other *dispatcher) bool { return other == d })
+}
+
+// setScheduler makes the scheduler's runs pollable and includes their
+// schedules in the status.
+func (c *controller) setScheduler(s *scheduler) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.schedule = s
+}
+
+func (c *controller) setPaused(paused bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.paused = paused
+	for _, d := range c.dispatchers {
+		d.setPaused(paused)
+	}
+}
+
+func (c *controller) setConcurrency(n int) error {
+	if c.autoConcurrency {
+		return errors.New("concurrency is adjusted automatically with --concurrency=auto")
+	}
+	if n < 1 || n > c.maxConcurrency {
+		return fmt.Errorf("concurrency must be 1-%d, see --max-concurrency", c.maxConcurrency)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.concurrency = n
+	for _, d := range c.dispatchers {
+		d.setLimit(n)
+	}
+	return nil
+}
+
+func (c *controller) draining() bool {
+	select {
+	case <-c.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// retry queues the recently failed files with ids, or all of them if ids is
+// empty, to be transferred again by the runs they failed in. It returns the
+// number of files queued and of those whose runs had already finished, which
+// remain recorded as failed.
+func (c *controller) retry(ids []int64) (retried, finished int) {
+	failures := c.transfers.takeFailures(ids)
+	var keep []*failedFile
+	for _, f := range failures {
+		if !f.run.retry(f.file, f.class) {
+			keep = append(keep, f)
+			continue
+		}
+		f.run.logf(log.Printf, "retrying fileid=%d(%s)", f.file.ID, f.file.Name)
+		retried++
+	}
+	c.transfers.restoreFailures(keep)
+	return retried, len(keep)
+}
+
+type controlStatus struct {
+	StartedAt       time.Time        `json:"started_at"`
+	Paused          bool             `json:"paused"`
+	Draining        bool             `json:"draining"`
+	Concurrency     int              `json:"concurrency"`
+	AutoConcurrency bool             `json:"auto_concurrency,omitempty"`
+	Bandwidth       uint64           `json:"bandwidth"`
+	Queue           []queueStatus    `json:"queue"`
+	InFlight        []transferStatus `json:"in_flight"`
+	Failures        []failureStatus  `json:"recent_failures"`
+	Certificate     certStatus       `json:"certificate"`
+	Schedule        *scheduleStatus  `json:"schedule,omitempty"`
+}
+
+type certStatus struct {
+	Expiration time.Time `json:"expiration,omitzero"`
+	DaysLeft   int       `json:"days_left"`
+	Expired    bool      `json:"expired"`
+	Error      string    `json:"error,omitempty"`
+}
+
+func (c *controller) status(now time.Time) controlStatus {
+	c.mu.Lock()
+	status := controlStatus{
+		StartedAt:       c.started,
+		Paused:          c.paused,
+		Draining:        c.draining(),
+		Concurrency:     c.concurrency,
+		AutoConcurrency: c.autoConcurrency,
+		Bandwidth:       c.transfers.bandwidth.getRate(),
+		Queue:           []queueStatus{},
+		InFlight:        c.transfers.inFlight(now),
+		Failures:        c.transfers.recentFailures(),
+	}
+	for _, d := range c.dispatchers {
+		status.Queue = append(status.Queue, d.status()...)
+	}
+	schedule := c.schedule
+	c.mu.Unlock()
+
+	if schedule != nil {
+		s := schedule.status(now)
+		status.Schedule = &s
+	}
+	if info, err := getCertificateInfo(c.certPath, c.keyPath); err != nil {
+		status.Certificate.Error = err.Error()
+	} else {
+		status.Certificate = certStatus{Expiration: info.Expiration, DaysLeft: info.DaysLeft, Expired: info.Expired}
+	}
+	return status
+}
+
+// controlRequest is the body of the control API actions that take an
+// argument.
+type controlRequest struct {
+	Concurrency int     `json:"concurrency,omitempty"`
+	Bandwidth   string  `json:"bandwidth,omitempty"`
+	IDs         []int64 `json:"ids,omitempty"`
+}
+
+// controlResponse is the response to a control API action.
+type controlResponse struct {
+	Message string `json:"message,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// handler returns the control API: the status at GET /status, metrics at GET
+// /metrics, and the actions, each a POST.
+func (c *controller) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, c.status(time.Now()))
+	})
+	mux.HandleFunc("GET /metrics", serveMetrics)
+	mux.HandleFunc("POST /pause", func(w http.ResponseWriter, r *http.Request) {
+		c.setPaused(true)
+		log.Printf("paused; in-flight transfers will finish, no new transfers will start")
+		writeJSON(w, controlResponse{Message: "paused"})
+	})
+	mux.HandleFunc("POST /resume", func(w http.ResponseWriter, r *http.Request) {
+		c.setPaused(false)
+		log.Printf("resumed")
+		writeJSON(w, controlResponse{Message: "resumed"})
+	})
+	mux.HandleFunc("POST /concurrency", func(w http.ResponseWriter, r *http.Request) {
+		req, ok := decodeControlRequest(w, r)
+		if !ok {
+			return
+		}
+		if err := c.setConcurrency(req.Concurrency); err != nil {
+			writeControlError(w, http.StatusBadRequest, err)
+			return
+		}
+		log.Printf("concurrency set to %d", req.Concurrency)
+		writeJSON(w, controlResponse{Message: fmt.Sprintf("concurrency set to %d", req.Concurrency)})
+	})
+	mux.HandleFunc("POST /bandwidth", func(w http.ResponseWriter, r *http.Request) {
+		req, ok := decodeControlRequest(w, r)
+		if !ok {
+			return
+		}
+		rate, err := internal.ParseSize(req.Bandwidth)
+		if err != nil {
+			writeControlError(w, http.StatusBadRequest, err)
+			return
+		}
+		c.transfers.bandwidth.setRate(rate)
+		msg := "bandwidth limit removed"
+		if rate > 0 {
+			msg = fmt.Sprintf("bandwidth limited to %d bytes/s", rate)
+		}
+		log.Printf("%s", msg)
+		writeJSON(w, controlResponse{Message: msg})
+	})
+	mux.HandleFunc("POST /poll", func(w http.ResponseWriter, r *http.Request) {
+		c.mu.Lock()
+		schedule := c.schedule
+		c.mu.Unlock()
+		if schedule == nil {
+			writeControlError(w, http.StatusConflict, errors.New("polling is only supported by the schedule command"))
+			return
+		}
+		polled, running := schedule.poll()
+		msg := fmt.Sprintf("polling %d subscriptions", polled)
+		if running > 0 {
+			msg += fmt.Sprintf(", %d already running", running)
+		}
+		log.Printf("%s", msg)
+		writeJSON(w, controlResponse{Message: msg})
+	})
+	mux.HandleFunc("POST /retry", func(w http.ResponseWriter, r *http.Request) {
+		req, ok := decodeControlRequest(w, r)
+		if !ok {
+			return
+		}
+		retried, finished := c.retry(req.IDs)
+		if retried == 0 && finished == 0 {
+			writeControlError(w, http.StatusNotFound, errors.New("no matching recent failures"))
+			return
+		}
+		msg := fmt.Sprintf("retrying %d files", retried)
+		if finished > 0 {
+			msg += fmt.Sprintf("; %d failed in runs that have finished and are left for the next run", finished)
+		}
+		writeJSON(w, controlResponse{Message: msg})
+	})
+	mux.HandleFunc("POST /drain", func(w http.ResponseWriter, r *http.Request) {
+		c.drain()
+		writeJSON(w, controlResponse{Message: "draining; in-flight transfers will finish, then the process will exit"})
+	})
+	return guardControl(mux)
+}
+
+// guardControl rejects requests to the control API that a web page open in a
+// browser on the same host could send: any with an Origin header, any for a
+// host name other than a loopback one, as after DNS rebinding, and POSTs that
+// are not JSON, which a page may send without a CORS preflight.
+func guardControl(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Origin") != "" {
+			writeControlError(w, http.StatusForbidden, errors.New("cross-origin requests are not allowed"))
+			return
+		}
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			writeControlError(w, http.StatusForbidden, fmt.Errorf("host %q is not a loopback address", r.Host))
+			return
+		}
+		if r.Method == http.MethodPost {
+			if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+				writeControlError(w, http.StatusUnsupportedMediaType, errors.New("requests must have Content-Type application/json"))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// decodeControlRequest decodes the body of r, writing an error response and
+// returning false if it is invalid. An empty body is an empty request.
+func decodeControlRequest(w http.ResponseWriter, r *http.Request) (controlRequest, bool) {
+	req := controlRequest{}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxControlRequest))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeControlError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+		return req, false
+	}
+	return req, true
+}
+
+func writeControlError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(controlResponse{Error: err.Error()})
+}
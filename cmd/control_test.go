@@ -0,0 +1,227 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asips/sdtp-client/internal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestController(t *testing.T, opts ingestOptions) (*controller, *dispatcher, *ingestRun, chan struct{}) {
+	t.Helper()
+	opts.transfers = newTransferTracker(0)
+	stop := make(chan struct{})
+	c := newController(opts, "", "", stop, func() { close(stop) })
+
+	d := newDispatcher(t.Context(), nil, int(max(opts.concurrency, opts.maxConcurrency)))
+	run := &ingestRun{name: "a", stats: &ingestStats{}, d: d, transfers: opts.transfers}
+	run.queue = d.add(run, 1)
+	c.attach(d)
+	return c, d, run, stop
+}
+
+func controlRequestTo(t *testing.T, h http.Handler, method, path, body string) (int, controlResponse) {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Host = "localhost:8090"
+	if method == http.MethodPost {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	resp := controlResponse{}
+	if strings.HasPrefix(rec.Header().Get("Content-Type"), "application/json") && path != "/status" {
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	}
+	return rec.Code, resp
+}
+
+func Test_controller(t *testing.T) {
+	c, d, run, stop := newTestController(t, ingestOptions{concurrency: 2, maxConcurrency: 8})
+	h := c.handler()
+	assert.Equal(t, 2, d.limit)
+
+	code, _ := controlRequestTo(t, h, http.MethodPost, "/pause", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, d.paused)
+	// a run started later is paused too
+	d2 := newDispatcher(t.Context(), nil, 8)
+	c.attach(d2)
+	assert.True(t, d2.paused)
+	c.detach(d2)
+	controlRequestTo(t, h, http.MethodPost, "/resume", "")
+	assert.False(t, d.paused)
+
+	code, _ = controlRequestTo(t, h, http.MethodPost, "/concurrency", `{"concurrency": 6}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 6, d.limit)
+	code, resp := controlRequestTo(t, h, http.MethodPost, "/concurrency", `{"concurrency": 9}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Contains(t, resp.Error, "1-8")
+	code, _ = controlRequestTo(t, h, http.MethodPost, "/concurrency", `{"workers": 4}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = controlRequestTo(t, h, http.MethodPost, "/bandwidth", `{"bandwidth": "10MB"}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, uint64(10e6), c.transfers.bandwidth.getRate())
+	code, _ = controlRequestTo(t, h, http.MethodPost, "/bandwidth", `{"bandwidth": "fast"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = controlRequestTo(t, h, http.MethodPost, "/poll", "")
+	assert.Equal(t, http.StatusConflict, code, "not scheduled")
+
+	code, _ = controlRequestTo(t, h, http.MethodGet, "/pause", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+
+	// retried failures are no longer counted
+	file := internal.FileInfo{ID: 7, Name: "file7", Size: 100}
+	c.transfers.queued(file)
+	c.transfers.processed(file)
+	run.fail(file, errors.New("connection reset"))
+	code, _ = controlRequestTo(t, h, http.MethodPost, "/retry", `{"ids": [8]}`)
+	assert.Equal(t, http.StatusNotFound, code)
+	code, resp = controlRequestTo(t, h, http.MethodPost, "/retry", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "retrying 1 files", resp.Message)
+	assert.Equal(t, int64(0), run.stats.failures())
+	// nor is the file counted twice
+	pr := newProgressDisplay(c.transfers, io.Discard, false).snapshot(time.Now())
+	assert.Equal(t, 1, pr.files)
+	assert.Equal(t, 0, pr.doneFiles)
+	assert.Equal(t, int64(100), pr.bytes)
+	assert.Equal(t, int64(0), pr.doneBytes)
+	q, got, ok := d.take()
+	require.True(t, ok)
+	assert.Equal(t, file.ID, got.ID)
+	d.done(q)
+
+	status := c.status(time.Now())
+	require.Len(t, status.Queue, 1)
+	assert.Equal(t, "a", status.Queue[0].Subscription)
+	assert.Equal(t, 6, status.Concurrency)
+	assert.NotEmpty(t, status.Certificate.Error)
+
+	// the run has finished, so the failure is left for the next run
+	d.close(run.queue)
+	_, _, ok = d.take()
+	require.False(t, ok)
+	run.fail(file, errors.New("connection reset"))
+	_, resp = controlRequestTo(t, h, http.MethodPost, "/retry", `{"ids": [7]}`)
+	assert.Contains(t, resp.Message, "retrying 0 files; 1 failed")
+	assert.Len(t, c.transfers.recentFailures(), 1)
+
+	controlRequestTo(t, h, http.MethodPost, "/drain", "")
+	assert.True(t, c.status(time.Now()).Draining)
+	select {
+	case <-stop:
+	default:
+		t.Fatal("not drained")
+	}
+}
+
+func Test_controller_auto(t *testing.T) {
+	c, _, _, _ := newTestController(t, ingestOptions{concurrency: 1, maxConcurrency: 8, autoConcurrency: true})
+	code, resp := controlRequestTo(t, c.handler(), http.MethodPost, "/concurrency", `{"concurrency": 4}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Contains(t, resp.Error, "auto")
+}
+
+func Test_controller_poll(t *testing.T) {
+	c, _, _, _ := newTestController(t, ingestOptions{concurrency: 1})
+	sched, err := newRunSchedule("@daily", nil, nil, missedSkip)
+	require.NoError(t, err)
+	s := newScheduler(nil, ingestOptions{})
+	s.add(subscription{name: "a"}, sched, time.Now())
+	s.add(subscription{name: "b"}, sched, time.Now())
+	s.jobs[1].running = true
+	c.setScheduler(s)
+
+	code, resp := controlRequestTo(t, c.handler(), http.MethodPost, "/poll", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "polling 1 subscriptions, 1 already running", resp.Message)
+	assert.Equal(t, []*scheduledJob{s.jobs[0]}, s.tick(time.Now()))
+	assert.NotNil(t, c.status(time.Now()).Schedule)
+}
+
+func Test_controlClient(t *testing.T) {
+	// unix socket paths are limited to around 100 bytes, which t.TempDir may
+	// exceed
+	dir, err := os.MkdirTemp("", "sdtp")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	addr := "unix:" + filepath.Join(dir, "control.sock")
+
+	c, _, _, _ := newTestController(t, ingestOptions{concurrency: 1, maxConcurrency: 4})
+	require.NoError(t, serveStatus(t.Context(), "control API", addr, c.handler()))
+	_, err = listen(addr)
+	assert.ErrorContains(t, err, "already in use")
+	// only a stale socket is replaced
+	notSocket := filepath.Join(dir, "control.conf")
+	require.NoError(t, os.WriteFile(notSocket, []byte("keep"), 0600))
+	_, err = listen("unix:" + notSocket)
+	assert.ErrorContains(t, err, "not a socket")
+	assert.FileExists(t, notSocket)
+
+	client := newControlClient(addr)
+	resp := controlResponse{}
+	require.NoError(t, client.do(t.Context(), http.MethodPost, "/concurrency", &controlRequest{Concurrency: 3}, &resp))
+	assert.Equal(t, "concurrency set to 3", resp.Message)
+	err = client.do(t.Context(), http.MethodPost, "/concurrency", &controlRequest{Concurrency: 5}, &resp)
+	assert.ErrorContains(t, err, "concurrency must be 1-4")
+
+	status := controlStatus{}
+	require.NoError(t, client.do(t.Context(), http.MethodGet, "/status", nil, &status))
+	assert.Equal(t, 3, status.Concurrency)
+
+	out := &strings.Builder{}
+	require.NoError(t, writeControlStatus(out, status, time.Now()))
+	assert.Contains(t, out.String(), "Concurrency:  3")
+}
+
+func Test_validateControlAddr(t *testing.T) {
+	for _, addr := range []string{"localhost:8090", "127.0.0.1:8090", "127.1.2.3:0", "[::1]:8090", "unix:/run/sdtp/control.sock"} {
+		assert.NoError(t, validateControlAddr(addr), addr)
+	}
+	for _, addr := range []string{":8090", "0.0.0.0:8090", "[::]:8090", "192.168.1.10:8090", "example.com:8090", "localhost"} {
+		assert.Error(t, validateControlAddr(addr), addr)
+	}
+}
+
+func Test_controller_guard(t *testing.T) {
+	c, d, _, _ := newTestController(t, ingestOptions{concurrency: 2, maxConcurrency: 8})
+	h := c.handler()
+	request := func(host, origin, contentType string) int {
+		req := httptest.NewRequest(http.MethodPost, "/pause", nil)
+		req.Host = host
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// as a web page could send
+	assert.Equal(t, http.StatusForbidden, request("localhost:8090", "https://example.com", "application/json"))
+	assert.Equal(t, http.StatusForbidden, request("attacker.example:8090", "", "application/json"))
+	assert.Equal(t, http.StatusUnsupportedMediaType, request("localhost:8090", "", "text/plain"))
+	assert.Equal(t, http.StatusUnsupportedMediaType, request("127.0.0.1:8090", "", ""))
+	assert.False(t, d.paused)
+
+	assert.Equal(t, http.StatusOK, request("127.0.0.1:8090", "", "application/json; charset=utf-8"))
+	assert.Equal(t, http.StatusOK, request("[::1]:8090", "", "application/json"))
+	assert.True(t, d.paused)
+}
@@ -0,0 +1,303 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/asips/sdtp-client/internal"
+	"github.com/asips/sdtp-client/internal/log"
+	"github.com/spf13/cobra"
+)
+
+var ctlCmd = &cobra.Command{
+	Use:   "ctl",
+	Short: "Inspect and steer a running ingest or schedule through its control API",
+	Long: `Inspect and steer a running ingest or schedule through the control API it serves
+with --control-addr, e.g.,
+
+  sdtp schedule --control-addr unix:/run/sdtp/control.sock ...
+  sdtp ctl --addr unix:/run/sdtp/control.sock status
+  sdtp ctl --addr unix:/run/sdtp/control.sock concurrency 8
+
+No certificate is needed.
+`,
+}
+
+var ctlStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the queue, in-flight transfers, recent failures and certificate expiry",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		format, err := cmd.Flags().GetString("output")
+		cobra.CheckErr(err)
+		if format != "table" && format != "json" {
+			log.Fatal("invalid --output %q; must be table or json", format)
+		}
+		status := controlStatus{}
+		if err := controlClientFromFlags(cmd).do(cmd.Context(), http.MethodGet, "/status", nil, &status); err != nil {
+			return err
+		}
+		if format == "json" {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(status)
+		}
+		return writeControlStatus(os.Stdout, status, time.Now())
+	},
+}
+
+var ctlPauseCmd = &cobra.Command{
+	Use:   "pause",
+	Short: "Stop starting new transfers, letting those in flight finish",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return doControlAction(cmd, "/pause", nil)
+	},
+}
+
+var ctlResumeCmd = &cobra.Command{
+	Use:   "resume",
+	Short: "Resume starting new transfers after pause",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return doControlAction(cmd, "/resume", nil)
+	},
+}
+
+var ctlConcurrencyCmd = &cobra.Command{
+	Use:   "concurrency <n>",
+	Short: "Change the number of concurrent downloads, up to --max-concurrency",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 1 {
+			log.Fatal("invalid concurrency %q; must be a positive number", args[0])
+		}
+		return doControlAction(cmd, "/concurrency", &controlRequest{Concurrency: n})
+	},
+}
+
+var ctlBandwidthCmd = &cobra.Command{
+	Use:   "bandwidth <rate>",
+	Short: "Change the maximum total download rate, in bytes per second, e.g., 50MB. 0 removes the limit",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if _, err := internal.ParseSize(args[0]); err != nil {
+			log.Fatal("invalid bandwidth: %s", err)
+		}
+		return doControlAction(cmd, "/bandwidth", &controlRequest{Bandwidth: args[0]})
+	},
+}
+
+var ctlPollCmd = &cobra.Command{
+	Use:   "poll",
+	Short: "Start a run of every subscription now, rather than waiting for its schedule",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return doControlAction(cmd, "/poll", nil)
+	},
+}
+
+var ctlRetryCmd = &cobra.Command{
+	Use:   "retry [fileid...]",
+	Short: "Retry the recently failed files with these ids, or all of them",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		req := &controlRequest{}
+		for _, arg := range args {
+			id, err := strconv.ParseInt(arg, 10, 64)
+			if err != nil {
+				log.Fatal("invalid file id %q", arg)
+			}
+			req.IDs = append(req.IDs, id)
+		}
+		return doControlAction(cmd, "/retry", req)
+	},
+}
+
+var ctlDrainCmd = &cobra.Command{
+	Use:   "drain",
+	Short: "Stop starting new transfers and exit once those in flight finish, as on interrupt",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return doControlAction(cmd, "/drain", nil)
+	},
+}
+
+func init() {
+	flags := ctlCmd.PersistentFlags()
+	flags.String("addr", "", "Address of the control API, as given to --control-addr, e.g., localhost:8090 or unix:/run/sdtp/control.sock")
+	ctlCmd.MarkPersistentFlagRequired("addr")
+	ctlStatusCmd.Flags().StringP("output", "o", "table", "Output format: table or json")
+
+	for _, cmd := range []*cobra.Command{
+		ctlStatusCmd, ctlPauseCmd, ctlResumeCmd, ctlConcurrencyCmd, ctlBandwidthCmd, ctlPollCmd, ctlRetryCmd, ctlDrainCmd,
+	} {
+		cmd.PreRun = func(cmd *cobra.Command, args []string) {
+			// The control API is local, so no certificate is needed.
+			cmd.Flags().SetAnnotation("cert", cobra.BashCompOneRequiredFlag, []string{"false"})
+			cmd.Flags().SetAnnotation("key", cobra.BashCompOneRequiredFlag, []string{"false"})
+		}
+		ctlCmd.AddCommand(cmd)
+	}
+}
+
+// controlClient sends requests to a control API.
+type controlClient struct {
+	client *http.Client
+	// base is the URL the request paths are relative to.
+	base string
+}
+
+func newControlClient(addr string) *controlClient {
+	base := "http://" + addr
+	if strings.HasPrefix(addr, "unix:") {
+		// the host is ignored when dialing a unix socket
+		base = "http://localhost"
+	}
+	return &controlClient{
+		client: &http.Client{Transport: &http.Transport{DialContext: dialContext(addr)}, Timeout: 30 * time.Second},
+		base:   base,
+	}
+}
+
+func controlClientFromFlags(cmd *cobra.Command) *controlClient {
+	addr, err := cmd.Flags().GetString("addr")
+	cobra.CheckErr(err)
+	return newControlClient(addr)
+}
+
+// do sends req, if not nil, as the JSON body of a request for path, decoding
+// the response into resp. An error response is returned as an error.
+func (c *controlClient) do(ctx context.Context, method, path string, req, resp any) error {
+	var body io.Reader
+	if req != nil {
+		dat, err := json.Marshal(req)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(dat)
+	}
+	r, err := http.NewRequestWithContext(ctx, method, c.base+path, body)
+	if err != nil {
+		return err
+	}
+	// required by the control API for every action, even without a body
+	if req != nil || method == http.MethodPost {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	res, err := c.client.Do(r)
+	if err != nil {
+		return fmt.Errorf("failed to reach control API: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		failed := controlResponse{}
+		if err := json.NewDecoder(res.Body).Decode(&failed); err != nil || failed.Error == "" {
+			return fmt.Errorf("control API failed: %s", res.Status)
+		}
+		return fmt.Errorf("%s", failed.Error)
+	}
+	return json.NewDecoder(res.Body).Decode(resp)
+}
+
+// doControlAction posts req to the action at path and prints its response.
+func doControlAction(cmd *cobra.Command, path string, req *controlRequest) error {
+	resp := controlResponse{}
+	var body any
+	if req != nil {
+		body = req
+	}
+	if err := controlClientFromFlags(cmd).do(cmd.Context(), http.MethodPost, path, body, &resp); err != nil {
+		return err
+	}
+	fmt.Println(resp.Message)
+	return nil
+}
+
+func writeControlStatus(w io.Writer, status controlStatus, now time.Time) error {
+	state := "running"
+	switch {
+	case status.Draining:
+		state = "draining"
+	case status.Paused:
+		state = "paused"
+	}
+	concurrency := fmt.Sprint(status.Concurrency)
+	if status.AutoConcurrency {
+		concurrency = "auto"
+	}
+	bandwidth := "unlimited"
+	if status.Bandwidth > 0 {
+		bandwidth = humanSize(int64(status.Bandwidth)) + "/s"
+	}
+	cert := status.Certificate.Error
+	if cert == "" {
+		cert = fmt.Sprintf("expires %s (%d days)", status.Certificate.Expiration.Format(time.RFC3339), status.Certificate.DaysLeft)
+		if status.Certificate.Expired {
+			cert = fmt.Sprintf("expired %s", status.Certificate.Expiration.Format(time.RFC3339))
+		}
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Started:\t%s (up %s)\n", status.StartedAt.Format(time.RFC3339), now.Sub(status.StartedAt).Round(time.Second))
+	fmt.Fprintf(tw, "State:\t%s\n", state)
+	fmt.Fprintf(tw, "Concurrency:\t%s\n", concurrency)
+	fmt.Fprintf(tw, "Bandwidth:\t%s\n", bandwidth)
+	fmt.Fprintf(tw, "Certificate:\t%s\n", cert)
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w, "\nQueue:")
+	tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "  SUBSCRIPTION\tQUEUED\tACTIVE\tLISTING\tSUMMARY")
+	for _, q := range status.Queue {
+		fmt.Fprintf(tw, "  %s\t%d\t%d\t%t\t%s\n", valueOr(q.Subscription, "-"), q.Queued, q.Active, q.Listing, q.Summary)
+	}
+	tw.Flush()
+
+	fmt.Fprintln(w, "\nIn flight:")
+	tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "  FILE\tSUBSCRIPTION\tPROGRESS\tRATE")
+	for _, t := range status.InFlight {
+		fmt.Fprintf(tw, "  %d(%s)\t%s\t%s of %s (%.0f%%)\t%s/s\n", t.ID, t.Name, valueOr(t.Subscription, "-"),
+			humanSize(t.Bytes), humanSize(t.Size), t.Percent, humanSize(int64(t.Rate)))
+	}
+	tw.Flush()
+
+	fmt.Fprintln(w, "\nRecent failures:")
+	tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "  FILE\tSUBSCRIPTION\tFAILED\tCLASS\tERROR")
+	for _, f := range status.Failures {
+		fmt.Fprintf(tw, "  %d(%s)\t%s\t%s\t%s\t%s\n", f.ID, f.Name, valueOr(f.Subscription, "-"),
+			f.FailedAt.Format(time.RFC3339), f.Class, f.Error)
+	}
+	tw.Flush()
+
+	if status.Schedule != nil {
+		fmt.Fprintln(w, "\nSchedule:")
+		tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "  SUBSCRIPTION\tSCHEDULE\tRUNNING\tNEXT RUN\tLAST RUN")
+		for _, sub := range status.Schedule.Subscriptions {
+			next, last := "-", "-"
+			if sub.NextRun != nil {
+				next = sub.NextRun.Format(time.RFC3339)
+			}
+			if sub.LastRun != nil {
+				last = fmt.Sprintf("%s %s", sub.LastRun.Status, sub.LastRun.StartedAt.Format(time.RFC3339))
+			}
+			fmt.Fprintf(tw, "  %s\t%s\t%t\t%s\t%s\n", valueOr(sub.Name, "-"), sub.Schedule, sub.Running, next, last)
+		}
+		tw.Flush()
+	}
+	return nil
+}
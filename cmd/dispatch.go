@@ -0,0 +1,347 @@
+package cmd
+
+import (
+	"context"
+	"slices"
+	"sync"
+
+	"github.com/asips/sdtp-client/internal"
+)
+
+// dispatchQueueSize is how many listed files each run may have waiting for a
+// worker before its listing blocks.
+const dispatchQueueSize = 64
+
+// dispatcher hands the files queued by one or more runs to a shared pool of
+// workers. Runs take turns in proportion to their weight, deficit round robin
+// style, and while other runs have files waiting a run may only occupy its
+// weighted share of the workers, so a large backlog, or large files, in one
+// run cannot starve the others. Workers are never left idle while any run has
+// files waiting.
+type dispatcher struct {
+	workers int
+	// limiter, if set, adjusts the number of workers that may transfer at
+	// once. Each file taken is acquired from it, and must be released.
+	limiter *adaptiveLimiter
+
+	ctx  context.Context
+	stop <-chan struct{}
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queues []*runQueue
+	next   int
+	// limit, if set, is the number of workers that may transfer at once,
+	// changed through the control API.
+	limit int
+	// paused holds workers before they take another file.
+	paused bool
+	// persistent, if set, keeps the workers waiting for more runs to be added
+	// once every queue is done, until shutdown.
+	persistent bool
+	// finished is set once every queue is closed, empty and idle, or on
+	// shutdown.
+	finished bool
+}
+
+type runQueue struct {
+	run    *ingestRun
+	weight int
+	files  []internal.FileInfo
+	closed bool
+	// credit is the number of files the run may still take in its current
+	// turn.
+	credit int
+	active int
+	// stopped is set once the run stops starting new transfers, and removed
+	// once it has been removed from the dispatcher.
+	stopped bool
+	removed bool
+}
+
+// waiting returns true if q has files that may be taken.
+func (q *runQueue) waiting() bool {
+	return len(q.files) > 0 && !q.stopped
+}
+
+// newDispatcher returns a dispatcher for workers workers. Waiting workers and
+// runs are released once stop is closed or ctx is done.
+func newDispatcher(ctx context.Context, stop <-chan struct{}, workers int) *dispatcher {
+	d := &dispatcher{workers: workers, ctx: ctx, stop: stop}
+	d.cond = sync.NewCond(&d.mu)
+	go func() {
+		select {
+		case <-stop:
+		case <-ctx.Done():
+		}
+		// taken so no waiter can miss the broadcast between checking stopped
+		// and waiting
+		d.mu.Lock()
+		d.mu.Unlock()
+		d.cond.Broadcast()
+	}()
+	return d
+}
+
+// stopped returns true once stop is closed or ctx is done.
+func (d *dispatcher) stopped() bool {
+	select {
+	case <-d.stop:
+		return true
+	case <-d.ctx.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+// add registers run, returning the queue it adds its files to.
+func (d *dispatcher) add(run *ingestRun, weight int) *runQueue {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	q := &runQueue{run: run, weight: max(weight, 1)}
+	d.queues = append(d.queues, q)
+	return q
+}
+
+// push queues file, blocking while the queue is full. It returns false if the
+// dispatcher, or q, has been stopped.
+func (d *dispatcher) push(q *runQueue, file internal.FileInfo) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for len(q.files) >= dispatchQueueSize && !d.stopped() && !q.stopped {
+		d.cond.Wait()
+	}
+	if d.stopped() || q.stopped {
+		return false
+	}
+	q.files = append(q.files, file)
+	d.cond.Broadcast()
+	return true
+}
+
+// close marks q as complete; no more files will be pushed.
+func (d *dispatcher) close(q *runQueue) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	q.closed = true
+	d.cond.Broadcast()
+}
+
+// take returns the next file to transfer and the run it belongs to, blocking
+// until one is available. It returns false once every queue is closed and
+// empty, unless the dispatcher is persistent, or the dispatcher has been
+// stopped or shut down. Each file taken must be returned
+// with done.
+func (d *dispatcher) take() (*runQueue, internal.FileInfo, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for {
+		if d.stopped() {
+			return nil, internal.FileInfo{}, false
+		}
+		if d.paused || d.active() >= d.capacity() {
+			d.cond.Wait()
+			continue
+		}
+		if q := d.pick(); q != nil {
+			file := q.files[0]
+			q.files = q.files[1:]
+			q.active++
+			d.limiter.acquire()
+			d.cond.Broadcast()
+			return q, file, true
+		}
+		// files that fail while others are still being transferred may be
+		// queued again, see requeue
+		finished := d.active() == 0 && !d.persistent
+		for _, q := range d.queues {
+			if !q.stopped && (!q.closed || len(q.files) > 0) {
+				finished = false
+			}
+		}
+		if finished || d.finished {
+			d.finished = true
+			return nil, internal.FileInfo{}, false
+		}
+		d.cond.Wait()
+	}
+}
+
+// pick chooses the queue to take the next file from, or nil if none have files
+// waiting.
+func (d *dispatcher) pick() *runQueue {
+	waiting, total := 0, 0
+	for _, q := range d.queues {
+		total += q.weight
+		if q.waiting() {
+			waiting++
+		}
+	}
+	if waiting == 0 {
+		return nil
+	}
+
+	// first respecting the shares, then, if every queue with files waiting
+	// has used its share, ignoring them so no worker is left idle
+	for _, shares := range []bool{true, false} {
+		for i := range d.queues {
+			idx := (d.next + i) % len(d.queues)
+			q := d.queues[idx]
+			if !q.waiting() {
+				q.credit = 0
+				continue
+			}
+			if shares && waiting > 1 && q.active >= d.share(q, total) {
+				continue
+			}
+			if q.credit == 0 {
+				q.credit = q.weight
+			}
+			q.credit--
+			d.next = idx
+			if q.credit == 0 {
+				d.next = idx + 1
+			}
+			return q
+		}
+	}
+	return nil
+}
+
+// share is the number of workers q may occupy while other runs have files
+// waiting, at least one.
+func (d *dispatcher) share(q *runQueue, total int) int {
+	return max(1, (d.capacity()*q.weight+total-1)/total)
+}
+
+// capacity is the number of workers that may transfer at once.
+func (d *dispatcher) capacity() int {
+	n := d.workers
+	if d.limit > 0 {
+		n = min(n, d.limit)
+	}
+	if d.limiter != nil {
+		n = min(n, d.limiter.current())
+	}
+	return n
+}
+
+// active returns the number of files taken and not yet done.
+func (d *dispatcher) active() int {
+	n := 0
+	for _, q := range d.queues {
+		n += q.active
+	}
+	return n
+}
+
+// setLimit changes the number of workers that may transfer at once. Workers
+// already transferring finish their files.
+func (d *dispatcher) setLimit(n int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.limit = n
+	d.cond.Broadcast()
+}
+
+// setPaused pauses or resumes taking files. Files already taken are not
+// affected.
+func (d *dispatcher) setPaused(paused bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.paused = paused
+	d.cond.Broadcast()
+}
+
+// requeue queues file again, e.g., to retry it, without waiting for space. It
+// returns false if the workers have finished, or the dispatcher, or q, has
+// been stopped or q removed.
+func (d *dispatcher) requeue(q *runQueue, file internal.FileInfo) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.finished || d.stopped() || q.stopped || q.removed {
+		return false
+	}
+	q.files = append(q.files, file)
+	d.cond.Broadcast()
+	return true
+}
+
+type queueStatus struct {
+	Subscription string `json:"subscription,omitempty"`
+	Queued       int    `json:"queued"`
+	Active       int    `json:"active"`
+	Listing      bool   `json:"listing"`
+	Summary      string `json:"summary"`
+}
+
+// status returns the files waiting, and being transferred, for each run.
+func (d *dispatcher) status() []queueStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	statuses := []queueStatus{}
+	for _, q := range d.queues {
+		statuses = append(statuses, queueStatus{
+			Subscription: q.run.name,
+			Queued:       len(q.files),
+			Active:       q.active,
+			Listing:      !q.closed,
+			Summary:      q.run.stats.String(),
+		})
+	}
+	return statuses
+}
+
+// queued returns the number of q's files waiting to be taken.
+func (d *dispatcher) queued(q *runQueue) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(q.files)
+}
+
+// done returns a file taken from q.
+func (d *dispatcher) done(q *runQueue) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	q.active--
+	d.cond.Broadcast()
+}
+
+// stopQueue stops taking files from q, e.g., once its run window closes.
+// Files already taken are not affected.
+func (d *dispatcher) stopQueue(q *runQueue) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	q.stopped = true
+	d.cond.Broadcast()
+}
+
+// wait blocks until none of q's files are being transferred and no more will
+// be: q is closed and empty, or it, or the dispatcher, has been stopped.
+func (d *dispatcher) wait(q *runQueue) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for q.active > 0 || !(q.stopped || d.stopped() || q.closed && len(q.files) == 0) {
+		d.cond.Wait()
+	}
+}
+
+// remove removes q, once its run has finished, from a persistent dispatcher.
+func (d *dispatcher) remove(q *runQueue) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	q.removed = true
+	d.queues = slices.DeleteFunc(d.queues, func(other *runQueue) bool { return other == q })
+	d.next = 0
+	d.cond.Broadcast()
+}
+
+// shutdown releases the workers once they finish their files, for a
+// persistent dispatcher.
+func (d *dispatcher) shutdown() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.finished = true
+	d.cond.Broadcast()
+}
@@ -0,0 +1,166 @@
+package cmd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/asips/sdtp-client/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_dispatcher(t *testing.T) {
+	fill := func(d *dispatcher, q *runQueue, ids ...int64) {
+		for _, id := range ids {
+			d.push(q, internal.FileInfo{ID: id})
+		}
+		d.close(q)
+	}
+
+	t.Run("weighted turns", func(t *testing.T) {
+		d := newDispatcher(t.Context(), nil, 1)
+		a := d.add(&ingestRun{name: "a"}, 2)
+		b := d.add(&ingestRun{name: "b"}, 1)
+		fill(d, a, 1, 2, 3, 4, 5)
+		fill(d, b, 11, 12, 13, 14, 15)
+
+		var got []int64
+		for q, file, ok := d.take(); ok; q, file, ok = d.take() {
+			got = append(got, file.ID)
+			d.done(q)
+		}
+		assert.Equal(t, []int64{1, 2, 11, 3, 4, 12, 5, 13, 14, 15}, got)
+	})
+
+	t.Run("shares", func(t *testing.T) {
+		d := newDispatcher(t.Context(), nil, 4)
+		a := d.add(&ingestRun{name: "a"}, 1)
+		b := d.add(&ingestRun{name: "b"}, 1)
+		fill(d, a, 1, 2, 3, 4, 5, 6)
+		fill(d, b, 11, 12, 13)
+
+		// a may not take more than half the workers while b has files waiting
+		var got []int64
+		for range 4 {
+			_, file, _ := d.take()
+			got = append(got, file.ID)
+		}
+		assert.ElementsMatch(t, []int64{1, 2, 11, 12}, got)
+
+		// once the other queue is empty workers are not left idle
+		d2 := newDispatcher(t.Context(), nil, 2)
+		c := d2.add(&ingestRun{name: "c"}, 1)
+		d2.add(&ingestRun{name: "d"}, 1)
+		fill(d2, c, 1, 2)
+		_, first, _ := d2.take()
+		_, second, _ := d2.take()
+		assert.Equal(t, []int64{1, 2}, []int64{first.ID, second.ID})
+	})
+
+	t.Run("stop", func(t *testing.T) {
+		stop := make(chan struct{})
+		d := newDispatcher(t.Context(), stop, 1)
+		d.add(&ingestRun{}, 1)
+
+		done := make(chan bool)
+		go func() {
+			_, _, ok := d.take()
+			done <- ok
+		}()
+		close(stop)
+		select {
+		case ok := <-done:
+			assert.False(t, ok)
+		case <-time.After(time.Second):
+			t.Fatal("take did not return after stop")
+		}
+	})
+
+	t.Run("limit and pause", func(t *testing.T) {
+		d := newDispatcher(t.Context(), nil, 4)
+		a := d.add(&ingestRun{name: "a"}, 1)
+		fill(d, a, 1, 2, 3)
+		d.setLimit(1)
+		d.setPaused(true)
+
+		taken := make(chan int64, 3)
+		for range 2 {
+			go func() {
+				for q, file, ok := d.take(); ok; q, file, ok = d.take() {
+					taken <- file.ID
+					time.Sleep(10 * time.Millisecond)
+					d.done(q)
+				}
+			}()
+		}
+		select {
+		case <-taken:
+			t.Fatal("file taken while paused")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		d.setPaused(false)
+		for range 3 {
+			select {
+			case <-taken:
+				d.mu.Lock()
+				assert.LessOrEqual(t, d.active(), 1)
+				d.mu.Unlock()
+			case <-time.After(time.Second):
+				t.Fatal("file not taken after resume")
+			}
+		}
+	})
+
+	t.Run("adaptive limit", func(t *testing.T) {
+		d := newDispatcher(t.Context(), nil, 4)
+		d.limiter = newAdaptiveLimiter(2, 4, time.Hour)
+		a := d.add(&ingestRun{name: "a"}, 1)
+
+		taken := make(chan *runQueue, 4)
+		for range 4 {
+			go func() {
+				for q, _, ok := d.take(); ok; q, _, ok = d.take() {
+					taken <- q
+				}
+			}()
+		}
+		time.Sleep(20 * time.Millisecond)
+		assert.False(t, d.limiter.saturated, "workers waiting for files are not busy")
+
+		fill(d, a, 1, 2, 3)
+		for range 2 {
+			<-taken
+		}
+		select {
+		case <-taken:
+			t.Fatal("more files taken than the limit")
+		case <-time.After(20 * time.Millisecond):
+		}
+		assert.True(t, d.limiter.saturated)
+
+		d.limiter.release(0, 0, nil)
+		d.done(a)
+		<-taken
+		d.close(a)
+	})
+
+	t.Run("requeue", func(t *testing.T) {
+		d := newDispatcher(t.Context(), nil, 2)
+		a := d.add(&ingestRun{name: "a"}, 1)
+		fill(d, a, 1)
+
+		q, file, ok := d.take()
+		assert.True(t, ok)
+		// the file failed and is retried while it is still being transferred
+		assert.True(t, d.requeue(a, file))
+		d.done(q)
+		q, file, ok = d.take()
+		assert.True(t, ok)
+		assert.Equal(t, int64(1), file.ID)
+		d.done(q)
+
+		_, _, ok = d.take()
+		assert.False(t, ok)
+		assert.False(t, d.requeue(a, file), "finished")
+	})
+}
@@ -0,0 +1,163 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/asips/sdtp-client/internal"
+)
+
+// existsPolicy is what to do when a file being ingested already exists in the
+// destination directory.
+type existsPolicy string
+
+const (
+	// existsOverwrite replaces the existing file and acks.
+	existsOverwrite existsPolicy = "overwrite"
+	// existsSkip keeps the existing file and leaves the server copy unacked.
+	existsSkip existsPolicy = "skip"
+	// existsSkipIfSame keeps the existing file and acks if its size and
+	// checksum match, otherwise the file is overwritten.
+	existsSkipIfSame existsPolicy = "skip-if-same"
+	// existsRename downloads to a new name with a file id, or numeric, suffix
+	// and acks.
+	existsRename existsPolicy = "rename"
+	// existsFail reports the file as failed and leaves the server copy unacked.
+	existsFail existsPolicy = "fail"
+)
+
+var existsPolicies = []existsPolicy{existsOverwrite, existsSkip, existsSkipIfSame, existsRename, existsFail}
+
+func parseExistsPolicy(s string) (existsPolicy, error) {
+	for _, p := range existsPolicies {
+		if string(p) == s {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("invalid on-exists policy %q", s)
+}
+
+var errFileExists = fmt.Errorf("file exists")
+
+// destLocks serializes the ingest of files to the same destination path.
+var destLocks = &pathLocks{locks: map[string]*pathLock{}}
+
+// pathLocks is a mutex per path, kept only while in use.
+type pathLocks struct {
+	mu    sync.Mutex
+	locks map[string]*pathLock
+}
+
+type pathLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// lock locks p, blocking while another caller holds it, and returns the func
+// that unlocks it.
+func (l *pathLocks) lock(p string) (unlock func()) {
+	l.mu.Lock()
+	pl, ok := l.locks[p]
+	if !ok {
+		pl = &pathLock{}
+		l.locks[p] = pl
+	}
+	pl.refs++
+	l.mu.Unlock()
+
+	pl.mu.Lock()
+	return func() {
+		pl.mu.Unlock()
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		pl.refs--
+		if pl.refs == 0 {
+			delete(l.locks, p)
+		}
+	}
+}
+
+// existsAction is the outcome of applying an existsPolicy to a file.
+type existsAction struct {
+	// download is true if the file should be downloaded to name.
+	download bool
+	name     string
+	// ack is true if a file that is not downloaded should still be acked.
+	ack bool
+}
+
+// resolveExisting applies policy to file, returning what should be done with
+// it. An error wrapping errFileExists is returned for the fail policy.
+func resolveExisting(policy existsPolicy, destDir string, file internal.FileInfo) (existsAction, error) {
+	destPath := path.Join(destDir, file.Name)
+	if _, err := os.Stat(destPath); errors.Is(err, os.ErrNotExist) {
+		return existsAction{download: true, name: file.Name}, nil
+	} else if err != nil {
+		return existsAction{}, err
+	}
+
+	switch policy {
+	case existsSkip:
+		return existsAction{}, nil
+	case existsSkipIfSame:
+		same, err := sameFile(destPath, file)
+		if err != nil {
+			return existsAction{}, err
+		}
+		if same {
+			return existsAction{ack: true}, nil
+		}
+		return existsAction{download: true, name: file.Name}, nil
+	case existsRename:
+		name, err := uniqueName(destDir, file)
+		if err != nil {
+			return existsAction{}, err
+		}
+		return existsAction{download: true, name: name}, nil
+	case existsFail:
+		return existsAction{}, fmt.Errorf("%w: %s", errFileExists, destPath)
+	}
+	return existsAction{download: true, name: file.Name}, nil
+}
+
+// sameFile returns true if the file at p has the size and checksum of file.
+func sameFile(p string, file internal.FileInfo) (bool, error) {
+	st, err := os.Stat(p)
+	if err != nil {
+		return false, err
+	}
+	if st.Size() != file.Size {
+		return false, nil
+	}
+	alg, expected, found := strings.Cut(file.Checksum, ":")
+	if !found {
+		return false, fmt.Errorf("invalid checksum format")
+	}
+	computed, err := internal.Checksum(alg, p)
+	if err != nil {
+		return false, fmt.Errorf("failed to checksum %s: %w", p, err)
+	}
+	return strings.EqualFold(computed, expected), nil
+}
+
+// uniqueName returns a name for file that does not exist in destDir, adding
+// the file id before the extension, e.g., file.1234.h5, and then a number if
+// that exists too.
+func uniqueName(destDir string, file internal.FileInfo) (string, error) {
+	ext := path.Ext(file.Name)
+	stem := strings.TrimSuffix(file.Name, ext)
+	name := fmt.Sprintf("%s.%d%s", stem, file.ID, ext)
+	for i := 1; ; i++ {
+		_, err := os.Stat(path.Join(destDir, name))
+		if errors.Is(err, os.ErrNotExist) {
+			return name, nil
+		} else if err != nil {
+			return "", err
+		}
+		name = fmt.Sprintf("%s.%d.%d%s", stem, file.ID, i, ext)
+	}
+}
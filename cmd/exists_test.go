@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/asips/sdtp-client/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_resolveExisting(t *testing.T) {
+	dir := t.TempDir()
+	file := internal.FileInfo{
+		ID:       1234,
+		Name:     "file1.h5",
+		Size:     3,
+		Checksum: "md5:f561aaf6ef0bf14d4208bb46a4ccb3ad",
+	}
+
+	t.Run("not exists", func(t *testing.T) {
+		for _, policy := range existsPolicies {
+			action, err := resolveExisting(policy, dir, file)
+			assert.NoError(t, err)
+			assert.Equal(t, existsAction{download: true, name: file.Name}, action, policy)
+		}
+	})
+
+	assert.NoError(t, os.WriteFile(path.Join(dir, file.Name), []byte("xxx"), 0644))
+
+	t.Run("overwrite", func(t *testing.T) {
+		action, err := resolveExisting(existsOverwrite, dir, file)
+		assert.NoError(t, err)
+		assert.Equal(t, existsAction{download: true, name: file.Name}, action)
+	})
+
+	t.Run("skip", func(t *testing.T) {
+		action, err := resolveExisting(existsSkip, dir, file)
+		assert.NoError(t, err)
+		assert.Equal(t, existsAction{}, action)
+	})
+
+	t.Run("skip-if-same", func(t *testing.T) {
+		action, err := resolveExisting(existsSkipIfSame, dir, file)
+		assert.NoError(t, err)
+		assert.Equal(t, existsAction{ack: true}, action)
+
+		different := file
+		different.Checksum = "md5:00000000000000000000000000000000"
+		action, err = resolveExisting(existsSkipIfSame, dir, different)
+		assert.NoError(t, err)
+		assert.Equal(t, existsAction{download: true, name: file.Name}, action)
+	})
+
+	t.Run("rename", func(t *testing.T) {
+		action, err := resolveExisting(existsRename, dir, file)
+		assert.NoError(t, err)
+		assert.Equal(t, existsAction{download: true, name: "file1.1234.h5"}, action)
+
+		assert.NoError(t, os.WriteFile(path.Join(dir, "file1.1234.h5"), []byte("xxx"), 0644))
+		action, err = resolveExisting(existsRename, dir, file)
+		assert.NoError(t, err)
+		assert.Equal(t, existsAction{download: true, name: "file1.1234.1.h5"}, action)
+	})
+
+	t.Run("fail", func(t *testing.T) {
+		_, err := resolveExisting(existsFail, dir, file)
+		assert.ErrorIs(t, err, errFileExists)
+	})
+}
+
+// writingSDTP writes each file's id to it, slowly, as a download would.
+type writingSDTP struct {
+	*mockSDTP
+	downloads atomic.Int32
+}
+
+func (s *writingSDTP) Download(ctx context.Context, file internal.FileInfo, destDir string) error {
+	s.downloads.Add(1)
+	tmpPath := internal.TempPath(destDir, file)
+	if err := os.WriteFile(tmpPath, []byte(file.Name), 0644); err != nil {
+		return err
+	}
+	time.Sleep(20 * time.Millisecond)
+	return os.Rename(tmpPath, path.Join(destDir, file.Name))
+}
+
+func Test_doIngest_sameName(t *testing.T) {
+	dir := t.TempDir()
+	sdtp := &writingSDTP{mockSDTP: createMockSDTP(t)}
+	sdtp.listing = []internal.FileInfo{{ID: 1, Name: "a.dat"}, {ID: 2, Name: "a.dat"}}
+
+	// ingested one at a time, so the second sees the first and fails
+	err := doIngest(t.Context(), nil, sdtp, ingestOptions{destDir: dir, concurrency: 2, noAck: true, onExists: existsFail})
+	assert.ErrorContains(t, err, "1 of 2 files failed")
+	assert.Equal(t, int32(1), sdtp.downloads.Load())
+}
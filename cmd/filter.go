@@ -0,0 +1,132 @@
+package cmd
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+
+	"github.com/asips/sdtp-client/internal"
+	"github.com/asips/sdtp-client/internal/filter"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// fileFilter selects files from a listing on the client side, after any server
+// side filtering by tags.
+type fileFilter struct {
+	expr          *filter.Filter
+	include       []string
+	exclude       []string
+	includeRegexp []*regexp.Regexp
+	excludeRegexp []*regexp.Regexp
+}
+
+func addFilterFlags(flags *pflag.FlagSet) {
+	flags.String("filter", "", `Client-side filter expression, e.g., 'size < 2GB && expires_in < 24h && extra.collection == 5.1'. `+
+		`Fields are id, name, checksum, size, expires, expires_in, tags.<key> and extra.<key>`)
+	flags.StringSlice("include", nil, "Only include files whose name matches this glob. May be specified multiple times")
+	flags.StringSlice("exclude", nil, "Exclude files whose name matches this glob. May be specified multiple times")
+	flags.StringSlice("include-regex", nil, "Only include files whose name matches this regular expression. May be specified multiple times")
+	flags.StringSlice("exclude-regex", nil, "Exclude files whose name matches this regular expression. May be specified multiple times")
+}
+
+// filterFromFlags builds a fileFilter from the flags added by addFilterFlags. It
+// returns nil if no filtering was requested.
+func filterFromFlags(flags *pflag.FlagSet) (*fileFilter, error) {
+	expr, err := flags.GetString("filter")
+	cobra.CheckErr(err)
+	include, err := flags.GetStringSlice("include")
+	cobra.CheckErr(err)
+	exclude, err := flags.GetStringSlice("exclude")
+	cobra.CheckErr(err)
+	includeRegex, err := flags.GetStringSlice("include-regex")
+	cobra.CheckErr(err)
+	excludeRegex, err := flags.GetStringSlice("exclude-regex")
+	cobra.CheckErr(err)
+
+	return newFileFilter(expr, include, exclude, includeRegex, excludeRegex)
+}
+
+func newFileFilter(expr string, include, exclude, includeRegex, excludeRegex []string) (*fileFilter, error) {
+	if expr == "" && len(include)+len(exclude)+len(includeRegex)+len(excludeRegex) == 0 {
+		return nil, nil
+	}
+
+	f := &fileFilter{include: include, exclude: exclude}
+	if expr != "" {
+		parsed, err := filter.Parse(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter: %w", err)
+		}
+		f.expr = parsed
+	}
+	for _, pat := range append(append([]string{}, include...), exclude...) {
+		if _, err := path.Match(pat, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob %q: %w", pat, err)
+		}
+	}
+	for _, pat := range includeRegex {
+		re, err := regexp.Compile(pat)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex %q: %w", pat, err)
+		}
+		f.includeRegexp = append(f.includeRegexp, re)
+	}
+	for _, pat := range excludeRegex {
+		re, err := regexp.Compile(pat)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex %q: %w", pat, err)
+		}
+		f.excludeRegexp = append(f.excludeRegexp, re)
+	}
+	return f, nil
+}
+
+// match returns true if file passes all of the filters. A file must match at
+// least one include glob or regex, if there are any, and none of the excludes.
+func (f *fileFilter) match(file internal.FileInfo) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.include)+len(f.includeRegexp) > 0 {
+		included := false
+		for _, pat := range f.include {
+			if ok, _ := path.Match(pat, file.Name); ok {
+				included = true
+			}
+		}
+		for _, re := range f.includeRegexp {
+			if re.MatchString(file.Name) {
+				included = true
+			}
+		}
+		if !included {
+			return false
+		}
+	}
+	for _, pat := range f.exclude {
+		if ok, _ := path.Match(pat, file.Name); ok {
+			return false
+		}
+	}
+	for _, re := range f.excludeRegexp {
+		if re.MatchString(file.Name) {
+			return false
+		}
+	}
+	return f.expr == nil || f.expr.Match(file)
+}
+
+// apply returns the files that match the filter.
+func (f *fileFilter) apply(files []internal.FileInfo) []internal.FileInfo {
+	if f == nil {
+		return files
+	}
+	matched := []internal.FileInfo{}
+	for _, file := range files {
+		if f.match(file) {
+			matched = append(matched, file)
+		}
+	}
+	return matched
+}
@@ -0,0 +1,132 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"github.com/asips/sdtp-client/internal"
+	"github.com/asips/sdtp-client/internal/log"
+	"github.com/spf13/cobra"
+)
+
+var getCmd = &cobra.Command{
+	Use:   "get <fileid>",
+	Short: "Download a single file by its file id",
+	Long: `Download a single file by its file id.
+
+The file must be present in the listing for the provided tags so its checksum can be
+verified. With --stdout the file is streamed to stdout and never written to local disk.
+If the checksum does not match the command exits non-zero and the file is not acked,
+so downstream consumers can discard what they received.
+`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := cmd.Flags()
+		certPath, err := flags.GetString("cert")
+		cobra.CheckErr(err)
+		keyPath, err := flags.GetString("key")
+		cobra.CheckErr(err)
+		checkCertDays, err := flags.GetInt("check-cert-days")
+		cobra.CheckErr(err)
+
+		mustValidateCert(certPath, keyPath, checkCertDays)
+
+		fileID, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			log.Fatal("invalid file id %q: %s", args[0], err)
+		}
+
+		stagingDir, err := flags.GetString("staging-dir")
+		cobra.CheckErr(err)
+		clientOpts := clientOptionsFromFlags(flags)
+		clientOpts.StagingDir = stagingDir
+		sdtp := newClientFromFlags(flags, certPath, keyPath, clientOpts)
+
+		tags, err := flags.GetStringToString("tag")
+		cobra.CheckErr(err)
+		destDir, err := flags.GetString("dest-dir")
+		cobra.CheckErr(err)
+		toStdout, err := flags.GetBool("stdout")
+		cobra.CheckErr(err)
+		ack, err := flags.GetBool("ack")
+		cobra.CheckErr(err)
+
+		ctx, cancel := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+
+		var out io.Writer
+		if toStdout {
+			out = os.Stdout
+		}
+		transfers := newTransferTracker(0)
+		stopProgress := startProgressFromFlags(flags, transfers)
+		err = doGet(ctx, sdtp, tags, fileID, destDir, out, ack, transfers)
+		stopProgress()
+		if err != nil {
+			log.Fatal("Failed to get fileid=%d: %s", fileID, err)
+		}
+		return nil
+	},
+}
+
+func init() {
+	flags := getCmd.Flags()
+
+	flags.StringP("dest-dir", "d", ".", "Local directory to download the file to")
+	flags.String("staging-dir", "", "Directory to download and verify the file in before moving it to dest-dir. May be on a different filesystem")
+	flags.StringToStringP("tag", "t", map[string]string{}, "<key>=<value> tags used to list the file. May be specified multiple times or as a comma-separated list")
+	addProviderFlags(flags)
+	addProgressFlag(flags)
+	flags.Bool("stdout", false, "Stream the file to stdout rather than writing it to dest-dir")
+	flags.Bool("ack", false, "Acknowledge the file after it has been successfully downloaded and verified")
+}
+
+// doGet downloads fileID to destDir, or streams it to out if out is not nil,
+// recording its progress in transfers.
+func doGet(ctx context.Context, sdtp internal.SDTPClient, tags map[string]string, fileID int64, destDir string, out io.Writer, ack bool, transfers *transferTracker) error {
+	file, err := findFile(ctx, sdtp, tags, fileID)
+	if err != nil {
+		return err
+	}
+
+	transfers.queued(file)
+	defer transfers.processed(file)
+	ctx, tr := transfers.start(ctx, "", file)
+	defer transfers.finish(tr)
+	if out != nil {
+		log.Printf("streaming fileid=%d(%s)", file.ID, file.Name)
+		err = sdtp.Stream(ctx, file, out)
+	} else {
+		log.Printf("downloading fileid=%d(%s)", file.ID, file.Name)
+		err = sdtp.Download(ctx, file, destDir)
+	}
+	if err != nil {
+		return err
+	}
+
+	if ack {
+		if err := sdtp.Ack(ctx, file); err != nil {
+			return fmt.Errorf("failed to ack: %w", err)
+		}
+	}
+	return nil
+}
+
+// findFile returns the file from the listing for tags with the given ID.
+func findFile(ctx context.Context, sdtp internal.FileListor, tags map[string]string, fileID int64) (internal.FileInfo, error) {
+	files, err := sdtp.List(ctx, tags)
+	if err != nil {
+		return internal.FileInfo{}, fmt.Errorf("failed to list files: %w", err)
+	}
+	for _, file := range files {
+		if file.ID == fileID {
+			return file, nil
+		}
+	}
+	return internal.FileInfo{}, fmt.Errorf("fileid=%d %w in listing", fileID, internal.ErrNotFound)
+}
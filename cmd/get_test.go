@@ -0,0 +1,22 @@
+package cmd
+
+import (
+	"io"
+	"testing"
+
+	"github.com/asips/sdtp-client/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_doGet(t *testing.T) {
+	sdtp := createMockSDTP(t)
+	sdtp.listing = []internal.FileInfo{
+		{ID: 7, Name: "file1.txt", Size: 1234, Tags: map[string]string{"stream": "test"}},
+	}
+
+	err := doGet(t.Context(), sdtp, map[string]string{}, 7, "", io.Discard, true, newTransferTracker(0))
+	assert.NoError(t, err)
+
+	err = doGet(t.Context(), sdtp, map[string]string{}, 8, "", io.Discard, true, newTransferTracker(0))
+	assert.ErrorIs(t, err, internal.ErrNotFound)
+}
@@ -2,158 +2,1000 @@ package cmd
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"os"
-	"os/signal"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
-	"syscall"
+	"sync/atomic"
+	"text/template"
+	"time"
 
 	"github.com/asips/sdtp-client/internal"
 	"github.com/asips/sdtp-client/internal/log"
+	"github.com/asips/sdtp-client/internal/metrics"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 var ingestCmd = &cobra.Command{
 	Use:   "ingest",
 	Short: "Ingest data from SDTP server",
 	RunE: func(cmd *cobra.Command, args []string) error {
-		flags := cmd.Flags()
-		certPath, err := flags.GetString("cert")
-		cobra.CheckErr(err)
-		keyPath, err := flags.GetString("key")
-		cobra.CheckErr(err)
-		httpTimeout, err := flags.GetDuration("http-timeout")
-		cobra.CheckErr(err)
-		checkCertDays, err := flags.GetInt("check-cert-days")
-		cobra.CheckErr(err)
-		checkCertExprFlag, err := flags.GetBool("check-cert-expr")
-		cobra.CheckErr(err)
+		setup := setupIngest(cmd)
+		defer setup.close()
+		defer startProgressFromFlags(cmd.Flags(), setup.opts.transfers)()
+		return doIngestSubscriptions(setup.ctx, setup.stop, setup.sdtp, setup.opts, setup.subs)
+	},
+}
+
+// ingestSetup is what an ingest needs, read from the command line flags.
+type ingestSetup struct {
+	ctx    context.Context
+	stop   <-chan struct{}
+	cancel context.CancelFunc
+	unlock func()
+
+	sdtp        sdtpClient
+	opts        ingestOptions
+	subs        []subscription
+	metricsFile string
+}
+
+// setupIngest reads the ingest flags, creating the client and destination
+// directories, and locking the state directories. Invalid flags are fatal.
+func setupIngest(cmd *cobra.Command) *ingestSetup {
+	flags := cmd.Flags()
+	certPath, err := flags.GetString("cert")
+	cobra.CheckErr(err)
+	keyPath, err := flags.GetString("key")
+	cobra.CheckErr(err)
+	checkCertDays, err := flags.GetInt("check-cert-days")
+	cobra.CheckErr(err)
+	checkCertExprFlag, err := flags.GetBool("check-cert-expr")
+	cobra.CheckErr(err)
+
+	mustValidateCert(certPath, keyPath, checkCertDays)
+
+	stagingDir, err := flags.GetString("staging-dir")
+	cobra.CheckErr(err)
+	clientOpts := clientOptionsFromFlags(flags)
+	clientOpts.StagingDir = stagingDir
+	sdtp := newClientFromFlags(flags, certPath, keyPath, clientOpts)
+
+	destDir, err := flags.GetString("dest-dir")
+	cobra.CheckErr(err)
+	if _, err := os.Stat(destDir); os.IsNotExist(err) {
+		log.Printf("creating destination directory: %q", destDir)
+		os.MkdirAll(destDir, 0755)
+	}
+
+	tags, err := flags.GetStringToString("tag")
+	cobra.CheckErr(err)
 
+	stream, err := flags.GetString("stream")
+	cobra.CheckErr(err)
+	if flags.Changed("stream") {
+		tags["stream"] = stream
+	}
+	mission, err := flags.GetString("mission")
+	cobra.CheckErr(err)
+	if flags.Changed("mission") {
+		tags["mission"] = mission
+	}
+	shortName, err := flags.GetString("short-name")
+	cobra.CheckErr(err)
+	if flags.Changed("short-name") {
+		tags["ShortName"] = shortName
+	}
+	if checkCertExprFlag {
 		mustValidateCert(certPath, keyPath, checkCertDays)
+	}
 
-		strApiUrl, err := flags.GetString("api-url")
-		cobra.CheckErr(err)
-		apiUrl := parseApiUrl(strApiUrl)
-		sdtp, err := internal.NewDefaultSDTP(apiUrl, certPath, keyPath, httpTimeout)
-		if err != nil {
-			log.Fatal("Failed to create SDTP client: %s", err)
-		}
+	noAckFlag, err := flags.GetBool("no-ack")
+	cobra.CheckErr(err)
 
-		destDir, err := flags.GetString("dest-dir")
+	concurrencyStr, err := flags.GetString("concurrency")
+	cobra.CheckErr(err)
+	concurrency, autoConcurrency, err := parseConcurrency(concurrencyStr)
+	if err != nil {
+		log.Fatal("invalid --concurrency: %s", err)
+	}
+	if autoConcurrency {
+		concurrency, err = flags.GetUint("min-concurrency")
 		cobra.CheckErr(err)
-		if _, err := os.Stat(destDir); os.IsNotExist(err) {
-			log.Printf("creating destination directory: %q", destDir)
-			os.MkdirAll(destDir, 0755)
+	}
+	maxConcurrency, err := flags.GetUint("max-concurrency")
+	cobra.CheckErr(err)
+	if autoConcurrency && (concurrency == 0 || maxConcurrency < concurrency) {
+		log.Fatal("--min-concurrency must be at least 1 and no more than --max-concurrency")
+	}
+	filter, err := filterFromFlags(flags)
+	if err != nil {
+		log.Fatal("%s", err)
+	}
+	pipeCmd, err := flags.GetString("pipe")
+	cobra.CheckErr(err)
+	minFreeStr, err := flags.GetString("min-free")
+	cobra.CheckErr(err)
+	minFree, err := internal.ParseSize(minFreeStr)
+	if err != nil {
+		log.Fatal("invalid --min-free: %s", err)
+	}
+	onExistsStr, err := flags.GetString("on-exists")
+	cobra.CheckErr(err)
+	onExists, err := parseExistsPolicy(onExistsStr)
+	if err != nil {
+		log.Fatal("invalid --on-exists: %s", err)
+	}
+	maxBytesStr, err := flags.GetString("max-bytes-per-run")
+	cobra.CheckErr(err)
+	maxBytesPerRun, err := internal.ParseSize(maxBytesStr)
+	if err != nil {
+		log.Fatal("invalid --max-bytes-per-run: %s", err)
+	}
+
+	order, err := flags.GetString("order")
+	cobra.CheckErr(err)
+	if err := validateOrder(order); err != nil {
+		log.Fatal("invalid --order: %s", err)
+	}
+	expiryWarning, err := flags.GetDuration("expiry-warning")
+	cobra.CheckErr(err)
+	pageSize, err := flags.GetInt("page-size")
+	cobra.CheckErr(err)
+	limit, err := flags.GetInt("limit")
+	cobra.CheckErr(err)
+	metricsFile, err := flags.GetString("metrics-file")
+	cobra.CheckErr(err)
+
+	stateDir, err := flags.GetString("state-dir")
+	cobra.CheckErr(err)
+	destTemplateStr, err := flags.GetString("dest-template")
+	cobra.CheckErr(err)
+	var destTemplate *template.Template
+	if destTemplateStr != "" {
+		if destTemplate, err = parseDestTemplate(destTemplateStr); err != nil {
+			log.Fatal("invalid --dest-template: %s", err)
+		}
+	}
+	hook, err := flags.GetString("hook")
+	cobra.CheckErr(err)
+	subscriptionsFile, err := flags.GetString("subscriptions")
+	cobra.CheckErr(err)
+	gracePeriod, err := flags.GetDuration("grace-period")
+	cobra.CheckErr(err)
+	ackConcurrency, err := flags.GetUint("ack-concurrency")
+	cobra.CheckErr(err)
+	ackRetries, err := flags.GetInt("ack-retries")
+	cobra.CheckErr(err)
+	ackBackoff, err := flags.GetDuration("ack-backoff")
+	cobra.CheckErr(err)
+	lockWait, err := flags.GetBool("lock-wait")
+	cobra.CheckErr(err)
+	lockTimeout, err := flags.GetDuration("lock-timeout")
+	cobra.CheckErr(err)
+	maxBandwidthStr, err := flags.GetString("max-bandwidth")
+	cobra.CheckErr(err)
+	maxBandwidth, err := internal.ParseSize(maxBandwidthStr)
+	if err != nil {
+		log.Fatal("invalid --max-bandwidth: %s", err)
+	}
+	controlAddr, err := flags.GetString("control-addr")
+	cobra.CheckErr(err)
+	if controlAddr != "" {
+		if err := validateControlAddr(controlAddr); err != nil {
+			log.Fatal("invalid --control-addr: %s", err)
 		}
+	}
 
-		tags, err := flags.GetStringToString("tag")
-		cobra.CheckErr(err)
+	stop, ctx, cancel, drain := notifyShutdown(cmd.Context(), gracePeriod)
 
-		stream, err := flags.GetString("stream")
-		cobra.CheckErr(err)
-		if flags.Changed("stream") {
-			tags["stream"] = stream
+	certReloadInterval, err := flags.GetDuration("cert-reload-interval")
+	cobra.CheckErr(err)
+	watchCertificate(ctx, sdtp, certReloadInterval)
+
+	opts := ingestOptions{
+		destDir:         destDir,
+		tags:            tags,
+		filter:          filter,
+		noAck:           noAckFlag,
+		concurrency:     concurrency,
+		autoConcurrency: autoConcurrency,
+		maxConcurrency:  maxConcurrency,
+		stagingDir:      stagingDir,
+		pipeCmd:         pipeCmd,
+		minFree:         minFree,
+		maxBytesPerRun:  maxBytesPerRun,
+		onExists:        onExists,
+		order:           order,
+		expiryWarning:   expiryWarning,
+		pageSize:        pageSize,
+		limit:           limit,
+		stateDir:        stateDir,
+		ackConcurrency:  ackConcurrency,
+		ackRetries:      ackRetries,
+		ackBackoff:      ackBackoff,
+		destTemplate:    destTemplate,
+		hook:            hook,
+		transfers:       newTransferTracker(maxBandwidth),
+	}
+	if controlAddr != "" {
+		opts.control = newController(opts, certPath, keyPath, stop, drain)
+	}
+	subs := []subscription{{weight: 1, opts: opts}}
+	if subscriptionsFile != "" {
+		if subs, err = loadSubscriptions(subscriptionsFile, opts); err != nil {
+			log.Fatal("%s", err)
 		}
-		mission, err := flags.GetString("mission")
-		cobra.CheckErr(err)
-		if flags.Changed("mission") {
-			tags["mission"] = mission
+	}
+	for i := range subs {
+		sub := &subs[i].opts
+		if _, err := os.Stat(sub.destDir); os.IsNotExist(err) {
+			log.Printf("creating destination directory: %q", sub.destDir)
+			os.MkdirAll(sub.destDir, 0755)
 		}
-		shortName, err := flags.GetString("short-name")
-		cobra.CheckErr(err)
-		if flags.Changed("short-name") {
-			tags["ShortName"] = shortName
+		if sub.stateDir == "" {
+			sub.stateDir = sub.destDir
 		}
-		if checkCertExprFlag {
-			mustValidateCert(certPath, keyPath, checkCertDays)
+	}
+	stateDirs := []string{}
+	for _, sub := range subs {
+		stateDirs = append(stateDirs, sub.opts.stateDir)
+	}
+	unlock, err := lockIngest(ctx, stateDirs, lockWait || lockTimeout > 0, lockTimeout)
+	if err != nil {
+		log.Fatal("%s", err)
+	}
+	if opts.control != nil {
+		if err := serveStatus(ctx, "control API", controlAddr, opts.control.handler()); err != nil {
+			log.Fatal("failed to serve control API on %s: %s", controlAddr, err)
 		}
+	}
+	return &ingestSetup{
+		ctx:         ctx,
+		stop:        stop,
+		cancel:      cancel,
+		unlock:      unlock,
+		sdtp:        sdtp,
+		opts:        opts,
+		subs:        subs,
+		metricsFile: metricsFile,
+	}
+}
 
-		noAckFlag, err := flags.GetBool("no-ack")
-		cobra.CheckErr(err)
-
-		concurrency, err := flags.GetUint("concurrency")
-		cobra.CheckErr(err)
-
-		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
-		defer cancel()
-
-		return doIngest(
-			ctx,
-			sdtp,
-			destDir,
-			tags,
-			noAckFlag,
-			concurrency,
-		)
-	},
+// close releases the state directories and writes the metrics file, if any.
+func (s *ingestSetup) close() {
+	s.unlock()
+	s.cancel()
+	if s.metricsFile != "" {
+		if err := metrics.WriteFile(s.metricsFile); err != nil {
+			log.Printf("failed to write metrics to %s: %s", s.metricsFile, err)
+		}
+	}
 }
 
 func init() {
 	flags := ingestCmd.Flags()
+	addIngestFlags(flags)
+	addProgressFlag(flags)
+	flags.Bool("list", false, "List available files, but do not download")
+	flags.MarkDeprecated("list", "use 'list' sub-command instead")
+}
 
+// addIngestFlags adds the flags shared by the ingest and schedule commands.
+func addIngestFlags(flags *pflag.FlagSet) {
 	flags.StringP("dest-dir", "d", ".", "Local directory to ingest data to")
+	flags.String("staging-dir", "", "Directory to download and verify files in before moving them to dest-dir. May be on a different filesystem")
 	flags.String("stream", "", "SDTP 'stream' field (query parameter)")
 	flags.String("short-name", "", "SDTP 'ShortName' field (query parameter)")
 	flags.String("mission", "", "SDTP 'mission' field (query parameter)")
 	flags.StringToStringP("tag", "t", map[string]string{}, "<key>=<value> tags to filter by. May be specified multiple times or as a comma-separated list")
+	addFilterFlags(flags)
+	addListingFlags(flags)
+	addProviderFlags(flags)
 	flags.Bool("no-ack", false, "Skip acknowledgment after successful ingest")
-	flags.Bool("list", false, "List available files, but do not download")
-	flags.Uint("concurrency", 4, "Number of concurrent downloads")
+	flags.Uint("ack-concurrency", 2, "Number of acknowledgments to send at once, separately from downloads")
+	flags.Int("ack-retries", 3, "How many times a failed acknowledgment is retried")
+	flags.Duration("ack-backoff", time.Second, "Delay before retrying a failed acknowledgment, doubling with each retry")
+	flags.String("concurrency", "4", "Number of concurrent downloads, or auto to adjust it between --min-concurrency and --max-concurrency "+
+		"from throughput, latency and server errors")
+	flags.Uint("min-concurrency", 1, "Minimum, and initial, number of concurrent downloads with --concurrency=auto")
+	flags.Uint("max-concurrency", 16, "Maximum number of concurrent downloads with --concurrency=auto")
+	flags.String("pipe", "", "Stream each file to the stdin of this shell command rather than writing it to dest-dir. "+
+		"File details are available in the SDTP_FILE_ID, SDTP_FILE_NAME, SDTP_FILE_SIZE and SDTP_FILE_CHECKSUM "+
+		"environment variables. The command is killed and the file not acked if the checksum does not match")
+	flags.String("on-exists", string(existsOverwrite), "What to do when a file already exists in dest-dir: "+
+		"overwrite (replace and ack), skip (keep and do not ack), skip-if-same (keep and ack if size and checksum match, otherwise overwrite), "+
+		"rename (download with a file id suffix and ack) or fail (do not download or ack)")
+	flags.String("order", "", "Order to download files in: expires (soonest first), size-asc, size-desc, id, name or random. "+
+		"Defaults to the order returned by the server")
+	flags.Duration("expiry-warning", 6*time.Hour, "Log a warning for files that expire within this duration. Files that have already expired are skipped")
+	flags.String("metrics-file", "", "Write metrics to this file in Prometheus text format at the end of the run, e.g., for the node_exporter textfile collector")
+	flags.String("min-free", "0", "Minimum free space to leave on the dest-dir filesystem, e.g., 10G. Files that do not fit are left for the next run")
+	flags.String("max-bytes-per-run", "0", "Maximum total size of files to download in a single run, e.g., 500GB. Zero means no limit")
+	flags.String("max-bandwidth", "0", "Maximum total rate to download at, in bytes per second, e.g., 50MB. Zero means no limit")
+	flags.String("control-addr", "", "Address, e.g., localhost:8090 or unix:/run/sdtp/control.sock, to serve the control API on, "+
+		"to inspect and steer the ingest while it runs, see 'ctl'. It is unauthenticated, so must be a unix socket or a loopback address, e.g., localhost or 127.0.0.1; "+
+		"other hosts, including 0.0.0.0, are rejected")
+	flags.Duration("grace-period", 30*time.Second, "On interrupt or SIGTERM, how long to let in-flight downloads and acks finish before aborting them. "+
+		"A second signal aborts immediately")
+	flags.String("state-dir", "", "Directory to record the outcome of the run in, so the next run can ack files left unacked. Defaults to dest-dir")
+	flags.Bool("lock-wait", false, "Wait for another ingest using the same state-dir to finish rather than exiting")
+	flags.Duration("lock-timeout", 0, "Maximum time to wait for another ingest using the same state-dir to finish. Implies --lock-wait")
+	flags.String("dest-template", "", "Template for the directory below dest-dir to write each file to, e.g., '{{.Tags.mission}}/{{.Tags.stream}}'. "+
+		"Fields are ID, Name, Checksum, Size, Expires, Tags, Extra and Subscription")
+	flags.String("hook", "", "Shell command to run after each file is downloaded, with the SDTP_FILE_* environment variables as for --pipe "+
+		"plus SDTP_FILE_PATH and SDTP_SUBSCRIPTION. The file is not acked if the command fails")
+	flags.String("subscriptions", "", "JSON file of subscriptions to ingest at once, each with its own tags, destination, weight and settings. "+
+		"Other flags provide the defaults")
+}
 
-	flags.MarkDeprecated("list", "use 'list' sub-command instead")
+type ingestOptions struct {
+	destDir string
+	tags    map[string]string
+	filter  *fileFilter
+	// stagingDir, if set, is where the client writes files before committing
+	// them to destDir.
+	stagingDir  string
+	noAck       bool
+	concurrency uint
+	// autoConcurrency, if set, runs up to maxConcurrency workers, limiting how
+	// many transfer at once with an adaptiveLimiter starting at concurrency.
+	autoConcurrency bool
+	maxConcurrency  uint
+	// pipeCmd, if set, is the shell command each file is streamed to instead
+	// of being written to destDir.
+	pipeCmd string
+	// minFree is the number of bytes that must remain free on the destDir
+	// filesystem after a download.
+	minFree uint64
+	// maxBytesPerRun limits the total size of the files downloaded in a run.
+	// Zero means no limit.
+	maxBytesPerRun uint64
+	onExists       existsPolicy
+	// order is the order files are downloaded in, see orderFiles.
+	order string
+	// expiryWarning is how close to expiring a file must be to log a warning.
+	expiryWarning time.Duration
+	// pageSize and limit are passed to the provider when listing, see
+	// internal.ListOptions.
+	pageSize int
+	limit    int
+	// stateDir, if set, is where the outcome of the run is recorded, see
+	// ingestState.
+	stateDir string
+	// ackConcurrency is the number of acks sent at once, and ackRetries how
+	// many times a failed ack is retried, waiting ackBackoff, doubling each
+	// time, between attempts.
+	ackConcurrency uint
+	ackRetries     int
+	ackBackoff     time.Duration
+	// destTemplate, if set, renders the directory below destDir each file is
+	// written to, see renderDestTemplate.
+	destTemplate *template.Template
+	// hook, if set, is a shell command run after each file is transferred.
+	// The file is only acked if it succeeds.
+	hook string
+	// transfers, if set, tracks the transfers in flight and limits their
+	// bandwidth.
+	transfers *transferTracker
+	// control, if set, lets the control API steer the ingest.
+	control *controller
 }
 
-func doIngest(ctx context.Context, sdtp internal.SDTPClient, destDir string, tags map[string]string, noAck bool, concurrency uint) error {
-	files, err := sdtp.List(ctx, tags)
-	if err != nil {
-		log.Fatal("Failed to list files: %s", err)
+// ingestStats are the counts reported at the end of an ingest.
+type ingestStats struct {
+	downloaded atomic.Int64
+	acked      atomic.Int64
+	// deferred are files left on the server for the next run because they
+	// did not fit in the available space or per-run limit.
+	deferred atomic.Int64
+	// skipped are files not downloaded because they already exist locally.
+	skipped atomic.Int64
+	// expired are listed files that had already expired.
+	expired atomic.Int64
+	// aborted are transfers interrupted by shutdown.
+	aborted atomic.Int64
+	// ackPending are verified files still waiting to be acked, and ackFailed
+	// files whose ack failed after any retries.
+	ackPending atomic.Int64
+	ackFailed  atomic.Int64
+
+	mu     sync.Mutex
+	failed map[string]int64
+}
+
+// fail records a failed file under the class of err.
+func (s *ingestStats) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failed == nil {
+		s.failed = map[string]int64{}
 	}
+	class := errorClass(err)
+	s.failed[class]++
+	metricFilesFailed.With(class).Inc()
+}
 
-	if len(files) == 0 {
-		log.Printf("No files found")
-		return nil
+// unfail forgets a failure recorded under class, e.g., because the file is
+// being retried.
+func (s *ingestStats) unfail(class string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failed[class] > 0 {
+		s.failed[class]--
 	}
-	log.Printf("Found %d files:", len(files))
+	if s.failed[class] == 0 {
+		delete(s.failed, class)
+	}
+}
 
-	wg := sync.WaitGroup{}
-	filesCh := make(chan internal.FileInfo, concurrency)
-	for i := 0; i < int(concurrency); i++ {
-		go downloadWorker(ctx, &wg, sdtp, filesCh, noAck, destDir)
-		wg.Add(1)
+func (s *ingestStats) failures() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int64
+	for _, count := range s.failed {
+		n += count
 	}
+	return n
+}
 
-	for _, file := range files {
-		filesCh <- file
+func (s *ingestStats) String() string {
+	str := fmt.Sprintf("%d downloaded, %d acked, %d ack_pending, %d ack_failed, %d skipped, %d expired, %d deferred, %d failed",
+		s.downloaded.Load(), s.acked.Load(), s.ackPending.Load(), s.ackFailed.Load(),
+		s.skipped.Load(), s.expired.Load(), s.deferred.Load(), s.failures())
+	if n := s.aborted.Load(); n > 0 {
+		str += fmt.Sprintf(", %d aborted", n)
 	}
-	close(filesCh)
 
-	wg.Wait()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	classes := []string{}
+	for class, count := range s.failed {
+		classes = append(classes, fmt.Sprintf("%s=%d", class, count))
+	}
+	if len(classes) > 0 {
+		sort.Strings(classes)
+		str += " (" + strings.Join(classes, ", ") + ")"
+	}
+	return str
+}
 
-	return nil
+// errorClass groups download errors for reporting in the ingest summary.
+func errorClass(err error) string {
+	switch {
+	case internal.IsNoSpace(err):
+		return "no-space"
+	case errors.Is(err, internal.ErrChecksumMismatch):
+		return "checksum"
+	case errors.Is(err, internal.ErrNotAuthorized), errors.Is(err, internal.ErrForbidden):
+		return "auth"
+	case errors.Is(err, internal.ErrNotFound):
+		return "not-found"
+	case errors.Is(err, errFileExists):
+		return "exists"
+	case errors.Is(err, errHookFailed):
+		return "hook"
+	}
+	return "other"
 }
 
-func defaultDownloadWorker(ctx context.Context, wg *sync.WaitGroup, sdtp internal.SDTPClient, files chan internal.FileInfo, noAck bool, destDir string) {
-	defer wg.Done()
+// ingestRun is the state of the ingest of a single subscription.
+type ingestRun struct {
+	// name is the subscription name, empty for a plain ingest.
+	name    string
+	opts    ingestOptions
+	stats   *ingestStats
+	budgets []*diskBudget
+	// stop is closed when no new transfers should be started.
+	stop  <-chan struct{}
+	state *runState
+	// acks is nil if acks are disabled.
+	acks  *ackQueue
+	queue *runQueue
+	d     *dispatcher
+	// transfers may be nil.
+	transfers *transferTracker
 
-	for {
-		select {
-		case file, more := <-files:
-			if !more {
-				return
+	// produced is closed once produce returns.
+	produced chan struct{}
+
+	// set by produce
+	listed, matched int
+	listErr         error
+	// listedAll is set once every listed file has been queued.
+	listedAll bool
+}
+
+// stopping returns true once shutdown has started.
+func (r *ingestRun) stopping(ctx context.Context) bool {
+	select {
+	case <-r.stop:
+		return true
+	case <-ctx.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+// reserve claims space for file on the destination, and staging, filesystems.
+func (r *ingestRun) reserve(file internal.FileInfo) bool {
+	for i, budget := range r.budgets {
+		if !budget.reserve(file.Size) {
+			for _, b := range r.budgets[:i] {
+				b.release(file.Size)
+			}
+			return false
+		}
+	}
+	return true
+}
+
+func (r *ingestRun) release(file internal.FileInfo) {
+	for _, budget := range r.budgets {
+		budget.release(file.Size)
+	}
+}
+
+// ack queues file, written to p or piped if p is empty, to be acknowledged
+// unless acks are disabled.
+func (r *ingestRun) ack(ctx context.Context, file internal.FileInfo, p string) {
+	if r.acks == nil {
+		return
+	}
+	r.acks.add(ctx, file, p)
+}
+
+// resumeAcks queues the files the previous run left unacked, before any new
+// files, provided a written file still matches. With acks disabled they are
+// carried over to the next run.
+func (r *ingestRun) resumeAcks(ctx context.Context, prev *ingestState) {
+	for _, file := range prev.Unacked {
+		if r.acks == nil {
+			r.state.addUnacked(file)
+			continue
+		}
+		if file.Path != "" {
+			if same, _ := sameFile(file.Path, file.FileInfo); !same {
+				log.Printf("fileid=%d(%s) left unacked by the previous run no longer matches %s, not acking", file.ID, file.Name, file.Path)
+				continue
 			}
-			log.Printf("downloading fileid=%d(%s)", file.ID, file.Name)
-			if err := sdtp.Download(ctx, file, destDir); err != nil {
-				log.Printf("failed to download fileid=%d(%s), skipping ack; %s", file.ID, file.Name, err)
+		}
+		// the listing that recorded where the file came from was in the
+		// previous run
+		if tracker, ok := r.acks.sdtp.(internal.OriginTracker); ok && len(file.Providers) > 0 {
+			if err := tracker.SetOrigins(file.FileInfo, file.Providers); err != nil {
+				log.Warn("not acking fileid=%d(%s) left unacked by the previous run; %s", file.ID, file.Name, err)
+				r.state.addUnacked(file)
 				continue
 			}
-			if !noAck {
-				if err := sdtp.Ack(ctx, file); err != nil {
-					log.Printf("failed to ack fileid=%d(%s); %s", file.ID, file.Name, err)
-				}
+		}
+		log.Debug("acking fileid=%d(%s) left unacked by the previous run", file.ID, file.Name)
+		r.state.addResumed(file.FileInfo)
+		r.acks.add(ctx, file.FileInfo, file.Path)
+	}
+}
+
+// doIngest downloads and acks the files matching opts. Once stop is closed no
+// new downloads are started, and once ctx is cancelled in-flight downloads are
+// aborted.
+func doIngest(ctx context.Context, stop <-chan struct{}, sdtp internal.SDTPClient, opts ingestOptions) error {
+	return doIngestSubscriptions(ctx, stop, sdtp, opts, []subscription{{weight: 1, opts: opts}})
+}
+
+// doIngestSubscriptions ingests subs at once, sharing the workers, and the
+// client's connections, between them. The concurrency settings are taken from
+// opts.
+func doIngestSubscriptions(ctx context.Context, stop <-chan struct{}, sdtp internal.SDTPClient, opts ingestOptions, subs []subscription) error {
+	started := time.Now()
+	pool := newIngestPool(ctx, stop, sdtp, opts, false)
+	runs := make([]*ingestRun, len(subs))
+	for i, sub := range subs {
+		runs[i] = pool.add(ctx, stop, sub)
+	}
+	pool.start(ctx)
+	pool.workers.Wait()
+	// the workers may finish first after a stop, while a run is still
+	// listing, so the producers are waited for before their runs finish
+	for _, run := range runs {
+		<-run.produced
+	}
+	pool.close()
+
+	var errs []error
+	for _, run := range runs {
+		if err := run.finish(ctx, started); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ingestPool is a dispatcher and the workers transferring the files it hands
+// out, shared by the runs added to it.
+type ingestPool struct {
+	sdtp    internal.SDTPClient
+	opts    ingestOptions
+	d       *dispatcher
+	cancel  context.CancelFunc
+	workers sync.WaitGroup
+}
+
+// newIngestPool returns a pool of workers for the concurrency settings in
+// opts, to be started with start. They stop taking files once stop is closed
+// or ctx is done. If persistent is set they wait for more runs to be added
+// until close, rather than returning once the runs added so far are done.
+func newIngestPool(ctx context.Context, stop <-chan struct{}, sdtp internal.SDTPClient, opts ingestOptions, persistent bool) *ingestPool {
+	dispatchCtx, cancel := context.WithCancel(ctx)
+	workers := opts.concurrency
+	if opts.autoConcurrency || opts.control != nil {
+		// with a controller the concurrency may be raised up to the maximum
+		workers = max(workers, opts.maxConcurrency)
+	}
+	d := newDispatcher(dispatchCtx, stop, int(workers))
+	d.persistent = persistent
+	if opts.autoConcurrency {
+		d.limiter = newAdaptiveLimiter(int(opts.concurrency), int(opts.maxConcurrency), concurrencyInterval)
+	} else {
+		d.limit = int(opts.concurrency)
+	}
+	opts.control.attach(d)
+
+	return &ingestPool{sdtp: sdtp, opts: opts, d: d, cancel: cancel}
+}
+
+// start starts the workers.
+func (p *ingestPool) start(ctx context.Context) {
+	for range p.d.workers {
+		p.workers.Add(1)
+		go downloadWorker(ctx, &p.workers, p.sdtp, p.d)
+	}
+}
+
+// add starts ingesting sub, which starts no new transfers once stop is
+// closed. Its produced channel is closed once it has finished listing.
+func (p *ingestPool) add(ctx context.Context, stop <-chan struct{}, sub subscription) *ingestRun {
+	run := newIngestRun(ctx, stop, p.sdtp, sub)
+	run.queue = p.d.add(run, sub.weight)
+	run.d = p.d
+	run.transfers = p.opts.transfers
+	run.produced = make(chan struct{})
+	go func() {
+		defer close(run.produced)
+		run.produce(ctx, p.sdtp, p.d)
+	}()
+	return run
+}
+
+// close waits for the workers to finish their files and return.
+func (p *ingestPool) close() {
+	p.d.shutdown()
+	p.workers.Wait()
+	p.opts.control.detach(p.d)
+	p.cancel()
+}
+
+// newIngestRun prepares to ingest sub, acking any files left unacked by its
+// previous run.
+func newIngestRun(ctx context.Context, stop <-chan struct{}, sdtp internal.SDTPClient, sub subscription) *ingestRun {
+	opts := sub.opts
+	run := &ingestRun{
+		name:    sub.name,
+		opts:    opts,
+		stats:   &ingestStats{},
+		budgets: []*diskBudget{newDiskBudget(opts.destDir, opts.minFree)},
+		stop:    stop,
+		state:   newRunState(),
+	}
+	if opts.stagingDir != "" {
+		run.budgets = append(run.budgets, newDiskBudget(opts.stagingDir, opts.minFree))
+	}
+
+	prev := &ingestState{}
+	if opts.stateDir != "" {
+		var err error
+		if prev, err = loadIngestState(opts.stateDir, sub.name); err != nil {
+			run.logf(log.Warn, "ignoring state from previous run: %s", err)
+			prev = &ingestState{}
+		}
+		if prev.Status != "" && prev.Status != runComplete {
+			run.logf(log.Printf, "previous run %s at %s: %s", prev.Status, prev.FinishedAt.Format(time.RFC3339), prev.Summary)
+		}
+	}
+	if !opts.noAck {
+		run.acks = newAckQueue(ctx, sdtp, opts, run.stats, run.state)
+	}
+	run.resumeAcks(ctx, prev)
+	return run
+}
+
+// logf logs with the run's subscription name, if any, as a prefix.
+func (r *ingestRun) logf(logger func(string, ...any), format string, args ...any) {
+	if r.name != "" {
+		format = "[" + r.name + "] " + format
+	}
+	logger(format, args...)
+}
+
+// produce lists the run's files, queueing those to be transferred. Files are
+// queued as they are listed, so downloads start before a large listing is
+// complete.
+func (r *ingestRun) produce(ctx context.Context, sdtp internal.SDTPClient, d *dispatcher) {
+	defer d.close(r.queue)
+	opts, stats := r.opts, r.stats
+
+	listing := listFiles(ctx, sdtp, internal.ListOptions{Tags: opts.tags, PageSize: opts.pageSize, Limit: opts.limit})
+	if opts.order != "" {
+		// ordering needs the complete listing before anything is downloaded
+		files, err := collectFiles(listing)
+		if err != nil {
+			r.listErr = err
+			return
+		}
+		orderFiles(files, opts.order)
+		listing = sliceFiles(files)
+	}
+
+	var scheduled uint64
+	for file, err := range listing {
+		if err != nil {
+			r.listErr = err
+			return
+		}
+		if r.stopping(ctx) {
+			return
+		}
+		r.listed++
+		if !opts.filter.match(file) {
+			continue
+		}
+		r.matched++
+		// checked as each file is queued since files may expire while waiting
+		if isExpired(file, time.Now(), opts.expiryWarning) {
+			stats.expired.Add(1)
+			continue
+		}
+		if opts.maxBytesPerRun > 0 && scheduled+uint64(file.Size) > opts.maxBytesPerRun {
+			log.Debug("deferring fileid=%d(%s) to next run; exceeds max-bytes-per-run", file.ID, file.Name)
+			stats.deferred.Add(1)
+			continue
+		}
+		scheduled += uint64(file.Size)
+		if !d.push(r.queue, file) {
+			return
+		}
+		r.transfers.queued(file)
+	}
+	r.listedAll = true
+}
+
+// finish waits for outstanding acks, records the outcome of the run and logs
+// its summary.
+func (r *ingestRun) finish(ctx context.Context, started time.Time) error {
+	opts, stats := r.opts, r.stats
+	if r.acks != nil {
+		r.acks.close()
+	}
+
+	status := runComplete
+	switch {
+	case r.workDone():
+		// whatever stopped the run, there was nothing left for it to do
+	case ctx.Err() != nil:
+		status = runAborted
+	case r.stopping(ctx):
+		status = runInterrupted
+	}
+	if opts.stateDir != "" {
+		if err := r.state.state(status, started, stats.String()).save(opts.stateDir, r.name); err != nil {
+			r.logf(log.Warn, "failed to save run state: %s", err)
+		}
+	}
+
+	if r.listed == 0 && r.listErr != nil {
+		return r.wrap(fmt.Errorf("failed to list files: %w", r.listErr))
+	}
+	if r.listed == 0 && status == runComplete {
+		r.logf(log.Printf, "No files found")
+		return nil
+	}
+	if opts.filter != nil {
+		r.logf(log.Printf, "Found %d files, %d match filters", r.listed, r.matched)
+	} else {
+		r.logf(log.Printf, "Found %d files", r.listed)
+	}
+	if status != runComplete {
+		r.logf(log.Printf, "Ingest %s: %s", status, stats)
+		return r.wrap(fmt.Errorf("ingest %s, remaining files are left for the next run", status))
+	}
+	r.logf(log.Printf, "Ingest complete: %s", stats)
+	if r.listErr != nil {
+		return r.wrap(fmt.Errorf("listing failed after %d files: %w", r.listed, r.listErr))
+	}
+	if n := stats.failures(); n > 0 {
+		return r.wrap(fmt.Errorf("%d of %d files failed", n, r.matched))
+	}
+	return nil
+}
+
+// workDone returns true once the run has nothing left to do: every file was
+// listed and transferred, none were aborted and every ack has been sent.
+func (r *ingestRun) workDone() bool {
+	return r.listedAll && r.d.queued(r.queue) == 0 && r.stats.aborted.Load() == 0 && r.stats.ackPending.Load() == 0
+}
+
+// fail records that file failed with err.
+func (r *ingestRun) fail(file internal.FileInfo, err error) {
+	r.stats.fail(err)
+	r.transfers.fail(r, file, err)
+}
+
+// retry queues file, which failed, to be transferred again. It returns false
+// if the run's workers have finished.
+func (r *ingestRun) retry(file internal.FileInfo, class string) bool {
+	if !r.d.requeue(r.queue, file) {
+		return false
+	}
+	r.transfers.requeued(file)
+	r.stats.unfail(class)
+	return true
+}
+
+// wrap adds the run's subscription name, if any, to err.
+func (r *ingestRun) wrap(err error) error {
+	if r.name == "" {
+		return err
+	}
+	return fmt.Errorf("subscription %s: %w", r.name, err)
+}
+
+// destDir returns the directory file is written to: the destination directory
+// or, with a destination template, a directory below it.
+func (r *ingestRun) destDir(file internal.FileInfo) (string, error) {
+	if r.opts.destTemplate == nil {
+		return r.opts.destDir, nil
+	}
+	sub, err := renderDestTemplate(r.opts.destTemplate, r.name, file)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(r.opts.destDir, sub), nil
+}
+
+// removeTempFiles removes the temporary files for files left in dirs by a
+// previous run that crashed or was killed mid-download.
+func removeTempFiles(files []internal.FileInfo, dirs ...string) {
+	for _, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+		for _, file := range files {
+			removed, err := internal.RemoveTemp(dir, file)
+			if err != nil {
+				log.Printf("failed to remove stale temp file for fileid=%d(%s) in %s; %s", file.ID, file.Name, dir, err)
+			} else if removed {
+				log.Printf("removed stale temp file for fileid=%d(%s) in %s", file.ID, file.Name, dir)
 			}
-		case <-ctx.Done():
+		}
+	}
+}
+
+func defaultDownloadWorker(ctx context.Context, wg *sync.WaitGroup, sdtp internal.SDTPClient, d *dispatcher) {
+	defer wg.Done()
+
+	for {
+		q, file, ok := d.take()
+		if !ok {
 			return
 		}
+		n, elapsed, err := q.run.ingest(ctx, sdtp, file)
+		q.run.transfers.processed(file)
+		d.limiter.release(n, elapsed, err)
+		d.done(q)
+	}
+}
+
+// ingest downloads, or streams, and acks a single file. It returns the number
+// of bytes transferred, how long the transfer alone took and any transfer
+// error, for tuning concurrency.
+func (r *ingestRun) ingest(ctx context.Context, sdtp internal.SDTPClient, file internal.FileInfo) (int64, time.Duration, error) {
+	opts, stats := r.opts, r.stats
+	if r.state.isResumed(file) {
+		log.Printf("fileid=%d(%s) was transferred by the previous run, skipping download", file.ID, file.Name)
+		stats.skipped.Add(1)
+		return 0, 0, nil
+	}
+	var err error
+	var elapsed time.Duration
+	destDir, destPath := "", ""
+	// local is file as written to destDir, possibly renamed
+	local := file
+	if opts.pipeCmd != "" {
+		log.Printf("streaming fileid=%d(%s)", file.ID, file.Name)
+		tctx, tr := r.transfers.start(ctx, r.name, file)
+		start := time.Now()
+		err = streamToCommand(tctx, sdtp, file, opts.pipeCmd)
+		elapsed = time.Since(start)
+		r.transfers.finish(tr)
+	} else {
+		destDir, err = r.destDir(file)
+		if err == nil {
+			// files with the same name are ingested one at a time, so each
+			// applies the on-exists policy to whatever the other wrote
+			defer destLocks.lock(path.Join(destDir, file.Name))()
+			err = os.MkdirAll(destDir, 0755)
+		}
+		if err == nil {
+			// under the lock, so never one being written by another transfer
+			removeTempFiles([]internal.FileInfo{file}, destDir, opts.stagingDir)
+		}
+		var action existsAction
+		if err == nil {
+			action, err = resolveExisting(opts.onExists, destDir, file)
+		}
+		if err != nil {
+			log.Printf("failed to download fileid=%d(%s), skipping ack; %s", file.ID, file.Name, err)
+			r.fail(file, err)
+			return 0, 0, nil
+		}
+		if !action.download {
+			log.Printf("fileid=%d(%s) already exists, skipping download", file.ID, file.Name)
+			stats.skipped.Add(1)
+			if action.ack {
+				r.ack(ctx, file, path.Join(destDir, file.Name))
+			}
+			return 0, 0, nil
+		}
+		if action.name != file.Name {
+			log.Printf("fileid=%d(%s) already exists, downloading as %s", file.ID, file.Name, action.name)
+		}
+
+		if !r.reserve(file) {
+			log.Printf("insufficient space for fileid=%d(%s), deferring to next run", file.ID, file.Name)
+			stats.deferred.Add(1)
+			return 0, 0, nil
+		}
+		log.Printf("downloading fileid=%d(%s)", file.ID, file.Name)
+		local.Name = action.name
+		destPath = path.Join(destDir, action.name)
+		tctx, tr := r.transfers.start(ctx, r.name, file)
+		start := time.Now()
+		err = sdtp.Download(tctx, local, destDir)
+		elapsed = time.Since(start)
+		r.transfers.finish(tr)
+		r.release(file)
+	}
+	if err != nil && ctx.Err() != nil {
+		log.Printf("aborted fileid=%d(%s)", file.ID, file.Name)
+		stats.aborted.Add(1)
+		r.state.addAborted(file)
+		if opts.pipeCmd == "" {
+			removeTempFiles([]internal.FileInfo{local}, destDir, opts.stagingDir)
+		}
+		return 0, 0, nil
+	}
+	if err != nil {
+		log.Printf("failed to download fileid=%d(%s), skipping ack; %s", file.ID, file.Name, err)
+		r.fail(file, err)
+		return 0, elapsed, err
+	}
+	stats.downloaded.Add(1)
+	metricFilesDownloaded.Inc()
+	metricBytesDownloaded.Add(float64(file.Size))
+	if opts.hook != "" {
+		if err := runHook(ctx, opts.hook, r.name, file, destPath); err != nil {
+			log.Printf("hook failed for fileid=%d(%s), skipping ack; %s", file.ID, file.Name, err)
+			r.fail(file, err)
+			return file.Size, elapsed, nil
+		}
 	}
+	r.ack(ctx, file, destPath)
+	return file.Size, elapsed, nil
 }
 
 var downloadWorker = defaultDownloadWorker
@@ -2,8 +2,12 @@ package cmd
 
 import (
 	"context"
+	"errors"
+	"iter"
+	"os"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/asips/sdtp-client/internal"
 	"github.com/stretchr/testify/assert"
@@ -16,16 +20,138 @@ func Test_doIngest(t *testing.T) {
 	sdtp := createMockSDTP(t)
 	sdtp.listing = listing
 
-	downloadWorker = func(ctx context.Context, wg *sync.WaitGroup, sdtp internal.SDTPClient, files chan internal.FileInfo, noAck bool, destDir string) {
-		for f := range files {
+	downloadWorker = func(ctx context.Context, wg *sync.WaitGroup, sdtp internal.SDTPClient, d *dispatcher) {
+		for q, f, ok := d.take(); ok; q, f, ok = d.take() {
 			t.Logf("Mock download worker processing file: %v", f)
+			d.done(q)
 		}
 		wg.Done()
 	}
 	defer func() { downloadWorker = defaultDownloadWorker }()
 
-	err := doIngest(t.Context(), sdtp, "dest/dir", map[string]string{"stream": "test"}, true, 10)
+	err := doIngest(t.Context(), nil, sdtp, ingestOptions{
+		destDir:     "dest/dir",
+		tags:        map[string]string{"stream": "test"},
+		noAck:       true,
+		concurrency: 10,
+	})
 
 	assert.NoError(t, err)
 
 }
+
+func Test_doIngest_maxBytesPerRun(t *testing.T) {
+	listing := []internal.FileInfo{
+		{ID: 0, Name: "file1.txt", Size: 600},
+		{ID: 1, Name: "file2.txt", Size: 600},
+		{ID: 2, Name: "file3.txt", Size: 400},
+	}
+	sdtp := createMockSDTP(t)
+	sdtp.listing = listing
+
+	var got []int64
+	downloadWorker = func(ctx context.Context, wg *sync.WaitGroup, sdtp internal.SDTPClient, d *dispatcher) {
+		for q, f, ok := d.take(); ok; q, f, ok = d.take() {
+			got = append(got, f.ID)
+			d.done(q)
+		}
+		wg.Done()
+	}
+	defer func() { downloadWorker = defaultDownloadWorker }()
+
+	err := doIngest(t.Context(), nil, sdtp, ingestOptions{
+		destDir:        "dest/dir",
+		noAck:          true,
+		concurrency:    1,
+		maxBytesPerRun: 1000,
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{0, 2}, got)
+}
+
+// streamingSDTP lists files incrementally, failing with err after listing.
+// If wait is set the listing starts once it is closed.
+type streamingSDTP struct {
+	*mockSDTP
+	listErr error
+	wait    chan struct{}
+}
+
+func (s *streamingSDTP) ListStream(ctx context.Context, opts internal.ListOptions) iter.Seq2[internal.FileInfo, error] {
+	return func(yield func(internal.FileInfo, error) bool) {
+		if s.wait != nil {
+			<-s.wait
+		}
+		for _, file := range s.listing {
+			if !yield(file, nil) {
+				return
+			}
+		}
+		if s.listErr != nil {
+			yield(internal.FileInfo{}, s.listErr)
+		}
+	}
+}
+
+func Test_doIngest_streaming(t *testing.T) {
+	sdtp := &streamingSDTP{mockSDTP: createMockSDTP(t), listErr: errors.New("connection reset")}
+	sdtp.listing = []internal.FileInfo{
+		{ID: 0, Name: "file1.txt", Size: 600},
+		{ID: 1, Name: "file2.txt", Size: 600},
+	}
+
+	var got []int64
+	downloadWorker = func(ctx context.Context, wg *sync.WaitGroup, sdtp internal.SDTPClient, d *dispatcher) {
+		for q, f, ok := d.take(); ok; q, f, ok = d.take() {
+			got = append(got, f.ID)
+			d.done(q)
+		}
+		wg.Done()
+	}
+	defer func() { downloadWorker = defaultDownloadWorker }()
+
+	// files listed before the failure are still downloaded
+	err := doIngest(t.Context(), nil, sdtp, ingestOptions{destDir: "dest/dir", noAck: true, concurrency: 1})
+	assert.ErrorContains(t, err, "listing failed after 2 files: connection reset")
+	assert.Equal(t, []int64{0, 1}, got)
+}
+
+func Test_listFiles(t *testing.T) {
+	sdtp := createMockSDTP(t)
+	sdtp.listing = []internal.FileInfo{{ID: 0}, {ID: 1}, {ID: 2}}
+
+	files, err := collectFiles(listFiles(t.Context(), sdtp, internal.ListOptions{Limit: 2}))
+	assert.NoError(t, err)
+	assert.Len(t, files, 2)
+
+	sdtp.err = errors.New("failed")
+	_, err = collectFiles(listFiles(t.Context(), sdtp, internal.ListOptions{}))
+	assert.Error(t, err)
+}
+
+func Test_doIngest_stopWhileListing(t *testing.T) {
+	sdtp := &streamingSDTP{mockSDTP: createMockSDTP(t), listErr: errors.New("connection reset"), wait: make(chan struct{})}
+	stop := make(chan struct{})
+	close(stop)
+	// the workers return at once, while the listing is still in progress
+	time.AfterFunc(50*time.Millisecond, func() { close(sdtp.wait) })
+
+	err := doIngest(t.Context(), stop, sdtp, ingestOptions{destDir: t.TempDir(), noAck: true, concurrency: 2})
+	assert.ErrorContains(t, err, "failed to list files: connection reset")
+}
+
+func Test_doIngest_removeStaleTemp(t *testing.T) {
+	dir, staging := t.TempDir(), t.TempDir()
+	sdtp := createMockSDTP(t)
+	file := internal.FileInfo{ID: 1, Name: "a.dat"}
+	sdtp.listing = []internal.FileInfo{file}
+	for _, d := range []string{dir, staging} {
+		assert.NoError(t, os.WriteFile(internal.TempPath(d, file), []byte("partial"), 0644))
+	}
+
+	err := doIngest(t.Context(), nil, sdtp, ingestOptions{destDir: dir, stagingDir: staging, concurrency: 1, noAck: true, onExists: existsOverwrite})
+	assert.NoError(t, err)
+	assert.NoFileExists(t, internal.TempPath(dir, file))
+	assert.NoFileExists(t, internal.TempPath(staging, file))
+}
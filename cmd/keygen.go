@@ -0,0 +1,275 @@
+package cmd
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/asips/sdtp-client/internal/log"
+	"github.com/spf13/cobra"
+)
+
+var keygenCmd = &cobra.Command{
+	Use:   "keygen",
+	Short: "Generate a private key and certificate signing request (CSR)",
+	Long: `Generate a private key and a PKCS#10 certificate signing request (CSR).
+
+The key is written to the path given by --key, readable only by the current user, and
+the CSR to --csr. Submit the CSR to your provider's CA; once you receive the signed
+certificate use it with --cert and the same --key to register and check it.
+
+The subject is given as attribute=value pairs, in order, using the attribute names
+reported by 'check', e.g.,
+
+  sdtp keygen --key client.key --subject C=US,O=Example,OU=Ingest,CN=ingest.example.com
+`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		// There is no certificate until the CSR has been signed.
+		cmd.Flags().SetAnnotation("cert", cobra.BashCompOneRequiredFlag, []string{"false"})
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := cmd.Flags()
+		keyPath, err := flags.GetString("key")
+		cobra.CheckErr(err)
+		csrPath, err := flags.GetString("csr")
+		cobra.CheckErr(err)
+		if csrPath == "" {
+			csrPath = strings.TrimSuffix(keyPath, filepath.Ext(keyPath)) + ".csr"
+		}
+		keyType, err := flags.GetString("key-type")
+		cobra.CheckErr(err)
+		keySize, err := flags.GetInt("key-size")
+		cobra.CheckErr(err)
+		subjectAttrs, err := flags.GetStringSlice("subject")
+		cobra.CheckErr(err)
+		dnsNames, err := flags.GetStringSlice("dns")
+		cobra.CheckErr(err)
+		force, err := flags.GetBool("force")
+		cobra.CheckErr(err)
+
+		subject, err := parseSubject(subjectAttrs)
+		if err != nil {
+			log.Fatal("invalid --subject: %s", err)
+		}
+
+		opts := keygenOptions{
+			keyPath:  keyPath,
+			csrPath:  csrPath,
+			keyType:  keyType,
+			keySize:  keySize,
+			subject:  subject,
+			dnsNames: dnsNames,
+			force:    force,
+		}
+		if err := doKeygen(opts, os.Stdout); err != nil {
+			log.Fatal("%s", err)
+		}
+		return nil
+	},
+}
+
+func init() {
+	flags := keygenCmd.Flags()
+
+	flags.String("csr", "", "Path to write the PEM encoded CSR to. Defaults to the key path with a .csr extension")
+	flags.String("key-type", "rsa", "Private key type: rsa or ecdsa")
+	flags.Int("key-size", 0, "RSA key size in bits (2048, 3072 or 4096; default 3072) or ECDSA curve size (256, 384 or 521; default 256)")
+	flags.StringSlice("subject", nil, "Subject attributes as <attr>=<value>, e.g., C=US,O=Example,CN=ingest.example.com. "+
+		"May be specified multiple times or as a comma-separated list")
+	flags.StringSlice("dns", nil, "DNS names to include as subject alternative names")
+	flags.Bool("force", false, "Overwrite existing key and CSR files")
+}
+
+type keygenOptions struct {
+	keyPath  string
+	csrPath  string
+	keyType  string
+	keySize  int
+	subject  pkix.Name
+	dnsNames []string
+	force    bool
+}
+
+// subjectOIDs maps the attribute names in oid, and their lowercase forms, to
+// their object identifiers.
+func subjectOIDs() map[string]asn1.ObjectIdentifier {
+	oids := map[string]asn1.ObjectIdentifier{}
+	for dotted, name := range oid {
+		id := asn1.ObjectIdentifier{}
+		for _, part := range strings.Split(dotted, ".") {
+			n, err := strconv.Atoi(part)
+			if err != nil {
+				panic(fmt.Sprintf("invalid oid %q", dotted))
+			}
+			id = append(id, n)
+		}
+		oids[name] = id
+		oids[strings.ToLower(name)] = id
+	}
+	return oids
+}
+
+// parseSubject builds a subject from attr=value pairs, keeping their order.
+func parseSubject(attrs []string) (pkix.Name, error) {
+	if len(attrs) == 0 {
+		return pkix.Name{}, errors.New("at least one attribute, e.g., CN=<name>, is required")
+	}
+	oids := subjectOIDs()
+	name := pkix.Name{}
+	for _, attr := range attrs {
+		key, val, ok := strings.Cut(attr, "=")
+		key, val = strings.TrimSpace(key), strings.TrimSpace(val)
+		if !ok || key == "" || val == "" {
+			return pkix.Name{}, fmt.Errorf("expected <attr>=<value>, got %q", attr)
+		}
+		id, ok := oids[key]
+		if !ok {
+			id, ok = oids[strings.ToLower(key)]
+		}
+		if !ok {
+			return pkix.Name{}, fmt.Errorf("unknown attribute %q", key)
+		}
+		var value any = val
+		switch oid[id.String()] {
+		case "C":
+			if len(val) != 2 {
+				return pkix.Name{}, fmt.Errorf("country must be a 2 letter code, got %q", val)
+			}
+		case "emailAddress":
+			// RFC 5280 requires an IA5String, which CAs may enforce
+			value = asn1.RawValue{Tag: asn1.TagIA5String, Bytes: []byte(val)}
+		}
+		name.ExtraNames = append(name.ExtraNames, pkix.AttributeTypeAndValue{Type: id, Value: value})
+	}
+	return name, nil
+}
+
+// subjectString formats a subject built by parseSubject using the attribute
+// names in oid, in the order given.
+func subjectString(name pkix.Name) string {
+	parts := []string{}
+	for _, atv := range name.ExtraNames {
+		val := fmt.Sprint(atv.Value)
+		if raw, ok := atv.Value.(asn1.RawValue); ok {
+			val = string(raw.Bytes)
+		}
+		parts = append(parts, oid[atv.Type.String()]+"="+val)
+	}
+	return strings.Join(parts, ",")
+}
+
+func generateKey(keyType string, size int) (crypto.Signer, error) {
+	switch keyType {
+	case "rsa":
+		if size == 0 {
+			size = 3072
+		}
+		if size != 2048 && size != 3072 && size != 4096 {
+			return nil, fmt.Errorf("invalid RSA key size %d; must be 2048, 3072 or 4096", size)
+		}
+		return rsa.GenerateKey(rand.Reader, size)
+	case "ecdsa":
+		var curve elliptic.Curve
+		switch size {
+		case 0, 256:
+			curve = elliptic.P256()
+		case 384:
+			curve = elliptic.P384()
+		case 521:
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("invalid ECDSA curve size %d; must be 256, 384 or 521", size)
+		}
+		return ecdsa.GenerateKey(curve, rand.Reader)
+	}
+	return nil, fmt.Errorf("invalid key type %q; must be rsa or ecdsa", keyType)
+}
+
+// doKeygen generates a key and CSR, writing them to opts.keyPath and
+// opts.csrPath, then prints the next steps to w.
+func doKeygen(opts keygenOptions, w io.Writer) error {
+	if !opts.force {
+		// check both up front so a key is not left without its CSR
+		for _, path := range []string{opts.keyPath, opts.csrPath} {
+			if _, err := os.Stat(path); err == nil {
+				return fmt.Errorf("%s already exists; use --force to overwrite it", path)
+			}
+		}
+	}
+
+	key, err := generateKey(opts.keyType, opts.keySize)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("failed to encode private key: %w", err)
+	}
+	csrDer, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  opts.subject,
+		DNSNames: opts.dnsNames,
+	}, key)
+	if err != nil {
+		return fmt.Errorf("failed to create CSR: %w", err)
+	}
+
+	if err := writePEM(opts.keyPath, "PRIVATE KEY", keyDer, 0600, opts.force); err != nil {
+		return fmt.Errorf("failed to write key: %w", err)
+	}
+	if err := writePEM(opts.csrPath, "CERTIFICATE REQUEST", csrDer, 0644, opts.force); err != nil {
+		return fmt.Errorf("failed to write CSR: %w", err)
+	}
+
+	certPath := strings.TrimSuffix(opts.csrPath, filepath.Ext(opts.csrPath)) + ".crt"
+	fmt.Fprintf(w, "Wrote private key to %s\n", opts.keyPath)
+	fmt.Fprintf(w, "Wrote CSR for %s to %s\n", subjectString(opts.subject), opts.csrPath)
+	fmt.Fprintf(w, `
+Next steps:
+  1. Submit %[1]s to your provider's CA and save the signed certificate, e.g., as %[2]s.
+     Keep %[3]s private; it is never sent to the CA.
+  2. Register the certificate with the server:
+       sdtp register --cert %[2]s --key %[3]s
+  3. Once your administrator has activated your account, check it can list files:
+       sdtp check --cert %[2]s --key %[3]s
+`, opts.csrPath, certPath, opts.keyPath)
+	return nil
+}
+
+// writePEM writes a single PEM block to path with perm. Existing files are
+// only replaced if force is true.
+func writePEM(path, blockType string, der []byte, perm os.FileMode, force bool) error {
+	flag := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force {
+		flag = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, flag, perm)
+	if err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("%s already exists; use --force to overwrite it", path)
+		}
+		return err
+	}
+	// OpenFile only applies perm to new files
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if err := pem.Encode(f, &pem.Block{Type: blockType, Bytes: der}); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
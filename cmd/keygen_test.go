@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseSubject(t *testing.T) {
+	name, err := parseSubject([]string{"C=US", "o=Example", "OU=Ingest", "CN=ingest.example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, "CN=ingest.example.com,OU=Ingest,O=Example,C=US", name.ToRDNSequence().String())
+	assert.Equal(t, "C=US,O=Example,OU=Ingest,CN=ingest.example.com", subjectString(name))
+
+	for _, attrs := range [][]string{
+		nil,
+		{"CN"},
+		{"CN="},
+		{"XX=value"},
+		{"C=USA"},
+	} {
+		_, err := parseSubject(attrs)
+		assert.Error(t, err, attrs)
+	}
+}
+
+func Test_doKeygen(t *testing.T) {
+	subject, err := parseSubject([]string{"O=Example", "CN=ingest.example.com", "emailAddress=ops@example.com"})
+	require.NoError(t, err)
+
+	for _, keyType := range []string{"rsa", "ecdsa"} {
+		t.Run(keyType, func(t *testing.T) {
+			dir := t.TempDir()
+			opts := keygenOptions{
+				keyPath:  filepath.Join(dir, "client.key"),
+				csrPath:  filepath.Join(dir, "client.csr"),
+				keyType:  keyType,
+				keySize:  2048,
+				subject:  subject,
+				dnsNames: []string{"ingest.example.com"},
+			}
+			if keyType == "ecdsa" {
+				opts.keySize = 256
+			}
+			out := &strings.Builder{}
+			require.NoError(t, doKeygen(opts, out))
+			assert.Contains(t, out.String(), "sdtp register --cert "+filepath.Join(dir, "client.crt")+" --key "+opts.keyPath)
+
+			st, err := os.Stat(opts.keyPath)
+			require.NoError(t, err)
+			if runtime.GOOS != "windows" {
+				assert.Equal(t, os.FileMode(0600), st.Mode().Perm())
+			}
+
+			dat, err := os.ReadFile(opts.keyPath)
+			require.NoError(t, err)
+			block, _ := pem.Decode(dat)
+			require.NotNil(t, block)
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			require.NoError(t, err)
+			switch keyType {
+			case "rsa":
+				assert.IsType(t, &rsa.PrivateKey{}, key)
+			case "ecdsa":
+				assert.IsType(t, &ecdsa.PrivateKey{}, key)
+			}
+
+			dat, err = os.ReadFile(opts.csrPath)
+			require.NoError(t, err)
+			block, _ = pem.Decode(dat)
+			require.NotNil(t, block)
+			assert.Equal(t, "CERTIFICATE REQUEST", block.Type)
+			csr, err := x509.ParseCertificateRequest(block.Bytes)
+			require.NoError(t, err)
+			assert.NoError(t, csr.CheckSignature())
+			assert.Equal(t, "CN=ingest.example.com,O=Example,1.2.840.113549.1.9.1=ops@example.com", csr.Subject.String())
+			// emailAddress is encoded as an IA5String
+			assert.Contains(t, string(csr.RawSubject), "\x16\x0fops@example.com")
+			assert.Equal(t, []string{"ingest.example.com"}, csr.DNSNames)
+
+			// existing files are not overwritten without force
+			assert.ErrorContains(t, doKeygen(opts, io.Discard), "already exists")
+			opts.force = true
+			assert.NoError(t, doKeygen(opts, io.Discard))
+		})
+	}
+
+	_, err = generateKey("rsa", 1024)
+	assert.Error(t, err)
+	_, err = generateKey("dsa", 0)
+	assert.Error(t, err)
+}
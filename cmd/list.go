@@ -2,15 +2,17 @@ package cmd
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
+	"iter"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
 	"github.com/asips/sdtp-client/internal"
 	"github.com/asips/sdtp-client/internal/log"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 var listCmd = &cobra.Command{
@@ -18,8 +20,12 @@ var listCmd = &cobra.Command{
 	Short: "List available items from the server based on provided tags",
 	Long: `List available items from the server based on provided tags.
 
-Listed files will be printed as JSON objects, one per line to stdout. Any log messages
-go to stderr.
+By default listed files will be printed as JSON objects, one per line to stdout. Use
+--output to print a JSON array, a table, CSV, TSV or the result of a Go template
+(--template) for each file instead. Any log messages go to stderr.
+
+Columns for the table, csv and tsv formats are id, name, checksum, size, expires,
+tags.<key> and extra.<key>.
 `,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		flags := cmd.Flags()
@@ -27,28 +33,44 @@ go to stderr.
 		cobra.CheckErr(err)
 		keyPath, err := flags.GetString("key")
 		cobra.CheckErr(err)
-		httpTimeout, err := flags.GetDuration("http-timeout")
-		cobra.CheckErr(err)
 		checkCertDays, err := flags.GetInt("check-cert-days")
 		cobra.CheckErr(err)
 
 		mustValidateCert(certPath, keyPath, checkCertDays)
 
-		strApiUrl, err := flags.GetString("api-url")
+		sdtp := newClientFromFlags(flags, certPath, keyPath, clientOptionsFromFlags(flags))
+
+		tags, err := flags.GetStringToString("tag")
 		cobra.CheckErr(err)
-		apiUrl := parseApiUrl(strApiUrl)
-		sdtp, err := internal.NewDefaultSDTP(apiUrl, certPath, keyPath, httpTimeout)
+		filter, err := filterFromFlags(flags)
 		if err != nil {
-			log.Fatal("Failed to create SDTP client: %s", err)
+			log.Fatal("%s", err)
 		}
-
-		tags, err := flags.GetStringToString("tag")
+		output, err := outputFromFlags(flags)
+		if err != nil {
+			log.Fatal("%s", err)
+		}
+		sort, err := flags.GetString("sort")
+		cobra.CheckErr(err)
+		pageSize, err := flags.GetInt("page-size")
+		cobra.CheckErr(err)
+		limit, err := flags.GetInt("limit")
 		cobra.CheckErr(err)
+		if err := validateOrder(sort); err != nil {
+			log.Fatal("invalid --sort: %s", err)
+		}
 
-		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		ctx, cancel := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
 		defer cancel()
 
-		_, err = doList(ctx, sdtp, tags)
+		_, err = doList(ctx, sdtp, listOptions{
+			tags:     tags,
+			filter:   filter,
+			sort:     sort,
+			output:   output,
+			pageSize: pageSize,
+			limit:    limit,
+		})
 		if err != nil {
 			log.Fatal("Failed to list files: %s", err)
 		}
@@ -61,28 +83,145 @@ func init() {
 	flags := listCmd.Flags()
 
 	flags.StringToStringP("tag", "t", map[string]string{}, "<key>=<value> tags to filter by. May be specified multiple times or as a comma-separated list")
+	addFilterFlags(flags)
+	addListingFlags(flags)
+	addProviderFlags(flags)
+	flags.StringP("output", "o", "ndjson", "Output format: "+strings.Join(outputFormats, ", "))
+	flags.String("template", "", "Go template used for each file with the template output, e.g., '{{.ID}} {{.Name}}'. Implies --output=template")
+	flags.StringSlice("columns", defaultColumns, "Columns for the table, csv and tsv output, e.g., id,name,size,tags.stream,extra.collection")
+	flags.BoolP("human", "H", false, "Print human-readable sizes, e.g., 1.5 GiB")
+	flags.String("sort", "", "Sort files by expires, size-asc, size-desc, id, name or random. Defaults to the order returned by the server")
+}
+
+// outputFromFlags reads the output options for the list command.
+func outputFromFlags(flags *pflag.FlagSet) (outputOptions, error) {
+	format, err := flags.GetString("output")
+	cobra.CheckErr(err)
+	tmpl, err := flags.GetString("template")
+	cobra.CheckErr(err)
+	columns, err := flags.GetStringSlice("columns")
+	cobra.CheckErr(err)
+	human, err := flags.GetBool("human")
+	cobra.CheckErr(err)
+
+	if tmpl != "" && !flags.Changed("output") {
+		format = "template"
+	}
+	opts := outputOptions{format: format, template: tmpl, columns: columns, human: human}
+	return opts, opts.validate()
+}
+
+type listOptions struct {
+	tags     map[string]string
+	filter   *fileFilter
+	sort     string
+	output   outputOptions
+	pageSize int
+	limit    int
 }
 
-func doList(ctx context.Context, sdtp internal.SDTPClient, tags map[string]string) (int, error) {
-	files, err := sdtp.List(ctx, tags)
+func doList(ctx context.Context, sdtp internal.SDTPClient, opts listOptions) (int, error) {
+	listing := listFiles(ctx, sdtp, internal.ListOptions{Tags: opts.tags, PageSize: opts.pageSize, Limit: opts.limit})
+
+	// ndjson is written as files are listed; other formats and sorting need
+	// the complete listing
+	if opts.sort == "" && (opts.output.format == "" || opts.output.format == "ndjson") {
+		count := 0
+		for file, err := range listing {
+			if err != nil {
+				return count, fmt.Errorf("Failed to list files: %s", err)
+			}
+			if !opts.filter.match(file) {
+				continue
+			}
+			count++
+			if err := writeFiles(os.Stdout, []internal.FileInfo{file}, opts.output); err != nil {
+				return count, fmt.Errorf("failed to write listing: %w", err)
+			}
+		}
+		if count == 0 {
+			log.Printf("No files found")
+		} else {
+			log.Printf("Found %d files", count)
+		}
+		return count, nil
+	}
+
+	files, err := collectFiles(listing)
 	if err != nil {
 		return 0, fmt.Errorf("Failed to list files: %s", err)
 	}
+	files = opts.filter.apply(files)
 
 	if len(files) == 0 {
 		log.Printf("No files found")
+		// so the output is always valid json
+		if opts.output.format == "json" {
+			if err := writeFiles(os.Stdout, files, opts.output); err != nil {
+				return 0, fmt.Errorf("failed to write listing: %w", err)
+			}
+		}
 		return 0, nil
 	}
 
 	log.Printf("Found %d files:", len(files))
-	for _, file := range files {
-		dat, err := json.Marshal(file)
+	orderFiles(files, opts.sort)
+	if err := writeFiles(os.Stdout, files, opts.output); err != nil {
+		return 0, fmt.Errorf("failed to write listing: %w", err)
+	}
+
+	return len(files), nil
+}
+
+// addListingFlags adds the flags controlling how the provider is asked for the
+// listing.
+func addListingFlags(flags *pflag.FlagSet) {
+	flags.Int("page-size", 0, "Request the listing this many files at a time, for providers that support the limit and offset query parameters")
+	flags.Int("limit", 0, "Maximum number of files to list. Zero means no limit")
+}
+
+// listFiles lists files incrementally if sdtp supports it, otherwise it
+// yields the files from a complete listing.
+func listFiles(ctx context.Context, sdtp internal.FileListor, opts internal.ListOptions) iter.Seq2[internal.FileInfo, error] {
+	if streamer, ok := sdtp.(internal.FileStreamer); ok {
+		return streamer.ListStream(ctx, opts)
+	}
+	return func(yield func(internal.FileInfo, error) bool) {
+		files, err := sdtp.List(ctx, opts.Tags)
+		if err != nil {
+			yield(internal.FileInfo{}, err)
+			return
+		}
+		if opts.Limit > 0 && len(files) > opts.Limit {
+			files = files[:opts.Limit]
+		}
+		for _, file := range files {
+			if !yield(file, nil) {
+				return
+			}
+		}
+	}
+}
+
+// collectFiles returns all files from listing, or the first error.
+func collectFiles(listing iter.Seq2[internal.FileInfo, error]) ([]internal.FileInfo, error) {
+	files := []internal.FileInfo{}
+	for file, err := range listing {
 		if err != nil {
-			log.Printf("failed to marshal to json: %s", err)
-			continue
+			return nil, err
 		}
-		fmt.Fprintf(os.Stdout, "%s\n", string(dat))
+		files = append(files, file)
 	}
+	return files, nil
+}
 
-	return len(files), nil
+// sliceFiles yields files, for use where a listing is expected.
+func sliceFiles(files []internal.FileInfo) iter.Seq2[internal.FileInfo, error] {
+	return func(yield func(internal.FileInfo, error) bool) {
+		for _, file := range files {
+			if !yield(file, nil) {
+				return
+			}
+		}
+	}
 }
@@ -17,8 +17,15 @@ func Test_doList(t *testing.T) {
 	sdtp := createMockSDTP(t)
 	sdtp.listing = listing
 
-	count, err := doList(t.Context(), sdtp, map[string]string{"stream": "test"})
+	count, err := doList(t.Context(), sdtp, listOptions{tags: map[string]string{"stream": "test"}})
 
 	assert.NoError(t, err)
 	assert.Equal(t, 4, count)
+
+	filter, err := newFileFilter("id >= 2", nil, []string{"*4.txt"}, nil, nil)
+	assert.NoError(t, err)
+	count, err = doList(t.Context(), sdtp, listOptions{tags: map[string]string{"stream": "test"}, filter: filter})
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
 }
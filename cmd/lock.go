@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/asips/sdtp-client/internal"
+	"github.com/asips/sdtp-client/internal/log"
+)
+
+// lockFileName is the name of the file in the state directory locked while an
+// ingest is running, so runs using the same directory cannot overlap.
+const lockFileName = ".sdtp-ingest.lock"
+
+// lockIngest locks each of the state dirs, creating them if needed. If wait is
+// set a held lock is waited for, for up to timeout if it is positive, or
+// until interrupted. It returns a func releasing the locks.
+func lockIngest(ctx context.Context, dirs []string, wait bool, timeout time.Duration) (func(), error) {
+	dirs = slices.Clone(dirs)
+	for i, dir := range dirs {
+		dirs[i] = filepath.Clean(dir)
+	}
+	// always in the same order, so processes waiting on each other's locks
+	// cannot deadlock
+	slices.Sort(dirs)
+	dirs = slices.Compact(dirs)
+
+	if wait {
+		var cancel context.CancelFunc
+		ctx, cancel = signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+		if timeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+	}
+
+	locks := []*internal.FileLock{}
+	release := func() {
+		for _, lock := range locks {
+			if err := lock.Unlock(); err != nil {
+				log.Printf("failed to release lock; %s", err)
+			}
+		}
+	}
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			release()
+			return nil, err
+		}
+		p := filepath.Join(dir, lockFileName)
+		var lock *internal.FileLock
+		var stale *internal.LockHolder
+		var err error
+		if wait {
+			lock, stale, err = internal.Lock(ctx, p)
+		} else {
+			lock, stale, err = internal.TryLock(p)
+		}
+		if err != nil {
+			release()
+			if errors.Is(err, internal.ErrLocked) && !wait {
+				return nil, fmt.Errorf("%w; another ingest is using the directory, use --lock-wait to wait for it", err)
+			}
+			return nil, err
+		}
+		if stale != nil {
+			log.Warn("%s was not released by %s, which is no longer running; taking it over", p, stale)
+		}
+		locks = append(locks, lock)
+	}
+	return release, nil
+}
@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/asips/sdtp-client/internal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_lockIngest(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+
+	// the same dir may be used by several subscriptions in one run
+	unlock, err := lockIngest(t.Context(), []string{b, a, a + "/"}, false, 0)
+	require.NoError(t, err)
+	assert.FileExists(t, filepath.Join(a, lockFileName))
+	assert.FileExists(t, filepath.Join(b, lockFileName))
+
+	_, err = lockIngest(t.Context(), []string{a}, false, 0)
+	assert.ErrorIs(t, err, internal.ErrLocked)
+	assert.ErrorContains(t, err, "--lock-wait")
+
+	// locks already taken are released when a later one is held
+	c := filepath.Join(dir, "0")
+	_, err = lockIngest(t.Context(), []string{b, c}, false, 0)
+	assert.ErrorIs(t, err, internal.ErrLocked)
+	unlockC, err := lockIngest(t.Context(), []string{c}, false, 0)
+	require.NoError(t, err)
+	unlockC()
+
+	_, err = lockIngest(t.Context(), []string{b}, true, 20*time.Millisecond)
+	assert.ErrorIs(t, err, internal.ErrLocked)
+
+	unlock()
+	unlock, err = lockIngest(t.Context(), []string{a, b}, false, 0)
+	require.NoError(t, err)
+	unlock()
+}
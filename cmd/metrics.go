@@ -0,0 +1,24 @@
+package cmd
+
+import "github.com/asips/sdtp-client/internal/metrics"
+
+var (
+	metricFilesDownloaded = metrics.NewCounter("sdtp_files_downloaded_total",
+		"Files downloaded and verified.")
+	metricBytesDownloaded = metrics.NewCounter("sdtp_bytes_downloaded_total",
+		"Bytes of files downloaded and verified.")
+	metricFilesAcked = metrics.NewCounter("sdtp_files_acked_total",
+		"Files acknowledged on the server.")
+	metricAcksFailed = metrics.NewCounter("sdtp_acks_failed_total",
+		"Files whose acknowledgment failed after any retries.")
+	metricFilesFailed = metrics.NewCounterVec("sdtp_files_failed_total",
+		"Files that failed to download, by error class.", "class")
+	metricFilesExpired = metrics.NewCounter("sdtp_files_expired_total",
+		"Listed files skipped because they had already expired.")
+	metricFilesExpiringSoon = metrics.NewCounter("sdtp_files_expiring_soon_total",
+		"Listed files within the expiry warning window when queued for download.")
+	metricConcurrencyLimit = metrics.NewGauge("sdtp_concurrency_limit",
+		"Current limit on concurrent downloads with --concurrency=auto.")
+	metricConcurrencyAdjustments = metrics.NewCounterVec("sdtp_concurrency_adjustments_total",
+		"Adjustments of the concurrent download limit with --concurrency=auto, by direction.", "direction")
+)
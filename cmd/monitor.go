@@ -0,0 +1,222 @@
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/asips/sdtp-client/internal"
+)
+
+// monitorStatus is a monitoring plugin status, which is also the exit code
+// expected by Nagios compatible monitoring systems.
+type monitorStatus int
+
+const (
+	statusOK monitorStatus = iota
+	statusWarning
+	statusCritical
+	statusUnknown
+)
+
+func (s monitorStatus) String() string {
+	switch s {
+	case statusOK:
+		return "OK"
+	case statusWarning:
+		return "WARNING"
+	case statusCritical:
+		return "CRITICAL"
+	}
+	return "UNKNOWN"
+}
+
+// monitorOptions are the thresholds for check --monitoring. Zero disables the
+// backlog and age thresholds.
+type monitorOptions struct {
+	tags            map[string]string
+	warningDays     int
+	criticalDays    int
+	backlogWarning  int
+	backlogCritical int
+	// retention is how long the provider keeps files, used to work out how
+	// long ago a file was published from when it expires.
+	retention   time.Duration
+	ageWarning  time.Duration
+	ageCritical time.Duration
+}
+
+func (o monitorOptions) validate() error {
+	if o.criticalDays > o.warningDays {
+		return fmt.Errorf("--critical-days (%d) must not be greater than --warning-days (%d)", o.criticalDays, o.warningDays)
+	}
+	if o.backlogWarning > 0 && o.backlogCritical > 0 && o.backlogCritical < o.backlogWarning {
+		return fmt.Errorf("--backlog-critical must not be less than --backlog-warning")
+	}
+	if (o.ageWarning > 0 || o.ageCritical > 0) && o.retention <= 0 {
+		return fmt.Errorf("--age-warning and --age-critical require --retention")
+	}
+	if o.ageWarning > 0 && o.ageCritical > 0 && o.ageCritical < o.ageWarning {
+		return fmt.Errorf("--age-critical must not be less than --age-warning")
+	}
+	return nil
+}
+
+// monitorResult is the outcome of check --monitoring.
+type monitorResult struct {
+	status   monitorStatus
+	problems map[monitorStatus][]string
+	summary  []string
+	perfdata []string
+}
+
+func (r *monitorResult) raise(status monitorStatus, format string, args ...any) {
+	if r.problems == nil {
+		r.problems = map[monitorStatus][]string{}
+	}
+	r.problems[status] = append(r.problems[status], fmt.Sprintf(format, args...))
+	if status > r.status {
+		r.status = status
+	}
+}
+
+// perf adds performance data in the plugin format label=value;warn;crit,
+// omitting zero thresholds.
+func (r *monitorResult) perf(label, value string, warn, crit int64) {
+	threshold := func(v int64) string {
+		if v == 0 {
+			return ""
+		}
+		return strconv.FormatInt(v, 10)
+	}
+	p := fmt.Sprintf("%s=%s;%s;%s", label, value, threshold(warn), threshold(crit))
+	r.perfdata = append(r.perfdata, strings.TrimRight(p, ";"))
+}
+
+// String formats the result as a single plugin status line, e.g.,
+//
+//	SDTP WARNING - certificate expires in 20 days | days_left=20;30;7 ...
+//
+// Problems are listed most severe first; if there are none the summary is used.
+func (r *monitorResult) String() string {
+	msgs := []string{}
+	for status := statusUnknown; status > statusOK; status-- {
+		msgs = append(msgs, r.problems[status]...)
+	}
+	if len(msgs) == 0 {
+		msgs = r.summary
+	}
+	line := fmt.Sprintf("SDTP %s - %s", r.status, strings.Join(msgs, ", "))
+	if len(r.perfdata) > 0 {
+		line += " | " + strings.Join(r.perfdata, " ")
+	}
+	return line
+}
+
+// doMonitor checks the certificate, the connection to the server and,
+// optionally, the backlog, reporting the result in monitoring plugin terms
+// rather than logging.
+func doMonitor(ctx context.Context, sdtp internal.SDTPClient, certPath, keyPath string, certParser certParserFunc, opts monitorOptions) *monitorResult {
+	res := &monitorResult{}
+
+	certInfo, err := certParser(certPath, keyPath)
+	if err != nil {
+		res.raise(statusUnknown, "failed to read certificate: %s", err)
+		return res
+	}
+	switch {
+	case certInfo.Expired:
+		res.raise(statusCritical, "certificate expired on %s", certInfo.Expiration.Format(time.RFC3339))
+	case certInfo.DaysLeft <= opts.criticalDays:
+		res.raise(statusCritical, "certificate expires in %d days", certInfo.DaysLeft)
+	case certInfo.DaysLeft <= opts.warningDays:
+		res.raise(statusWarning, "certificate expires in %d days", certInfo.DaysLeft)
+	default:
+		res.summary = append(res.summary, fmt.Sprintf("certificate expires in %d days", certInfo.DaysLeft))
+	}
+	res.perf("days_left", strconv.Itoa(certInfo.DaysLeft), int64(opts.warningDays), int64(opts.criticalDays))
+
+	var handshakeStart time.Time
+	var handshake time.Duration
+	traceCtx := httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		TLSHandshakeStart: func() { handshakeStart = time.Now() },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { handshake = time.Since(handshakeStart) },
+	})
+	if err := sdtp.Check(traceCtx); err != nil {
+		switch {
+		case errors.Is(err, internal.ErrNotAuthorized):
+			res.raise(statusCritical, "failed to authenticate using provided cert and key")
+		case errors.Is(err, internal.ErrForbidden):
+			res.raise(statusCritical, "not authorized to access /files endpoint")
+		default:
+			res.raise(statusCritical, "failed to connect to server: %s", err)
+		}
+		return res
+	}
+	res.perf("handshake_ms", strconv.FormatInt(handshake.Milliseconds(), 10), 0, 0)
+
+	start := time.Now()
+	files, err := sdtp.List(ctx, opts.tags)
+	if err != nil {
+		res.raise(statusCritical, "failed to list files: %s", err)
+		return res
+	}
+	res.perf("list_ms", strconv.FormatInt(time.Since(start).Milliseconds(), 10), 0, 0)
+
+	var bytes int64
+	for _, file := range files {
+		bytes += file.Size
+	}
+	backlog := fmt.Sprintf("%d files (%s) waiting", len(files), humanSize(bytes))
+	switch {
+	case opts.backlogCritical > 0 && len(files) >= opts.backlogCritical:
+		res.raise(statusCritical, "%s", backlog)
+	case opts.backlogWarning > 0 && len(files) >= opts.backlogWarning:
+		res.raise(statusWarning, "%s", backlog)
+	default:
+		res.summary = append(res.summary, backlog)
+	}
+	res.perf("backlog_files", strconv.Itoa(len(files)), int64(opts.backlogWarning), int64(opts.backlogCritical))
+	res.perf("backlog_bytes", strconv.FormatInt(bytes, 10)+"B", 0, 0)
+
+	if opts.retention > 0 {
+		age, oldest := oldestAge(files, opts.retention, time.Now())
+		switch {
+		case oldest == nil:
+		case opts.ageCritical > 0 && age >= opts.ageCritical:
+			res.raise(statusCritical, "oldest file fileid=%d(%s) is %s old", oldest.ID, oldest.Name, age.Round(time.Minute))
+		case opts.ageWarning > 0 && age >= opts.ageWarning:
+			res.raise(statusWarning, "oldest file fileid=%d(%s) is %s old", oldest.ID, oldest.Name, age.Round(time.Minute))
+		}
+		res.perf("oldest_age_s", strconv.FormatInt(int64(age.Seconds()), 10), int64(opts.ageWarning.Seconds()), int64(opts.ageCritical.Seconds()))
+	}
+
+	return res
+}
+
+// oldestAge returns the age of the oldest file, the one with the lowest id as
+// in summary, since the provider assigns ids in the order files are published.
+// The age is worked out assuming files expire retention after they are
+// published. Files without a valid expiration are ignored.
+func oldestAge(files []internal.FileInfo, retention time.Duration, now time.Time) (time.Duration, *internal.FileInfo) {
+	var oldest *internal.FileInfo
+	var expires time.Time
+	for i, file := range files {
+		exp, err := file.ExpiresAt()
+		if err != nil {
+			continue
+		}
+		if oldest == nil || file.ID < oldest.ID {
+			oldest, expires = &files[i], exp
+		}
+	}
+	if oldest == nil {
+		return 0, nil
+	}
+	return max(retention-expires.Sub(now), 0), oldest
+}
@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/asips/sdtp-client/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_doMonitor(t *testing.T) {
+	certWithDays := func(days int) certParserFunc {
+		return func(certPath, keyPath string) (CertInfo, error) {
+			return CertInfo{
+				Expiration: time.Now().Add(time.Duration(days) * 24 * time.Hour),
+				DaysLeft:   days,
+				Expired:    days < 0,
+			}, nil
+		}
+	}
+	expires := func(d time.Duration) string {
+		return time.Now().Add(d).UTC().Format(time.RFC3339)
+	}
+	opts := monitorOptions{warningDays: 30, criticalDays: 7}
+
+	t.Run("ok", func(t *testing.T) {
+		sdtp := createMockSDTP(t)
+		sdtp.listing = []internal.FileInfo{{ID: 1, Name: "file1.txt", Size: 2048}}
+
+		res := doMonitor(t.Context(), sdtp, "cert", "key", certWithDays(90), opts)
+		assert.Equal(t, statusOK, res.status)
+		assert.Regexp(t, `^SDTP OK - certificate expires in 90 days, 1 files \(2.0 KiB\) waiting \| days_left=90;30;7 handshake_ms=\d+ list_ms=\d+ backlog_files=1 backlog_bytes=2048B$`, res.String())
+	})
+
+	t.Run("cert thresholds", func(t *testing.T) {
+		sdtp := createMockSDTP(t)
+		assert.Equal(t, statusWarning, doMonitor(t.Context(), sdtp, "cert", "key", certWithDays(20), opts).status)
+		assert.Equal(t, statusCritical, doMonitor(t.Context(), sdtp, "cert", "key", certWithDays(5), opts).status)
+		res := doMonitor(t.Context(), sdtp, "cert", "key", certWithDays(-1), opts)
+		assert.Equal(t, statusCritical, res.status)
+		assert.Contains(t, res.String(), "certificate expired on")
+	})
+
+	t.Run("unreadable cert is unknown", func(t *testing.T) {
+		parser := func(certPath, keyPath string) (CertInfo, error) {
+			return CertInfo{}, fmt.Errorf("no such file")
+		}
+		res := doMonitor(t.Context(), createMockSDTP(t), "cert", "key", parser, opts)
+		assert.Equal(t, statusUnknown, res.status)
+		assert.Equal(t, "SDTP UNKNOWN - failed to read certificate: no such file", res.String())
+	})
+
+	t.Run("server failure is critical", func(t *testing.T) {
+		sdtp := createMockSDTP(t)
+		sdtp.err = internal.ErrNotAuthorized
+		res := doMonitor(t.Context(), sdtp, "cert", "key", certWithDays(20), opts)
+		assert.Equal(t, statusCritical, res.status)
+		// most severe problem first
+		assert.Equal(t, "SDTP CRITICAL - failed to authenticate using provided cert and key, certificate expires in 20 days | days_left=20;30;7", res.String())
+	})
+
+	t.Run("backlog and age", func(t *testing.T) {
+		sdtp := createMockSDTP(t)
+		sdtp.listing = []internal.FileInfo{
+			{ID: 2, Name: "file2.txt", Expires: expires(24 * time.Hour)},
+			{ID: 1, Name: "file1.txt", Expires: expires(5 * 24 * time.Hour)},
+			{ID: 0, Name: "file0.txt"},
+		}
+		opts := opts
+		opts.backlogWarning = 2
+		opts.backlogCritical = 10
+		opts.retention = 7 * 24 * time.Hour
+		opts.ageWarning = 2 * 24 * time.Hour
+		opts.ageCritical = 5 * 24 * time.Hour
+
+		res := doMonitor(t.Context(), sdtp, "cert", "key", certWithDays(90), opts)
+		assert.Equal(t, statusWarning, res.status)
+		assert.Contains(t, res.String(), "SDTP WARNING - 3 files (0 B) waiting, oldest file fileid=1(file1.txt) is 48h0m0s old |")
+		assert.Contains(t, res.String(), "backlog_files=3;2;10")
+		assert.Contains(t, res.String(), "oldest_age_s=172800;172800;432000")
+	})
+}
+
+func Test_monitorOptions_validate(t *testing.T) {
+	assert.NoError(t, monitorOptions{warningDays: 30, criticalDays: 7}.validate())
+	assert.Error(t, monitorOptions{warningDays: 7, criticalDays: 30}.validate())
+	assert.Error(t, monitorOptions{warningDays: 30, criticalDays: 7, ageWarning: time.Hour}.validate())
+	assert.Error(t, monitorOptions{warningDays: 30, criticalDays: 7, backlogWarning: 10, backlogCritical: 5}.validate())
+}
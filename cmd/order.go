@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/asips/sdtp-client/internal"
+	"github.com/asips/sdtp-client/internal/log"
+)
+
+var fileOrders = []string{"expires", "size-asc", "size-desc", "id", "name", "random"}
+
+func validateOrder(order string) error {
+	if order == "" || slices.Contains(fileOrders, order) {
+		return nil
+	}
+	return fmt.Errorf("invalid order %q; must be one of %s", order, strings.Join(fileOrders, ", "))
+}
+
+// orderFiles sorts files in place. An empty order leaves files in the order
+// returned by the server. Files without a valid expiry are sorted last by
+// the expires order.
+func orderFiles(files []internal.FileInfo, order string) {
+	switch order {
+	case "expires":
+		slices.SortStableFunc(files, func(a, b internal.FileInfo) int {
+			at, aErr := a.ExpiresAt()
+			bt, bErr := b.ExpiresAt()
+			switch {
+			case aErr != nil && bErr != nil:
+				return 0
+			case aErr != nil:
+				return 1
+			case bErr != nil:
+				return -1
+			}
+			return at.Compare(bt)
+		})
+	case "size-asc":
+		slices.SortStableFunc(files, func(a, b internal.FileInfo) int { return cmpInt(a.Size, b.Size) })
+	case "size-desc":
+		slices.SortStableFunc(files, func(a, b internal.FileInfo) int { return cmpInt(b.Size, a.Size) })
+	case "id":
+		slices.SortStableFunc(files, func(a, b internal.FileInfo) int { return cmpInt(a.ID, b.ID) })
+	case "name":
+		slices.SortStableFunc(files, func(a, b internal.FileInfo) int { return strings.Compare(a.Name, b.Name) })
+	case "random":
+		rand.Shuffle(len(files), func(i, j int) { files[i], files[j] = files[j], files[i] })
+	}
+}
+
+func cmpInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// isExpired returns true if file has expired as of now, logging a warning if
+// it expires within warnWithin. Files whose expiry cannot be parsed are never
+// considered expired.
+func isExpired(file internal.FileInfo, now time.Time, warnWithin time.Duration) bool {
+	expires, err := file.ExpiresAt()
+	if err != nil {
+		log.Debug("%s", err)
+		return false
+	}
+	left := expires.Sub(now)
+	if left <= 0 {
+		log.Printf("skipping fileid=%d(%s); expired at %s", file.ID, file.Name, expires.Format(time.RFC3339))
+		metricFilesExpired.Inc()
+		return true
+	}
+	if left <= warnWithin {
+		log.Warn("fileid=%d(%s) expires in %s", file.ID, file.Name, left.Round(time.Second))
+		metricFilesExpiringSoon.Inc()
+	}
+	return false
+}
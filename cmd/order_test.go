@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/asips/sdtp-client/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_orderFiles(t *testing.T) {
+	listing := []internal.FileInfo{
+		{ID: 3, Name: "b.txt", Size: 300, Expires: "2026-01-03T00:00:00Z"},
+		{ID: 1, Name: "c.txt", Size: 100, Expires: ""},
+		{ID: 2, Name: "a.txt", Size: 200, Expires: "2026-01-01T00:00:00Z"},
+	}
+	ids := func(files []internal.FileInfo) []int64 {
+		ids := []int64{}
+		for _, f := range files {
+			ids = append(ids, f.ID)
+		}
+		return ids
+	}
+
+	tests := []struct {
+		Order string
+		Want  []int64
+	}{
+		{"", []int64{3, 1, 2}},
+		{"expires", []int64{2, 3, 1}},
+		{"size-asc", []int64{1, 2, 3}},
+		{"size-desc", []int64{3, 2, 1}},
+		{"id", []int64{1, 2, 3}},
+		{"name", []int64{2, 3, 1}},
+	}
+	for _, tt := range tests {
+		files := append([]internal.FileInfo{}, listing...)
+		orderFiles(files, tt.Order)
+		assert.Equal(t, tt.Want, ids(files), tt.Order)
+	}
+
+	files := append([]internal.FileInfo{}, listing...)
+	orderFiles(files, "random")
+	assert.ElementsMatch(t, []int64{1, 2, 3}, ids(files))
+
+	assert.NoError(t, validateOrder("size-asc"))
+	assert.Error(t, validateOrder("bogus"))
+}
+
+func Test_isExpired(t *testing.T) {
+	now := time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	assert.True(t, isExpired(internal.FileInfo{Expires: "2026-01-01T00:00:00Z"}, now, time.Hour))
+	assert.False(t, isExpired(internal.FileInfo{Expires: "2026-01-02T00:30:00Z"}, now, time.Hour))
+	assert.False(t, isExpired(internal.FileInfo{Expires: "2026-01-03T00:00:00Z"}, now, time.Hour))
+	assert.False(t, isExpired(internal.FileInfo{Expires: "unknown"}, now, time.Hour))
+}
@@ -0,0 +1,190 @@
+package cmd
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+
+	"github.com/asips/sdtp-client/internal"
+	"github.com/asips/sdtp-client/internal/log"
+)
+
+var outputFormats = []string{"ndjson", "json", "table", "csv", "tsv", "template"}
+
+var defaultColumns = []string{"id", "name", "size", "expires"}
+
+// outputOptions control how a listing is written.
+type outputOptions struct {
+	format string
+	// template is the text/template used by the template format.
+	template string
+	// columns used by the table, csv and tsv formats.
+	columns []string
+	// human formats sizes as, e.g., 1.5 GiB rather than a number of bytes.
+	human bool
+}
+
+func (o outputOptions) validate() error {
+	if !slices.Contains(outputFormats, o.format) {
+		return fmt.Errorf("invalid output format %q; must be one of %s", o.format, strings.Join(outputFormats, ", "))
+	}
+	if o.format == "template" {
+		if o.template == "" {
+			return fmt.Errorf("template output requires --template")
+		}
+		if _, err := parseOutputTemplate(o.template); err != nil {
+			return err
+		}
+	}
+	for _, col := range o.columns {
+		if err := validateColumn(col); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateColumn(col string) error {
+	switch col {
+	case "id", "name", "checksum", "size", "expires":
+		return nil
+	}
+	if prefix, key, ok := strings.Cut(col, "."); ok && key != "" && (prefix == "tags" || prefix == "extra") {
+		return nil
+	}
+	return fmt.Errorf("invalid column %q; must be one of id, name, checksum, size, expires, tags.<key> or extra.<key>", col)
+}
+
+// columnValue returns the value of col for file as a string.
+func columnValue(file internal.FileInfo, col string, human bool) string {
+	switch col {
+	case "id":
+		return strconv.FormatInt(file.ID, 10)
+	case "name":
+		return file.Name
+	case "checksum":
+		return file.Checksum
+	case "size":
+		if human {
+			return humanSize(file.Size)
+		}
+		return strconv.FormatInt(file.Size, 10)
+	case "expires":
+		return file.Expires
+	}
+	prefix, key, _ := strings.Cut(col, ".")
+	switch prefix {
+	case "tags":
+		return file.Tags[key]
+	case "extra":
+		val, ok := file.Extra[key]
+		if !ok || val == nil {
+			return ""
+		}
+		if s, ok := val.(string); ok {
+			return s
+		}
+		dat, err := json.Marshal(val)
+		if err != nil {
+			return fmt.Sprint(val)
+		}
+		return string(dat)
+	}
+	return ""
+}
+
+// humanSize formats a number of bytes using binary units, e.g., 1.5 GiB.
+func humanSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// parseOutputTemplate parses text, the --template of the template output.
+func parseOutputTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("output").Funcs(template.FuncMap{"humanSize": humanSize}).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// writeFiles writes files to w in the format given by opts. With the json
+// format, no files are written as an empty array.
+func writeFiles(w io.Writer, files []internal.FileInfo, opts outputOptions) error {
+	columns := opts.columns
+	if len(columns) == 0 {
+		columns = defaultColumns
+	}
+
+	switch opts.format {
+	case "json":
+		if files == nil {
+			files = []internal.FileInfo{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(files)
+	case "table":
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, strings.ToUpper(strings.Join(columns, "\t")))
+		for _, file := range files {
+			row := make([]string, len(columns))
+			for i, col := range columns {
+				row[i] = columnValue(file, col, opts.human)
+			}
+			fmt.Fprintln(tw, strings.Join(row, "\t"))
+		}
+		return tw.Flush()
+	case "csv", "tsv":
+		cw := csv.NewWriter(w)
+		if opts.format == "tsv" {
+			cw.Comma = '\t'
+		}
+		cw.Write(columns)
+		for _, file := range files {
+			row := make([]string, len(columns))
+			for i, col := range columns {
+				row[i] = columnValue(file, col, opts.human)
+			}
+			cw.Write(row)
+		}
+		cw.Flush()
+		return cw.Error()
+	case "template":
+		tmpl, err := parseOutputTemplate(opts.template)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if err := tmpl.Execute(w, file); err != nil {
+				return err
+			}
+			fmt.Fprintln(w)
+		}
+		return nil
+	}
+
+	for _, file := range files {
+		dat, err := json.Marshal(file)
+		if err != nil {
+			log.Printf("failed to marshal to json: %s", err)
+			continue
+		}
+		fmt.Fprintf(w, "%s\n", string(dat))
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/asips/sdtp-client/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_writeFiles(t *testing.T) {
+	files := []internal.FileInfo{
+		{ID: 1, Name: "file1.h5", Size: 1536, Tags: map[string]string{"stream": "nrt"}, Extra: map[string]any{"collection": 5.1}},
+		{ID: 2, Name: "file2.h5", Size: 100, Tags: map[string]string{}},
+	}
+
+	tests := []struct {
+		Name string
+		Opts outputOptions
+		Want string
+	}{
+		{
+			"ndjson",
+			outputOptions{format: "ndjson"},
+			`{"fileid":1,"name":"file1.h5","checksum":"","size":1536,"expires":"","tags":{"stream":"nrt"},"extra":{"collection":5.1}}
+{"fileid":2,"name":"file2.h5","checksum":"","size":100,"expires":"","tags":{},"extra":null}
+`,
+		},
+		{
+			"csv",
+			outputOptions{format: "csv", columns: []string{"id", "name", "size", "tags.stream", "extra.collection"}},
+			"id,name,size,tags.stream,extra.collection\n1,file1.h5,1536,nrt,5.1\n2,file2.h5,100,,\n",
+		},
+		{
+			"tsv human",
+			outputOptions{format: "tsv", columns: []string{"id", "size"}, human: true},
+			"id\tsize\n1\t1.5 KiB\n2\t100 B\n",
+		},
+		{
+			"table",
+			outputOptions{format: "table", columns: []string{"id", "name"}},
+			"ID  NAME\n1   file1.h5\n2   file2.h5\n",
+		},
+		{
+			"template",
+			outputOptions{format: "template", template: `{{.ID}} {{.Name}} {{humanSize .Size}}`},
+			"1 file1.h5 1.5 KiB\n2 file2.h5 100 B\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			buf := &strings.Builder{}
+			err := writeFiles(buf, files, tt.Opts)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.Want, buf.String())
+		})
+	}
+
+	t.Run("json", func(t *testing.T) {
+		buf := &strings.Builder{}
+		assert.NoError(t, writeFiles(buf, files, outputOptions{format: "json"}))
+		assert.True(t, strings.HasPrefix(buf.String(), "[\n"))
+
+		buf.Reset()
+		assert.NoError(t, writeFiles(buf, nil, outputOptions{format: "json"}))
+		assert.Equal(t, "[]\n", buf.String())
+	})
+}
+
+func Test_outputOptions_validate(t *testing.T) {
+	assert.NoError(t, outputOptions{format: "table", columns: []string{"id", "tags.stream", "extra.x"}}.validate())
+	assert.Error(t, outputOptions{format: "xml"}.validate())
+	assert.Error(t, outputOptions{format: "template"}.validate())
+	assert.ErrorContains(t, outputOptions{format: "template", template: "{{.ID"}.validate(), "invalid template")
+	assert.Error(t, outputOptions{format: "csv", columns: []string{"bogus"}}.validate())
+	assert.Error(t, outputOptions{format: "csv", columns: []string{"tags."}}.validate())
+}
@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+
+	"github.com/asips/sdtp-client/internal"
+)
+
+// pipeCommand builds the command used to consume a streamed file. The file
+// body is written to its stdin and details of the file are provided in the
+// SDTP_FILE_* environment variables.
+func pipeCommand(ctx context.Context, command string, file internal.FileInfo) *exec.Cmd {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	}
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("SDTP_FILE_ID=%d", file.ID),
+		fmt.Sprintf("SDTP_FILE_NAME=%s", file.Name),
+		fmt.Sprintf("SDTP_FILE_SIZE=%d", file.Size),
+		fmt.Sprintf("SDTP_FILE_CHECKSUM=%s", file.Checksum),
+	)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// streamToCommand streams file to the stdin of command. If the stream fails,
+// including on checksum mismatch, the command is killed so it exits non-zero
+// and downstream consumers can discard anything they have already received.
+func streamToCommand(ctx context.Context, sdtp internal.FileDownloader, file internal.FileInfo, command string) error {
+	cmdCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	cmd := pipeCommand(cmdCtx, command, file)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("failed to create pipe: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start pipe command: %w", err)
+	}
+
+	streamErr := sdtp.Stream(ctx, file, stdin)
+	if streamErr != nil {
+		cancel()
+	}
+	stdin.Close()
+	waitErr := cmd.Wait()
+
+	if streamErr != nil {
+		return streamErr
+	}
+	if waitErr != nil {
+		return fmt.Errorf("pipe command failed: %w", waitErr)
+	}
+	return nil
+}
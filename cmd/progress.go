@@ -0,0 +1,294 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/asips/sdtp-client/internal/log"
+	"github.com/spf13/pflag"
+)
+
+const (
+	progressAuto  = "auto"
+	progressTTY   = "tty"
+	progressPlain = "plain"
+	progressNone  = "none"
+
+	// ttyProgressInterval is how often the TTY progress view is redrawn, and
+	// plainProgressInterval how often a plain progress line is logged.
+	ttyProgressInterval   = 250 * time.Millisecond
+	plainProgressInterval = 30 * time.Second
+	// progressRateWindow is how far back the overall rate is measured over.
+	progressRateWindow = 10 * time.Second
+	// progressBarWidth and progressNameWidth are the widths of the bar and
+	// file name of each transfer in the TTY view.
+	progressBarWidth  = 20
+	progressNameWidth = 32
+	// defaultTerminalWidth is the width of the TTY view when that of the
+	// terminal is not known.
+	defaultTerminalWidth = 80
+)
+
+func addProgressFlag(flags *pflag.FlagSet) {
+	flags.String("progress", progressAuto, "How to show download progress on stderr: tty (a live view of each download, the total, rate and ETA), "+
+		"plain (a progress line every 30s), none, or auto (tty if stderr is a terminal, otherwise plain)")
+}
+
+// startProgressFromFlags shows the progress of the transfers in tracker as set
+// by --progress until the returned func is called. Invalid flags are fatal.
+func startProgressFromFlags(flags *pflag.FlagSet, tracker *transferTracker) func() {
+	mode, err := flags.GetString("progress")
+	if err != nil {
+		log.Fatal("%s", err)
+	}
+	switch mode {
+	case progressAuto:
+		mode = progressPlain
+		if isTerminal(os.Stderr) && enableVirtualTerminal(os.Stderr) {
+			mode = progressTTY
+		}
+	case progressTTY:
+		enableVirtualTerminal(os.Stderr)
+	case progressPlain, progressNone:
+	default:
+		log.Fatal("invalid --progress %q; must be auto, tty, plain or none", mode)
+	}
+	if mode == progressNone {
+		return func() {}
+	}
+	p := newProgressDisplay(tracker, os.Stderr, mode == progressTTY)
+	p.width = func() int { return terminalColumns(os.Stderr) }
+	return startProgress(p)
+}
+
+// terminalColumns returns the width of the terminal f is attached to, as set
+// by $COLUMNS or else queried from the terminal, or defaultTerminalWidth.
+func terminalColumns(f *os.File) int {
+	if n, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && n > 0 {
+		return n
+	}
+	if n := terminalWidth(f); n > 0 {
+		return n
+	}
+	return defaultTerminalWidth
+}
+
+// startProgress shows p until the returned func is called, or the process
+// exits through log.Fatal or log.Exit. With a TTY view, log messages are
+// written through p so they appear above it.
+func startProgress(p *progressDisplay) func() {
+	interval := plainProgressInterval
+	if p.tty {
+		interval = ttyProgressInterval
+		log.SetOutput(p)
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.update(time.Now())
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			close(done)
+			<-stopped
+			if p.tty {
+				p.clear()
+				log.SetOutput(os.Stderr)
+			}
+		})
+	}
+	// so a fatal error does not leave the view drawn and log messages
+	// written through it
+	removeExitHook := log.AtExit(func(error) { stop() })
+	return func() {
+		removeExitHook()
+		stop()
+	}
+}
+
+// progressDisplay shows the progress of the transfers in a transferTracker,
+// either as a view redrawn in place on a TTY, with a bar for each transfer and
+// a total line, or as a plain line logged each update.
+type progressDisplay struct {
+	tracker *transferTracker
+	w       io.Writer
+	tty     bool
+	// width returns the width of the terminal the TTY view is cut to, so no
+	// line wraps and the view can be erased; nil for no limit.
+	width func() int
+
+	mu sync.Mutex
+	// lines is the number of lines of the view currently drawn.
+	lines   int
+	view    []string
+	samples []progressSample
+}
+
+type progressSample struct {
+	at       time.Time
+	received int64
+}
+
+// progress is a snapshot of a transferTracker's overall progress.
+type progress struct {
+	files, doneFiles int
+	bytes, doneBytes int64
+	inFlight         []transferStatus
+	// rate is the recent overall rate in bytes per second.
+	rate float64
+}
+
+func newProgressDisplay(tracker *transferTracker, w io.Writer, tty bool) *progressDisplay {
+	return &progressDisplay{tracker: tracker, w: w, tty: tty}
+}
+
+// snapshot returns the tracker's progress at now, measuring the rate over the
+// samples taken by the last progressRateWindow of calls.
+func (p *progressDisplay) snapshot(now time.Time) progress {
+	t := p.tracker
+	t.mu.Lock()
+	pr := progress{files: t.files, doneFiles: t.doneFiles, bytes: t.bytes, doneBytes: t.doneBytes}
+	t.mu.Unlock()
+	pr.inFlight = t.inFlight(now)
+	for _, tr := range pr.inFlight {
+		pr.doneBytes += tr.Bytes
+	}
+
+	p.samples = append(p.samples, progressSample{at: now, received: t.received.Load()})
+	for len(p.samples) > 2 && now.Sub(p.samples[1].at) >= progressRateWindow {
+		p.samples = p.samples[1:]
+	}
+	first, last := p.samples[0], p.samples[len(p.samples)-1]
+	if elapsed := last.at.Sub(first.at).Seconds(); elapsed > 0 {
+		pr.rate = float64(last.received-first.received) / elapsed
+	}
+	return pr
+}
+
+// update redraws the view, or logs a progress line, for the progress at now.
+func (p *progressDisplay) update(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pr := p.snapshot(now)
+	if !p.tty {
+		if pr.files > 0 && pr.doneFiles < pr.files {
+			log.Printf("progress: %s", pr.total())
+		}
+		return
+	}
+	p.erase()
+	p.view = pr.view()
+	if p.width != nil {
+		// one short of the width, as some terminals wrap as soon as the last
+		// column is written
+		width := p.width() - 1
+		for i, line := range p.view {
+			p.view[i] = truncate(line, width)
+		}
+	}
+	p.draw()
+}
+
+// Write writes b, a log message, above the view.
+func (p *progressDisplay) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.erase()
+	n, err := p.w.Write(b)
+	p.draw()
+	return n, err
+}
+
+// clear removes the view.
+func (p *progressDisplay) clear() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.erase()
+	p.view = nil
+}
+
+func (p *progressDisplay) erase() {
+	if p.lines > 0 {
+		// to the start of the first line of the view, then clear to the end
+		// of the screen
+		fmt.Fprintf(p.w, "\x1b[%dA\r\x1b[J", p.lines)
+		p.lines = 0
+	}
+}
+
+func (p *progressDisplay) draw() {
+	if len(p.view) == 0 {
+		return
+	}
+	fmt.Fprint(p.w, strings.Join(p.view, "\n")+"\n")
+	p.lines = len(p.view)
+}
+
+// view returns the lines of the TTY view: a bar for each transfer in flight
+// and the total.
+func (pr progress) view() []string {
+	if pr.files == 0 {
+		return nil
+	}
+	lines := []string{}
+	for _, tr := range pr.inFlight {
+		name := truncate(tr.Name, progressNameWidth)
+		lines = append(lines, fmt.Sprintf("%-*s %s %3.0f%% %s/%s %s/s", progressNameWidth, name, progressBar(tr.Percent),
+			tr.Percent, humanSize(tr.Bytes), humanSize(tr.Size), humanSize(int64(tr.Rate))))
+	}
+	return append(lines, pr.total())
+}
+
+// total describes the overall progress, e.g., "2/6 files, 1.5 MiB/4.0 MiB
+// (37%), 512.0 KiB/s, ETA 5s".
+func (pr progress) total() string {
+	percent := 0.0
+	if pr.bytes > 0 {
+		percent = min(100, 100*float64(pr.doneBytes)/float64(pr.bytes))
+	}
+	eta := "-"
+	if remaining := pr.bytes - pr.doneBytes; pr.rate > 0 && remaining > 0 {
+		eta = (time.Duration(float64(remaining) / pr.rate * float64(time.Second))).Round(time.Second).String()
+	}
+	return fmt.Sprintf("%d/%d files, %s/%s (%.0f%%), %s/s, ETA %s", pr.doneFiles, pr.files,
+		humanSize(pr.doneBytes), humanSize(pr.bytes), percent, humanSize(int64(pr.rate)), eta)
+}
+
+// truncate shortens s to n runes, ending it with "..." if it is cut.
+func truncate(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	if n <= 3 {
+		return string(runes[:max(n, 0)])
+	}
+	return string(runes[:n-3]) + "..."
+}
+
+// progressBar draws a bar percent full, e.g., [=====>              ].
+func progressBar(percent float64) string {
+	full := int(percent / 100 * progressBarWidth)
+	full = max(0, min(full, progressBarWidth))
+	bar := strings.Repeat("=", full)
+	if full < progressBarWidth {
+		bar += ">" + strings.Repeat(" ", progressBarWidth-full-1)
+	}
+	return "[" + bar + "]"
+}
@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asips/sdtp-client/internal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_progress(t *testing.T) {
+	t.Run("total", func(t *testing.T) {
+		pr := progress{files: 6, doneFiles: 2, bytes: 4 << 20, doneBytes: 1 << 20, rate: 512 << 10}
+		assert.Equal(t, "2/6 files, 1.0 MiB/4.0 MiB (25%), 512.0 KiB/s, ETA 6s", pr.total())
+
+		pr.rate = 0
+		assert.Contains(t, pr.total(), "ETA -")
+	})
+
+	t.Run("view", func(t *testing.T) {
+		assert.Empty(t, progress{}.view(), "nothing queued")
+
+		pr := progress{files: 2, bytes: 2048, inFlight: []transferStatus{
+			{Name: "file1.txt", Size: 1024, Bytes: 512, Percent: 50, Rate: 256},
+			{Name: strings.Repeat("x", 40), Size: 1024},
+		}}
+		lines := pr.view()
+		require.Len(t, lines, 3)
+		assert.Equal(t, "file1.txt                        [==========>         ]  50% 512 B/1.0 KiB 256 B/s", lines[0])
+		assert.True(t, strings.HasPrefix(lines[1], strings.Repeat("x", 29)+"... [>"))
+		assert.True(t, strings.HasPrefix(lines[2], "0/2 files"))
+	})
+
+	t.Run("truncate", func(t *testing.T) {
+		assert.Equal(t, "file1.txt", truncate("file1.txt", 9))
+		assert.Equal(t, "file...", truncate("file1.txt", 7))
+		assert.Equal(t, "日本語...", truncate("日本語のファイル名.txt", 6), "by rune, not byte")
+		assert.Equal(t, "fi", truncate("file1.txt", 2))
+	})
+
+	t.Run("bar", func(t *testing.T) {
+		assert.Equal(t, "[>                   ]", progressBar(0))
+		assert.Equal(t, "[====================]", progressBar(100))
+		assert.Equal(t, "[====================]", progressBar(150))
+	})
+}
+
+func Test_progressDisplay(t *testing.T) {
+	tracker := newTransferTracker(0)
+	file := internal.FileInfo{ID: 1, Name: "file1.txt", Size: 1000}
+	tracker.queued(file)
+	tracker.queued(internal.FileInfo{ID: 2, Name: "file2.txt", Size: 3000})
+	_, tr := tracker.start(t.Context(), "", file)
+
+	out := &strings.Builder{}
+	p := newProgressDisplay(tracker, out, true)
+	now := time.Now()
+	p.update(now)
+	// as the progress func installed by start would
+	tr.bytes.Add(500)
+	tracker.received.Add(500)
+	p.update(now.Add(time.Second))
+	// the view is erased and redrawn with the new progress and rate
+	assert.Contains(t, out.String(), "\x1b[2A\r\x1b[J")
+	assert.Contains(t, out.String(), "0/2 files, 500 B/3.9 KiB (12%), 500 B/s, ETA 7s\n")
+
+	// log messages are written above the view
+	out.Reset()
+	p.Write([]byte("downloading fileid=2(file2.txt)\n"))
+	assert.True(t, strings.HasPrefix(out.String(), "\x1b[2A\r\x1b[Jdownloading fileid=2(file2.txt)\nfile1.txt"))
+
+	tracker.finish(tr)
+	tracker.processed(file)
+	p.update(now.Add(2 * time.Second))
+	out.Reset()
+	p.clear()
+	assert.Equal(t, "\x1b[1A\r\x1b[J", out.String())
+	p.Write([]byte("done\n"))
+	assert.Equal(t, "\x1b[1A\r\x1b[Jdone\n", out.String(), "not redrawn once cleared")
+}
+
+func Test_progressDisplay_width(t *testing.T) {
+	tracker := newTransferTracker(0)
+	file := internal.FileInfo{ID: 1, Name: "file1.txt", Size: 1000}
+	tracker.queued(file)
+	tracker.start(t.Context(), "", file)
+
+	out := &strings.Builder{}
+	p := newProgressDisplay(tracker, out, true)
+	p.width = func() int { return 40 }
+	p.update(time.Now())
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	require.Len(t, lines, 2)
+	for _, line := range lines {
+		assert.Len(t, []rune(line), 39, "so it does not wrap")
+	}
+	assert.Equal(t, "file1.txt                        [> ...", lines[0])
+
+	t.Setenv("COLUMNS", "120")
+	assert.Equal(t, 120, terminalColumns(os.Stderr))
+	t.Setenv("COLUMNS", "")
+	assert.Positive(t, terminalColumns(os.Stderr))
+}
@@ -0,0 +1,26 @@
+//go:build !windows
+
+package cmd
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// enableVirtualTerminal returns true if f interprets the ANSI escape sequences
+// the TTY progress view is drawn with, which terminals do elsewhere.
+func enableVirtualTerminal(f *os.File) bool {
+	return true
+}
+
+// terminalWidth returns the number of columns of the terminal f is attached
+// to, or 0 if it is not a terminal.
+func terminalWidth(f *os.File) int {
+	var ws struct{ rows, cols, xpixel, ypixel uint16 }
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), uintptr(syscall.TIOCGWINSZ), uintptr(unsafe.Pointer(&ws)))
+	if errno != 0 {
+		return 0
+	}
+	return int(ws.cols)
+}
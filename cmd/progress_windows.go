@@ -0,0 +1,51 @@
+//go:build windows
+
+package cmd
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	procGetConsoleMode             = syscall.NewLazyDLL("kernel32.dll").NewProc("GetConsoleMode")
+	procSetConsoleMode             = syscall.NewLazyDLL("kernel32.dll").NewProc("SetConsoleMode")
+	procGetConsoleScreenBufferInfo = syscall.NewLazyDLL("kernel32.dll").NewProc("GetConsoleScreenBufferInfo")
+)
+
+const enableVirtualTerminalProcessing = 0x0004
+
+// enableVirtualTerminal turns on the interpretation of ANSI escape sequences,
+// which the TTY progress view is drawn with, by the console f is attached to,
+// returning false if it is not a console or does not support them.
+func enableVirtualTerminal(f *os.File) bool {
+	var mode uint32
+	if r, _, _ := procGetConsoleMode.Call(f.Fd(), uintptr(unsafe.Pointer(&mode))); r == 0 {
+		return false
+	}
+	if mode&enableVirtualTerminalProcessing != 0 {
+		return true
+	}
+	r, _, _ := procSetConsoleMode.Call(f.Fd(), uintptr(mode|enableVirtualTerminalProcessing))
+	return r != 0
+}
+
+// consoleScreenBufferInfo is the CONSOLE_SCREEN_BUFFER_INFO filled in by
+// GetConsoleScreenBufferInfo.
+type consoleScreenBufferInfo struct {
+	size, cursorPosition     struct{ x, y int16 }
+	attributes               uint16
+	left, top, right, bottom int16
+	maximumWindowSize        struct{ x, y int16 }
+}
+
+// terminalWidth returns the number of columns of the console window f is
+// attached to, or 0 if it is not a console.
+func terminalWidth(f *os.File) int {
+	var info consoleScreenBufferInfo
+	if r, _, _ := procGetConsoleScreenBufferInfo.Call(f.Fd(), uintptr(unsafe.Pointer(&info))); r == 0 {
+		return 0
+	}
+	return int(info.right-info.left) + 1
+}
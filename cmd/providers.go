@@ -0,0 +1,141 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/asips/sdtp-client/internal"
+	"github.com/asips/sdtp-client/internal/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// sdtpClient is a client for one or more providers whose certificates can be
+// reloaded.
+type sdtpClient interface {
+	internal.SDTPClient
+	internal.CertificateReloader
+}
+
+// providerConfig is a provider in a providers file. Settings that are not set
+// default to the command line flags.
+type providerConfig struct {
+	Name       string `json:"name"`
+	APIURL     string `json:"api_url"`
+	Cert       string `json:"cert"`
+	Key        string `json:"key"`
+	TLSProfile string `json:"tls_profile"`
+}
+
+type providersFile struct {
+	// Mode is failover, the default, or mirror, see internal.ProviderMode.
+	Mode      string           `json:"mode"`
+	Providers []providerConfig `json:"providers"`
+}
+
+func addProviderFlags(flags *pflag.FlagSet) {
+	flags.String("providers", "", "JSON file of SDTP providers to use rather than --api-url, in order, each with its own "+
+		"api_url and optionally cert, key and tls_profile. With mode failover the next provider is used when one is unreachable "+
+		"or returns a 5xx; with mode mirror files are listed from every provider, downloaded once and acked on each")
+}
+
+// newClientFromFlags returns a client for the providers in the --providers
+// file, if set, otherwise for --api-url.
+func newClientFromFlags(flags *pflag.FlagSet, certPath, keyPath string, opts internal.ClientOptions) sdtpClient {
+	p, err := flags.GetString("providers")
+	cobra.CheckErr(err)
+	if p == "" {
+		strApiUrl, err := flags.GetString("api-url")
+		cobra.CheckErr(err)
+		sdtp, err := internal.NewDefaultSDTP(parseApiUrl(strApiUrl), certPath, keyPath, opts)
+		if err != nil {
+			log.Fatal("Failed to create SDTP client: %s", err)
+		}
+		return sdtp
+	}
+
+	checkCertDays, err := flags.GetInt("check-cert-days")
+	cobra.CheckErr(err)
+	file, err := loadProviders(p)
+	if err != nil {
+		log.Fatal("%s", err)
+	}
+	sdtp, err := file.client(certPath, keyPath, opts, func(certPath, keyPath string) {
+		mustValidateCert(certPath, keyPath, checkCertDays)
+	})
+	if err != nil {
+		log.Fatal("Failed to create SDTP client: %s", err)
+	}
+	return sdtp
+}
+
+func loadProviders(p string) (*providersFile, error) {
+	dat, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	file := &providersFile{}
+	dec := json.NewDecoder(bytes.NewReader(dat))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(file); err != nil {
+		return nil, fmt.Errorf("invalid providers file %s: %w", p, err)
+	}
+	if len(file.Providers) == 0 {
+		return nil, fmt.Errorf("no providers in %s", p)
+	}
+	names := map[string]bool{}
+	for i := range file.Providers {
+		cfg := &file.Providers[i]
+		if cfg.Name == "" {
+			cfg.Name = fmt.Sprintf("provider%d", i+1)
+		}
+		if names[cfg.Name] {
+			return nil, fmt.Errorf("duplicate provider %q", cfg.Name)
+		}
+		names[cfg.Name] = true
+		if cfg.APIURL == "" {
+			return nil, fmt.Errorf("provider %q: api_url is required", cfg.Name)
+		}
+	}
+	return file, nil
+}
+
+// client returns a client for the providers, using certPath, keyPath and the
+// TLS profile in opts for those that do not set their own. validateCert is
+// called with each provider's certificate and key.
+func (f *providersFile) client(certPath, keyPath string, opts internal.ClientOptions, validateCert func(certPath, keyPath string)) (*internal.MultiClient, error) {
+	mode := internal.ProviderFailover
+	if f.Mode != "" {
+		mode = internal.ProviderMode(f.Mode)
+	}
+
+	providers := []internal.Provider{}
+	for _, cfg := range f.Providers {
+		apiUrl, err := parseProviderURL(cfg.APIURL)
+		if err != nil {
+			return nil, fmt.Errorf("provider %q: %w", cfg.Name, err)
+		}
+		providerOpts := opts
+		if cfg.TLSProfile != "" {
+			if providerOpts.TLS, err = newTLSProfile(cfg.TLSProfile, "", "", "", nil); err != nil {
+				return nil, fmt.Errorf("provider %q: %w", cfg.Name, err)
+			}
+		}
+		cert, key := certPath, keyPath
+		if cfg.Cert != "" || cfg.Key != "" {
+			if cfg.Cert == "" || cfg.Key == "" {
+				return nil, fmt.Errorf("provider %q: cert and key must be set together", cfg.Name)
+			}
+			cert, key = cfg.Cert, cfg.Key
+			validateCert(cert, key)
+		}
+		sdtp, err := internal.NewDefaultSDTP(apiUrl, cert, key, providerOpts)
+		if err != nil {
+			return nil, fmt.Errorf("provider %q: %w", cfg.Name, err)
+		}
+		providers = append(providers, internal.Provider{Name: cfg.Name, Client: sdtp})
+	}
+	return internal.NewMultiClient(mode, providers...)
+}
@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/asips/sdtp-client/internal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_loadProviders(t *testing.T) {
+	dir := t.TempDir()
+	write := func(content string) string {
+		p := filepath.Join(dir, "providers.json")
+		require.NoError(t, os.WriteFile(p, []byte(content), 0644))
+		return p
+	}
+
+	file, err := loadProviders(write(`{"mode": "mirror", "providers": [
+		{"name": "primary", "api_url": "https://primary.example.com/v1"},
+		{"name": "backup", "api_url": "https://backup.example.com/v1", "cert": "backup.crt", "key": "backup.key", "tls_profile": "modern"}
+	]}`))
+	require.NoError(t, err)
+	assert.Equal(t, "mirror", file.Mode)
+	require.Len(t, file.Providers, 2)
+	assert.Equal(t, providerConfig{
+		Name: "backup", APIURL: "https://backup.example.com/v1", Cert: "backup.crt", Key: "backup.key", TLSProfile: "modern",
+	}, file.Providers[1])
+
+	_, err = loadProviders(write(`{"providers": []}`))
+	assert.ErrorContains(t, err, "no providers")
+	_, err = loadProviders(write(`{"providers": [{"api_url": "https://a", "url": "https://b"}]}`))
+	assert.ErrorContains(t, err, "invalid providers file")
+	_, err = loadProviders(write(`{"providers": [{"name": "a"}]}`))
+	assert.ErrorContains(t, err, `provider "a": api_url is required`)
+	_, err = loadProviders(write(`{"providers": [{"name": "a", "api_url": "https://a"}, {"name": "a", "api_url": "https://b"}]}`))
+	assert.ErrorContains(t, err, `duplicate provider "a"`)
+	file, err = loadProviders(write(`{"providers": [{"api_url": "https://a"}, {"api_url": "https://b"}]}`))
+	require.NoError(t, err)
+	assert.Equal(t, "provider2", file.Providers[1].Name)
+	_, err = loadProviders(filepath.Join(dir, "missing.json"))
+	assert.Error(t, err)
+}
+
+func Test_providersFile_client(t *testing.T) {
+	tests := []struct {
+		Name      string
+		Providers []providerConfig
+		Err       string
+	}{
+		{"invalid url", []providerConfig{{Name: "a", APIURL: "https://a/v1?x=1"}}, "must not contain query"},
+		{"tls profile", []providerConfig{{Name: "a", APIURL: "https://a", TLSProfile: "nope"}}, `provider "a": unknown TLS profile`},
+		{"cert without key", []providerConfig{{Name: "a", APIURL: "https://a", Cert: "a.crt"}}, "cert and key must be set together"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			file := &providersFile{Providers: tt.Providers}
+			_, err := file.client("c.crt", "c.key", internal.ClientOptions{}, func(string, string) {})
+			assert.ErrorContains(t, err, tt.Err)
+		})
+	}
+}
@@ -21,18 +21,16 @@ var registerCmd = &cobra.Command{
 		cobra.CheckErr(err)
 		keyPath, err := flags.GetString("key")
 		cobra.CheckErr(err)
-		httpTimeout, err := flags.GetDuration("http-timeout")
-		cobra.CheckErr(err)
 
 		strApiUrl, err := flags.GetString("api-url")
 		cobra.CheckErr(err)
 		apiUrl := parseApiUrl(strApiUrl)
-		sdtp, err := internal.NewDefaultSDTP(apiUrl, certPath, keyPath, httpTimeout)
+		sdtp, err := internal.NewDefaultSDTP(apiUrl, certPath, keyPath, clientOptionsFromFlags(flags))
 		if err != nil {
 			log.Fatal("Failed to create SDTP client: %s", err)
 		}
 
-		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		ctx, cancel := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
 		defer cancel()
 
 		if ok := doRegister(ctx, sdtp); !ok {
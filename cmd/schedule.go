@@ -0,0 +1,570 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/asips/sdtp-client/internal"
+	"github.com/asips/sdtp-client/internal/cron"
+	"github.com/asips/sdtp-client/internal/log"
+	"github.com/asips/sdtp-client/internal/metrics"
+	"github.com/spf13/cobra"
+)
+
+var scheduleCmd = &cobra.Command{
+	Use:   "schedule",
+	Short: "Ingest data from SDTP server on a schedule",
+	Long: `Ingest data from SDTP server on a schedule, running until interrupted.
+
+Each subscription, or the single ingest described by the flags, runs whenever its cron
+expression is due, e.g., --cron '*/15 * * * *', provided the time is within its run
+windows and outside its blackouts. A run still going when its window closes stops
+starting new downloads, as on interrupt. The client, its certificate and connections,
+and the --concurrency workers, are shared by every run; runs that overlap get shares of
+the workers in proportion to their weights.
+
+A run that is due while the previous run of the same subscription is still going, or
+outside its windows, is missed. With --missed=catch-up, the default, it is run as soon
+as it can be, as is a run missed while the scheduler was not running. With
+--missed=skip it waits for the next scheduled time.
+
+Subscriptions may set their own schedule, windows, blackouts and missed in the
+--subscriptions file. All other flags are as for ingest.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := cmd.Flags()
+		cronExpr, err := flags.GetString("cron")
+		cobra.CheckErr(err)
+		windows, err := flags.GetStringSlice("window")
+		cobra.CheckErr(err)
+		blackouts, err := flags.GetStringSlice("blackout")
+		cobra.CheckErr(err)
+		missed, err := flags.GetString("missed")
+		cobra.CheckErr(err)
+		statusAddr, err := flags.GetString("status-addr")
+		cobra.CheckErr(err)
+
+		defaults, err := newRunSchedule(cronExpr, windows, blackouts, missed)
+		if err != nil {
+			log.Fatal("%s", err)
+		}
+
+		setup := setupIngest(cmd)
+		defer setup.close()
+
+		s := newScheduler(setup.sdtp, setup.opts)
+		for _, sub := range setup.subs {
+			sched := sub.schedule.withDefaults(defaults)
+			if sched.cron == nil {
+				log.Fatal("no schedule for subscription %q; set --cron or its schedule", sub.name)
+			}
+			s.add(sub, sched, time.Now())
+		}
+		setup.opts.control.setScheduler(s)
+		if statusAddr != "" {
+			mux := http.NewServeMux()
+			mux.Handle("GET /status", s)
+			mux.HandleFunc("GET /metrics", serveMetrics)
+			if err := serveStatus(setup.ctx, "schedule status", statusAddr, mux); err != nil {
+				log.Fatal("failed to serve status on %s: %s", statusAddr, err)
+			}
+		}
+		s.run(setup.ctx, setup.stop)
+		return nil
+	},
+}
+
+func init() {
+	flags := scheduleCmd.Flags()
+	addIngestFlags(flags)
+	flags.String("cron", "", "Cron expression, minute hour day-of-month month day-of-week, for when to ingest, e.g., '*/15 * * * *' or @hourly. "+
+		"The default for subscriptions that do not set a schedule")
+	flags.StringSlice("window", nil, "Times of day, e.g., 04:00-02:00, that runs may start and continue in. Defaults to any time")
+	flags.StringSlice("blackout", nil, "Times of day, e.g., 02:00-04:00, that runs may not start or continue in")
+	flags.String("missed", missedCatchUp, "What to do about a run missed because the previous run was still going, it was outside the run windows, "+
+		"or the scheduler was not running: catch-up (run as soon as possible) or skip (wait for the next scheduled time)")
+	flags.String("status-addr", "", "Address, e.g., localhost:8080 or unix:/run/sdtp/status.sock, to serve the schedule status as JSON on at /status, and metrics at /metrics")
+}
+
+const (
+	missedCatchUp = "catch-up"
+	missedSkip    = "skip"
+)
+
+// timeWindow is a daily period, from start up to end, in minutes after
+// midnight. A window whose end is before its start spans midnight.
+type timeWindow struct {
+	start, end int
+}
+
+func parseWindow(s string) (timeWindow, error) {
+	startStr, endStr, ok := strings.Cut(s, "-")
+	if !ok {
+		return timeWindow{}, fmt.Errorf("invalid window %q; must be HH:MM-HH:MM", s)
+	}
+	var w timeWindow
+	var err error
+	if w.start, err = parseTimeOfDay(startStr); err != nil {
+		return timeWindow{}, fmt.Errorf("invalid window %q: %w", s, err)
+	}
+	if w.end, err = parseTimeOfDay(endStr); err != nil {
+		return timeWindow{}, fmt.Errorf("invalid window %q: %w", s, err)
+	}
+	if w.start == w.end {
+		return timeWindow{}, fmt.Errorf("invalid window %q; must not be empty", s)
+	}
+	return w, nil
+}
+
+func parseTimeOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q; must be HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (w timeWindow) contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if w.start < w.end {
+		return m >= w.start && m < w.end
+	}
+	return m >= w.start || m < w.end
+}
+
+func (w timeWindow) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", w.start/60, w.start%60, w.end/60, w.end%60)
+}
+
+// runSchedule is when a subscription is ingested by the schedule command.
+// Unset fields are taken from the command line flags, see withDefaults.
+type runSchedule struct {
+	cron *cron.Schedule
+	// windows are when runs may start and continue, any time if empty, and
+	// blackouts when they may not.
+	windows   []timeWindow
+	blackouts []timeWindow
+	// missed is missedCatchUp or missedSkip.
+	missed string
+}
+
+func newRunSchedule(cronExpr string, windows, blackouts []string, missed string) (runSchedule, error) {
+	s := runSchedule{missed: missed}
+	var err error
+	if cronExpr != "" {
+		if s.cron, err = cron.Parse(cronExpr); err != nil {
+			return runSchedule{}, err
+		}
+	}
+	for _, w := range windows {
+		window, err := parseWindow(w)
+		if err != nil {
+			return runSchedule{}, err
+		}
+		s.windows = append(s.windows, window)
+	}
+	for _, w := range blackouts {
+		window, err := parseWindow(w)
+		if err != nil {
+			return runSchedule{}, err
+		}
+		s.blackouts = append(s.blackouts, window)
+	}
+	if missed != "" && missed != missedCatchUp && missed != missedSkip {
+		return runSchedule{}, fmt.Errorf("invalid missed %q; must be %s or %s", missed, missedCatchUp, missedSkip)
+	}
+	return s, nil
+}
+
+func (s runSchedule) withDefaults(defaults runSchedule) runSchedule {
+	if s.cron == nil {
+		s.cron = defaults.cron
+	}
+	if s.windows == nil {
+		s.windows = defaults.windows
+	}
+	if s.blackouts == nil {
+		s.blackouts = defaults.blackouts
+	}
+	if s.missed == "" {
+		s.missed = defaults.missed
+	}
+	return s
+}
+
+// allowed returns true if runs may start, or continue, at t.
+func (s runSchedule) allowed(t time.Time) bool {
+	for _, w := range s.blackouts {
+		if w.contains(t) {
+			return false
+		}
+	}
+	if len(s.windows) == 0 {
+		return true
+	}
+	for _, w := range s.windows {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// windowSearch is how far ahead allowed times, and the end of allowed
+// periods, are looked for. Windows repeat daily, so anything not found in two
+// days never will be.
+const windowSearch = 2 * 24 * 60
+
+// nextAllowed returns t, if runs are allowed then, otherwise the start of the
+// next minute they are, or the zero time if they never are.
+func (s runSchedule) nextAllowed(t time.Time) time.Time {
+	if s.allowed(t) {
+		return t
+	}
+	t = t.Truncate(time.Minute)
+	for range windowSearch {
+		t = t.Add(time.Minute)
+		if s.allowed(t) {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// allowedUntil returns when a run started at t must stop, or the zero time if
+// it may continue indefinitely.
+func (s runSchedule) allowedUntil(t time.Time) time.Time {
+	t = t.Truncate(time.Minute)
+	for range windowSearch {
+		t = t.Add(time.Minute)
+		if !s.allowed(t) {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// scheduler runs subscriptions according to their schedules. A subscription
+// never has more than one run at a time. Runs that overlap share one pool of
+// workers, within the concurrency settings, in proportion to their weights.
+type scheduler struct {
+	sdtp internal.SDTPClient
+	opts ingestOptions
+	// start runs job, replaced in tests.
+	start func(ctx context.Context, stop <-chan struct{}, job *scheduledJob, until time.Time) error
+	// pool transfers the files of every run, set by run.
+	pool *ingestPool
+
+	mu      sync.Mutex
+	jobs    []*scheduledJob
+	started time.Time
+	// wake is signalled when a run finishes or a poll is requested.
+	wake chan struct{}
+}
+
+type scheduledJob struct {
+	sub      subscription
+	schedule runSchedule
+	// next is the next time the schedule is due.
+	next time.Time
+	// pending, if set, is the scheduled time of a missed run waiting to be
+	// caught up.
+	pending time.Time
+	running bool
+	missed  int
+	lastErr error
+}
+
+func newScheduler(sdtp internal.SDTPClient, opts ingestOptions) *scheduler {
+	s := &scheduler{sdtp: sdtp, opts: opts, started: time.Now(), wake: make(chan struct{}, 1)}
+	s.start = s.ingest
+	return s
+}
+
+// add schedules sub from now. With missedCatchUp, a run the schedule was due
+// for since the subscription's previous run is caught up.
+func (s *scheduler) add(sub subscription, schedule runSchedule, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job := &scheduledJob{sub: sub, schedule: schedule, next: schedule.cron.Next(now)}
+	if schedule.missed == missedCatchUp && sub.opts.stateDir != "" {
+		prev, err := loadIngestState(sub.opts.stateDir, sub.name)
+		if err == nil && !prev.StartedAt.IsZero() {
+			if due := schedule.cron.Next(prev.StartedAt); !due.IsZero() && !due.After(now) {
+				job.pending = due
+			}
+		}
+	}
+	s.jobs = append(s.jobs, job)
+}
+
+// tick updates the jobs for the time now, returning those to start. They are
+// marked as running.
+func (s *scheduler) tick(now time.Time) []*scheduledJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	start := []*scheduledJob{}
+	for _, job := range s.jobs {
+		if !job.next.IsZero() && !now.Before(job.next) {
+			due := job.next
+			job.next = job.schedule.cron.Next(now)
+			if job.running || !job.schedule.allowed(now) {
+				job.missed++
+				reason := "outside its run windows"
+				if job.running {
+					reason = "the previous run is still going"
+				}
+				log.Printf("%smissed the run scheduled for %s; %s", job.prefix(), due.Format(time.RFC3339), reason)
+				if job.schedule.missed == missedCatchUp && job.pending.IsZero() {
+					job.pending = due
+				}
+				continue
+			}
+			job.pending = time.Time{}
+			job.running = true
+			start = append(start, job)
+			continue
+		}
+		if !job.pending.IsZero() && !job.running && job.schedule.allowed(now) {
+			log.Printf("%scatching up the run scheduled for %s", job.prefix(), job.pending.Format(time.RFC3339))
+			job.pending = time.Time{}
+			job.running = true
+			start = append(start, job)
+		}
+	}
+	return start
+}
+
+// wait returns how long until tick should next be called.
+func (s *scheduler) wait(now time.Time) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// checked at least every minute, so waiting catch ups start when a
+	// window opens
+	next := now.Truncate(time.Minute).Add(time.Minute)
+	for _, job := range s.jobs {
+		if !job.next.IsZero() && job.next.Before(next) {
+			next = job.next
+		}
+	}
+	return next.Sub(now)
+}
+
+// poll starts a run of every subscription not already running, as a caught up
+// run, so one outside its run windows waits for a window to open. It returns
+// the number of runs polled and of those already running.
+func (s *scheduler) poll() (polled, running int) {
+	s.mu.Lock()
+	now := time.Now()
+	for _, job := range s.jobs {
+		if job.running {
+			running++
+			continue
+		}
+		if job.pending.IsZero() {
+			job.pending = now
+		}
+		polled++
+	}
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return polled, running
+}
+
+func (j *scheduledJob) prefix() string {
+	if j.sub.name == "" {
+		return ""
+	}
+	return "[" + j.sub.name + "] "
+}
+
+// run starts jobs as they are due until stop is closed, then waits for those
+// running to finish.
+func (s *scheduler) run(ctx context.Context, stop <-chan struct{}) {
+	s.pool = newIngestPool(ctx, stop, s.sdtp, s.opts, true)
+	s.pool.start(ctx)
+	defer s.pool.close()
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	for {
+		now := time.Now()
+		for _, job := range s.tick(now) {
+			until := job.schedule.allowedUntil(now)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := s.start(ctx, stop, job, until)
+				if err != nil {
+					log.Printf("%srun failed: %s", job.prefix(), err)
+				}
+				s.mu.Lock()
+				job.running = false
+				job.lastErr = err
+				s.mu.Unlock()
+				select {
+				case s.wake <- struct{}{}:
+				default:
+				}
+			}()
+		}
+
+		timer := time.NewTimer(s.wait(time.Now()))
+		select {
+		case <-timer.C:
+		case <-s.wake:
+			timer.Stop()
+		case <-stop:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// ingest runs job in the shared pool, stopping it from starting new downloads
+// at until, if set.
+func (s *scheduler) ingest(ctx context.Context, stop <-chan struct{}, job *scheduledJob, until time.Time) error {
+	started := time.Now()
+	runStop := make(chan struct{})
+	run := s.pool.add(ctx, runStop, job.sub)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		var windowEnd <-chan time.Time
+		if !until.IsZero() {
+			timer := time.NewTimer(time.Until(until))
+			defer timer.Stop()
+			windowEnd = timer.C
+		}
+		select {
+		case <-stop:
+		case <-windowEnd:
+			log.Printf("%srun window closed; finishing in-flight transfers", job.prefix())
+		case <-done:
+			return
+		}
+		close(runStop)
+		s.pool.d.stopQueue(run.queue)
+	}()
+	s.pool.d.wait(run.queue)
+	<-run.produced
+	s.pool.d.remove(run.queue)
+
+	err := run.finish(ctx, started)
+	select {
+	case <-runStop:
+		// stopped by the window or shutdown, which the run state records,
+		// rather than failed
+		if err != nil && ctx.Err() == nil {
+			log.Printf("%s%s", job.prefix(), err)
+			return nil
+		}
+	default:
+	}
+	return err
+}
+
+// nextRun returns when job will next start, or the zero time if it never
+// will.
+func (j *scheduledJob) nextRun(now time.Time) time.Time {
+	if !j.pending.IsZero() {
+		return j.schedule.nextAllowed(now)
+	}
+	t := j.next
+	// bounded so a schedule only ever due in blackouts cannot loop forever
+	for range 10000 {
+		if t.IsZero() || j.schedule.allowed(t) {
+			return t
+		}
+		if j.schedule.missed == missedCatchUp {
+			return j.schedule.nextAllowed(t)
+		}
+		t = j.schedule.cron.Next(t)
+	}
+	return time.Time{}
+}
+
+type scheduleStatus struct {
+	StartedAt     time.Time              `json:"started_at"`
+	Subscriptions []subscriptionSchedule `json:"subscriptions"`
+}
+
+type subscriptionSchedule struct {
+	Name      string       `json:"name,omitempty"`
+	Schedule  string       `json:"schedule"`
+	Windows   []string     `json:"windows,omitempty"`
+	Blackouts []string     `json:"blackouts,omitempty"`
+	Missed    string       `json:"missed"`
+	Running   bool         `json:"running"`
+	NextRun   *time.Time   `json:"next_run"`
+	Pending   *time.Time   `json:"pending,omitempty"`
+	MissedRun int          `json:"missed_runs"`
+	LastRun   *ingestState `json:"last_run,omitempty"`
+	LastError string       `json:"last_error,omitempty"`
+}
+
+func (s *scheduler) status(now time.Time) scheduleStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := scheduleStatus{StartedAt: s.started, Subscriptions: []subscriptionSchedule{}}
+	for _, job := range s.jobs {
+		sub := subscriptionSchedule{
+			Name:      job.sub.name,
+			Schedule:  job.schedule.cron.String(),
+			Missed:    job.schedule.missed,
+			Running:   job.running,
+			MissedRun: job.missed,
+		}
+		for _, w := range job.schedule.windows {
+			sub.Windows = append(sub.Windows, w.String())
+		}
+		for _, w := range job.schedule.blackouts {
+			sub.Blackouts = append(sub.Blackouts, w.String())
+		}
+		if next := job.nextRun(now); !next.IsZero() {
+			sub.NextRun = &next
+		}
+		if !job.pending.IsZero() {
+			pending := job.pending
+			sub.Pending = &pending
+		}
+		if job.sub.opts.stateDir != "" {
+			if prev, err := loadIngestState(job.sub.opts.stateDir, job.sub.name); err == nil && prev.Status != "" {
+				sub.LastRun = prev
+			}
+		}
+		if job.lastErr != nil {
+			sub.LastError = job.lastErr.Error()
+		}
+		status.Subscriptions = append(status.Subscriptions, sub)
+	}
+	return status
+}
+
+// ServeHTTP serves the schedule status as JSON.
+func (s *scheduler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.status(time.Now()))
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Debug("failed to write response: %s", err)
+	}
+}
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := metrics.WriteText(w); err != nil {
+		log.Debug("failed to write metrics: %s", err)
+	}
+}
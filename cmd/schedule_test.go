@@ -0,0 +1,297 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/asips/sdtp-client/internal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseWindow(t *testing.T) {
+	at := func(h, m int) time.Time { return time.Date(2026, 1, 1, h, m, 0, 0, time.UTC) }
+
+	w, err := parseWindow("02:00-04:30")
+	require.NoError(t, err)
+	assert.Equal(t, "02:00-04:30", w.String())
+	assert.False(t, w.contains(at(1, 59)))
+	assert.True(t, w.contains(at(2, 0)))
+	assert.True(t, w.contains(at(4, 29)))
+	assert.False(t, w.contains(at(4, 30)))
+
+	// spanning midnight
+	w, err = parseWindow("22:00-02:00")
+	require.NoError(t, err)
+	assert.True(t, w.contains(at(23, 0)))
+	assert.True(t, w.contains(at(1, 0)))
+	assert.False(t, w.contains(at(12, 0)))
+
+	for _, s := range []string{"", "02:00", "2-4", "02:00-25:00", "02:00-02:00"} {
+		_, err := parseWindow(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func Test_runSchedule(t *testing.T) {
+	at := func(h, m int) time.Time { return time.Date(2026, 1, 1, h, m, 0, 0, time.UTC) }
+
+	s, err := newRunSchedule("*/15 * * * *", []string{"01:00-05:00"}, []string{"02:00-04:00"}, missedSkip)
+	require.NoError(t, err)
+	assert.False(t, s.allowed(at(0, 30)))
+	assert.True(t, s.allowed(at(1, 30)))
+	assert.False(t, s.allowed(at(3, 0)))
+	assert.True(t, s.allowed(at(4, 0)))
+	assert.False(t, s.allowed(at(5, 0)))
+
+	assert.Equal(t, at(1, 30), s.nextAllowed(at(1, 30)))
+	assert.Equal(t, at(4, 0), s.nextAllowed(at(2, 10)))
+	assert.Equal(t, at(1, 0).AddDate(0, 0, 1), s.nextAllowed(at(5, 0)))
+	assert.Equal(t, at(2, 0), s.allowedUntil(at(1, 30)))
+	assert.Equal(t, at(5, 0), s.allowedUntil(at(4, 0)))
+
+	always, err := newRunSchedule("@hourly", nil, nil, "")
+	require.NoError(t, err)
+	assert.True(t, always.allowedUntil(at(1, 0)).IsZero())
+
+	never, err := newRunSchedule("@hourly", nil, []string{"00:00-12:00", "12:00-00:00"}, "")
+	require.NoError(t, err)
+	assert.True(t, never.nextAllowed(at(1, 0)).IsZero())
+
+	merged := runSchedule{}.withDefaults(s)
+	assert.Equal(t, s, merged)
+	own, err := newRunSchedule("@daily", nil, nil, missedCatchUp)
+	require.NoError(t, err)
+	merged = own.withDefaults(s)
+	assert.Equal(t, "@daily", merged.cron.String())
+	assert.Equal(t, s.windows, merged.windows)
+	assert.Equal(t, missedCatchUp, merged.missed)
+
+	_, err = newRunSchedule("* * *", nil, nil, "")
+	assert.Error(t, err)
+	_, err = newRunSchedule("", nil, nil, "later")
+	assert.Error(t, err)
+}
+
+func Test_scheduler_tick(t *testing.T) {
+	at := func(h, m int) time.Time { return time.Date(2026, 1, 1, h, m, 0, 0, time.UTC) }
+	names := func(jobs []*scheduledJob) []string {
+		out := []string{}
+		for _, job := range jobs {
+			out = append(out, job.sub.name)
+		}
+		return out
+	}
+
+	catchUp, err := newRunSchedule("0 * * * *", nil, []string{"02:00-04:00"}, missedCatchUp)
+	require.NoError(t, err)
+	skip, err := newRunSchedule("0 * * * *", nil, []string{"02:00-04:00"}, missedSkip)
+	require.NoError(t, err)
+
+	s := newScheduler(nil, ingestOptions{})
+	s.add(subscription{name: "a"}, catchUp, at(0, 30))
+	s.add(subscription{name: "b"}, skip, at(0, 30))
+	a, b := s.jobs[0], s.jobs[1]
+
+	assert.Empty(t, s.tick(at(0, 59)))
+	assert.Equal(t, time.Second, s.wait(at(0, 59).Add(59*time.Second)))
+	assert.Equal(t, []string{"a", "b"}, names(s.tick(at(1, 0))))
+	assert.Equal(t, at(2, 0), a.next)
+
+	// still running when due again
+	assert.Empty(t, s.tick(at(2, 0)))
+	assert.Equal(t, 1, a.missed)
+	assert.Equal(t, at(2, 0), a.pending)
+	assert.True(t, b.pending.IsZero())
+
+	a.running, b.running = false, false
+	// in the blackout the catch up waits, and the next run is missed too
+	assert.Empty(t, s.tick(at(2, 30)))
+	assert.Equal(t, at(4, 0), a.nextRun(at(2, 30)))
+	assert.Equal(t, at(4, 0), b.nextRun(at(2, 30)))
+	assert.Empty(t, s.tick(at(3, 0)))
+	assert.Equal(t, 2, a.missed)
+	assert.Equal(t, 2, b.missed)
+	assert.Equal(t, at(2, 0), a.pending, "the first missed run is caught up")
+
+	assert.Equal(t, []string{"a", "b"}, names(s.tick(at(4, 0))))
+	assert.True(t, a.pending.IsZero())
+
+	// caught up once the previous run finishes
+	assert.Empty(t, s.tick(at(5, 0)))
+	assert.Equal(t, at(5, 0), a.pending)
+	a.running = false
+	assert.Equal(t, []string{"a"}, names(s.tick(at(5, 10))))
+}
+
+func Test_scheduler_addCatchUp(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2026, 1, 1, 10, 30, 0, 0, time.UTC)
+	state := &ingestState{Status: runComplete, StartedAt: now.Add(-3 * time.Hour), FinishedAt: now.Add(-3 * time.Hour)}
+	require.NoError(t, state.save(dir, "a"))
+	require.NoError(t, state.save(dir, "b"))
+
+	catchUp, err := newRunSchedule("0 * * * *", nil, nil, missedCatchUp)
+	require.NoError(t, err)
+	skip, err := newRunSchedule("0 * * * *", nil, nil, missedSkip)
+	require.NoError(t, err)
+
+	s := newScheduler(nil, ingestOptions{})
+	s.add(subscription{name: "a", opts: ingestOptions{stateDir: dir}}, catchUp, now)
+	s.add(subscription{name: "b", opts: ingestOptions{stateDir: dir}}, skip, now)
+	// no previous run
+	s.add(subscription{name: "c", opts: ingestOptions{stateDir: dir}}, catchUp, now)
+
+	assert.Equal(t, time.Date(2026, 1, 1, 8, 0, 0, 0, time.UTC), s.jobs[0].pending)
+	assert.True(t, s.jobs[1].pending.IsZero())
+	assert.True(t, s.jobs[2].pending.IsZero())
+
+	started := s.tick(now)
+	require.Len(t, started, 1)
+	assert.Equal(t, "a", started[0].sub.name)
+}
+
+func Test_scheduler_status(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2026, 1, 1, 10, 30, 0, 0, time.UTC)
+	state := &ingestState{Status: runInterrupted, StartedAt: now.Add(-time.Hour), Summary: "1 downloaded"}
+	require.NoError(t, state.save(dir, "a"))
+
+	sched, err := newRunSchedule("0 * * * *", []string{"06:00-18:00"}, nil, missedSkip)
+	require.NoError(t, err)
+	s := newScheduler(nil, ingestOptions{})
+	s.add(subscription{name: "a", opts: ingestOptions{stateDir: dir}}, sched, now)
+	s.add(subscription{name: "b"}, sched, now)
+
+	status := s.status(now)
+	require.Len(t, status.Subscriptions, 2)
+	a := status.Subscriptions[0]
+	assert.Equal(t, "0 * * * *", a.Schedule)
+	assert.Equal(t, []string{"06:00-18:00"}, a.Windows)
+	require.NotNil(t, a.NextRun)
+	assert.Equal(t, time.Date(2026, 1, 1, 11, 0, 0, 0, time.UTC), *a.NextRun)
+	require.NotNil(t, a.LastRun)
+	assert.Equal(t, runInterrupted, a.LastRun.Status)
+	assert.Nil(t, status.Subscriptions[1].LastRun)
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	got := scheduleStatus{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &got))
+	assert.Len(t, got.Subscriptions, 2)
+}
+
+func Test_scheduler_run(t *testing.T) {
+	sched, err := newRunSchedule("* * * * *", nil, nil, missedSkip)
+	require.NoError(t, err)
+	s := newScheduler(nil, ingestOptions{})
+	// due immediately
+	s.add(subscription{name: "a"}, sched, time.Now().Add(-time.Minute))
+
+	started := make(chan string, 1)
+	s.start = func(ctx context.Context, stop <-chan struct{}, job *scheduledJob, until time.Time) error {
+		started <- job.sub.name
+		<-stop
+		return nil
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		s.run(t.Context(), stop)
+		close(done)
+	}()
+
+	select {
+	case name := <-started:
+		assert.Equal(t, "a", name)
+	case <-time.After(5 * time.Second):
+		t.Fatal("run not started")
+	}
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("scheduler did not stop")
+	}
+	assert.False(t, s.jobs[0].running)
+}
+
+// concurrentSDTP records the most downloads in flight at once.
+type concurrentSDTP struct {
+	*mockSDTP
+	active, peak atomic.Int32
+	downloaded   atomic.Int32
+}
+
+func (s *concurrentSDTP) Download(ctx context.Context, file internal.FileInfo, destDir string) error {
+	n := s.active.Add(1)
+	for peak := s.peak.Load(); n > peak && !s.peak.CompareAndSwap(peak, n); peak = s.peak.Load() {
+	}
+	time.Sleep(5 * time.Millisecond)
+	s.active.Add(-1)
+	s.downloaded.Add(1)
+	return nil
+}
+
+func Test_scheduler_sharedPool(t *testing.T) {
+	sdtp := &concurrentSDTP{mockSDTP: createMockSDTP(t)}
+	for i := range 4 {
+		sdtp.listing = append(sdtp.listing, internal.FileInfo{ID: int64(i), Name: "file.dat", Size: 10})
+	}
+	opts := ingestOptions{concurrency: 2, noAck: true, onExists: existsOverwrite}
+	s := newScheduler(sdtp, opts)
+	stop := make(chan struct{})
+	s.pool = newIngestPool(t.Context(), stop, sdtp, opts, true)
+	s.pool.start(t.Context())
+	defer s.pool.close()
+
+	// overlapping runs of three subscriptions
+	wg := sync.WaitGroup{}
+	for _, name := range []string{"a", "b", "c"} {
+		subOpts := opts
+		subOpts.destDir = t.TempDir()
+		job := &scheduledJob{sub: subscription{name: name, weight: 1, opts: subOpts}}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, s.ingest(t.Context(), stop, job, time.Time{}))
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(12), sdtp.downloaded.Load())
+	assert.LessOrEqual(t, sdtp.peak.Load(), int32(2), "within --concurrency across runs")
+	s.pool.d.mu.Lock()
+	assert.Empty(t, s.pool.d.queues, "finished runs are removed")
+	s.pool.d.mu.Unlock()
+}
+
+func Test_scheduler_windowClosed(t *testing.T) {
+	sdtp := &recordingSDTP{mockSDTP: createMockSDTP(t), block: map[int64]bool{0: true}, started: make(chan int64)}
+	sdtp.listing = []internal.FileInfo{{ID: 0, Name: "a.dat"}, {ID: 1, Name: "b.dat"}}
+	opts := ingestOptions{concurrency: 1, noAck: true, onExists: existsOverwrite}
+	s := newScheduler(sdtp, opts)
+	ctx, cancel := context.WithCancel(t.Context())
+	s.pool = newIngestPool(ctx, nil, sdtp, opts, true)
+	s.pool.start(ctx)
+	defer s.pool.close()
+
+	subOpts := opts
+	subOpts.destDir = t.TempDir()
+	job := &scheduledJob{sub: subscription{name: "a", weight: 1, opts: subOpts}}
+	done := make(chan error)
+	go func() { done <- s.ingest(ctx, nil, job, time.Now().Add(50*time.Millisecond)) }()
+	<-sdtp.started
+	// the window closes while file 0 is in flight, which is then aborted
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	assert.ErrorContains(t, <-done, "ingest aborted")
+	assert.Equal(t, []int64{0}, sdtp.downloaded, "no new downloads once the window closes")
+}
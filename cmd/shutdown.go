@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/asips/sdtp-client/internal/log"
+)
+
+// notifyShutdown starts a two-phase shutdown on interrupt or SIGTERM, see
+// twoPhaseShutdown. The returned drain func starts it as if signalled, e.g.,
+// when asked to through the control API.
+func notifyShutdown(parent context.Context, grace time.Duration) (<-chan struct{}, context.Context, context.CancelFunc, func()) {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	stop, ctx, cancel := twoPhaseShutdown(parent, sigs, grace)
+	drain := func() {
+		select {
+		case sigs <- drainRequest{}:
+		default:
+		}
+	}
+	return stop, ctx, func() {
+		signal.Stop(sigs)
+		cancel()
+	}, drain
+}
+
+// drainRequest is the os.Signal sent to start a shutdown without a signal.
+type drainRequest struct{}
+
+func (drainRequest) String() string { return "drain request" }
+func (drainRequest) Signal()        {}
+
+// twoPhaseShutdown returns a stop channel, closed on the first signal so no
+// new work is started, and a context, cancelled on the second signal or grace
+// after the first, so in-flight work is aborted.
+func twoPhaseShutdown(parent context.Context, sigs <-chan os.Signal, grace time.Duration) (<-chan struct{}, context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	stop := make(chan struct{})
+	go func() {
+		var timeout <-chan time.Time
+		for {
+			select {
+			case sig := <-sigs:
+				select {
+				case <-stop:
+					log.Printf("received %s again; aborting in-flight transfers", sig)
+					cancel()
+					return
+				default:
+				}
+				close(stop)
+				if grace <= 0 {
+					log.Printf("received %s; aborting in-flight transfers", sig)
+					cancel()
+					return
+				}
+				log.Printf("received %s; finishing in-flight transfers for up to %s, signal again to abort", sig, grace)
+				timer := time.NewTimer(grace)
+				defer timer.Stop()
+				timeout = timer.C
+			case <-timeout:
+				log.Printf("grace period expired; aborting in-flight transfers")
+				cancel()
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return stop, ctx, cancel
+}
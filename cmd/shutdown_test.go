@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_twoPhaseShutdown(t *testing.T) {
+	isClosed := func(ch <-chan struct{}) bool {
+		select {
+		case <-ch:
+			return true
+		case <-time.After(100 * time.Millisecond):
+			return false
+		}
+	}
+
+	t.Run("second signal", func(t *testing.T) {
+		sigs := make(chan os.Signal)
+		stop, ctx, cancel := twoPhaseShutdown(t.Context(), sigs, time.Hour)
+		defer cancel()
+
+		sigs <- os.Interrupt
+		assert.True(t, isClosed(stop))
+		assert.False(t, isClosed(ctx.Done()))
+
+		sigs <- os.Interrupt
+		assert.True(t, isClosed(ctx.Done()))
+	})
+
+	t.Run("grace period", func(t *testing.T) {
+		sigs := make(chan os.Signal)
+		stop, ctx, cancel := twoPhaseShutdown(t.Context(), sigs, 50*time.Millisecond)
+		defer cancel()
+
+		assert.False(t, isClosed(stop))
+		sigs <- os.Interrupt
+		assert.True(t, isClosed(stop))
+		assert.True(t, isClosed(ctx.Done()))
+	})
+
+	t.Run("no grace period", func(t *testing.T) {
+		sigs := make(chan os.Signal)
+		stop, ctx, cancel := twoPhaseShutdown(t.Context(), sigs, 0)
+		defer cancel()
+
+		sigs <- os.Interrupt
+		assert.True(t, isClosed(stop))
+		assert.True(t, isClosed(ctx.Done()))
+	})
+}
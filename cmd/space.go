@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"sync"
+
+	"github.com/asips/sdtp-client/internal"
+	"github.com/asips/sdtp-client/internal/log"
+)
+
+// freeSpace returns the bytes available on the filesystem containing a path.
+var freeSpace = defaultFreeSpace
+
+var defaultFreeSpace = internal.FreeSpace
+
+// diskBudget tracks the space needed by in-flight downloads so concurrent
+// workers do not all claim the same free space. Bytes already written by an
+// in-flight download are counted both as used and as reserved, so the check is
+// conservative.
+type diskBudget struct {
+	mu       sync.Mutex
+	dir      string
+	minFree  uint64
+	reserved uint64
+}
+
+func newDiskBudget(dir string, minFree uint64) *diskBudget {
+	return &diskBudget{dir: dir, minFree: minFree}
+}
+
+// reserve claims size bytes for a download, returning false if doing so would
+// leave less than minFree bytes available. The claim must be returned with
+// release once the download is complete.
+//
+// If the free space cannot be determined the reservation is allowed, as there
+// is nothing better to go on.
+func (b *diskBudget) reserve(size int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	free, err := freeSpace(b.dir)
+	if err != nil {
+		log.Debug("failed to get free space for %s, skipping check; %s", b.dir, err)
+		b.reserved += uint64(size)
+		return true
+	}
+	need := b.reserved + uint64(size) + b.minFree
+	if free < need {
+		log.Debug("insufficient space in %s: free=%d reserved=%d size=%d min-free=%d", b.dir, free, b.reserved, size, b.minFree)
+		return false
+	}
+	b.reserved += uint64(size)
+	return true
+}
+
+func (b *diskBudget) release(size int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.reserved -= uint64(size)
+}
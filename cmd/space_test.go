@@ -0,0 +1,21 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_diskBudget(t *testing.T) {
+	freeSpace = func(path string) (uint64, error) { return 1000, nil }
+	defer func() { freeSpace = defaultFreeSpace }()
+
+	budget := newDiskBudget("dest/dir", 100)
+
+	assert.True(t, budget.reserve(500))
+	assert.True(t, budget.reserve(400))
+	assert.False(t, budget.reserve(1), "should not go below min-free")
+
+	budget.release(400)
+	assert.True(t, budget.reserve(300))
+}
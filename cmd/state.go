@@ -0,0 +1,150 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/asips/sdtp-client/internal"
+)
+
+// stateFileName is the name of the file in the state directory recording the
+// outcome of the last ingest run.
+const stateFileName = ".sdtp-ingest-state.json"
+
+// stateFile returns the path of the state file in dir for the named
+// subscription, or a plain ingest if name is empty.
+func stateFile(dir, name string) string {
+	if name == "" {
+		return filepath.Join(dir, stateFileName)
+	}
+	return filepath.Join(dir, ".sdtp-ingest-state."+name+".json")
+}
+
+const (
+	runComplete    = "complete"
+	runInterrupted = "interrupted"
+	runAborted     = "aborted"
+)
+
+// unackedFile is a file that was transferred and verified but not acked.
+type unackedFile struct {
+	internal.FileInfo
+	// Path is where the file was written, or empty if it was piped to a
+	// command.
+	Path string `json:"path,omitempty"`
+	// Providers are where the file still has to be acked, with --providers.
+	Providers []internal.FileOrigin `json:"providers,omitempty"`
+}
+
+// ingestState is the outcome of an ingest run, used by the next run to resume.
+type ingestState struct {
+	Status     string    `json:"status"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Summary    string    `json:"summary"`
+	// Unacked files are acked first by the next run, without transferring
+	// them again, provided a written file is still intact.
+	Unacked []unackedFile `json:"unacked,omitempty"`
+	// Aborted are the ids of files whose transfer was aborted. Their partial
+	// files have been removed.
+	Aborted []int64 `json:"aborted,omitempty"`
+}
+
+func loadIngestState(dir, name string) (*ingestState, error) {
+	dat, err := os.ReadFile(stateFile(dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return &ingestState{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	state := &ingestState{}
+	if err := json.Unmarshal(dat, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// save writes the state for the named subscription to dir, replacing any
+// existing state atomically.
+func (s *ingestState) save(dir, name string) error {
+	dat, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, filepath.Base(stateFile(dir, name))+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(dat); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), stateFile(dir, name))
+}
+
+// runState tracks the files an ingest run has left unfinished. Files are kept
+// by internal.FileKey, as with more than one provider the same id may be
+// another provider's file.
+type runState struct {
+	mu      sync.Mutex
+	unacked map[string]unackedFile
+	aborted []int64
+	// resumed are the unacked files from the previous run that have been
+	// queued for ack by this run.
+	resumed map[string]bool
+}
+
+func newRunState() *runState {
+	return &runState{unacked: map[string]unackedFile{}, resumed: map[string]bool{}}
+}
+
+func (s *runState) addUnacked(file unackedFile) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unacked[internal.FileKey(file.FileInfo)] = file
+}
+
+func (s *runState) addAborted(file internal.FileInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.aborted = append(s.aborted, file.ID)
+}
+
+func (s *runState) addResumed(file internal.FileInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.resumed[internal.FileKey(file)] = true
+}
+
+// isResumed returns true if file was left unacked by the previous run and has
+// been queued for ack by this one.
+func (s *runState) isResumed(file internal.FileInfo) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.resumed[internal.FileKey(file)]
+}
+
+func (s *runState) state(status string, started time.Time, summary string) *ingestState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := &ingestState{
+		Status:     status,
+		StartedAt:  started,
+		FinishedAt: time.Now(),
+		Summary:    summary,
+		Aborted:    s.aborted,
+	}
+	for _, file := range s.unacked {
+		state.Unacked = append(state.Unacked, file)
+	}
+	return state
+}
@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/asips/sdtp-client/internal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ingestState(t *testing.T) {
+	dir := t.TempDir()
+
+	state, err := loadIngestState(dir, "")
+	require.NoError(t, err)
+	assert.Equal(t, &ingestState{}, state)
+
+	started := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	want := &ingestState{
+		Status:     runAborted,
+		StartedAt:  started,
+		FinishedAt: started.Add(time.Minute),
+		Summary:    "1 downloaded",
+		Unacked:    []unackedFile{{FileInfo: internal.FileInfo{ID: 1, Name: "a.dat"}, Path: "/data/a.dat"}},
+		Aborted:    []int64{2},
+	}
+	require.NoError(t, want.save(dir, ""))
+
+	got, err := loadIngestState(dir, "")
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+}
+
+// recordingSDTP records downloads and acks. Downloads of ids in block wait for
+// the context to be cancelled.
+type recordingSDTP struct {
+	*mockSDTP
+	block   map[int64]bool
+	started chan int64
+	ackErr  error
+
+	mu         sync.Mutex
+	downloaded []int64
+	acked      []int64
+}
+
+func (s *recordingSDTP) Download(ctx context.Context, file internal.FileInfo, destDir string) error {
+	s.mu.Lock()
+	s.downloaded = append(s.downloaded, file.ID)
+	s.mu.Unlock()
+	if s.block[file.ID] {
+		s.started <- file.ID
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return nil
+}
+
+func (s *recordingSDTP) Ack(ctx context.Context, file internal.FileInfo) error {
+	if s.ackErr != nil {
+		return s.ackErr
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.acked = append(s.acked, file.ID)
+	return nil
+}
+
+func Test_runState_sameID(t *testing.T) {
+	// mirrored providers may list different files with the same id
+	a := internal.FileInfo{ID: 1, Name: "a.dat", Checksum: "md5:aa"}
+	b := internal.FileInfo{ID: 1, Name: "b.dat", Checksum: "md5:bb"}
+	s := newRunState()
+	s.addUnacked(unackedFile{FileInfo: a})
+	s.addUnacked(unackedFile{FileInfo: b})
+	assert.Len(t, s.state(runComplete, time.Now(), "").Unacked, 2)
+
+	s.addResumed(a)
+	assert.True(t, s.isResumed(a))
+	assert.False(t, s.isResumed(b))
+}
+
+func Test_doIngest_shutdown(t *testing.T) {
+	dir := t.TempDir()
+	sdtp := &recordingSDTP{
+		mockSDTP: createMockSDTP(t),
+		block:    map[int64]bool{0: true},
+		started:  make(chan int64),
+	}
+	sdtp.listing = []internal.FileInfo{{ID: 0, Name: "a.dat"}, {ID: 1, Name: "b.dat"}, {ID: 2, Name: "c.dat"}}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	stop := make(chan struct{})
+	go func() {
+		<-sdtp.started
+		close(stop)
+		cancel()
+	}()
+
+	err := doIngest(ctx, stop, sdtp, ingestOptions{destDir: dir, stateDir: dir, concurrency: 1})
+	assert.ErrorContains(t, err, "ingest aborted")
+	assert.Equal(t, []int64{0}, sdtp.downloaded)
+
+	state, err := loadIngestState(dir, "")
+	require.NoError(t, err)
+	assert.Equal(t, runAborted, state.Status)
+	assert.Equal(t, []int64{0}, state.Aborted)
+}
+
+// stopOnAckSDTP closes stop once a file has been acked.
+type stopOnAckSDTP struct {
+	*recordingSDTP
+	stop chan struct{}
+}
+
+func (s *stopOnAckSDTP) Ack(ctx context.Context, file internal.FileInfo) error {
+	err := s.recordingSDTP.Ack(ctx, file)
+	close(s.stop)
+	return err
+}
+
+func Test_doIngest_stopAfterWorkDone(t *testing.T) {
+	dir := t.TempDir()
+	sdtp := &stopOnAckSDTP{recordingSDTP: &recordingSDTP{mockSDTP: createMockSDTP(t)}, stop: make(chan struct{})}
+	sdtp.listing = []internal.FileInfo{{ID: 0, Name: "a.dat"}}
+
+	// stopped only once the single file has been transferred and acked
+	err := doIngest(t.Context(), sdtp.stop, sdtp, ingestOptions{destDir: dir, stateDir: dir, concurrency: 1, pipeCmd: "cat"})
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{0}, sdtp.acked)
+
+	state, err := loadIngestState(dir, "")
+	require.NoError(t, err)
+	assert.Equal(t, runComplete, state.Status)
+}
+
+func Test_doIngest_resume(t *testing.T) {
+	dir := t.TempDir()
+	sdtp := &recordingSDTP{mockSDTP: createMockSDTP(t), ackErr: errors.New("connection reset")}
+	sdtp.listing = []internal.FileInfo{{ID: 0, Name: "a.dat"}}
+
+	// the ack fails so the file is recorded as unacked
+	err := doIngest(t.Context(), nil, sdtp, ingestOptions{destDir: dir, stateDir: dir, concurrency: 1, pipeCmd: "cat"})
+	assert.NoError(t, err)
+	state, err := loadIngestState(dir, "")
+	require.NoError(t, err)
+	assert.Equal(t, runComplete, state.Status)
+	require.Len(t, state.Unacked, 1)
+	assert.Equal(t, int64(0), state.Unacked[0].ID)
+
+	// the next run acks it without transferring it again
+	sdtp.ackErr = nil
+	err = doIngest(t.Context(), nil, sdtp, ingestOptions{destDir: dir, stateDir: dir, concurrency: 1, pipeCmd: "cat"})
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{0}, sdtp.acked)
+
+	state, err = loadIngestState(dir, "")
+	require.NoError(t, err)
+	assert.Empty(t, state.Unacked)
+}
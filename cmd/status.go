@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/asips/sdtp-client/internal/log"
+)
+
+// serveStatus serves handler, described by name in the log, on addr until ctx
+// is done. It returns once the address is being listened on. See listen for
+// the addresses accepted.
+func serveStatus(ctx context.Context, name, addr string, handler http.Handler) error {
+	l, err := listen(addr)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("%s server failed: %s", name, err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	if l.Addr().Network() == "unix" {
+		log.Printf("serving %s on unix:%s", name, l.Addr())
+	} else {
+		log.Printf("serving %s on http://%s", name, l.Addr())
+	}
+	return nil
+}
+
+// listen listens on addr, either a TCP host:port or unix: followed by the path
+// of a unix socket. The socket is only accessible by the current user, and a
+// socket left behind by a process that no longer listens on it is replaced.
+func listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if st, err := os.Lstat(path); err == nil {
+		if st.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is already in use", path)
+		}
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// validateControlAddr returns an error if addr, as accepted by listen, could be
+// reached from other hosts. The control API is unauthenticated, so it may only
+// listen on a unix socket or a loopback address, e.g., localhost:8090.
+func validateControlAddr(addr string) error {
+	if strings.HasPrefix(addr, "unix:") {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+	return fmt.Errorf("%s is not a loopback address; the control API is unauthenticated, so must listen on localhost, a loopback IP or a unix socket", addr)
+}
+
+// dialContext returns a dialer for an http.Transport that connects to addr, as
+// accepted by listen, whatever the address requested.
+func dialContext(addr string) func(ctx context.Context, network, _ string) (net.Conn, error) {
+	d := &net.Dialer{}
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		return func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return d.DialContext(ctx, "unix", path)
+		}
+	}
+	return func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return d.DialContext(ctx, network, addr)
+	}
+}
@@ -0,0 +1,205 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/asips/sdtp-client/internal"
+)
+
+// subscription is a named set of files ingested with its own settings.
+type subscription struct {
+	name string
+	// weight is the subscription's share of the workers relative to the other
+	// subscriptions, see dispatcher.
+	weight int
+	opts   ingestOptions
+	// schedule is when the schedule command runs the subscription.
+	schedule runSchedule
+}
+
+// subscriptionConfig is a subscription in a subscriptions file. Settings that
+// are not set default to the ingest command line flags.
+type subscriptionConfig struct {
+	Name         string            `json:"name"`
+	Tags         map[string]string `json:"tags"`
+	DestDir      string            `json:"dest_dir"`
+	DestTemplate string            `json:"dest_template"`
+	Weight       int               `json:"weight"`
+	NoAck        *bool             `json:"no_ack"`
+	OnExists     string            `json:"on_exists"`
+	Order        string            `json:"order"`
+	Pipe         string            `json:"pipe"`
+	Hook         string            `json:"hook"`
+	Filter       string            `json:"filter"`
+	Include      []string          `json:"include"`
+	Exclude      []string          `json:"exclude"`
+	MaxBytes     string            `json:"max_bytes_per_run"`
+	Schedule     string            `json:"schedule"`
+	Windows      []string          `json:"windows"`
+	Blackouts    []string          `json:"blackouts"`
+	Missed       string            `json:"missed"`
+}
+
+type subscriptionsFile struct {
+	Subscriptions []subscriptionConfig `json:"subscriptions"`
+}
+
+var subscriptionNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// loadSubscriptions reads the subscriptions in the JSON file at p, applying
+// each one's settings on top of defaults.
+func loadSubscriptions(p string, defaults ingestOptions) ([]subscription, error) {
+	dat, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	var file subscriptionsFile
+	dec := json.NewDecoder(bytes.NewReader(dat))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&file); err != nil {
+		return nil, fmt.Errorf("invalid subscriptions file %s: %w", p, err)
+	}
+	if len(file.Subscriptions) == 0 {
+		return nil, fmt.Errorf("no subscriptions in %s", p)
+	}
+
+	subs := []subscription{}
+	names := map[string]bool{}
+	for _, cfg := range file.Subscriptions {
+		sub, err := cfg.subscription(defaults)
+		if err != nil {
+			return nil, fmt.Errorf("subscription %q: %w", cfg.Name, err)
+		}
+		if names[sub.name] {
+			return nil, fmt.Errorf("duplicate subscription %q", sub.name)
+		}
+		names[sub.name] = true
+		subs = append(subs, sub)
+	}
+	return subs, nil
+}
+
+func (cfg subscriptionConfig) subscription(defaults ingestOptions) (subscription, error) {
+	if !subscriptionNameRegexp.MatchString(cfg.Name) {
+		return subscription{}, fmt.Errorf("name must be letters, digits, '_', '.' or '-'")
+	}
+	if cfg.Weight < 0 {
+		return subscription{}, fmt.Errorf("weight must not be negative")
+	}
+	sub := subscription{name: cfg.Name, weight: max(cfg.Weight, 1), opts: defaults}
+	opts := &sub.opts
+
+	// tags from the command line apply to every subscription
+	opts.tags = maps.Clone(defaults.tags)
+	if opts.tags == nil {
+		opts.tags = map[string]string{}
+	}
+	maps.Copy(opts.tags, cfg.Tags)
+
+	if cfg.DestDir != "" {
+		opts.destDir = cfg.DestDir
+	}
+	if cfg.DestTemplate != "" {
+		tmpl, err := parseDestTemplate(cfg.DestTemplate)
+		if err != nil {
+			return subscription{}, err
+		}
+		opts.destTemplate = tmpl
+	}
+	if cfg.NoAck != nil {
+		opts.noAck = *cfg.NoAck
+	}
+	if cfg.OnExists != "" {
+		policy, err := parseExistsPolicy(cfg.OnExists)
+		if err != nil {
+			return subscription{}, err
+		}
+		opts.onExists = policy
+	}
+	if cfg.Order != "" {
+		if err := validateOrder(cfg.Order); err != nil {
+			return subscription{}, err
+		}
+		opts.order = cfg.Order
+	}
+	if cfg.Pipe != "" {
+		opts.pipeCmd = cfg.Pipe
+	}
+	if cfg.Hook != "" {
+		opts.hook = cfg.Hook
+	}
+	if cfg.Filter != "" || len(cfg.Include)+len(cfg.Exclude) > 0 {
+		filter, err := newFileFilter(cfg.Filter, cfg.Include, cfg.Exclude, nil, nil)
+		if err != nil {
+			return subscription{}, err
+		}
+		opts.filter = filter
+	}
+	if cfg.MaxBytes != "" {
+		size, err := internal.ParseSize(cfg.MaxBytes)
+		if err != nil {
+			return subscription{}, fmt.Errorf("invalid max_bytes_per_run: %w", err)
+		}
+		opts.maxBytesPerRun = size
+	}
+	schedule, err := newRunSchedule(cfg.Schedule, cfg.Windows, cfg.Blackouts, cfg.Missed)
+	if err != nil {
+		return subscription{}, err
+	}
+	sub.schedule = schedule
+	return sub, nil
+}
+
+// destTemplateData is what a destination template is rendered with.
+type destTemplateData struct {
+	internal.FileInfo
+	Subscription string
+}
+
+func parseDestTemplate(s string) (*template.Template, error) {
+	tmpl, err := template.New("dest").Option("missingkey=error").Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid destination template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// renderDestTemplate renders the directory, relative to the destination
+// directory, file is written to, e.g., {{.Tags.mission}}/{{.Tags.stream}}.
+func renderDestTemplate(tmpl *template.Template, subscription string, file internal.FileInfo) (string, error) {
+	buf := &strings.Builder{}
+	if err := tmpl.Execute(buf, destTemplateData{FileInfo: file, Subscription: subscription}); err != nil {
+		return "", fmt.Errorf("failed to render destination template: %w", err)
+	}
+	dir := filepath.Clean(filepath.FromSlash(buf.String()))
+	if !filepath.IsLocal(dir) {
+		return "", fmt.Errorf("destination template rendered %q, which is not below the destination directory", buf.String())
+	}
+	return dir, nil
+}
+
+var errHookFailed = fmt.Errorf("hook failed")
+
+// runHook runs the shell command hook for file, transferred to p, or piped if
+// p is empty. The SDTP_FILE_* environment variables are set as for --pipe,
+// along with SDTP_FILE_PATH and SDTP_SUBSCRIPTION.
+func runHook(ctx context.Context, hook, subscription string, file internal.FileInfo, p string) error {
+	cmd := pipeCommand(ctx, hook, file)
+	cmd.Env = append(cmd.Env,
+		"SDTP_FILE_PATH="+p,
+		"SDTP_SUBSCRIPTION="+subscription,
+	)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%w: %w", errHookFailed, err)
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/asips/sdtp-client/internal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_loadSubscriptions(t *testing.T) {
+	dir := t.TempDir()
+	write := func(content string) string {
+		p := filepath.Join(dir, "subs.json")
+		require.NoError(t, os.WriteFile(p, []byte(content), 0644))
+		return p
+	}
+	defaults := ingestOptions{
+		destDir:  "/data",
+		tags:     map[string]string{"mission": "goes"},
+		onExists: existsOverwrite,
+	}
+
+	subs, err := loadSubscriptions(write(`{"subscriptions": [
+		{"name": "east", "tags": {"stream": "east"}, "dest_dir": "/data/east", "weight": 3, "no_ack": true},
+		{"name": "west", "tags": {"stream": "west", "mission": "other"}, "on_exists": "skip", "dest_template": "{{.Tags.stream}}"}
+	]}`), defaults)
+	require.NoError(t, err)
+	require.Len(t, subs, 2)
+
+	assert.Equal(t, "east", subs[0].name)
+	assert.Equal(t, 3, subs[0].weight)
+	assert.Equal(t, map[string]string{"mission": "goes", "stream": "east"}, subs[0].opts.tags)
+	assert.Equal(t, "/data/east", subs[0].opts.destDir)
+	assert.True(t, subs[0].opts.noAck)
+	assert.Equal(t, existsOverwrite, subs[0].opts.onExists)
+
+	assert.Equal(t, 1, subs[1].weight)
+	assert.Equal(t, map[string]string{"mission": "other", "stream": "west"}, subs[1].opts.tags)
+	assert.Equal(t, "/data", subs[1].opts.destDir)
+	assert.False(t, subs[1].opts.noAck)
+	assert.Equal(t, existsSkip, subs[1].opts.onExists)
+	assert.NotNil(t, subs[1].opts.destTemplate)
+	assert.Equal(t, map[string]string{"mission": "goes"}, defaults.tags, "defaults are not modified")
+
+	for _, content := range []string{
+		`{"subscriptions": []}`,
+		`{"subscriptions": [{"name": "a/b"}]}`,
+		`{"subscriptions": [{"name": "a"}, {"name": "a"}]}`,
+		`{"subscriptions": [{"name": "a", "on_exists": "maybe"}]}`,
+		`{"subscriptions": [{"name": "a", "unknown": 1}]}`,
+		`{"subscriptions": [{"name": "a", "dest_template": "{{.Tags"}]}`,
+	} {
+		_, err := loadSubscriptions(write(content), defaults)
+		assert.Error(t, err, content)
+	}
+}
+
+func Test_renderDestTemplate(t *testing.T) {
+	file := internal.FileInfo{ID: 1, Name: "a.dat", Tags: map[string]string{"mission": "goes", "stream": "east"}}
+	render := func(s string) (string, error) {
+		tmpl, err := parseDestTemplate(s)
+		require.NoError(t, err)
+		return renderDestTemplate(tmpl, "sub", file)
+	}
+
+	got, err := render("{{.Subscription}}/{{.Tags.mission}}/{{.Tags.stream}}")
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join("sub", "goes", "east"), got)
+
+	_, err = render("{{.Tags.missing}}")
+	assert.Error(t, err)
+	_, err = render("../{{.Tags.mission}}")
+	assert.Error(t, err)
+	_, err = render("/abs")
+	assert.Error(t, err)
+}
+
+func Test_runHook(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a POSIX shell")
+	}
+	file := internal.FileInfo{ID: 7, Name: "a.dat"}
+	assert.NoError(t, runHook(t.Context(), `test "$SDTP_FILE_PATH" = /data/a.dat -a "$SDTP_SUBSCRIPTION" = sub -a "$SDTP_FILE_ID" = 7`, "sub", file, "/data/a.dat"))
+
+	err := runHook(t.Context(), "exit 1", "sub", file, "/data/a.dat")
+	assert.ErrorIs(t, err, errHookFailed)
+	assert.Equal(t, "hook", errorClass(err))
+}
+
+// taggedSDTP lists only the files with the requested tags.
+type taggedSDTP struct {
+	*recordingSDTP
+}
+
+func (s *taggedSDTP) List(ctx context.Context, tags map[string]string) ([]internal.FileInfo, error) {
+	var files []internal.FileInfo
+	for _, file := range s.listing {
+		match := true
+		for k, v := range tags {
+			if file.Tags[k] != v {
+				match = false
+			}
+		}
+		if match {
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+func Test_doIngestSubscriptions(t *testing.T) {
+	dir := t.TempDir()
+	sdtp := &taggedSDTP{&recordingSDTP{mockSDTP: createMockSDTP(t)}}
+	sdtp.listing = []internal.FileInfo{
+		{ID: 1, Name: "e1.dat", Tags: map[string]string{"stream": "east"}},
+		{ID: 2, Name: "w1.dat", Tags: map[string]string{"stream": "west"}},
+		{ID: 3, Name: "e2.dat", Tags: map[string]string{"stream": "east"}},
+	}
+	opts := ingestOptions{destDir: dir, stateDir: dir, concurrency: 2, onExists: existsOverwrite}
+	east, west := opts, opts
+	east.tags = map[string]string{"stream": "east"}
+	west.tags = map[string]string{"stream": "west"}
+	west.noAck = true
+
+	err := doIngestSubscriptions(t.Context(), nil, sdtp, opts, []subscription{
+		{name: "east", weight: 1, opts: east},
+		{name: "west", weight: 1, opts: west},
+	})
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []int64{1, 2, 3}, sdtp.downloaded)
+	assert.ElementsMatch(t, []int64{1, 3}, sdtp.acked, "west does not ack")
+
+	for _, name := range []string{"east", "west"} {
+		state, err := loadIngestState(dir, name)
+		require.NoError(t, err)
+		assert.Equal(t, runComplete, state.Status, name)
+	}
+}
+
+func Test_loadSubscriptions_schedule(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "subs.json")
+	require.NoError(t, os.WriteFile(p, []byte(`{"subscriptions": [
+		{"name": "a", "schedule": "*/10 * * * *", "blackouts": ["02:00-04:00"], "missed": "skip"},
+		{"name": "b"}
+	]}`), 0644))
+	subs, err := loadSubscriptions(p, ingestOptions{})
+	require.NoError(t, err)
+	require.Len(t, subs, 2)
+	assert.Equal(t, "*/10 * * * *", subs[0].schedule.cron.String())
+	assert.Equal(t, []timeWindow{{120, 240}}, subs[0].schedule.blackouts)
+	assert.Equal(t, missedSkip, subs[0].schedule.missed)
+	assert.Nil(t, subs[1].schedule.cron)
+
+	require.NoError(t, os.WriteFile(p, []byte(`{"subscriptions": [{"name": "a", "schedule": "every hour"}]}`), 0644))
+	_, err = loadSubscriptions(p, ingestOptions{})
+	assert.ErrorContains(t, err, "invalid cron expression")
+}
@@ -0,0 +1,222 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/asips/sdtp-client/internal"
+	"github.com/asips/sdtp-client/internal/log"
+	"github.com/spf13/cobra"
+)
+
+var summaryCmd = &cobra.Command{
+	Use:   "summary",
+	Short: "Summarize the files waiting on the server, grouped by tag",
+	Long: `Summarize the files waiting on the server, grouped by tag.
+
+For each group the number of files, total size, oldest and newest file (by file id)
+and the soonest expiry are printed. No files are downloaded or acknowledged.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := cmd.Flags()
+		certPath, err := flags.GetString("cert")
+		cobra.CheckErr(err)
+		keyPath, err := flags.GetString("key")
+		cobra.CheckErr(err)
+		checkCertDays, err := flags.GetInt("check-cert-days")
+		cobra.CheckErr(err)
+
+		mustValidateCert(certPath, keyPath, checkCertDays)
+
+		sdtp := newClientFromFlags(flags, certPath, keyPath, clientOptionsFromFlags(flags))
+
+		tags, err := flags.GetStringToString("tag")
+		cobra.CheckErr(err)
+		filter, err := filterFromFlags(flags)
+		if err != nil {
+			log.Fatal("%s", err)
+		}
+		groupBy, err := flags.GetStringSlice("group-by")
+		cobra.CheckErr(err)
+		format, err := flags.GetString("output")
+		cobra.CheckErr(err)
+		if format != "table" && format != "json" {
+			log.Fatal("invalid --output %q; must be table or json", format)
+		}
+		watch, err := flags.GetDuration("watch")
+		cobra.CheckErr(err)
+
+		ctx, cancel := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+
+		opts := summaryOptions{tags: tags, filter: filter, groupBy: groupBy, format: format}
+		if watch <= 0 {
+			if err := doSummary(ctx, sdtp, os.Stdout, opts); err != nil {
+				log.Fatal("Failed to summarize files: %s", err)
+			}
+			return nil
+		}
+
+		certReloadInterval, err := flags.GetDuration("cert-reload-interval")
+		cobra.CheckErr(err)
+		watchCertificate(ctx, sdtp, certReloadInterval)
+
+		clearScreen := isTerminal(os.Stdout) && format == "table"
+		ticker := time.NewTicker(watch)
+		defer ticker.Stop()
+		for {
+			if clearScreen {
+				fmt.Fprint(os.Stdout, "\033[H\033[2J")
+			}
+			if err := doSummary(ctx, sdtp, os.Stdout, opts); err != nil {
+				log.Printf("Failed to summarize files: %s", err)
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	},
+}
+
+func init() {
+	flags := summaryCmd.Flags()
+
+	flags.StringToStringP("tag", "t", map[string]string{}, "<key>=<value> tags to filter by. May be specified multiple times or as a comma-separated list")
+	addFilterFlags(flags)
+	addProviderFlags(flags)
+	flags.StringSlice("group-by", []string{"stream"}, "Tags to group files by, e.g., stream,ShortName")
+	flags.StringP("output", "o", "table", "Output format: table or json")
+	flags.Duration("watch", 0, "Refresh the summary on this interval, e.g., 1m, until interrupted")
+}
+
+type summaryOptions struct {
+	tags    map[string]string
+	filter  *fileFilter
+	groupBy []string
+	format  string
+}
+
+// backlogGroup is the summary of the listed files with the same group-by tag
+// values.
+type backlogGroup struct {
+	Group         map[string]string  `json:"group"`
+	Count         int                `json:"count"`
+	Bytes         int64              `json:"bytes"`
+	Oldest        *internal.FileInfo `json:"oldest"`
+	Newest        *internal.FileInfo `json:"newest"`
+	SoonestExpiry string             `json:"soonest_expiry,omitempty"`
+
+	soonest time.Time
+}
+
+func doSummary(ctx context.Context, sdtp internal.FileListor, w io.Writer, opts summaryOptions) error {
+	files, err := sdtp.List(ctx, opts.tags)
+	if err != nil {
+		return fmt.Errorf("failed to list files: %w", err)
+	}
+	groups := summarize(opts.filter.apply(files), opts.groupBy)
+
+	if opts.format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(groups)
+	}
+	return writeSummaryTable(w, groups, opts.groupBy)
+}
+
+// summarize aggregates files by the values of the groupBy tags. Groups are
+// sorted by their tag values.
+func summarize(files []internal.FileInfo, groupBy []string) []*backlogGroup {
+	byKey := map[string]*backlogGroup{}
+	for _, file := range files {
+		values := make([]string, len(groupBy))
+		for i, tag := range groupBy {
+			values[i] = file.Tags[tag]
+		}
+		key := strings.Join(values, "\x00")
+
+		group, ok := byKey[key]
+		if !ok {
+			group = &backlogGroup{Group: map[string]string{}}
+			for i, tag := range groupBy {
+				group.Group[tag] = values[i]
+			}
+			byKey[key] = group
+		}
+
+		group.Count++
+		group.Bytes += file.Size
+		if group.Oldest == nil || file.ID < group.Oldest.ID {
+			group.Oldest = &file
+		}
+		if group.Newest == nil || file.ID > group.Newest.ID {
+			group.Newest = &file
+		}
+		if expires, err := file.ExpiresAt(); err == nil && (group.soonest.IsZero() || expires.Before(group.soonest)) {
+			group.soonest = expires
+			group.SoonestExpiry = file.Expires
+		}
+	}
+
+	keys := make([]string, 0, len(byKey))
+	for key := range byKey {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	groups := make([]*backlogGroup, 0, len(keys))
+	for _, key := range keys {
+		groups = append(groups, byKey[key])
+	}
+	return groups
+}
+
+func writeSummaryTable(w io.Writer, groups []*backlogGroup, groupBy []string) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	header := append(slices.Clone(groupBy), "FILES", "SIZE", "OLDEST", "NEWEST", "SOONEST EXPIRY")
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+
+	var totalCount int
+	var totalBytes int64
+	for _, group := range groups {
+		row := []string{}
+		for _, tag := range groupBy {
+			row = append(row, valueOr(group.Group[tag], "-"))
+		}
+		row = append(row,
+			fmt.Sprint(group.Count),
+			humanSize(group.Bytes),
+			fmt.Sprintf("%d(%s)", group.Oldest.ID, group.Oldest.Name),
+			fmt.Sprintf("%d(%s)", group.Newest.ID, group.Newest.Name),
+			valueOr(group.SoonestExpiry, "-"),
+		)
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+		totalCount += group.Count
+		totalBytes += group.Bytes
+	}
+
+	total := make([]string, len(groupBy))
+	if len(total) > 0 {
+		total[0] = "TOTAL"
+	}
+	total = append(total, fmt.Sprint(totalCount), humanSize(totalBytes))
+	fmt.Fprintln(tw, strings.Join(total, "\t"))
+	return tw.Flush()
+}
+
+func valueOr(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
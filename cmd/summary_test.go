@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/asips/sdtp-client/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_doSummary(t *testing.T) {
+	sdtp := createMockSDTP(t)
+	sdtp.listing = []internal.FileInfo{
+		{ID: 3, Name: "a3", Size: 1024, Expires: "2026-01-03T00:00:00Z", Tags: map[string]string{"stream": "a", "ShortName": "X"}},
+		{ID: 1, Name: "a1", Size: 1024, Expires: "2026-01-02T00:00:00Z", Tags: map[string]string{"stream": "a", "ShortName": "X"}},
+		{ID: 2, Name: "b2", Size: 2048, Expires: "2026-01-05T00:00:00Z", Tags: map[string]string{"stream": "b", "ShortName": "X"}},
+		{ID: 4, Name: "c4", Size: 10, Tags: map[string]string{}},
+	}
+
+	t.Run("json", func(t *testing.T) {
+		buf := &strings.Builder{}
+		err := doSummary(t.Context(), sdtp, buf, summaryOptions{groupBy: []string{"stream", "ShortName"}, format: "json"})
+		assert.NoError(t, err)
+
+		var groups []backlogGroup
+		assert.NoError(t, json.Unmarshal([]byte(buf.String()), &groups))
+		if assert.Len(t, groups, 3) {
+			assert.Equal(t, map[string]string{"stream": "", "ShortName": ""}, groups[0].Group)
+			assert.Equal(t, "", groups[0].SoonestExpiry)
+
+			assert.Equal(t, map[string]string{"stream": "a", "ShortName": "X"}, groups[1].Group)
+			assert.Equal(t, 2, groups[1].Count)
+			assert.Equal(t, int64(2048), groups[1].Bytes)
+			assert.Equal(t, int64(1), groups[1].Oldest.ID)
+			assert.Equal(t, int64(3), groups[1].Newest.ID)
+			assert.Equal(t, "2026-01-02T00:00:00Z", groups[1].SoonestExpiry)
+		}
+	})
+
+	t.Run("table", func(t *testing.T) {
+		buf := &strings.Builder{}
+		err := doSummary(t.Context(), sdtp, buf, summaryOptions{groupBy: []string{"stream"}, format: "table"})
+		assert.NoError(t, err)
+		assert.Equal(t, `stream  FILES  SIZE     OLDEST  NEWEST  SOONEST EXPIRY
+-       1      10 B     4(c4)   4(c4)   -
+a       2      2.0 KiB  1(a1)   3(a3)   2026-01-02T00:00:00Z
+b       1      2.0 KiB  2(b2)   2(b2)   2026-01-05T00:00:00Z
+TOTAL   4      4.0 KiB
+`, buf.String())
+	})
+}
@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/asips/sdtp-client/internal"
+	"github.com/asips/sdtp-client/internal/log"
+	"github.com/asips/sdtp-client/internal/trace"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// commandSpan is the span covering the whole command, the parent of all other
+// spans, if tracing is enabled.
+var commandSpan *trace.Span
+
+// removeTracingExitHook unregisters the hook that stops tracing if the command
+// exits early, e.g., through log.Fatal.
+var removeTracingExitHook = func() {}
+
+// otlpEndpointFromEnv returns the OTLP traces endpoint from the standard
+// OpenTelemetry environment variables, if set.
+func otlpEndpointFromEnv() string {
+	if endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"); endpoint != "" {
+		return endpoint
+	}
+	if endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); endpoint != "" {
+		return strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+	}
+	return ""
+}
+
+func newTraceExporter(endpoint, file string) (trace.Exporter, error) {
+	switch {
+	case endpoint != "" && file != "":
+		return nil, fmt.Errorf("--trace-endpoint and --trace-file are mutually exclusive")
+	case file != "":
+		return trace.NewFileExporter(file)
+	case endpoint != "":
+		return trace.NewOTLPExporter(endpoint), nil
+	}
+	return nil, nil
+}
+
+// startTracing enables tracing if configured, starting the span for cmd. The
+// span is a child of the TRACEPARENT environment variable, if set, so a run
+// can be part of a wider trace, e.g., from a scheduler.
+func startTracing(cmd *cobra.Command, flags *pflag.FlagSet) error {
+	endpoint, err := flags.GetString("trace-endpoint")
+	cobra.CheckErr(err)
+	if !flags.Changed("trace-endpoint") {
+		endpoint = otlpEndpointFromEnv()
+	}
+	file, err := flags.GetString("trace-file")
+	cobra.CheckErr(err)
+
+	exp, err := newTraceExporter(endpoint, file)
+	if err != nil || exp == nil {
+		return err
+	}
+
+	service := os.Getenv("OTEL_SERVICE_NAME")
+	if service == "" {
+		service = "sdtp-client"
+	}
+	trace.Init(exp,
+		trace.String("service.name", service),
+		trace.String("service.version", internal.Version),
+	)
+
+	ctx := cmd.Context()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if tp := os.Getenv("TRACEPARENT"); tp != "" {
+		if parent, err := trace.ParseTraceParent(tp); err != nil {
+			log.Printf("ignoring TRACEPARENT: %s", err)
+		} else {
+			ctx = trace.ContextWithRemoteParent(ctx, parent)
+		}
+	}
+	ctx, commandSpan = trace.Start(ctx, cmd.CommandPath(), trace.KindInternal, trace.String("sdtp.command", cmd.Name()))
+	cmd.SetContext(ctx)
+	removeTracingExitHook = log.AtExit(stopTracing)
+	return nil
+}
+
+// stopTracing ends the command span, recording err, and exports any
+// remaining spans. It is also called before exiting through log.Fatal or
+// log.Exit, so spans are not lost when a command exits early.
+func stopTracing(err error) {
+	if commandSpan == nil {
+		return
+	}
+	removeTracingExitHook()
+	removeTracingExitHook = func() {}
+	commandSpan.RecordError(err)
+	commandSpan.End()
+	commandSpan = nil
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := trace.Shutdown(ctx); err != nil {
+		log.Printf("failed to export traces: %s", err)
+	}
+}
@@ -0,0 +1,307 @@
+package cmd
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/asips/sdtp-client/internal"
+)
+
+// maxRecentFailures is how many failed files a transferTracker remembers.
+const maxRecentFailures = 100
+
+// transferTracker records the transfers in flight, the files that recently
+// failed and the overall progress, and limits the bandwidth transfers use. A
+// nil *transferTracker does nothing.
+type transferTracker struct {
+	bandwidth *bandwidthLimiter
+	// received is the number of bytes received by all transfers.
+	received atomic.Int64
+
+	mu       sync.Mutex
+	active   []*transfer
+	failures []*failedFile
+	// the number, and total size, of the files queued and of those processed,
+	// whatever the outcome
+	files, doneFiles int
+	bytes, doneBytes int64
+}
+
+// transfer is a file being downloaded or streamed.
+type transfer struct {
+	// subscription is the name of the subscription the file belongs to, if
+	// any.
+	subscription string
+	file         internal.FileInfo
+	started      time.Time
+	bytes        atomic.Int64
+}
+
+// failedFile is a file whose transfer failed.
+type failedFile struct {
+	run   *ingestRun
+	file  internal.FileInfo
+	err   error
+	class string
+	at    time.Time
+}
+
+func newTransferTracker(bandwidth uint64) *transferTracker {
+	return &transferTracker{bandwidth: newBandwidthLimiter(bandwidth)}
+}
+
+// start records the transfer of file for subscription, returning the context
+// to transfer it with. It must be ended with finish.
+func (t *transferTracker) start(ctx context.Context, subscription string, file internal.FileInfo) (context.Context, *transfer) {
+	if t == nil {
+		return ctx, nil
+	}
+	tr := &transfer{subscription: subscription, file: file, started: time.Now()}
+	t.mu.Lock()
+	t.active = append(t.active, tr)
+	t.mu.Unlock()
+	return internal.WithProgress(ctx, func(n int) {
+		tr.bytes.Add(int64(n))
+		t.received.Add(int64(n))
+		t.bandwidth.wait(ctx, n)
+	}), tr
+}
+
+// finish removes tr from the transfers in flight.
+func (t *transferTracker) finish(tr *transfer) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.active = slices.DeleteFunc(t.active, func(other *transfer) bool { return other == tr })
+}
+
+// queued counts file as waiting to be processed.
+func (t *transferTracker) queued(file internal.FileInfo) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.files++
+	t.bytes += file.Size
+}
+
+// processed counts a queued file as done with, whatever the outcome.
+func (t *transferTracker) processed(file internal.FileInfo) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.doneFiles++
+	t.doneBytes += file.Size
+}
+
+// requeued counts a processed file, queued again to be retried, as not done
+// with, so it is not counted twice.
+func (t *transferTracker) requeued(file internal.FileInfo) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.doneFiles--
+	t.doneBytes -= file.Size
+}
+
+// fail records that file, transferred by run, failed with err, forgetting
+// the oldest failure once there are maxRecentFailures.
+func (t *transferTracker) fail(run *ingestRun, file internal.FileInfo, err error) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.failures = slices.DeleteFunc(t.failures, func(f *failedFile) bool { return f.file.ID == file.ID })
+	t.failures = append(t.failures, &failedFile{run: run, file: file, err: err, class: errorClass(err), at: time.Now()})
+	if len(t.failures) > maxRecentFailures {
+		t.failures = t.failures[len(t.failures)-maxRecentFailures:]
+	}
+}
+
+// takeFailures removes and returns the recent failures of the files with ids,
+// or all of them if ids is empty.
+func (t *transferTracker) takeFailures(ids []int64) []*failedFile {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	taken := []*failedFile{}
+	t.failures = slices.DeleteFunc(t.failures, func(f *failedFile) bool {
+		if len(ids) == 0 || slices.Contains(ids, f.file.ID) {
+			taken = append(taken, f)
+			return true
+		}
+		return false
+	})
+	return taken
+}
+
+// restoreFailures puts back failures taken with takeFailures that could not be
+// retried.
+func (t *transferTracker) restoreFailures(failures []*failedFile) {
+	if t == nil || len(failures) == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.failures = append(failures, t.failures...)
+	slices.SortStableFunc(t.failures, func(a, b *failedFile) int { return a.at.Compare(b.at) })
+}
+
+type transferStatus struct {
+	Subscription string    `json:"subscription,omitempty"`
+	ID           int64     `json:"fileid"`
+	Name         string    `json:"name"`
+	Size         int64     `json:"size"`
+	Bytes        int64     `json:"bytes"`
+	Percent      float64   `json:"percent"`
+	Rate         float64   `json:"rate"`
+	StartedAt    time.Time `json:"started_at"`
+}
+
+type failureStatus struct {
+	Subscription string    `json:"subscription,omitempty"`
+	ID           int64     `json:"fileid"`
+	Name         string    `json:"name"`
+	Class        string    `json:"class"`
+	Error        string    `json:"error"`
+	FailedAt     time.Time `json:"failed_at"`
+}
+
+// inFlight returns the transfers in flight, oldest first, with their progress
+// and average rate in bytes per second at now.
+func (t *transferTracker) inFlight(now time.Time) []transferStatus {
+	statuses := []transferStatus{}
+	if t == nil {
+		return statuses
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, tr := range t.active {
+		status := transferStatus{
+			Subscription: tr.subscription,
+			ID:           tr.file.ID,
+			Name:         tr.file.Name,
+			Size:         tr.file.Size,
+			Bytes:        tr.bytes.Load(),
+			StartedAt:    tr.started,
+		}
+		if status.Size > 0 {
+			status.Percent = min(100, 100*float64(status.Bytes)/float64(status.Size))
+		}
+		if elapsed := now.Sub(tr.started).Seconds(); elapsed > 0 {
+			status.Rate = float64(status.Bytes) / elapsed
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// recentFailures returns the recent failures, oldest first.
+func (t *transferTracker) recentFailures() []failureStatus {
+	statuses := []failureStatus{}
+	if t == nil {
+		return statuses
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, f := range t.failures {
+		statuses = append(statuses, failureStatus{
+			Subscription: f.run.name,
+			ID:           f.file.ID,
+			Name:         f.file.Name,
+			Class:        f.class,
+			Error:        f.err.Error(),
+			FailedAt:     f.at,
+		})
+	}
+	return statuses
+}
+
+// bandwidthLimiter is a token bucket limiting the total rate files are
+// received at, in bytes per second, allowing bursts of up to a second. The
+// rate may be changed while transfers are running. A nil *bandwidthLimiter
+// does not limit.
+type bandwidthLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+	// now is replaced in tests.
+	now func() time.Time
+}
+
+// newBandwidthLimiter returns a limiter for rate bytes per second, zero
+// meaning no limit.
+func newBandwidthLimiter(rate uint64) *bandwidthLimiter {
+	l := &bandwidthLimiter{now: time.Now}
+	l.setRate(rate)
+	return l
+}
+
+// setRate changes the limit to rate bytes per second, zero meaning no limit.
+func (l *bandwidthLimiter) setRate(rate uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = float64(rate)
+	// the debt built up at the old rate is forgiven
+	l.tokens = 0
+	l.last = l.now()
+}
+
+func (l *bandwidthLimiter) getRate() uint64 {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return uint64(l.rate)
+}
+
+// reserve takes n bytes from the bucket, returning how long the caller must
+// wait before receiving more.
+func (l *bandwidthLimiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return 0
+	}
+	now := l.now()
+	l.tokens = min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// wait takes n bytes from the bucket, sleeping until the rate allows more to
+// be received or ctx is done.
+func (l *bandwidthLimiter) wait(ctx context.Context, n int) {
+	if l == nil {
+		return
+	}
+	d := l.reserve(n)
+	if d <= 0 {
+		return
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/asips/sdtp-client/internal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_bandwidthLimiter(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := &bandwidthLimiter{now: func() time.Time { return now }}
+	l.setRate(1000)
+
+	assert.Equal(t, 500*time.Millisecond, l.reserve(500))
+	now = now.Add(time.Second)
+	assert.Equal(t, time.Duration(0), l.reserve(500))
+	// bursts are limited to a second's worth
+	now = now.Add(10 * time.Second)
+	assert.Equal(t, 500*time.Millisecond, l.reserve(1500))
+
+	l.setRate(0)
+	assert.Equal(t, time.Duration(0), l.reserve(1<<30))
+	assert.Equal(t, uint64(0), l.getRate())
+
+	var nilLimiter *bandwidthLimiter
+	nilLimiter.wait(t.Context(), 1<<30)
+}
+
+func Test_transferTracker(t *testing.T) {
+	tracker := newTransferTracker(0)
+	run := &ingestRun{name: "a"}
+	start := time.Now()
+
+	_, tr := tracker.start(context.Background(), "a", internal.FileInfo{ID: 1, Name: "file1", Size: 200})
+	tr.bytes.Add(50)
+	inFlight := tracker.inFlight(start.Add(time.Hour))
+	require.Len(t, inFlight, 1)
+	assert.Equal(t, "a", inFlight[0].Subscription)
+	assert.Equal(t, int64(50), inFlight[0].Bytes)
+	assert.Equal(t, 25.0, inFlight[0].Percent)
+	assert.Greater(t, inFlight[0].Rate, 0.0)
+	tracker.finish(tr)
+	assert.Empty(t, tracker.inFlight(time.Now()))
+
+	for id := range int64(maxRecentFailures + 2) {
+		tracker.fail(run, internal.FileInfo{ID: id}, errors.New("failed"))
+	}
+	// a file failing again replaces its previous failure
+	tracker.fail(run, internal.FileInfo{ID: 5}, internal.ErrNotFound)
+	failures := tracker.recentFailures()
+	require.Len(t, failures, maxRecentFailures)
+	assert.Equal(t, int64(2), failures[0].ID)
+	assert.Equal(t, int64(5), failures[len(failures)-1].ID)
+	assert.Equal(t, "not-found", failures[len(failures)-1].Class)
+
+	taken := tracker.takeFailures([]int64{3, 5, 1000})
+	require.Len(t, taken, 2)
+	assert.Len(t, tracker.recentFailures(), maxRecentFailures-2)
+	tracker.restoreFailures(taken)
+	failures = tracker.recentFailures()
+	assert.Equal(t, int64(3), failures[1].ID)
+	assert.Equal(t, int64(5), failures[len(failures)-1].ID)
+
+	var nilTracker *transferTracker
+	ctx, tr := nilTracker.start(t.Context(), "", internal.FileInfo{})
+	assert.Equal(t, t.Context(), ctx)
+	nilTracker.finish(tr)
+	nilTracker.fail(run, internal.FileInfo{}, errors.New("failed"))
+	assert.Empty(t, nilTracker.inFlight(time.Now()))
+}
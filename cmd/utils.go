@@ -4,13 +4,18 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"io"
 	"net/url"
 	"os"
+	"os/signal"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/asips/sdtp-client/internal"
 	"github.com/asips/sdtp-client/internal/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 type CertInfo struct {
@@ -69,7 +74,7 @@ func mustValidateCert(certFile, keyFile string, days int) {
 	}
 	if info.Expired {
 		log.Printf("Certificate expired on %s, run 'check' for more info", info.Expiration.Format(time.RFC3339))
-		os.Exit(3)
+		log.Exit(3)
 	}
 	if info.DaysLeft > 0 && info.DaysLeft <= days {
 		log.Printf("WARNING!! Certificate expiring in %d days; run 'check' for more info", info.DaysLeft)
@@ -77,14 +82,146 @@ func mustValidateCert(certFile, keyFile string, days int) {
 }
 
 func parseApiUrl(strUrl string) *url.URL {
-	u, err := url.Parse(strUrl)
+	u, err := parseProviderURL(strUrl)
 	if err != nil {
 		log.Fatal("invalid api-url: %s", err)
 	}
+	return u
+}
+
+// parseProviderURL parses the base url of an SDTP API.
+func parseProviderURL(strUrl string) (*url.URL, error) {
+	u, err := url.Parse(strUrl)
+	if err != nil {
+		return nil, err
+	}
 	if u.RawQuery != "" || u.Fragment != "" {
-		log.Fatal("api-url must not contain query or fragment")
+		return nil, fmt.Errorf("api url must not contain query or fragment")
 	}
-	return u
+	return u, nil
+}
+
+// isTerminal returns true if f is a character device, e.g., a TTY, rather
+// than a file or pipe.
+func isTerminal(f *os.File) bool {
+	st, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return st.Mode()&os.ModeCharDevice != 0
+}
+
+// clientOptionsFromFlags reads the client options common to all commands from
+// the root persistent flags.
+func clientOptionsFromFlags(flags *pflag.FlagSet) internal.ClientOptions {
+	httpTimeout, err := flags.GetDuration("http-timeout")
+	cobra.CheckErr(err)
+	proxyStr, err := flags.GetString("proxy")
+	cobra.CheckErr(err)
+	noProxy, err := flags.GetStringSlice("no-proxy")
+	cobra.CheckErr(err)
+
+	rate, err := flags.GetFloat64("rate-limit")
+	cobra.CheckErr(err)
+	burst, err := flags.GetInt("rate-burst")
+	cobra.CheckErr(err)
+	retries, err := flags.GetInt("rate-limit-retries")
+	cobra.CheckErr(err)
+	if rate < 0 || burst < 1 || retries < 0 {
+		log.Fatal("--rate-limit and --rate-limit-retries must not be negative, and --rate-burst must be at least 1")
+	}
+
+	tlsProfile, err := tlsProfileFromFlags(flags)
+	if err != nil {
+		log.Fatal("invalid TLS settings: %s", err)
+	}
+
+	opts := internal.ClientOptions{
+		Timeout:   httpTimeout,
+		NoProxy:   noProxy,
+		TLS:       tlsProfile,
+		RateLimit: internal.RateLimit{Rate: rate, Burst: burst, Retries: retries},
+	}
+	if proxyStr != "" {
+		opts.Proxy, err = internal.ParseProxyURL(proxyStr)
+		if err != nil {
+			log.Fatal("invalid --proxy: %s", err)
+		}
+	}
+	return opts
+}
+
+// watchCertificate reloads the client certificate on SIGHUP and, if interval is
+// positive, whenever the certificate or key file changes, until ctx is done.
+func watchCertificate(ctx context.Context, sdtp internal.CertificateReloader, interval time.Duration) {
+	if interval > 0 {
+		go sdtp.WatchCertificate(ctx, interval)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-hup:
+				if err := sdtp.ReloadCertificate(); err != nil {
+					log.Printf("failed to reload client certificate, continuing with current certificate; %s", err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// tlsProfileFromFlags returns the named --tls-profile with any of the other
+// --tls-* flags applied on top.
+func tlsProfileFromFlags(flags *pflag.FlagSet) (*internal.TLSProfile, error) {
+	name, err := flags.GetString("tls-profile")
+	cobra.CheckErr(err)
+	minVersion, err := flags.GetString("tls-min-version")
+	cobra.CheckErr(err)
+	maxVersion, err := flags.GetString("tls-max-version")
+	cobra.CheckErr(err)
+	renegotiation, err := flags.GetString("tls-renegotiation")
+	cobra.CheckErr(err)
+	ciphers, err := flags.GetStringSlice("tls-ciphers")
+	cobra.CheckErr(err)
+
+	return newTLSProfile(name, minVersion, maxVersion, renegotiation, ciphers)
+}
+
+func newTLSProfile(name, minVersion, maxVersion, renegotiation string, ciphers []string) (*internal.TLSProfile, error) {
+	if name == "" {
+		name = internal.DefaultTLSProfile
+	}
+	profile, ok := internal.TLSProfiles[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown TLS profile %q", name)
+	}
+	var err error
+	if minVersion != "" {
+		if profile.MinVersion, err = internal.ParseTLSVersion(minVersion); err != nil {
+			return nil, err
+		}
+	}
+	if maxVersion != "" {
+		if profile.MaxVersion, err = internal.ParseTLSVersion(maxVersion); err != nil {
+			return nil, err
+		}
+	}
+	if renegotiation != "" {
+		if profile.Renegotiation, err = internal.ParseRenegotiation(renegotiation); err != nil {
+			return nil, err
+		}
+	}
+	if len(ciphers) > 0 {
+		if profile.CipherSuites, err = internal.ParseCipherSuites(ciphers); err != nil {
+			return nil, err
+		}
+	}
+	return &profile, profile.Validate()
 }
 
 type mockSDTP struct {
@@ -102,6 +239,9 @@ func (m *mockSDTP) List(ctx context.Context, tags map[string]string) ([]internal
 func (m *mockSDTP) Download(ctx context.Context, file internal.FileInfo, destDir string) error {
 	return m.err
 }
+func (m *mockSDTP) Stream(ctx context.Context, file internal.FileInfo, w io.Writer) error {
+	return m.err
+}
 func (m *mockSDTP) Ack(ctx context.Context, file internal.FileInfo) error {
 	return m.err
 }
@@ -0,0 +1,120 @@
+package internal
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/asips/sdtp-client/internal/log"
+)
+
+// CertReloader provides the client certificate for TLS handshakes and can
+// reload it from disk, so long-running processes pick up rotated certificates
+// without restarting.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// NewCertReloader loads the key pair from certFile and keyFile. Unlike Reload
+// the initial certificate is not required to be currently valid, so callers can
+// report on an expired certificate.
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{certFile: certFile, keyFile: keyFile}
+	cert, modTime, err := r.load(false)
+	if err != nil {
+		return nil, err
+	}
+	r.cert, r.modTime = cert, modTime
+	return r, nil
+}
+
+// load reads the key pair, returning it with the latest modification time of
+// the two files. If validate is true the certificate must be currently valid.
+func (r *CertReloader) load(validate bool) (*tls.Certificate, time.Time, error) {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to load key pair: %w", err)
+	}
+	if !validate {
+		return &cert, modTime, nil
+	}
+	now := time.Now()
+	if now.After(cert.Leaf.NotAfter) {
+		return nil, time.Time{}, fmt.Errorf("certificate expired on %s", cert.Leaf.NotAfter.Format(time.RFC3339))
+	}
+	if now.Before(cert.Leaf.NotBefore) {
+		return nil, time.Time{}, fmt.Errorf("certificate not valid until %s", cert.Leaf.NotBefore.Format(time.RFC3339))
+	}
+	return &cert, modTime, nil
+}
+
+func (r *CertReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{r.certFile, r.keyFile} {
+		st, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if st.ModTime().After(latest) {
+			latest = st.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// GetClientCertificate implements tls.Config.GetClientCertificate.
+func (r *CertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// Expiration returns the expiration date of the current certificate.
+func (r *CertReloader) Expiration() time.Time {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert.Leaf.NotAfter
+}
+
+// Reload loads the key pair from disk, swapping it in only if it is valid.
+// If it is not, the current certificate continues to be used.
+func (r *CertReloader) Reload() error {
+	cert, modTime, err := r.load(true)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	old := r.cert
+	r.cert, r.modTime = cert, modTime
+	r.mu.Unlock()
+
+	if old.Leaf.SerialNumber.Cmp(cert.Leaf.SerialNumber) != 0 || !old.Leaf.NotAfter.Equal(cert.Leaf.NotAfter) {
+		log.Printf("rotated client certificate; old expiration %s, new expiration %s",
+			old.Leaf.NotAfter.Format(time.RFC3339), cert.Leaf.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// Changed returns true if either file has been modified since the certificate
+// was last loaded.
+func (r *CertReloader) Changed() bool {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return modTime.After(r.modTime)
+}
@@ -0,0 +1,110 @@
+package internal
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeKeyPair writes a self-signed certificate valid from notBefore to
+// notAfter, and its key, to certFile and keyFile.
+func writeKeyPair(t *testing.T, certFile, keyFile string, serial int64, notBefore, notAfter time.Time) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+}
+
+// touch sets the modification time of paths to t so changes are detected on
+// filesystems with coarse timestamps.
+func touch(t *testing.T, mtime time.Time, paths ...string) {
+	t.Helper()
+	for _, path := range paths {
+		require.NoError(t, os.Chtimes(path, mtime, mtime))
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	now := time.Now()
+
+	writeKeyPair(t, certFile, keyFile, 1, now.Add(-time.Hour), now.Add(24*time.Hour))
+	touch(t, now.Add(-time.Minute), certFile, keyFile)
+	r, err := NewCertReloader(certFile, keyFile)
+	require.NoError(t, err)
+	assert.False(t, r.Changed())
+	firstExpiration := r.Expiration()
+
+	t.Run("rotated", func(t *testing.T) {
+		writeKeyPair(t, certFile, keyFile, 2, now.Add(-time.Hour), now.Add(48*time.Hour))
+		touch(t, now, certFile, keyFile)
+		assert.True(t, r.Changed())
+
+		assert.NoError(t, r.Reload())
+		assert.False(t, r.Changed())
+		assert.True(t, r.Expiration().After(firstExpiration))
+
+		cert, err := r.GetClientCertificate(nil)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), cert.Leaf.SerialNumber.Int64())
+	})
+
+	t.Run("expired keeps current", func(t *testing.T) {
+		current := r.Expiration()
+		writeKeyPair(t, certFile, keyFile, 3, now.Add(-48*time.Hour), now.Add(-time.Hour))
+		touch(t, now.Add(time.Minute), certFile, keyFile)
+
+		assert.Error(t, r.Reload())
+		assert.Equal(t, current, r.Expiration())
+	})
+
+	t.Run("mismatched pair keeps current", func(t *testing.T) {
+		current := r.Expiration()
+		otherCert := filepath.Join(dir, "other.pem")
+		otherKey := filepath.Join(dir, "other.key")
+		writeKeyPair(t, otherCert, otherKey, 4, now.Add(-time.Hour), now.Add(72*time.Hour))
+		writeKeyPair(t, certFile, keyFile, 5, now.Add(-time.Hour), now.Add(72*time.Hour))
+		require.NoError(t, os.Rename(otherKey, keyFile))
+		touch(t, now.Add(2*time.Minute), certFile, keyFile)
+
+		assert.Error(t, r.Reload())
+		assert.Equal(t, current, r.Expiration())
+	})
+}
+
+func TestNewCertReloader_Expired(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writeKeyPair(t, certFile, keyFile, 1, time.Now().Add(-48*time.Hour), time.Now().Add(-time.Hour))
+
+	// the initial certificate may be expired so it can be reported on
+	r, err := NewCertReloader(certFile, keyFile)
+	assert.NoError(t, err)
+	assert.True(t, r.Expiration().Before(time.Now()))
+}
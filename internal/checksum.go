@@ -38,21 +38,30 @@ func Checksum(alg, path string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	var hash hash.Hash
+	defer f.Close()
+
+	hash, err := newHash(alg)
+	if err != nil {
+		return "", err
+	}
+	if _, err = io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// newHash returns a new hash for alg, which is matched case-insensitively
+// against sha256, sha384, sha512, or md5.
+func newHash(alg string) (hash.Hash, error) {
 	switch strings.ToLower(alg) {
 	case "sha256":
-		hash = sha256.New()
+		return sha256.New(), nil
 	case "sha384":
-		hash = sha512.New384()
+		return sha512.New384(), nil
 	case "sha512":
-		hash = sha512.New()
+		return sha512.New(), nil
 	case "md5":
-		hash = md5.New()
-	default:
-		return "", fmt.Errorf("%s checksum not supported", alg)
+		return md5.New(), nil
 	}
-	if _, err = io.Copy(hash, f); err != nil {
-		return "", err
-	}
-	return hex.EncodeToString(hash.Sum(nil)), nil
+	return nil, fmt.Errorf("%s checksum not supported", alg)
 }
@@ -0,0 +1,104 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/asips/sdtp-client/internal/log"
+)
+
+// TempPath returns the path of the hidden temporary file used while file is
+// being downloaded to dir, e.g., .name.1234. It includes the file id so files
+// with the same name never share one.
+func TempPath(dir string, file FileInfo) string {
+	return path.Join(dir, fmt.Sprintf(".%s.%d", file.Name, file.ID))
+}
+
+// RemoveTemp removes the temporary file for file in dir left behind by an
+// interrupted download. It returns true if a file was removed.
+func RemoveTemp(dir string, file FileInfo) (bool, error) {
+	err := os.Remove(TempPath(dir, file))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// syncAndClose flushes f to stable storage and closes it.
+func syncAndClose(f *os.File) error {
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// commit renames the synced file tmpPath to name in destDir, then syncs destDir
+// so the rename itself is durable.
+func commit(tmpPath, destDir, name string) error {
+	destPath := path.Join(destDir, name)
+	if err := os.Rename(tmpPath, destPath); err != nil {
+		return fmt.Errorf("failed to rename %s to %s: %w", tmpPath, name, err)
+	}
+	if err := syncDir(destDir); err != nil {
+		return fmt.Errorf("failed to sync %s: %w", destDir, err)
+	}
+	return nil
+}
+
+// commitStaged moves the verified file at stagedPath into destDir. When the
+// staging directory is on another filesystem the file is copied to a temporary
+// file in destDir, synced and its checksum verified again before being renamed
+// into place.
+func commitStaged(stagedPath, destDir string, file FileInfo) error {
+	tmpPath := TempPath(destDir, file)
+	if err := os.Rename(stagedPath, tmpPath); err == nil {
+		return commit(tmpPath, destDir, file.Name)
+	}
+
+	if err := copyFile(stagedPath, tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to copy %s to %s: %w", stagedPath, destDir, err)
+	}
+	alg, expected, _ := strings.Cut(file.Checksum, ":")
+	computed, err := Checksum(alg, tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to verify copy of %s: %w", file.Name, err)
+	}
+	if !strings.EqualFold(computed, expected) {
+		os.Remove(tmpPath)
+		return fmt.Errorf("%w for copy of %s; got %s, wanted %s", ErrChecksumMismatch, file.Name, computed, expected)
+	}
+	if err := commit(tmpPath, destDir, file.Name); err != nil {
+		return err
+	}
+	// the file is already committed, so a staged copy left behind is not a failure
+	if err := os.Remove(stagedPath); err != nil {
+		log.Warn("failed to remove staged file %s; %s", stagedPath, err)
+	}
+	return nil
+}
+
+// copyFile copies src to dst and syncs dst to stable storage.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return syncAndClose(out)
+}
@@ -0,0 +1,34 @@
+package internal
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRemoveTemp(t *testing.T) {
+	dir := t.TempDir()
+	file := FileInfo{ID: 1, Name: "file1.txt"}
+
+	removed, err := RemoveTemp(dir, file)
+	assert.NoError(t, err)
+	assert.False(t, removed)
+
+	assert.NoError(t, os.WriteFile(TempPath(dir, file), []byte("partial"), 0644))
+	removed, err = RemoveTemp(dir, file)
+	assert.NoError(t, err)
+	assert.True(t, removed)
+	assert.NoFileExists(t, TempPath(dir, file))
+}
+
+func TestCopyFile(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(dir+"/src", []byte("xxx"), 0644))
+
+	assert.NoError(t, copyFile(dir+"/src", dir+"/dst"))
+
+	data, err := os.ReadFile(dir + "/dst")
+	assert.NoError(t, err)
+	assert.Equal(t, "xxx", string(data))
+}
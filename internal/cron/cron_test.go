@@ -0,0 +1,70 @@
+package cron
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNext(t *testing.T) {
+	// a Thursday
+	from := time.Date(2026, 1, 1, 10, 7, 30, 0, time.UTC)
+	tests := []struct {
+		Expr string
+		Want time.Time
+	}{
+		{"* * * * *", time.Date(2026, 1, 1, 10, 8, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2026, 1, 1, 10, 15, 0, 0, time.UTC)},
+		{"5 * * * *", time.Date(2026, 1, 1, 11, 5, 0, 0, time.UTC)},
+		{"0 2-4 * * *", time.Date(2026, 1, 2, 2, 0, 0, 0, time.UTC)},
+		{"30 9,17 * * *", time.Date(2026, 1, 1, 17, 30, 0, 0, time.UTC)},
+		{"0 0 * * mon-fri", time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * sat,sun", time.Date(2026, 1, 3, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2026, 1, 4, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 feb *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// either day field matches when both are restricted
+		{"0 0 15 * fri", time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{"10/20 * * * *", time.Date(2026, 1, 1, 10, 10, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2026, 1, 1, 11, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.Expr, func(t *testing.T) {
+			s, err := Parse(tt.Expr)
+			require.NoError(t, err)
+			assert.Equal(t, tt.Want, s.Next(from))
+			assert.Equal(t, tt.Expr, s.String())
+		})
+	}
+}
+
+func TestNext_location(t *testing.T) {
+	loc := time.FixedZone("IST", 5*3600+1800)
+	s, err := Parse("0 * * * *")
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2026, 1, 1, 11, 0, 0, 0, loc), s.Next(time.Date(2026, 1, 1, 10, 15, 0, 0, loc)))
+}
+
+func TestParse_invalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+		"* * * foo *",
+	} {
+		_, err := Parse(expr)
+		assert.Error(t, err, expr)
+	}
+}
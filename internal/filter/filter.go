@@ -0,0 +1,284 @@
+// Package filter implements a small expression language for selecting files
+// from an SDTP listing on the client side.
+//
+// An expression compares file fields with literals, e.g.,
+//
+//	name =~ "\.h5$" && size < 2GB && expires_in < 24h
+//	tags.stream == "nrt" || extra.collection == 5.1
+//
+// Fields are id, name, checksum, size, expires, expires_in (the duration until
+// the file expires), tags.<key> and extra.<key>[.<key>...]; field names are
+// case-insensitive. A field on its own is true if it is present and not empty,
+// zero or false.
+//
+// Literals are double or single quoted strings, numbers, sizes (2GB, 500MiB,
+// 2G, see internal.ParseSize) and durations (24h, 1h30m, 7d); a lower case m
+// is minutes rather than MiB. The comparison operators are ==, !=, <, <=, >,
+// >=, =~ and !~ (regular expression match), combined with && (and), || (or),
+// ! (not) and parentheses.
+package filter
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/asips/sdtp-client/internal"
+)
+
+// now returns the current time; replaced in tests.
+var now = time.Now
+
+// Filter is a parsed filter expression.
+type Filter struct {
+	expr string
+	root node
+}
+
+// Parse parses a filter expression.
+func Parse(expr string) (*Filter, error) {
+	toks, err := lex(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %q at offset %d", tok.text, tok.pos)
+	}
+	return &Filter{expr: expr, root: root}, nil
+}
+
+// Match returns true if file satisfies the expression.
+func (f *Filter) Match(file internal.FileInfo) bool {
+	return truthy(f.root.eval(file))
+}
+
+func (f *Filter) String() string {
+	return f.expr
+}
+
+type node interface {
+	eval(file internal.FileInfo) any
+}
+
+type andNode struct{ left, right node }
+
+func (n andNode) eval(file internal.FileInfo) any {
+	return truthy(n.left.eval(file)) && truthy(n.right.eval(file))
+}
+
+type orNode struct{ left, right node }
+
+func (n orNode) eval(file internal.FileInfo) any {
+	return truthy(n.left.eval(file)) || truthy(n.right.eval(file))
+}
+
+type notNode struct{ expr node }
+
+func (n notNode) eval(file internal.FileInfo) any {
+	return !truthy(n.expr.eval(file))
+}
+
+type literalNode struct{ val any }
+
+func (n literalNode) eval(file internal.FileInfo) any {
+	return n.val
+}
+
+type fieldNode struct{ path []string }
+
+func (n fieldNode) eval(file internal.FileInfo) any {
+	switch n.path[0] {
+	case "id":
+		return float64(file.ID)
+	case "name":
+		return file.Name
+	case "checksum":
+		return file.Checksum
+	case "size":
+		return float64(file.Size)
+	case "expires":
+		t, err := file.ExpiresAt()
+		if err != nil {
+			return nil
+		}
+		return t
+	case "expires_in":
+		t, err := file.ExpiresAt()
+		if err != nil {
+			return nil
+		}
+		return t.Sub(now())
+	case "tags":
+		if v, ok := file.Tags[n.path[1]]; ok {
+			return v
+		}
+		return nil
+	case "extra":
+		var v any = file.Extra
+		for _, key := range n.path[1:] {
+			m, ok := v.(map[string]any)
+			if !ok {
+				return nil
+			}
+			v = m[key]
+		}
+		return v
+	}
+	return nil
+}
+
+type compareNode struct {
+	op          string
+	left, right node
+	re          *regexp.Regexp
+}
+
+func (n compareNode) eval(file internal.FileInfo) any {
+	left := n.left.eval(file)
+	if n.re != nil {
+		if left == nil {
+			return n.op == "!~"
+		}
+		return n.re.MatchString(toString(left)) == (n.op == "=~")
+	}
+	right := n.right.eval(file)
+	if left == nil || right == nil {
+		switch n.op {
+		case "==":
+			return left == nil && right == nil
+		case "!=":
+			return (left == nil) != (right == nil)
+		}
+		return false
+	}
+	cmp, ok := compare(left, right)
+	if !ok {
+		return n.op == "!="
+	}
+	switch n.op {
+	case "==":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+// compare returns -1, 0 or 1 comparing a and b, converting between types where
+// it makes sense. It returns false if the values cannot be compared.
+func compare(a, b any) (int, bool) {
+	switch av := a.(type) {
+	case time.Time:
+		bv, ok := toTime(b)
+		if !ok {
+			return 0, false
+		}
+		return av.Compare(bv), true
+	case time.Duration:
+		bv, ok := b.(time.Duration)
+		if !ok {
+			return 0, false
+		}
+		return cmpOrdered(av, bv), true
+	case float64:
+		bv, ok := toNumber(b)
+		if !ok {
+			return strings.Compare(toString(a), toString(b)), true
+		}
+		return cmpOrdered(av, bv), true
+	case bool:
+		bv, ok := b.(bool)
+		if !ok {
+			return strings.Compare(toString(a), toString(b)), true
+		}
+		if av == bv {
+			return 0, true
+		}
+		return 1, true
+	case string:
+		switch b.(type) {
+		case float64, time.Time:
+			cmp, ok := compare(b, a)
+			return -cmp, ok
+		}
+		return strings.Compare(av, toString(b)), true
+	}
+	return 0, false
+}
+
+func cmpOrdered[T float64 | time.Duration](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func toNumber(v any) (float64, bool) {
+	switch vv := v.(type) {
+	case float64:
+		return vv, true
+	case string:
+		f, err := strconv.ParseFloat(vv, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func toTime(v any) (time.Time, bool) {
+	switch vv := v.(type) {
+	case time.Time:
+		return vv, true
+	case string:
+		t, err := internal.FileInfo{Expires: vv}.ExpiresAt()
+		return t, err == nil
+	}
+	return time.Time{}, false
+}
+
+func toString(v any) string {
+	switch vv := v.(type) {
+	case string:
+		return vv
+	case float64:
+		return strconv.FormatFloat(vv, 'f', -1, 64)
+	case time.Time:
+		return vv.Format(time.RFC3339)
+	}
+	return fmt.Sprint(v)
+}
+
+func truthy(v any) bool {
+	switch vv := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return vv
+	case string:
+		return vv != ""
+	case float64:
+		return vv != 0
+	case time.Duration:
+		return vv != 0
+	case time.Time:
+		return !vv.IsZero()
+	}
+	return true
+}
@@ -0,0 +1,89 @@
+package filter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/asips/sdtp-client/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilter(t *testing.T) {
+	fixedNow := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	now = func() time.Time { return fixedNow }
+	defer func() { now = time.Now }()
+
+	file := internal.FileInfo{
+		ID:       1234,
+		Name:     "VNP02MOD.A2026001.0000.002.nc",
+		Checksum: "md5:f561aaf6ef0bf14d4208bb46a4ccb3ad",
+		Size:     3 << 30,
+		Expires:  "2026-01-01T12:00:00Z",
+		Tags:     map[string]string{"stream": "nrt", "ShortName": "VNP02MOD"},
+		Extra: map[string]any{
+			"collection": 5.1,
+			"version":    "002",
+			"nested":     map[string]any{"flag": true},
+		},
+	}
+
+	tests := []struct {
+		Expr string
+		Want bool
+	}{
+		{`name =~ "\.nc$"`, true},
+		{`name =~ "\.h5$"`, false},
+		{`name !~ "\.h5$"`, true},
+		{`size < 2GB`, false},
+		{`size < 4 GiB`, true},
+		{`size >= 3GiB && size <= 3GiB`, true},
+		// the same units as the size flags
+		{`size > 2G && size == 3G`, true},
+		{`size < 3 G`, false},
+		{`size > 2g`, true},
+		{`expires_in < 30m`, false},
+		{`expires_in < 24h`, true},
+		{`expires_in < 1h`, false},
+		{`expires > "2025-12-31T00:00:00Z"`, true},
+		{`Extra.collection == 5.1`, true},
+		{`extra.collection > 5`, true},
+		{`extra.version == 2`, true},
+		{`extra.version == "002"`, true},
+		{`extra.nested.flag`, true},
+		{`extra.nested.flag == false`, false},
+		{`extra.missing`, false},
+		{`tags.stream == "nrt"`, true},
+		{`Tags.ShortName == 'VNP02MOD' and tags.stream != "nrt"`, false},
+		{`tags.missing != "x"`, true},
+		{`!(tags.stream == "nrt") || id == 1234`, true},
+		{`not tags.stream`, false},
+		{`id > 1000 and (name =~ "^VNP" or size < 1KB)`, true},
+	}
+	for _, tt := range tests {
+		f, err := Parse(tt.Expr)
+		if assert.NoError(t, err, tt.Expr) {
+			assert.Equal(t, tt.Want, f.Match(file), tt.Expr)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, expr := range []string{
+		``,
+		`name ==`,
+		`bogus == 1`,
+		`name =~ "["`,
+		`name =~ other`,
+		`(size > 1`,
+		`name == "unterminated`,
+		`size > 1 size`,
+		`size > 2XB`,
+		`id == 1.2.3`,
+		`size < 1.2.3`,
+		`size < inf B`,
+		`name # 1`,
+	} {
+		_, err := Parse(expr)
+		assert.Error(t, err, expr)
+	}
+}
@@ -0,0 +1,330 @@
+package filter
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/asips/sdtp-client/internal"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokOp
+	tokLParen
+	tokRParen
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// operators, longest first so they are matched greedily.
+var operators = []string{"&&", "||", "==", "!=", "<=", ">=", "=~", "!~", "<", ">", "!"}
+
+func lex(expr string) ([]token, error) {
+	var toks []token
+	for i := 0; i < len(expr); {
+		c := rune(expr[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '(':
+			toks = append(toks, token{tokLParen, "(", i})
+			i++
+		case c == ')':
+			toks = append(toks, token{tokRParen, ")", i})
+			i++
+		case c == '"' || c == '\'':
+			str, n, err := lexString(expr[i:])
+			if err != nil {
+				return nil, fmt.Errorf("%s at offset %d", err, i)
+			}
+			toks = append(toks, token{tokString, str, i})
+			i += n
+		case unicode.IsDigit(c) || (c == '-' && i+1 < len(expr) && unicode.IsDigit(rune(expr[i+1]))):
+			j := i + 1
+			for j < len(expr) && (isIdentChar(rune(expr[j])) || expr[j] == '.') {
+				j++
+			}
+			text := expr[i:j]
+			// allow a space between a number and its size unit, e.g., 2 GB
+			if k := skipSpace(expr, j); k > j {
+				end := k
+				for end < len(expr) && isIdentChar(rune(expr[end])) {
+					end++
+				}
+				if isSizeUnit(expr[k:end]) && isPlainNumber(text) {
+					text += expr[k:end]
+					j = end
+				}
+			}
+			toks = append(toks, token{tokNumber, text, i})
+			i = j
+		case unicode.IsLetter(c) || c == '_':
+			j := i + 1
+			for j < len(expr) && (isIdentChar(rune(expr[j])) || expr[j] == '.') {
+				j++
+			}
+			word := expr[i:j]
+			switch strings.ToLower(word) {
+			case "and":
+				toks = append(toks, token{tokOp, "&&", i})
+			case "or":
+				toks = append(toks, token{tokOp, "||", i})
+			case "not":
+				toks = append(toks, token{tokOp, "!", i})
+			default:
+				toks = append(toks, token{tokIdent, word, i})
+			}
+			i = j
+		default:
+			op := ""
+			for _, o := range operators {
+				if strings.HasPrefix(expr[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected %q at offset %d", c, i)
+			}
+			toks = append(toks, token{tokOp, op, i})
+			i += len(op)
+		}
+	}
+	return append(toks, token{tokEOF, "", len(expr)}), nil
+}
+
+func isIdentChar(c rune) bool {
+	return unicode.IsLetter(c) || unicode.IsDigit(c) || c == '_'
+}
+
+func skipSpace(s string, i int) int {
+	for i < len(s) && unicode.IsSpace(rune(s[i])) {
+		i++
+	}
+	return i
+}
+
+func isPlainNumber(s string) bool {
+	_, err := strconv.ParseFloat(s, 64)
+	return err == nil
+}
+
+// lexString reads a quoted string from the start of s, returning its unquoted
+// value and the number of bytes consumed. Backslash escapes only the quote
+// character so regular expressions can be written without double escaping.
+func lexString(s string) (string, int, error) {
+	quote := s[0]
+	var sb strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && s[i+1] == quote:
+			sb.WriteByte(quote)
+			i++
+		case s[i] == quote:
+			return sb.String(), i + 1, nil
+		default:
+			sb.WriteByte(s[i])
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string")
+}
+
+// isSizeUnit returns true if unit is a size unit, as accepted by
+// internal.ParseSize, other than a lower case m, which is minutes.
+func isSizeUnit(unit string) bool {
+	return unit != "m" && internal.IsSizeUnit(unit)
+}
+
+// parseNumber parses a number, size or duration literal.
+func parseNumber(text string) (any, error) {
+	if f, err := strconv.ParseFloat(text, 64); err == nil {
+		return f, nil
+	}
+	i := strings.IndexFunc(text, unicode.IsLetter)
+	if i < 0 {
+		return nil, fmt.Errorf("invalid number, size or duration %q", text)
+	}
+	num, unit := strings.TrimSpace(text[:i]), strings.TrimSpace(text[i:])
+	if isSizeUnit(unit) {
+		size, err := internal.ParseSize(text)
+		if err != nil {
+			return nil, err
+		}
+		return float64(size), nil
+	}
+	if unit == "d" {
+		f, err := strconv.ParseFloat(num, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid duration %q", text)
+		}
+		return time.Duration(f * float64(24*time.Hour)), nil
+	}
+	d, err := time.ParseDuration(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid number, size or duration %q", text)
+	}
+	return d, nil
+}
+
+var fields = map[string]bool{
+	"id":         true,
+	"name":       true,
+	"checksum":   true,
+	"size":       true,
+	"expires":    true,
+	"expires_in": true,
+}
+
+func parseField(tok token) (node, error) {
+	path := strings.Split(tok.text, ".")
+	path[0] = strings.ToLower(path[0])
+	switch {
+	case fields[path[0]] && len(path) == 1:
+	case path[0] == "tags" && len(path) == 2:
+	case path[0] == "extra" && len(path) >= 2:
+	default:
+		return nil, fmt.Errorf("unknown field %q at offset %d", tok.text, tok.pos)
+	}
+	return fieldNode{path: path}, nil
+}
+
+type parser struct {
+	toks []token
+	pos  int
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.toks[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokOp && p.peek().text == "||" {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokOp && p.peek().text == "&&" {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (node, error) {
+	if tok := p.peek(); tok.kind == tokOp && tok.text == "!" {
+		p.next()
+		expr, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{expr}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (node, error) {
+	if p.peek().kind == tokLParen {
+		p.next()
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if tok := p.next(); tok.kind != tokRParen {
+			return nil, fmt.Errorf("expected ) at offset %d", tok.pos)
+		}
+		return expr, nil
+	}
+
+	left, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	tok := p.peek()
+	if tok.kind != tokOp || tok.text == "&&" || tok.text == "||" || tok.text == "!" {
+		return left, nil
+	}
+	p.next()
+
+	if tok.text == "=~" || tok.text == "!~" {
+		pat := p.next()
+		if pat.kind != tokString {
+			return nil, fmt.Errorf("expected quoted regular expression at offset %d", pat.pos)
+		}
+		re, err := regexp.Compile(pat.text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression at offset %d: %w", pat.pos, err)
+		}
+		return compareNode{op: tok.text, left: left, re: re}, nil
+	}
+
+	right, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	return compareNode{op: tok.text, left: left, right: right}, nil
+}
+
+func (p *parser) parseValue() (node, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokIdent:
+		switch strings.ToLower(tok.text) {
+		case "true":
+			return literalNode{true}, nil
+		case "false":
+			return literalNode{false}, nil
+		}
+		return parseField(tok)
+	case tokString:
+		return literalNode{tok.text}, nil
+	case tokNumber:
+		val, err := parseNumber(tok.text)
+		if err != nil {
+			return nil, fmt.Errorf("%s at offset %d", err, tok.pos)
+		}
+		return literalNode{val}, nil
+	case tokEOF:
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected %q at offset %d", tok.text, tok.pos)
+}
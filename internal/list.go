@@ -0,0 +1,208 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"iter"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/asips/sdtp-client/internal/log"
+	"github.com/asips/sdtp-client/internal/trace"
+)
+
+// ListOptions control how files are listed.
+type ListOptions struct {
+	// Tags the files must have.
+	Tags map[string]string
+	// PageSize, if set, requests files PageSize at a time using the limit and
+	// offset query parameters, for providers that support them. Providers that
+	// ignore them return the complete listing on the first request, and
+	// listing stops at a page that only repeats files already listed.
+	PageSize int
+	// Limit, if set, is the maximum number of files listed. It is also sent to
+	// the provider as the limit query parameter.
+	Limit int
+}
+
+// FileStreamer is implemented by clients that can list files incrementally,
+// without holding the whole listing in memory.
+type FileStreamer interface {
+	ListStream(ctx context.Context, opts ListOptions) iter.Seq2[FileInfo, error]
+}
+
+// ListStream yields files as they are decoded from the listing response. If an
+// error occurs it is yielded, with a zero FileInfo, and iteration stops.
+func (s *DefaultSDTPClient) ListStream(ctx context.Context, opts ListOptions) iter.Seq2[FileInfo, error] {
+	return func(yield func(FileInfo, error) bool) {
+		ctx, span := trace.Start(ctx, "sdtp.List", trace.KindInternal,
+			trace.Int("sdtp.page_size", opts.PageSize), trace.Int("sdtp.limit", opts.Limit))
+		for k, v := range opts.Tags {
+			span.SetAttributes(trace.String("sdtp.tags."+k, v))
+		}
+		var count, pages int
+		var err error
+		defer func() {
+			span.SetAttributes(trace.Int("sdtp.files", count), trace.Int("sdtp.pages", pages))
+			span.RecordError(err)
+			span.End()
+		}()
+
+		stopped := false
+		// seen are the ids listed by earlier pages. A file may be listed again
+		// if files are added while paging, and a provider that ignores offset
+		// returns the first page again and again.
+		var seen map[int64]bool
+		if opts.PageSize > 0 {
+			seen = map[int64]bool{}
+		}
+		offset := 0
+		for {
+			limit := opts.PageSize
+			if opts.Limit > 0 && (limit == 0 || opts.Limit-count < limit) {
+				limit = opts.Limit - count
+			}
+			var n, fresh int
+			n, err = s.listPage(ctx, opts.Tags, limit, offset, opts.PageSize > 0, func(file FileInfo) bool {
+				if seen != nil {
+					if seen[file.ID] {
+						return true
+					}
+					seen[file.ID] = true
+				}
+				fresh++
+				if opts.Limit > 0 && count >= opts.Limit {
+					stopped = true
+					return false
+				}
+				count++
+				if !yield(file, nil) {
+					stopped = true
+					return false
+				}
+				return true
+			})
+			pages++
+			offset += n
+			if err != nil {
+				yield(FileInfo{}, err)
+				return
+			}
+			if pages > 1 && n > 0 && fresh == 0 {
+				log.Warn("page %d of the listing only repeats files already listed, stopping; the provider may not support offset", pages)
+				return
+			}
+			// a short page is the last one, and a page larger than requested
+			// means the provider does not support paging and has returned
+			// everything
+			if stopped || opts.PageSize == 0 || n != limit || (opts.Limit > 0 && count >= opts.Limit) {
+				return
+			}
+		}
+	}
+}
+
+// listPage requests a single page of the listing, calling fn for each file
+// until it returns false. It returns the number of files in the page that
+// were decoded.
+func (s *DefaultSDTPClient) listPage(ctx context.Context, tags map[string]string, limit, offset int, paged bool, fn func(FileInfo) bool) (int, error) {
+	qry := url.Values{}
+	for k, v := range tags {
+		qry.Set(k, v)
+	}
+	if limit > 0 {
+		qry.Set("limit", strconv.Itoa(limit))
+	}
+	if paged {
+		qry.Set("offset", strconv.Itoa(offset))
+	}
+	epUrl := fmt.Sprintf("%s/files?%s", s.apiUrl.String(), qry.Encode())
+
+	req := s.mustNewReq(ctx, http.MethodGet, epUrl)
+	resp, err := s.do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to setup request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusUnauthorized:
+		return 0, ErrNotAuthorized
+	case http.StatusForbidden:
+		return 0, ErrForbidden
+	case http.StatusNotFound:
+		return 0, ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, statusError(resp)
+	}
+
+	n, err := decodeFiles(resp.Body, fn)
+	if err != nil {
+		return n, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return n, nil
+}
+
+// decodeFiles decodes the files in a {"files": [...]} listing one at a time,
+// calling fn for each until it returns false. Other members of the response
+// object are skipped.
+func decodeFiles(r io.Reader, fn func(FileInfo) bool) (int, error) {
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '{'); err != nil {
+		return 0, err
+	}
+	n := 0
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return n, err
+		}
+		if key, _ := tok.(string); key != "files" {
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return n, err
+			}
+			continue
+		}
+
+		tok, err = dec.Token()
+		if err != nil {
+			return n, err
+		}
+		if tok == nil {
+			continue // "files": null
+		}
+		if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+			return n, fmt.Errorf("expected files array, got %v", tok)
+		}
+		for dec.More() {
+			var file FileInfo
+			if err := dec.Decode(&file); err != nil {
+				return n, err
+			}
+			n++
+			if !fn(file) {
+				return n, nil
+			}
+		}
+		if err := expectDelim(dec, ']'); err != nil {
+			return n, err
+		}
+	}
+	return n, expectDelim(dec, '}')
+}
+
+func expectDelim(dec *json.Decoder, want json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != want {
+		return fmt.Errorf("expected %s, got %v", want, tok)
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// pagedServer returns a mock client listing n files, honouring the limit and
+// offset query parameters if paged is true.
+func pagedServer(t *testing.T, n int, paged bool, requests *[]string) *DefaultSDTPClient {
+	return createMockClient(func(req *http.Request) *http.Response {
+		*requests = append(*requests, req.URL.RawQuery)
+		qry := req.URL.Query()
+		start, end := 0, n
+		if paged {
+			if offset := qry.Get("offset"); offset != "" {
+				start, _ = strconv.Atoi(offset)
+			}
+			if limit := qry.Get("limit"); limit != "" {
+				l, _ := strconv.Atoi(limit)
+				end = min(start+l, n)
+			}
+		}
+		files := []string{}
+		for i := start; i < end; i++ {
+			files = append(files, fmt.Sprintf(`{"fileid":%d,"name":"file%d.txt"}`, i+1, i+1))
+		}
+		body := fmt.Sprintf(`{"total": %d, "files": [%s], "meta": {"x": [1, 2]}}`, n, strings.Join(files, ","))
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body))}
+	})
+}
+
+func collect(t *testing.T, sdtp *DefaultSDTPClient, opts ListOptions) ([]int64, error) {
+	ids := []int64{}
+	for file, err := range sdtp.ListStream(t.Context(), opts) {
+		if err != nil {
+			return ids, err
+		}
+		ids = append(ids, file.ID)
+	}
+	return ids, nil
+}
+
+func TestListStream(t *testing.T) {
+	t.Run("unpaged", func(t *testing.T) {
+		requests := []string{}
+		ids, err := collect(t, pagedServer(t, 3, false, &requests), ListOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, []int64{1, 2, 3}, ids)
+		assert.Equal(t, []string{""}, requests)
+	})
+
+	t.Run("paged", func(t *testing.T) {
+		requests := []string{}
+		ids, err := collect(t, pagedServer(t, 5, true, &requests), ListOptions{PageSize: 2})
+		assert.NoError(t, err)
+		assert.Equal(t, []int64{1, 2, 3, 4, 5}, ids)
+		assert.Equal(t, []string{"limit=2&offset=0", "limit=2&offset=2", "limit=2&offset=4"}, requests)
+	})
+
+	t.Run("paging not supported", func(t *testing.T) {
+		requests := []string{}
+		ids, err := collect(t, pagedServer(t, 5, false, &requests), ListOptions{PageSize: 2})
+		assert.NoError(t, err)
+		assert.Equal(t, []int64{1, 2, 3, 4, 5}, ids)
+		assert.Len(t, requests, 1)
+	})
+
+	t.Run("offset ignored", func(t *testing.T) {
+		// a full page every time, so only the repeated ids end the listing
+		requests := []string{}
+		sdtp := createMockClient(func(req *http.Request) *http.Response {
+			requests = append(requests, req.URL.RawQuery)
+			body := `{"files": [{"fileid":1,"name":"file1.txt"}, {"fileid":2,"name":"file2.txt"}]}`
+			return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body))}
+		})
+		ids, err := collect(t, sdtp, ListOptions{PageSize: 2})
+		assert.NoError(t, err)
+		assert.Equal(t, []int64{1, 2}, ids)
+		assert.Equal(t, []string{"limit=2&offset=0", "limit=2&offset=2"}, requests)
+	})
+
+	t.Run("files added while paging", func(t *testing.T) {
+		// a new file at the start of the listing shifts file 2 onto the
+		// second page
+		pages := []string{
+			`{"fileid":1,"name":"file1.txt"}, {"fileid":2,"name":"file2.txt"}`,
+			`{"fileid":2,"name":"file2.txt"}, {"fileid":3,"name":"file3.txt"}`,
+			`{"fileid":4,"name":"file4.txt"}`,
+		}
+		sdtp := createMockClient(func(req *http.Request) *http.Response {
+			offset, _ := strconv.Atoi(req.URL.Query().Get("offset"))
+			body := `{"files": [` + pages[offset/2] + `]}`
+			return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body))}
+		})
+		ids, err := collect(t, sdtp, ListOptions{PageSize: 2})
+		assert.NoError(t, err)
+		assert.Equal(t, []int64{1, 2, 3, 4}, ids)
+	})
+
+	t.Run("limit", func(t *testing.T) {
+		requests := []string{}
+		ids, err := collect(t, pagedServer(t, 5, true, &requests), ListOptions{PageSize: 2, Limit: 3})
+		assert.NoError(t, err)
+		assert.Equal(t, []int64{1, 2, 3}, ids)
+		assert.Equal(t, []string{"limit=2&offset=0", "limit=1&offset=2"}, requests)
+
+		// enforced even if the provider ignores it
+		requests = []string{}
+		ids, err = collect(t, pagedServer(t, 5, false, &requests), ListOptions{Limit: 3})
+		assert.NoError(t, err)
+		assert.Equal(t, []int64{1, 2, 3}, ids)
+		assert.Equal(t, []string{"limit=3"}, requests)
+	})
+
+	t.Run("break", func(t *testing.T) {
+		requests := []string{}
+		sdtp := pagedServer(t, 5, true, &requests)
+		for file := range sdtp.ListStream(t.Context(), ListOptions{PageSize: 2}) {
+			if file.ID == 1 {
+				break
+			}
+		}
+		assert.Len(t, requests, 1)
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		sdtp := createMockClient(func(req *http.Request) *http.Response {
+			body := `{"files": [{"fileid":1,"name":"file1.txt"}, {"fileid":2,"na`
+			return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body))}
+		})
+		ids, err := collect(t, sdtp, ListOptions{})
+		assert.ErrorContains(t, err, "failed to decode response")
+		assert.Equal(t, []int64{1}, ids)
+	})
+
+	t.Run("null files", func(t *testing.T) {
+		sdtp := createMockClient(func(req *http.Request) *http.Response {
+			return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(`{"files": null}`))}
+		})
+		ids, err := collect(t, sdtp, ListOptions{})
+		assert.NoError(t, err)
+		assert.Empty(t, ids)
+	})
+
+	t.Run("not authorized", func(t *testing.T) {
+		sdtp := createMockClient(func(req *http.Request) *http.Response {
+			return &http.Response{StatusCode: http.StatusUnauthorized, Body: http.NoBody}
+		})
+		_, err := collect(t, sdtp, ListOptions{})
+		assert.Equal(t, ErrNotAuthorized, err)
+	})
+}
@@ -0,0 +1,164 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/asips/sdtp-client/internal/log"
+)
+
+// ErrLocked is returned, wrapped in a LockedError, when a lock is held by
+// another process.
+var ErrLocked = errors.New("locked")
+
+// processStart approximates when this process started.
+var processStart = time.Now()
+
+// lockPollInterval is how often Lock tries to take a lock held by another
+// process.
+var lockPollInterval = 500 * time.Millisecond
+
+// LockHolder describes the process holding a lock. It is written to the lock
+// file while the lock is held.
+type LockHolder struct {
+	PID       int       `json:"pid"`
+	Host      string    `json:"host"`
+	StartedAt time.Time `json:"started_at"`
+	Command   string    `json:"command"`
+}
+
+func (h LockHolder) String() string {
+	if h.PID == 0 {
+		return "an unknown process"
+	}
+	return fmt.Sprintf("pid %d on %s, started %s (%s)", h.PID, h.Host, h.StartedAt.Format(time.RFC3339), h.Command)
+}
+
+// LockedError is returned when a lock is held by another process.
+type LockedError struct {
+	Path string
+	// Holder is the process holding the lock, or zero if it could not be
+	// read.
+	Holder LockHolder
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("%s is locked by %s", e.Path, e.Holder)
+}
+
+func (e *LockedError) Unwrap() error {
+	return ErrLocked
+}
+
+// FileLock is an exclusive advisory lock on a file, held until Unlock is
+// called or the process exits. The operating system releases the lock when
+// the process exits, however it exits, so a lock file left behind by a process
+// that is gone never blocks another.
+type FileLock struct {
+	f    *os.File
+	path string
+}
+
+// TryLock takes the lock on the file at path, creating it if needed, without
+// waiting. If another process holds the lock a LockedError is returned. The
+// second value is the previous holder if it exited without releasing the lock,
+// i.e., the lock was stale, otherwise nil.
+func TryLock(path string) (*FileLock, *LockHolder, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := lockFile(f); err != nil {
+		holder, _ := readLockHolder(f)
+		f.Close()
+		if errors.Is(err, errWouldBlock) {
+			return nil, nil, &LockedError{Path: path, Holder: holder}
+		}
+		return nil, nil, fmt.Errorf("failed to lock %s: %w", path, err)
+	}
+
+	var stale *LockHolder
+	if holder, err := readLockHolder(f); err == nil && holder.PID != 0 {
+		stale = &holder
+	}
+	if err := writeLockHolder(f); err != nil {
+		unlockFile(f)
+		f.Close()
+		return nil, nil, fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return &FileLock{f: f, path: path}, stale, nil
+}
+
+// Lock takes the lock on the file at path, waiting while another process
+// holds it until ctx is done.
+func Lock(ctx context.Context, path string) (*FileLock, *LockHolder, error) {
+	var waiting *LockedError
+	for {
+		lock, stale, err := TryLock(path)
+		var locked *LockedError
+		if !errors.As(err, &locked) {
+			return lock, stale, err
+		}
+		if waiting == nil || waiting.Holder != locked.Holder {
+			log.Printf("%s; waiting for it to be released", locked)
+		}
+		waiting = locked
+
+		timer := time.NewTimer(lockPollInterval)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, nil, fmt.Errorf("%w: %w", locked, ctx.Err())
+		}
+	}
+}
+
+// Unlock clears the holder from the lock file and releases the lock. The
+// file is left in place since another process may already be waiting on it.
+func (l *FileLock) Unlock() error {
+	if l == nil {
+		return nil
+	}
+	err := l.f.Truncate(0)
+	return errors.Join(err, unlockFile(l.f), l.f.Close())
+}
+
+func readLockHolder(f *os.File) (LockHolder, error) {
+	holder := LockHolder{}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return holder, err
+	}
+	dat, err := io.ReadAll(f)
+	if err != nil || len(dat) == 0 {
+		return holder, err
+	}
+	err = json.Unmarshal(dat, &holder)
+	return holder, err
+}
+
+func writeLockHolder(f *os.File) error {
+	host, _ := os.Hostname()
+	dat, err := json.Marshal(LockHolder{
+		PID:       os.Getpid(),
+		Host:      host,
+		StartedAt: processStart.Truncate(time.Second),
+		Command:   strings.Join(os.Args, " "),
+	})
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(append(dat, '\n'), 0); err != nil {
+		return err
+	}
+	return f.Sync()
+}
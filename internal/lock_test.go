@@ -0,0 +1,75 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTryLock(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "test.lock")
+
+	lock, stale, err := TryLock(p)
+	require.NoError(t, err)
+	assert.Nil(t, stale)
+
+	// locks are per open file, so held against this process too
+	_, _, err = TryLock(p)
+	var locked *LockedError
+	require.ErrorAs(t, err, &locked)
+	assert.ErrorIs(t, err, ErrLocked)
+	assert.Equal(t, os.Getpid(), locked.Holder.PID)
+	assert.Equal(t, processStart.Truncate(time.Second).Unix(), locked.Holder.StartedAt.Unix())
+	assert.Contains(t, err.Error(), "is locked by pid ")
+
+	require.NoError(t, lock.Unlock())
+	dat, err := os.ReadFile(p)
+	require.NoError(t, err)
+	assert.Empty(t, dat, "holder is cleared on unlock")
+
+	lock, stale, err = TryLock(p)
+	require.NoError(t, err)
+	assert.Nil(t, stale)
+	require.NoError(t, lock.Unlock())
+}
+
+func TestTryLock_stale(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "test.lock")
+	// left by a process that exited without unlocking
+	holder := LockHolder{PID: 999999, Host: "other", StartedAt: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), Command: "sdtp ingest"}
+	dat, err := json.Marshal(holder)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(p, dat, 0644))
+
+	lock, stale, err := TryLock(p)
+	require.NoError(t, err)
+	defer lock.Unlock()
+	require.NotNil(t, stale)
+	assert.Equal(t, holder, *stale)
+}
+
+func TestLock_wait(t *testing.T) {
+	defer func(d time.Duration) { lockPollInterval = d }(lockPollInterval)
+	lockPollInterval = 10 * time.Millisecond
+	p := filepath.Join(t.TempDir(), "test.lock")
+
+	held, _, err := TryLock(p)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+	_, _, err = Lock(ctx, p)
+	assert.ErrorIs(t, err, ErrLocked)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	time.AfterFunc(30*time.Millisecond, func() { held.Unlock() })
+	lock, _, err := Lock(t.Context(), p)
+	require.NoError(t, err)
+	require.NoError(t, lock.Unlock())
+}
@@ -1,8 +1,11 @@
 package log
 
 import (
+	"fmt"
+	"io"
 	"log"
 	"os"
+	"sync"
 )
 
 var verbose = false
@@ -17,6 +20,14 @@ func SetVerbose(b bool) {
 	verbose = b
 }
 
+// SetOutput sets where messages are written, os.Stderr by default. Each
+// message is written with a single Write call.
+func SetOutput(w io.Writer) {
+	debugLogger.SetOutput(w)
+	infoLogger.SetOutput(w)
+	warnLogger.SetOutput(w)
+}
+
 func Debug(s string, args ...any) {
 	if verbose {
 		debugLogger.Printf(s, args...)
@@ -27,7 +38,59 @@ func Printf(format string, args ...any) {
 	infoLogger.Printf(format, args...)
 }
 
+func Warn(format string, args ...any) {
+	warnLogger.Printf(format, args...)
+}
+
+var (
+	exitMu    sync.Mutex
+	exitHooks []*func(error)
+)
+
+// AtExit registers fn to be called by Fatal and Exit before the process exits,
+// e.g., to flush buffered output, with the error it exits for, or nil. Hooks
+// are called most recently registered first. The returned func unregisters
+// fn.
+func AtExit(fn func(error)) (remove func()) {
+	exitMu.Lock()
+	defer exitMu.Unlock()
+	hook := &fn
+	exitHooks = append(exitHooks, hook)
+	return func() {
+		exitMu.Lock()
+		defer exitMu.Unlock()
+		for i, h := range exitHooks {
+			if h == hook {
+				exitHooks = append(exitHooks[:i], exitHooks[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// runExitHooks calls, and unregisters, the hooks registered with AtExit.
+func runExitHooks(err error) {
+	exitMu.Lock()
+	hooks := exitHooks
+	exitHooks = nil
+	exitMu.Unlock()
+	for i := len(hooks) - 1; i >= 0; i-- {
+		(*hooks[i])(err)
+	}
+}
+
+// Exit calls the hooks registered with AtExit then exits with code.
+func Exit(code int) {
+	var err error
+	if code != 0 {
+		err = fmt.Errorf("exit status %d", code)
+	}
+	runExitHooks(err)
+	os.Exit(code)
+}
+
 func Fatal(format string, args ...any) {
 	infoLogger.Printf(format, args...)
+	runExitHooks(fmt.Errorf(format, args...))
 	os.Exit(1)
 }
@@ -0,0 +1,23 @@
+package log
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAtExit(t *testing.T) {
+	var calls []string
+	AtExit(func(err error) { calls = append(calls, "first: "+err.Error()) })
+	remove := AtExit(func(error) { calls = append(calls, "removed") })
+	AtExit(func(err error) { calls = append(calls, "last: "+err.Error()) })
+	remove()
+
+	runExitHooks(errors.New("boom"))
+	assert.Equal(t, []string{"last: boom", "first: boom"}, calls)
+
+	// hooks are only called once
+	runExitHooks(nil)
+	assert.Len(t, calls, 2)
+}
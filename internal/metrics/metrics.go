@@ -0,0 +1,189 @@
+// Package metrics provides simple process-wide counters and gauges that can be
+// written out in the Prometheus text exposition format, e.g., for the
+// node_exporter textfile collector.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	mu       sync.Mutex
+	registry = map[string]*metric{}
+)
+
+type metric struct {
+	name   string
+	help   string
+	typ    string
+	label  string
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func register(name, help, typ, label string) *metric {
+	mu.Lock()
+	defer mu.Unlock()
+	if m, ok := registry[name]; ok {
+		return m
+	}
+	m := &metric{name: name, help: help, typ: typ, label: label, values: map[string]float64{}}
+	registry[name] = m
+	return m
+}
+
+func (m *metric) add(label string, delta float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[label] += delta
+}
+
+func (m *metric) set(label string, val float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[label] = val
+}
+
+func (m *metric) get(label string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.values[label]
+}
+
+// Counter is a value that only goes up.
+type Counter struct{ m *metric }
+
+// NewCounter returns the counter with name, registering it if necessary.
+func NewCounter(name, help string) *Counter {
+	return &Counter{register(name, help, "counter", "")}
+}
+
+func (c *Counter) Inc()              { c.m.add("", 1) }
+func (c *Counter) Add(delta float64) { c.m.add("", delta) }
+func (c *Counter) Value() float64    { return c.m.get("") }
+
+// CounterVec is a set of counters partitioned by the value of a single label.
+type CounterVec struct{ m *metric }
+
+// NewCounterVec returns the labelled counter with name, registering it if
+// necessary.
+func NewCounterVec(name, help, label string) *CounterVec {
+	return &CounterVec{register(name, help, "counter", label)}
+}
+
+// With returns the counter for the label value.
+func (c *CounterVec) With(value string) *LabelledCounter {
+	return &LabelledCounter{c.m, value}
+}
+
+type LabelledCounter struct {
+	m     *metric
+	value string
+}
+
+func (c *LabelledCounter) Inc()              { c.m.add(c.value, 1) }
+func (c *LabelledCounter) Add(delta float64) { c.m.add(c.value, delta) }
+func (c *LabelledCounter) Value() float64    { return c.m.get(c.value) }
+
+// Gauge is a value that can go up and down.
+type Gauge struct{ m *metric }
+
+// NewGauge returns the gauge with name, registering it if necessary.
+func NewGauge(name, help string) *Gauge {
+	return &Gauge{register(name, help, "gauge", "")}
+}
+
+func (g *Gauge) Set(val float64)   { g.m.set("", val) }
+func (g *Gauge) Add(delta float64) { g.m.add("", delta) }
+func (g *Gauge) Value() float64    { return g.m.get("") }
+
+// Snapshot returns the current value of every metric, keyed by name and, for
+// labelled metrics, the label, e.g., name{label="value"}.
+func Snapshot() map[string]float64 {
+	mu.Lock()
+	metrics := slices.Collect(maps.Values(registry))
+	mu.Unlock()
+
+	snap := map[string]float64{}
+	for _, m := range metrics {
+		m.mu.Lock()
+		for label, val := range m.values {
+			snap[m.key(label)] = val
+		}
+		m.mu.Unlock()
+	}
+	return snap
+}
+
+func (m *metric) key(label string) string {
+	if m.label == "" {
+		return m.name
+	}
+	return fmt.Sprintf("%s{%s=%q}", m.name, m.label, label)
+}
+
+// WriteText writes all metrics to w in the Prometheus text exposition format.
+func WriteText(w io.Writer) error {
+	mu.Lock()
+	names := slices.Sorted(maps.Keys(registry))
+	metrics := make([]*metric, 0, len(names))
+	for _, name := range names {
+		metrics = append(metrics, registry[name])
+	}
+	mu.Unlock()
+
+	for _, m := range metrics {
+		m.mu.Lock()
+		lines := []string{}
+		for label, val := range m.values {
+			lines = append(lines, fmt.Sprintf("%s %s", m.key(label), formatValue(val)))
+		}
+		m.mu.Unlock()
+		if len(lines) == 0 {
+			continue
+		}
+		sort.Strings(lines)
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s\n", m.name, m.help, m.name, m.typ, strings.Join(lines, "\n")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func formatValue(val float64) string {
+	if val == math.Trunc(val) && math.Abs(val) < 1e15 {
+		return fmt.Sprintf("%d", int64(val))
+	}
+	return fmt.Sprintf("%g", val)
+}
+
+// WriteFile writes all metrics to path, replacing it atomically so collectors
+// never read a partial file.
+func WriteFile(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := WriteText(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
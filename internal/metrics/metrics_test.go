@@ -0,0 +1,52 @@
+package metrics
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteText(t *testing.T) {
+	c := NewCounter("test_files_total", "Files processed.")
+	c.Add(3)
+	NewCounter("test_files_total", "Files processed.").Inc()
+	v := NewCounterVec("test_failures_total", "Failures by class.", "class")
+	v.With("checksum").Inc()
+	v.With("auth").Add(2)
+	g := NewGauge("test_workers", "Current workers.")
+	g.Set(1.5)
+	NewGauge("test_unset", "Never set.")
+
+	buf := &strings.Builder{}
+	assert.NoError(t, WriteText(buf))
+
+	assert.Equal(t, `# HELP test_failures_total Failures by class.
+# TYPE test_failures_total counter
+test_failures_total{class="auth"} 2
+test_failures_total{class="checksum"} 1
+# HELP test_files_total Files processed.
+# TYPE test_files_total counter
+test_files_total 4
+# HELP test_workers Current workers.
+# TYPE test_workers gauge
+test_workers 1.5
+`, buf.String())
+
+	snap := Snapshot()
+	assert.Equal(t, 4.0, snap["test_files_total"])
+	assert.Equal(t, 2.0, snap[`test_failures_total{class="auth"}`])
+}
+
+func TestWriteFile(t *testing.T) {
+	NewCounter("test_written_total", "Written.").Inc()
+	path := filepath.Join(t.TempDir(), "sdtp.prom")
+
+	assert.NoError(t, WriteFile(path))
+
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), "test_written_total 1\n")
+}
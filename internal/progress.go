@@ -0,0 +1,47 @@
+package internal
+
+import (
+	"context"
+	"io"
+)
+
+// ProgressFunc is called as the contents of a file are received with the
+// number of bytes read since the previous call. It is called from the
+// goroutine doing the transfer, so it may block to slow the transfer down.
+type ProgressFunc func(n int)
+
+type progressKey struct{}
+
+// WithProgress returns a context whose transfers report their progress to fn.
+func WithProgress(ctx context.Context, fn ProgressFunc) context.Context {
+	return context.WithValue(ctx, progressKey{}, fn)
+}
+
+func progressFrom(ctx context.Context) ProgressFunc {
+	fn, _ := ctx.Value(progressKey{}).(ProgressFunc)
+	return fn
+}
+
+// progressReader reports the bytes read from r to fn.
+type progressReader struct {
+	r  io.Reader
+	fn ProgressFunc
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.fn(n)
+	}
+	return n, err
+}
+
+// withProgress wraps r to report its progress to the ProgressFunc in ctx, if
+// any.
+func withProgress(ctx context.Context, r io.Reader) io.Reader {
+	fn := progressFrom(ctx)
+	if fn == nil {
+		return r
+	}
+	return &progressReader{r: r, fn: fn}
+}
@@ -0,0 +1,410 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/asips/sdtp-client/internal/log"
+	"github.com/asips/sdtp-client/internal/metrics"
+)
+
+var (
+	metricProviderFailovers = metrics.NewCounterVec("sdtp_provider_failovers_total",
+		"Requests sent to the next provider because a provider was unavailable.", "provider")
+	metricProviderDuplicates = metrics.NewCounter("sdtp_provider_duplicates_total",
+		"Files listed by more than one provider that were only transferred once.")
+)
+
+// ProviderMode is how a MultiClient uses its providers.
+type ProviderMode string
+
+const (
+	// ProviderFailover lists files from the first provider that is available.
+	ProviderFailover ProviderMode = "failover"
+	// ProviderMirror lists files from every provider, transferring a file
+	// listed by more than one of them only once and acking it on each.
+	ProviderMirror ProviderMode = "mirror"
+)
+
+// Provider is one of the SDTP providers of a MultiClient.
+type Provider struct {
+	Name   string
+	Client SDTPClient
+}
+
+// MultiClient is an SDTPClient for files available from an ordered list of
+// providers. A provider is unavailable if it cannot be reached or responds
+// with a 429 or 5xx, in which case the next provider is tried.
+//
+// Files are identified across providers by name and checksum, since file ids
+// are specific to a provider. Each file is downloaded from, and acked on, the
+// providers that listed it, so it must have been listed by this client first,
+// or its origins restored with SetOrigins, e.g., for a file left unacked by a
+// previous run. Files it knows nothing about are acked on the first provider.
+type MultiClient struct {
+	providers []Provider
+	mode      ProviderMode
+
+	mu sync.Mutex
+	// origins are the providers that have listed each file, by FileKey.
+	origins map[string][]origin
+}
+
+type origin struct {
+	provider int
+	// file is the file as listed by the provider.
+	file FileInfo
+}
+
+func NewMultiClient(mode ProviderMode, providers ...Provider) (*MultiClient, error) {
+	if len(providers) == 0 {
+		return nil, fmt.Errorf("no providers")
+	}
+	if mode != ProviderFailover && mode != ProviderMirror {
+		return nil, fmt.Errorf("unknown provider mode %q; must be failover or mirror", mode)
+	}
+	return &MultiClient{providers: providers, mode: mode, origins: map[string][]origin{}}, nil
+}
+
+// FileKey identifies file across providers by its name and checksum, as its id
+// is only unique on the provider that listed it.
+func FileKey(file FileInfo) string {
+	return file.Name + "\x00" + file.Checksum
+}
+
+// unavailable returns true if err means a provider could not be reached, or
+// could not handle the request, so another provider should be tried.
+func unavailable(ctx context.Context, err error) bool {
+	if err == nil || ctx.Err() != nil {
+		return false
+	}
+	var netErr net.Error
+	return IsOverloaded(err) || errors.As(err, &netErr)
+}
+
+func (m *MultiClient) addOrigin(provider int, file FileInfo) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := FileKey(file)
+	for i, o := range m.origins[key] {
+		if o.provider == provider {
+			m.origins[key][i].file = file
+			return
+		}
+	}
+	m.origins[key] = append(m.origins[key], origin{provider: provider, file: file})
+}
+
+// lookup returns the providers file can be transferred from, in order.
+func (m *MultiClient) lookup(file FileInfo) []origin {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	origins, ok := m.origins[FileKey(file)]
+	if !ok {
+		return []origin{{provider: 0, file: file}}
+	}
+	return append([]origin(nil), origins...)
+}
+
+// FileOrigin is a provider that listed a file, and the file's id there.
+type FileOrigin struct {
+	Provider string `json:"provider"`
+	ID       int64  `json:"fileid"`
+}
+
+// OriginTracker is implemented by clients for more than one provider, which
+// need to know which providers listed a file to ack it.
+type OriginTracker interface {
+	// Origins returns the providers that listed file and that it has not yet
+	// been acked on.
+	Origins(file FileInfo) []FileOrigin
+	// SetOrigins records that file was listed by origins.
+	SetOrigins(file FileInfo, origins []FileOrigin) error
+}
+
+func (m *MultiClient) Origins(file FileInfo) []FileOrigin {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	origins := []FileOrigin{}
+	for _, o := range m.origins[FileKey(file)] {
+		origins = append(origins, FileOrigin{Provider: m.providers[o.provider].Name, ID: o.file.ID})
+	}
+	return origins
+}
+
+// SetOrigins records that file was listed by origins, e.g., in a previous
+// run, so it is acked on those providers. It fails if a provider is unknown.
+func (m *MultiClient) SetOrigins(file FileInfo, origins []FileOrigin) error {
+	providers := map[string]int{}
+	for i, p := range m.providers {
+		providers[p.Name] = i
+	}
+	for _, o := range origins {
+		if _, ok := providers[o.Provider]; !ok {
+			return fmt.Errorf("unknown provider %q", o.Provider)
+		}
+	}
+	for _, o := range origins {
+		listed := file
+		listed.ID = o.ID
+		m.addOrigin(providers[o.Provider], listed)
+	}
+	return nil
+}
+
+// acked forgets that provider listed file, once it no longer has it to ack.
+func (m *MultiClient) acked(provider int, file FileInfo) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := FileKey(file)
+	origins := m.origins[key]
+	for i, o := range origins {
+		if o.provider == provider {
+			origins = append(origins[:i:i], origins[i+1:]...)
+			break
+		}
+	}
+	if len(origins) == 0 {
+		delete(m.origins, key)
+	} else {
+		m.origins[key] = origins
+	}
+}
+
+func (m *MultiClient) failover(from, to int, err error) {
+	metricProviderFailovers.With(m.providers[from].Name).Inc()
+	log.Warn("provider %s unavailable, trying %s; %s", m.providers[from].Name, m.providers[to].Name, err)
+}
+
+// providerListing lists files from client incrementally if it supports it.
+func providerListing(ctx context.Context, client SDTPClient, opts ListOptions) iter.Seq2[FileInfo, error] {
+	if streamer, ok := client.(FileStreamer); ok {
+		return streamer.ListStream(ctx, opts)
+	}
+	return func(yield func(FileInfo, error) bool) {
+		files, err := client.List(ctx, opts.Tags)
+		if err != nil {
+			yield(FileInfo{}, err)
+			return
+		}
+		for _, file := range files {
+			if !yield(file, nil) {
+				return
+			}
+		}
+	}
+}
+
+// ListStream yields the files listed by the first available provider or, in
+// mirror mode, by every provider, each file once. A provider that fails part
+// way through a listing is followed by the next, skipping the files already
+// yielded. An error is only yielded if every provider fails, or, in failover
+// mode, a provider fails for a reason other than being unavailable.
+func (m *MultiClient) ListStream(ctx context.Context, opts ListOptions) iter.Seq2[FileInfo, error] {
+	return func(yield func(FileInfo, error) bool) {
+		seen := map[string]bool{}
+		errs := []error{}
+		for i, p := range m.providers {
+			var err error
+			for file, lerr := range providerListing(ctx, p.Client, opts) {
+				if lerr != nil {
+					err = lerr
+					break
+				}
+				m.addOrigin(i, file)
+				key := FileKey(file)
+				if seen[key] {
+					metricProviderDuplicates.Inc()
+					continue
+				}
+				if opts.Limit > 0 && len(seen) >= opts.Limit {
+					return
+				}
+				seen[key] = true
+				if !yield(file, nil) {
+					return
+				}
+			}
+
+			switch {
+			case err == nil && m.mode == ProviderFailover:
+				return
+			case err == nil:
+				continue
+			case ctx.Err() != nil, m.mode == ProviderFailover && !unavailable(ctx, err):
+				yield(FileInfo{}, err)
+				return
+			}
+			errs = append(errs, fmt.Errorf("%s: %w", p.Name, err))
+			if m.mode == ProviderMirror {
+				log.Warn("failed to list files from provider %s; %s", p.Name, err)
+			} else if i+1 < len(m.providers) {
+				m.failover(i, i+1, err)
+			}
+		}
+		if len(errs) == len(m.providers) {
+			yield(FileInfo{}, errors.Join(errs...))
+		}
+	}
+}
+
+// List returns all files with tags, see ListStream.
+func (m *MultiClient) List(ctx context.Context, tags map[string]string) ([]FileInfo, error) {
+	files := []FileInfo{}
+	for file, err := range m.ListStream(ctx, ListOptions{Tags: tags}) {
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// transfer calls fn with each provider that listed file, in order, until one
+// succeeds or fails for a reason other than being unavailable.
+func (m *MultiClient) transfer(ctx context.Context, file FileInfo, fn func(SDTPClient, FileInfo) error) error {
+	origins := m.lookup(file)
+	for i, o := range origins {
+		err := fn(m.providers[o.provider].Client, o.file)
+		var partial *partialStreamError
+		if i+1 < len(origins) && unavailable(ctx, err) && !errors.As(err, &partial) {
+			m.failover(o.provider, origins[i+1].provider, err)
+			continue
+		}
+		return err
+	}
+	return nil
+}
+
+// Download writes file to destDir from the first available provider that
+// listed it.
+func (m *MultiClient) Download(ctx context.Context, file FileInfo, destDir string) error {
+	return m.transfer(ctx, file, func(client SDTPClient, file FileInfo) error {
+		return client.Download(ctx, file, destDir)
+	})
+}
+
+// Stream writes the contents of file to w from the first available provider
+// that listed it. Once anything has been written to w the stream is not
+// retried from another provider.
+func (m *MultiClient) Stream(ctx context.Context, file FileInfo, w io.Writer) error {
+	cw := &countingWriter{w: w}
+	return m.transfer(ctx, file, func(client SDTPClient, file FileInfo) error {
+		err := client.Stream(ctx, file, cw)
+		if err != nil && cw.n > 0 {
+			return &partialStreamError{err}
+		}
+		return err
+	})
+}
+
+// partialStreamError is a stream that failed after writing to its writer, so
+// cannot be retried from another provider.
+type partialStreamError struct {
+	err error
+}
+
+func (e *partialStreamError) Error() string { return e.err.Error() }
+func (e *partialStreamError) Unwrap() error { return e.err }
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// Ack acks file on every provider that listed it. A provider that no longer
+// has the file is ignored, unless none of them have it. Providers the file
+// has been acked on are not acked again if Ack is retried after an error.
+func (m *MultiClient) Ack(ctx context.Context, file FileInfo) error {
+	origins := m.lookup(file)
+	errs := []error{}
+	notFound := 0
+	for _, o := range origins {
+		p := m.providers[o.provider]
+		err := p.Client.Ack(ctx, o.file)
+		switch {
+		case err == nil:
+		case errors.Is(err, ErrNotFound):
+			notFound++
+			log.Debug("fileid=%d(%s) not found on provider %s", o.file.ID, o.file.Name, p.Name)
+		default:
+			errs = append(errs, fmt.Errorf("%s: %w", p.Name, err))
+			continue
+		}
+		m.acked(o.provider, file)
+	}
+	if notFound == len(origins) {
+		return ErrNotFound
+	}
+	return errors.Join(errs...)
+}
+
+// Register registers with every provider.
+func (m *MultiClient) Register(ctx context.Context) error {
+	errs := []error{}
+	for _, p := range m.providers {
+		if err := p.Client.Register(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", p.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Check checks the connection to every provider.
+func (m *MultiClient) Check(ctx context.Context) error {
+	errs := []error{}
+	for _, p := range m.providers {
+		if err := p.Client.Check(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", p.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// CertificateReloader is implemented by clients whose certificate can be
+// reloaded while running.
+type CertificateReloader interface {
+	ReloadCertificate() error
+	WatchCertificate(ctx context.Context, interval time.Duration)
+}
+
+// ReloadCertificate reloads the client certificate of every provider.
+func (m *MultiClient) ReloadCertificate() error {
+	errs := []error{}
+	for _, p := range m.providers {
+		if r, ok := p.Client.(CertificateReloader); ok {
+			if err := r.ReloadCertificate(); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", p.Name, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// WatchCertificate reloads the client certificate of each provider whenever
+// its files change, see DefaultSDTPClient.WatchCertificate.
+func (m *MultiClient) WatchCertificate(ctx context.Context, interval time.Duration) {
+	wg := sync.WaitGroup{}
+	for _, p := range m.providers {
+		if r, ok := p.Client.(CertificateReloader); ok {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				r.WatchCertificate(ctx, interval)
+			}()
+		}
+	}
+	wg.Wait()
+}
@@ -0,0 +1,280 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"iter"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeProvider is an SDTPClient serving files from memory.
+type fakeProvider struct {
+	files   []FileInfo
+	listErr error
+	// failAfter, if set, fails the listing with listErr after this many
+	// files.
+	failAfter int
+	getErr    error
+	ackErr    error
+
+	mu         sync.Mutex
+	downloaded []int64
+	acked      []int64
+}
+
+func (p *fakeProvider) List(ctx context.Context, tags map[string]string) ([]FileInfo, error) {
+	files := []FileInfo{}
+	for file, err := range p.ListStream(ctx, ListOptions{Tags: tags}) {
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+func (p *fakeProvider) ListStream(ctx context.Context, opts ListOptions) iter.Seq2[FileInfo, error] {
+	return func(yield func(FileInfo, error) bool) {
+		for i, file := range p.files {
+			if p.listErr != nil && i == p.failAfter {
+				break
+			}
+			if !yield(file, nil) {
+				return
+			}
+		}
+		if p.listErr != nil {
+			yield(FileInfo{}, p.listErr)
+		}
+	}
+}
+
+func (p *fakeProvider) Download(ctx context.Context, file FileInfo, destDir string) error {
+	return p.Stream(ctx, file, io.Discard)
+}
+
+func (p *fakeProvider) Stream(ctx context.Context, file FileInfo, w io.Writer) error {
+	if p.getErr != nil {
+		return p.getErr
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.downloaded = append(p.downloaded, file.ID)
+	_, err := w.Write([]byte(file.Name))
+	return err
+}
+
+func (p *fakeProvider) Ack(ctx context.Context, file FileInfo) error {
+	if p.ackErr != nil {
+		return p.ackErr
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.acked = append(p.acked, file.ID)
+	return nil
+}
+
+func (p *fakeProvider) Register(ctx context.Context) error { return nil }
+func (p *fakeProvider) Check(ctx context.Context) error    { return nil }
+
+var errUnreachable = &net.OpError{Op: "dial", Net: "tcp", Err: io.ErrUnexpectedEOF}
+
+func fileNames(t *testing.T, m *MultiClient) []string {
+	t.Helper()
+	files, err := m.List(t.Context(), nil)
+	require.NoError(t, err)
+	names := []string{}
+	for _, file := range files {
+		names = append(names, file.Name)
+	}
+	return names
+}
+
+func TestMultiClient_failover(t *testing.T) {
+	files := []FileInfo{{ID: 1, Name: "a", Checksum: "md5:a"}, {ID: 2, Name: "b", Checksum: "md5:b"}}
+	backupFiles := []FileInfo{{ID: 11, Name: "a", Checksum: "md5:a"}, {ID: 12, Name: "b", Checksum: "md5:b"}}
+
+	t.Run("primary available", func(t *testing.T) {
+		primary := &fakeProvider{files: files}
+		backup := &fakeProvider{files: backupFiles}
+		m, err := NewMultiClient(ProviderFailover, Provider{"primary", primary}, Provider{"backup", backup})
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{"a", "b"}, fileNames(t, m))
+		require.NoError(t, m.Download(t.Context(), files[0], t.TempDir()))
+		require.NoError(t, m.Ack(t.Context(), files[0]))
+		assert.Equal(t, []int64{1}, primary.downloaded)
+		assert.Equal(t, []int64{1}, primary.acked)
+		assert.Empty(t, backup.downloaded)
+		assert.Empty(t, backup.acked)
+	})
+
+	t.Run("primary unavailable", func(t *testing.T) {
+		primary := &fakeProvider{files: files, listErr: &StatusError{Code: http.StatusBadGateway, Status: "502 Bad Gateway"}}
+		backup := &fakeProvider{files: backupFiles}
+		m, err := NewMultiClient(ProviderFailover, Provider{"primary", primary}, Provider{"backup", backup})
+		require.NoError(t, err)
+
+		listed, err := m.List(t.Context(), nil)
+		require.NoError(t, err)
+		assert.Equal(t, backupFiles, listed)
+		require.NoError(t, m.Download(t.Context(), listed[0], t.TempDir()))
+		require.NoError(t, m.Ack(t.Context(), listed[0]))
+		assert.Empty(t, primary.acked)
+		assert.Equal(t, []int64{11}, backup.downloaded)
+		assert.Equal(t, []int64{11}, backup.acked)
+	})
+
+	t.Run("primary fails part way", func(t *testing.T) {
+		primary := &fakeProvider{files: files, listErr: errUnreachable, failAfter: 1}
+		backup := &fakeProvider{files: backupFiles}
+		m, err := NewMultiClient(ProviderFailover, Provider{"primary", primary}, Provider{"backup", backup})
+		require.NoError(t, err)
+
+		listed, err := m.List(t.Context(), nil)
+		require.NoError(t, err)
+		assert.Equal(t, []FileInfo{files[0], backupFiles[1]}, listed)
+	})
+
+	t.Run("not failed over for other errors", func(t *testing.T) {
+		primary := &fakeProvider{listErr: ErrForbidden}
+		backup := &fakeProvider{files: backupFiles}
+		m, err := NewMultiClient(ProviderFailover, Provider{"primary", primary}, Provider{"backup", backup})
+		require.NoError(t, err)
+
+		_, err = m.List(t.Context(), nil)
+		assert.ErrorIs(t, err, ErrForbidden)
+	})
+
+	t.Run("all unavailable", func(t *testing.T) {
+		primary := &fakeProvider{listErr: errUnreachable}
+		backup := &fakeProvider{listErr: &StatusError{Code: http.StatusServiceUnavailable, Status: "503 Service Unavailable"}}
+		m, err := NewMultiClient(ProviderFailover, Provider{"primary", primary}, Provider{"backup", backup})
+		require.NoError(t, err)
+
+		_, err = m.List(t.Context(), nil)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "primary: ")
+		assert.Contains(t, err.Error(), "backup: request failed: 503")
+	})
+}
+
+func TestMultiClient_mirror(t *testing.T) {
+	primary := &fakeProvider{files: []FileInfo{
+		{ID: 1, Name: "a", Checksum: "md5:a"},
+		{ID: 2, Name: "b", Checksum: "md5:b"},
+	}}
+	mirror := &fakeProvider{files: []FileInfo{
+		{ID: 21, Name: "b", Checksum: "md5:b"},
+		// same name, different content, so a different file
+		{ID: 22, Name: "a", Checksum: "md5:x"},
+		{ID: 23, Name: "c", Checksum: "md5:c"},
+	}}
+	m, err := NewMultiClient(ProviderMirror, Provider{"primary", primary}, Provider{"mirror", mirror})
+	require.NoError(t, err)
+
+	listed, err := m.List(t.Context(), nil)
+	require.NoError(t, err)
+	ids := []int64{}
+	for _, file := range listed {
+		ids = append(ids, file.ID)
+	}
+	assert.Equal(t, []int64{1, 2, 22, 23}, ids)
+
+	for _, file := range listed {
+		require.NoError(t, m.Download(t.Context(), file, t.TempDir()))
+		require.NoError(t, m.Ack(t.Context(), file))
+	}
+	assert.Equal(t, []int64{1, 2}, primary.downloaded)
+	assert.Equal(t, []int64{22, 23}, mirror.downloaded)
+	assert.Equal(t, []int64{1, 2}, primary.acked)
+	assert.Equal(t, []int64{21, 22, 23}, mirror.acked)
+}
+
+func TestMultiClient_mirrorUnavailable(t *testing.T) {
+	primary := &fakeProvider{files: []FileInfo{{ID: 1, Name: "a", Checksum: "md5:a"}}}
+	mirror := &fakeProvider{listErr: errUnreachable}
+	m, err := NewMultiClient(ProviderMirror, Provider{"primary", primary}, Provider{"mirror", mirror})
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"a"}, fileNames(t, m))
+}
+
+func TestMultiClient_downloadFailover(t *testing.T) {
+	file := FileInfo{ID: 1, Name: "a", Checksum: "md5:a"}
+	primary := &fakeProvider{files: []FileInfo{file}, getErr: &StatusError{Code: http.StatusInternalServerError, Status: "500"}}
+	mirror := &fakeProvider{files: []FileInfo{{ID: 21, Name: "a", Checksum: "md5:a"}}}
+	m, err := NewMultiClient(ProviderMirror, Provider{"primary", primary}, Provider{"mirror", mirror})
+	require.NoError(t, err)
+	_, err = m.List(t.Context(), nil)
+	require.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, m.Stream(t.Context(), file, buf))
+	assert.Equal(t, "a", buf.String())
+	assert.Equal(t, []int64{21}, mirror.downloaded)
+
+	// the checksum not matching is not a reason to fail over
+	primary.getErr = ErrChecksumMismatch
+	assert.ErrorIs(t, m.Download(t.Context(), file, t.TempDir()), ErrChecksumMismatch)
+	assert.Equal(t, []int64{21}, mirror.downloaded)
+}
+
+func TestMultiClient_ackRetry(t *testing.T) {
+	file := FileInfo{ID: 1, Name: "a", Checksum: "md5:a"}
+	primary := &fakeProvider{files: []FileInfo{file}}
+	mirror := &fakeProvider{files: []FileInfo{{ID: 21, Name: "a", Checksum: "md5:a"}}, ackErr: errUnreachable}
+	m, err := NewMultiClient(ProviderMirror, Provider{"primary", primary}, Provider{"mirror", mirror})
+	require.NoError(t, err)
+	_, err = m.List(t.Context(), nil)
+	require.NoError(t, err)
+
+	err = m.Ack(t.Context(), file)
+	require.Error(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "mirror: "), err.Error())
+
+	// the retry only acks on the provider that failed
+	mirror.ackErr = nil
+	require.NoError(t, m.Ack(t.Context(), file))
+	assert.Equal(t, []int64{1}, primary.acked)
+	assert.Equal(t, []int64{21}, mirror.acked)
+
+	// once acked everywhere the file is unknown, so acked on the first
+	// provider only, which no longer has it
+	primary.ackErr = ErrNotFound
+	assert.ErrorIs(t, m.Ack(t.Context(), file), ErrNotFound)
+}
+
+func TestNewMultiClient(t *testing.T) {
+	_, err := NewMultiClient(ProviderFailover)
+	assert.Error(t, err)
+	_, err = NewMultiClient("round-robin", Provider{"a", &fakeProvider{}})
+	assert.Error(t, err)
+}
+
+func TestMultiClient_setOrigins(t *testing.T) {
+	// a file listed by the backup in a previous run, whose id on the primary
+	// is another file
+	file := FileInfo{ID: 12, Name: "b", Checksum: "md5:b"}
+	primary := &fakeProvider{files: []FileInfo{{ID: 12, Name: "x", Checksum: "md5:x"}}}
+	backup := &fakeProvider{}
+	m, err := NewMultiClient(ProviderFailover, Provider{"primary", primary}, Provider{"backup", backup})
+	require.NoError(t, err)
+
+	assert.Error(t, m.SetOrigins(file, []FileOrigin{{Provider: "mirror", ID: 12}}))
+	require.NoError(t, m.SetOrigins(file, []FileOrigin{{Provider: "backup", ID: 12}}))
+	assert.Equal(t, []FileOrigin{{Provider: "backup", ID: 12}}, m.Origins(file))
+
+	require.NoError(t, m.Ack(t.Context(), file))
+	assert.Empty(t, primary.acked)
+	assert.Equal(t, []int64{12}, backup.acked)
+	assert.Empty(t, m.Origins(file))
+}
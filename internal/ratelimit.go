@@ -0,0 +1,217 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/asips/sdtp-client/internal/log"
+	"github.com/asips/sdtp-client/internal/metrics"
+)
+
+var (
+	metricRequestsThrottled = metrics.NewCounter("sdtp_requests_throttled_total",
+		"Requests delayed by the request rate limit or a server Retry-After.")
+	metricThrottleSeconds = metrics.NewCounter("sdtp_throttle_wait_seconds_total",
+		"Time requests spent waiting for the request rate limit or a server Retry-After.")
+	metricRateLimited = metrics.NewCounter("sdtp_rate_limited_responses_total",
+		"Responses asking the client to slow down, i.e., 429, or 503 with Retry-After.")
+	metricPaused = metrics.NewGauge("sdtp_client_paused",
+		"1 while all requests are paused following a server Retry-After.")
+)
+
+const (
+	// defaultRetryAfter is how long requests are paused for a rate limited
+	// response without a usable Retry-After header.
+	defaultRetryAfter = 5 * time.Second
+	// maxRetryAfter caps how long requests are paused for a single response.
+	maxRetryAfter = 5 * time.Minute
+)
+
+// RateLimit limits the requests sent to each host.
+type RateLimit struct {
+	// Rate is the sustained number of requests per second. Zero means no
+	// limit, though requests are still paused for a server Retry-After.
+	Rate float64
+	// Burst is the number of requests that may be sent at once after a quiet
+	// period. Values less than 1 are treated as 1.
+	Burst int
+	// Retries is how many times a rate limited request is sent again after
+	// the pause.
+	Retries int
+}
+
+// rateLimiter is a token bucket per host. A host can also be paused, holding
+// all requests to it, when it asks the client to back off.
+type rateLimiter struct {
+	limit RateLimit
+
+	mu    sync.Mutex
+	hosts map[string]*hostBucket
+	// now is replaced in tests.
+	now func() time.Time
+}
+
+type hostBucket struct {
+	tokens float64
+	last   time.Time
+	// paused holds requests until this time.
+	paused time.Time
+}
+
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	return &rateLimiter{limit: limit, hosts: map[string]*hostBucket{}, now: time.Now}
+}
+
+func (l *rateLimiter) bucket(host string) *hostBucket {
+	b, ok := l.hosts[host]
+	if !ok {
+		b = &hostBucket{tokens: float64(max(l.limit.Burst, 1)), last: l.now()}
+		l.hosts[host] = b
+	}
+	return b
+}
+
+// reserve takes a token for host, returning how long the caller must wait
+// before sending its request.
+func (l *rateLimiter) reserve(host string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	b := l.bucket(host)
+
+	var wait time.Duration
+	if b.paused.After(now) {
+		wait = b.paused.Sub(now)
+	}
+	if l.limit.Rate <= 0 {
+		return wait
+	}
+
+	// tokens accrue up to the burst, and go negative for requests queued
+	// behind the ones already waiting
+	burst := float64(max(l.limit.Burst, 1))
+	b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*l.limit.Rate)
+	b.last = now
+	b.tokens--
+	if b.tokens < 0 {
+		wait = max(wait, time.Duration(-b.tokens/l.limit.Rate*float64(time.Second)))
+	}
+	return wait
+}
+
+// wait blocks until a request may be sent to host, or ctx is done.
+func (l *rateLimiter) wait(ctx context.Context, host string) error {
+	if l == nil {
+		return nil
+	}
+	d := l.reserve(host)
+	if d <= 0 {
+		return nil
+	}
+	log.Debug("throttling request to %s for %s", host, d)
+	metricRequestsThrottled.Inc()
+	metricThrottleSeconds.Add(d.Seconds())
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// the request is not sent, so its token is free for the next
+		l.unreserve(host)
+		return ctx.Err()
+	}
+}
+
+// unreserve returns a token taken by reserve for a request that was not sent.
+func (l *rateLimiter) unreserve(host string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limit.Rate <= 0 {
+		return
+	}
+	b := l.bucket(host)
+	b.tokens = min(float64(max(l.limit.Burst, 1)), b.tokens+1)
+}
+
+// pause holds all requests to host for d. Overlapping pauses are not added
+// together.
+func (l *rateLimiter) pause(host string, d time.Duration) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	until := l.now().Add(d)
+	b := l.bucket(host)
+	if d > 0 && until.After(b.paused) {
+		log.Printf("%s asked the client to slow down; pausing all requests to it for %s", host, d)
+		b.paused = until
+		metricPaused.Set(1)
+		time.AfterFunc(d, l.unpaused)
+	}
+}
+
+// unpaused clears the paused metric once no host is paused.
+func (l *rateLimiter) unpaused() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	for _, b := range l.hosts {
+		if b.paused.After(now) {
+			return
+		}
+	}
+	metricPaused.Set(0)
+}
+
+// retryAfter returns how long resp asks the client to wait, and whether it is
+// asking the client to slow down at all, i.e., it is a 429, or a 503 with a
+// Retry-After header.
+func retryAfter(resp *http.Response, now time.Time) (time.Duration, bool) {
+	header := resp.Header.Get("Retry-After")
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+	case resp.StatusCode == http.StatusServiceUnavailable && header != "":
+	default:
+		return 0, false
+	}
+
+	d := defaultRetryAfter
+	if secs, err := strconv.Atoi(header); err == nil && secs >= 0 {
+		d = time.Duration(secs) * time.Second
+	} else if t, err := http.ParseTime(header); err == nil {
+		d = max(t.Sub(now), 0)
+	}
+	return min(d, maxRetryAfter), true
+}
+
+// do sends req once the rate limit allows. If the server asks the client to
+// slow down, requests to the host are paused for the Retry-After and req is
+// sent again, up to the configured number of retries. Requests are assumed to
+// have no body.
+func (s *DefaultSDTPClient) do(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	for attempt := 0; ; attempt++ {
+		if err := s.limiter.wait(req.Context(), host); err != nil {
+			return nil, err
+		}
+		resp, err := s.send(req, attempt)
+		if err != nil {
+			return nil, err
+		}
+		d, limited := retryAfter(resp, time.Now())
+		if !limited {
+			return resp, nil
+		}
+		metricRateLimited.Inc()
+		s.limiter.pause(host, d)
+		if s.limiter == nil || attempt >= s.limiter.limit.Retries {
+			return resp, nil
+		}
+		resp.Body.Close()
+	}
+}
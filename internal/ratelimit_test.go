@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter_reserve(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := newRateLimiter(RateLimit{Rate: 2, Burst: 2})
+	l.now = func() time.Time { return now }
+
+	// the burst is sent immediately, then requests are spaced by 1/rate
+	assert.Equal(t, time.Duration(0), l.reserve("a"))
+	assert.Equal(t, time.Duration(0), l.reserve("a"))
+	assert.Equal(t, 500*time.Millisecond, l.reserve("a"))
+	assert.Equal(t, time.Second, l.reserve("a"))
+
+	// hosts are limited separately
+	assert.Equal(t, time.Duration(0), l.reserve("b"))
+
+	now = now.Add(10 * time.Second)
+	assert.Equal(t, time.Duration(0), l.reserve("a"))
+
+	// a pause holds every request to the host
+	l.pause("a", 3*time.Second)
+	assert.Equal(t, 3*time.Second, l.reserve("a"))
+	assert.Equal(t, time.Duration(0), l.reserve("b"))
+}
+
+func TestRateLimiter_waitCancelled(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := newRateLimiter(RateLimit{Rate: 1, Burst: 1})
+	l.now = func() time.Time { return now }
+	assert.Equal(t, time.Duration(0), l.reserve("a"))
+
+	// a request given up on while waiting returns its token
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	assert.ErrorIs(t, l.wait(ctx, "a"), context.Canceled)
+	assert.Equal(t, time.Second, l.reserve("a"))
+}
+
+func TestRateLimiter_unlimited(t *testing.T) {
+	l := newRateLimiter(RateLimit{})
+	for range 100 {
+		assert.Equal(t, time.Duration(0), l.reserve("a"))
+	}
+	var nilLimiter *rateLimiter
+	assert.NoError(t, nilLimiter.wait(t.Context(), "a"))
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	resp := func(status int, header string) *http.Response {
+		r := &http.Response{StatusCode: status, Header: http.Header{}}
+		if header != "" {
+			r.Header.Set("Retry-After", header)
+		}
+		return r
+	}
+	tests := []struct {
+		Name    string
+		Resp    *http.Response
+		Want    time.Duration
+		Limited bool
+	}{
+		{"ok", resp(http.StatusOK, "10"), 0, false},
+		{"seconds", resp(http.StatusTooManyRequests, "10"), 10 * time.Second, true},
+		{"date", resp(http.StatusTooManyRequests, now.Add(time.Minute).Format(http.TimeFormat)), time.Minute, true},
+		{"missing", resp(http.StatusTooManyRequests, ""), defaultRetryAfter, true},
+		{"invalid", resp(http.StatusTooManyRequests, "soon"), defaultRetryAfter, true},
+		{"capped", resp(http.StatusTooManyRequests, "86400"), maxRetryAfter, true},
+		{"unavailable", resp(http.StatusServiceUnavailable, "2"), 2 * time.Second, true},
+		{"unavailable without header", resp(http.StatusServiceUnavailable, ""), 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			got, limited := retryAfter(tt.Resp, now)
+			assert.Equal(t, tt.Limited, limited)
+			assert.Equal(t, tt.Want, got)
+		})
+	}
+}
+
+func TestDo_retryAfter(t *testing.T) {
+	var requests atomic.Int32
+	sdtp := createMockClient(func(req *http.Request) *http.Response {
+		if requests.Add(1) == 1 {
+			return &http.Response{
+				StatusCode: http.StatusTooManyRequests,
+				Status:     "429 Too Many Requests",
+				Header:     http.Header{"Retry-After": []string{"0"}},
+				Body:       http.NoBody,
+			}
+		}
+		return &http.Response{StatusCode: http.StatusNoContent, Body: http.NoBody}
+	})
+	sdtp.limiter = newRateLimiter(RateLimit{Retries: 1})
+
+	assert.NoError(t, sdtp.Ack(t.Context(), FileInfo{ID: 1}))
+	assert.Equal(t, int32(2), requests.Load())
+
+	// once the retries are used up the rate limited response is returned
+	requests.Store(0)
+	sdtp.limiter.limit.Retries = 0
+	err := sdtp.Ack(t.Context(), FileInfo{ID: 1})
+	assert.True(t, IsOverloaded(err))
+	assert.Equal(t, int32(1), requests.Load())
+}
@@ -2,29 +2,50 @@ package internal
 
 import (
 	"context"
-	"crypto/md5"
-	"crypto/sha256"
-	"crypto/sha512"
 	"crypto/tls"
-	"encoding/json"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"hash"
 	"io"
 	"net/http"
 	"net/url"
 	"os"
-	"path"
 	"strings"
 	"time"
+
+	"github.com/asips/sdtp-client/internal/log"
+	"github.com/asips/sdtp-client/internal/trace"
 )
 
 var (
-	ErrNotAuthorized = fmt.Errorf("unable to authenticate with the provided certificate")
-	ErrNotFound      = fmt.Errorf("not found")
-	ErrForbidden     = fmt.Errorf("authenticated, but no permissions to the resource")
-	ErrExists        = fmt.Errorf("already exists")
+	ErrNotAuthorized    = fmt.Errorf("unable to authenticate with the provided certificate")
+	ErrNotFound         = fmt.Errorf("not found")
+	ErrForbidden        = fmt.Errorf("authenticated, but no permissions to the resource")
+	ErrExists           = fmt.Errorf("already exists")
+	ErrChecksumMismatch = fmt.Errorf("checksum mismatch")
 )
 
+// StatusError is returned for responses with an unexpected status.
+type StatusError struct {
+	Code   int
+	Status string
+}
+
+func (e *StatusError) Error() string {
+	return "request failed: " + e.Status
+}
+
+func statusError(resp *http.Response) error {
+	return &StatusError{Code: resp.StatusCode, Status: resp.Status}
+}
+
+// IsOverloaded returns true if err is a response indicating the server is
+// rate limiting or failing, i.e., a 429 or 5xx status.
+func IsOverloaded(err error) bool {
+	var se *StatusError
+	return errors.As(err, &se) && (se.Code == http.StatusTooManyRequests || se.Code >= 500)
+}
+
 // file returned to the client
 type FileInfo struct {
 	ID       int64             `json:"fileid"`
@@ -36,6 +57,23 @@ type FileInfo struct {
 	Extra    map[string]any    `json:"extra"`
 }
 
+var expiresLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02 15:04:05",
+}
+
+// ExpiresAt parses Expires. Timestamps without a zone are assumed to be UTC.
+func (f FileInfo) ExpiresAt() (time.Time, error) {
+	for _, layout := range expiresLayouts {
+		if t, err := time.Parse(layout, f.Expires); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid expires %q for %s", f.Expires, f.Name)
+}
+
 // SDTPClient is the interface for interacting with the SDTP server
 //
 // TODO: This interface is too heavy
@@ -44,6 +82,7 @@ type FileListor interface {
 }
 type FileDownloader interface {
 	Download(ctx context.Context, file FileInfo, destDir string) error
+	Stream(ctx context.Context, file FileInfo, w io.Writer) error
 	Ack(ctx context.Context, file FileInfo) error
 }
 
@@ -54,33 +93,98 @@ type SDTPClient interface {
 	Check(ctx context.Context) error
 }
 
+// ClientOptions are the optional settings for a DefaultSDTPClient.
+type ClientOptions struct {
+	// Timeout is the HTTP timeout for client operations.
+	Timeout time.Duration
+	// StagingDir, if set, is where files are downloaded and verified before
+	// being committed to their destination directory. It may be on a different
+	// filesystem than the destination.
+	StagingDir string
+	// Proxy, if set, is used for all requests rather than the proxy from the
+	// environment. See ParseProxyURL.
+	Proxy *url.URL
+	// NoProxy are hosts that are connected to directly, bypassing Proxy or the
+	// environment proxy.
+	NoProxy []string
+	// TLS are the TLS negotiation settings. If nil the DefaultTLSProfile is used.
+	TLS *TLSProfile
+	// RateLimit limits the rate requests are sent at.
+	RateLimit RateLimit
+}
+
 type DefaultSDTPClient struct {
-	client *http.Client
-	apiUrl *url.URL
+	client     *http.Client
+	apiUrl     *url.URL
+	stagingDir string
+	tlsProfile TLSProfile
+	certs      *CertReloader
+	limiter    *rateLimiter
 }
 
-func NewDefaultSDTP(apiUrl *url.URL, certFile, keyFile string, timeout time.Duration) (*DefaultSDTPClient, error) {
-	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+func NewDefaultSDTP(apiUrl *url.URL, certFile, keyFile string, opts ClientOptions) (*DefaultSDTPClient, error) {
+	certs, err := NewCertReloader(certFile, keyFile)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load key pair: %w", err)
+		return nil, err
 	}
 
+	profile := TLSProfiles[DefaultTLSProfile]
+	if opts.TLS != nil {
+		profile = *opts.TLS
+	}
+	if err := profile.Validate(); err != nil {
+		return nil, err
+	}
+	tlsConfig := profile.config()
+	tlsConfig.GetClientCertificate = certs.GetClientCertificate
+
 	return &DefaultSDTPClient{
-		apiUrl: apiUrl,
+		apiUrl:     apiUrl,
+		stagingDir: opts.StagingDir,
+		tlsProfile: profile,
+		certs:      certs,
+		limiter:    newRateLimiter(opts.RateLimit),
 		client: &http.Client{
 			Transport: &http.Transport{
-				TLSClientConfig: &tls.Config{
-					Certificates: []tls.Certificate{cert},
-					// disable TLS 1.3 to avoid Apache SSL error "Re-negotiation handshake failed"
-					MaxVersion: tls.VersionTLS12,
-					// set to avoid Apahce SSL error "SSL Library Error: error:0A000153:SSL routines::no renegotiation"
-					Renegotiation: tls.RenegotiateOnceAsClient,
-				},
+				Proxy:           proxyFunc(opts.Proxy, opts.NoProxy),
+				TLSClientConfig: tlsConfig,
 			},
-			Timeout: timeout,
+			Timeout: opts.Timeout,
 		}}, nil
 }
 
+// ReloadCertificate reloads the client certificate and key from disk. New
+// connections use the new certificate once it has been validated.
+func (s *DefaultSDTPClient) ReloadCertificate() error {
+	if err := s.certs.Reload(); err != nil {
+		return err
+	}
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// WatchCertificate reloads the client certificate whenever the certificate or
+// key file changes, checking every interval until ctx is done. A pair that
+// fails to load, e.g., because only one of the files has been replaced so far,
+// is retried on the next check.
+func (s *DefaultSDTPClient) WatchCertificate(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !s.certs.Changed() {
+				continue
+			}
+			if err := s.ReloadCertificate(); err != nil {
+				log.Printf("failed to reload client certificate, continuing with current certificate; %s", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
 func (s *DefaultSDTPClient) mustNewReq(ctx context.Context, method, url string) *http.Request {
 	req, err := http.NewRequestWithContext(ctx, method, url, nil)
 	if err != nil {
@@ -89,47 +193,86 @@ func (s *DefaultSDTPClient) mustNewReq(ctx context.Context, method, url string)
 	return req
 }
 
+// List returns all files with tags. See ListStream to process files as they
+// are listed.
 func (s *DefaultSDTPClient) List(ctx context.Context, tags map[string]string) ([]FileInfo, error) {
-	qry := url.Values{}
-	for k, v := range tags {
-		qry.Set(k, v)
+	files := []FileInfo{}
+	for file, err := range s.ListStream(ctx, ListOptions{Tags: tags}) {
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
 	}
-	epUrl := fmt.Sprintf("%s/files?%s", s.apiUrl.String(), qry.Encode())
+	return files, nil
+}
 
-	req := s.mustNewReq(ctx, http.MethodGet, epUrl)
-	resp, err := s.client.Do(req)
+// Download writes file to destDir, verifying its checksum. The file is written
+// to a hidden temporary file, see TempPath, which is synced to disk and renamed
+// into place only once verified, so a file with the final name is always
+// complete. If a staging directory is configured the file is downloaded there
+// first and copied to destDir if they are on different filesystems.
+func (s *DefaultSDTPClient) Download(ctx context.Context, file FileInfo, destDir string) (err error) {
+	ctx, span := trace.Start(ctx, "sdtp.Download", trace.KindInternal, fileAttrs(file)...)
+	span.SetAttributes(trace.String("sdtp.dest_dir", destDir))
+	defer func() {
+		span.RecordError(err)
+		span.End()
+	}()
+
+	tmpDir := destDir
+	if s.stagingDir != "" {
+		tmpDir = s.stagingDir
+	}
+	tmpPath := TempPath(tmpDir, file)
+	dest, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
 	if err != nil {
-		return nil, fmt.Errorf("failed to setup request: %w", err)
+		return fmt.Errorf("failed to create dest: %w", err)
 	}
-	defer resp.Body.Close()
 
-	switch resp.StatusCode {
-	case http.StatusUnauthorized:
-		return nil, ErrNotAuthorized
-	case http.StatusForbidden:
-		return nil, ErrForbidden
-	case http.StatusNotFound:
-		return nil, ErrNotFound
+	if err := s.Stream(ctx, file, dest); err != nil {
+		dest.Close()
+		os.Remove(tmpPath)
+		return err
 	}
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("request failed: %s", resp.Status)
+	if err := syncAndClose(dest); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write %s: %w", tmpPath, err)
 	}
 
-	var listResp struct {
-		Files []FileInfo `json:"files"`
-	}
-	if err := json.NewDecoder(resp.Body).Decode(&listResp); err != nil {
-		return nil, fmt.Errorf("failed to decode response: %w", err)
+	if tmpDir != destDir {
+		if err := commitStaged(tmpPath, destDir, file); err != nil {
+			os.Remove(tmpPath)
+			return err
+		}
+		return nil
 	}
-
-	return listResp.Files, nil
+	return commit(tmpPath, destDir, file.Name)
 }
 
-func (s *DefaultSDTPClient) Download(ctx context.Context, file FileInfo, destDir string) error {
+// Stream writes the contents of file to w, computing the checksum as the data
+// passes through. If the computed checksum does not match file.Checksum an error
+// wrapping ErrChecksumMismatch is returned, in which case everything already
+// written to w must be considered invalid.
+func (s *DefaultSDTPClient) Stream(ctx context.Context, file FileInfo, w io.Writer) (err error) {
+	ctx, span := trace.Start(ctx, "sdtp.Stream", trace.KindInternal, fileAttrs(file)...)
+	defer func() {
+		span.RecordError(err)
+		span.End()
+	}()
+
+	alg, expected, found := strings.Cut(file.Checksum, ":")
+	if !found {
+		return fmt.Errorf("invalid checksum format")
+	}
+	hash, err := newHash(alg)
+	if err != nil {
+		return err
+	}
+
 	epUrl := fmt.Sprintf("%s/files/%d", s.apiUrl, file.ID)
 
 	req := s.mustNewReq(ctx, http.MethodGet, epUrl)
-	resp, err := s.client.Do(req)
+	resp, err := s.do(req)
 	if err != nil {
 		return fmt.Errorf("failed to setup request: %w", err)
 	}
@@ -143,35 +286,36 @@ func (s *DefaultSDTPClient) Download(ctx context.Context, file FileInfo, destDir
 		return ErrNotFound
 	}
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("request failed: %s", resp.Status)
+		return statusError(resp)
 	}
 
-	destPath := path.Join(destDir, "."+file.Name)
-	dest, err := newWriter(destPath, file.Checksum)
+	n, err := io.Copy(io.MultiWriter(w, hash), withProgress(ctx, resp.Body))
+	span.SetAttributes(trace.Int64("sdtp.bytes", n))
 	if err != nil {
-		return fmt.Errorf("failed to create dest: %w", err)
+		return fmt.Errorf("failed to stream %s: %w", file.Name, err)
 	}
 
-	if _, err = io.Copy(dest, resp.Body); err != nil {
-		return fmt.Errorf("failed to write to %s: %w", destPath, err)
-	}
-	dest.Close()
-
-	if !dest.ChecksumMatches() {
-		os.Remove(destPath)
-		return fmt.Errorf("checksum mismatch for %s; got %s, wanted %s", file.Name, dest.Computed(), file.Checksum)
-	}
-	if err := os.Rename(destPath, path.Join(destDir, file.Name)); err != nil {
-		return fmt.Errorf("failed to rename %s to %s: %w", destPath, file.Name, err)
+	computed := hex.EncodeToString(hash.Sum(nil))
+	span.SetAttributes(trace.String("sdtp.checksum.algorithm", alg))
+	if !strings.EqualFold(computed, expected) {
+		span.SetAttributes(trace.String("sdtp.checksum.result", "mismatch"))
+		return fmt.Errorf("%w for %s; got %s, wanted %s", ErrChecksumMismatch, file.Name, computed, expected)
 	}
+	span.SetAttributes(trace.String("sdtp.checksum.result", "match"))
 	return nil
 }
 
-func (s *DefaultSDTPClient) Ack(ctx context.Context, file FileInfo) error {
+func (s *DefaultSDTPClient) Ack(ctx context.Context, file FileInfo) (err error) {
+	ctx, span := trace.Start(ctx, "sdtp.Ack", trace.KindInternal, fileAttrs(file)...)
+	defer func() {
+		span.RecordError(err)
+		span.End()
+	}()
+
 	epUrl := fmt.Sprintf("%s/files/%d", s.apiUrl, file.ID)
 
 	req := s.mustNewReq(ctx, http.MethodDelete, epUrl)
-	resp, err := s.client.Do(req)
+	resp, err := s.do(req)
 	if err != nil {
 		return fmt.Errorf("failed to setup request: %w", err)
 	}
@@ -189,14 +333,14 @@ func (s *DefaultSDTPClient) Ack(ctx context.Context, file FileInfo) error {
 		return nil
 	}
 
-	return fmt.Errorf("request failed: %s", resp.Status)
+	return statusError(resp)
 }
 
 func (s *DefaultSDTPClient) Register(ctx context.Context) error {
 	epUrl := fmt.Sprintf("%s/register", s.apiUrl)
 
 	req := s.mustNewReq(ctx, http.MethodPut, epUrl)
-	resp, err := s.client.Do(req)
+	resp, err := s.do(req)
 	if err != nil {
 		return fmt.Errorf("failed to setup request: %w", err)
 	}
@@ -214,86 +358,48 @@ func (s *DefaultSDTPClient) Register(ctx context.Context) error {
 	case http.StatusOK, http.StatusCreated:
 		return nil
 	}
-	return fmt.Errorf("request failed: %s", resp.Status)
+	return statusError(resp)
 }
 
 func (s *DefaultSDTPClient) Check(ctx context.Context) error {
+	_, err := s.CheckTLS(ctx)
+	return err
+}
+
+// CheckTLS performs the same request as Check, additionally returning the
+// negotiated TLS connection state. If the request fails during the handshake
+// the error includes a diagnosis in terms of the TLS profile, see
+// DiagnoseTLSError.
+func (s *DefaultSDTPClient) CheckTLS(ctx context.Context) (*tls.ConnectionState, error) {
 	epUrl := fmt.Sprintf("%s/files", s.apiUrl)
 
 	req := s.mustNewReq(ctx, http.MethodGet, epUrl)
-	resp, err := s.client.Do(req)
+	resp, err := s.do(req)
 	if err != nil {
-		return fmt.Errorf("failed to setup request: %w", err)
+		if diag := DiagnoseTLSError(err, s.tlsProfile); diag != "" {
+			return nil, fmt.Errorf("failed to setup request: %w; %s (tls profile: %s)", err, diag, s.tlsProfile)
+		}
+		return nil, fmt.Errorf("failed to setup request: %w", err)
 	}
 	defer resp.Body.Close()
 
 	switch resp.StatusCode {
 	case http.StatusUnauthorized:
-		return ErrNotAuthorized
+		return resp.TLS, ErrNotAuthorized
 	case http.StatusForbidden:
-		return ErrForbidden
+		return resp.TLS, ErrForbidden
 	case http.StatusNotFound:
-		return ErrNotFound
+		return resp.TLS, ErrNotFound
 	case http.StatusConflict:
-		return ErrExists
+		return resp.TLS, ErrExists
 	}
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("request failed: %s", resp.Status)
+		return resp.TLS, statusError(resp)
 	}
-	return nil
-}
-
-var _ SDTPClient = (*DefaultSDTPClient)(nil)
-
-type writer struct {
-	w            io.WriteCloser
-	h            hash.Hash
-	expectedCsum string
+	return resp.TLS, nil
 }
 
-func (w *writer) Close() error {
-	return w.w.Close()
-}
-
-func (w *writer) Write(p []byte) (int, error) {
-	_, err := w.h.Write(p)
-	if err != nil {
-		return 0, fmt.Errorf("checksum err: %w", err)
-	}
-	return w.w.Write(p)
-}
-
-func (w *writer) ChecksumMatches() bool {
-	return w.expectedCsum == w.Computed()
-}
-
-func (w *writer) Computed() string {
-	return strings.ToLower(fmt.Sprintf("%x", w.h.Sum(nil)))
-}
-
-func newWriter(destPath, checksum string) (*writer, error) {
-	alg, checksumVal, found := strings.Cut(checksum, ":")
-	if !found {
-		return nil, fmt.Errorf("invalid checksum format")
-	}
-
-	dest, err := os.OpenFile(destPath, os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open destination %s: %w", destPath, err)
-	}
-
-	var hash hash.Hash
-	switch strings.ToLower(alg) {
-	case "sha256":
-		hash = sha256.New()
-	case "sha384":
-		hash = sha512.New384()
-	case "sha512":
-		hash = sha512.New()
-	case "md5":
-		hash = md5.New()
-	default:
-		return nil, fmt.Errorf("%s checksum not supported", alg)
-	}
-	return &writer{dest, hash, checksumVal}, nil
-}
+var (
+	_ SDTPClient   = (*DefaultSDTPClient)(nil)
+	_ FileStreamer = (*DefaultSDTPClient)(nil)
+)
@@ -99,6 +99,52 @@ func TestDownload(t *testing.T) {
 		}
 	})
 
+	t.Run("staging", func(t *testing.T) {
+		tmpdir := t.TempDir()
+		stagingDir := t.TempDir()
+		body := `xxx`
+		sdtp := createMockClient(func(req *http.Request) *http.Response {
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(strings.NewReader(body)),
+			}
+		})
+		sdtp.stagingDir = stagingDir
+
+		err := sdtp.Download(t.Context(), FileInfo{
+			ID:       1,
+			Name:     "file1.txt",
+			Checksum: "md5:f561aaf6ef0bf14d4208bb46a4ccb3ad",
+		}, tmpdir)
+
+		if assert.NoError(t, err) {
+			data, err := os.ReadFile(tmpdir + "/file1.txt")
+			assert.NoError(t, err)
+			assert.Equal(t, body, string(data))
+			assert.NoFileExists(t, stagingDir+"/.file1.txt")
+		}
+	})
+
+	t.Run("checksum mismatch", func(t *testing.T) {
+		tmpdir := t.TempDir()
+		sdtp := createMockClient(func(req *http.Request) *http.Response {
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(strings.NewReader("xxx")),
+			}
+		})
+
+		err := sdtp.Download(t.Context(), FileInfo{
+			ID:       1,
+			Name:     "file1.txt",
+			Checksum: "md5:00000000000000000000000000000000",
+		}, tmpdir)
+
+		assert.ErrorIs(t, err, ErrChecksumMismatch)
+		assert.NoFileExists(t, tmpdir+"/file1.txt")
+		assert.NoFileExists(t, tmpdir+"/.file1.txt")
+	})
+
 	tests := []struct {
 		Status int
 		Err    error
@@ -123,6 +169,51 @@ func TestDownload(t *testing.T) {
 	}
 }
 
+func TestStream(t *testing.T) {
+	body := `xxx`
+	sdtp := createMockClient(func(req *http.Request) *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(body)),
+		}
+	})
+
+	t.Run("nominal", func(t *testing.T) {
+		buf := &strings.Builder{}
+		err := sdtp.Stream(t.Context(), FileInfo{
+			ID:       1,
+			Name:     "file1.txt",
+			Checksum: "md5:f561aaf6ef0bf14d4208bb46a4ccb3ad",
+		}, buf)
+
+		assert.NoError(t, err)
+		assert.Equal(t, body, buf.String())
+	})
+
+	t.Run("progress", func(t *testing.T) {
+		received := 0
+		ctx := WithProgress(t.Context(), func(n int) { received += n })
+		err := sdtp.Stream(ctx, FileInfo{
+			ID:       1,
+			Name:     "file1.txt",
+			Checksum: "md5:f561aaf6ef0bf14d4208bb46a4ccb3ad",
+		}, io.Discard)
+
+		assert.NoError(t, err)
+		assert.Equal(t, len(body), received)
+	})
+
+	t.Run("checksum mismatch", func(t *testing.T) {
+		err := sdtp.Stream(t.Context(), FileInfo{
+			ID:       1,
+			Name:     "file1.txt",
+			Checksum: "md5:00000000000000000000000000000000",
+		}, io.Discard)
+
+		assert.ErrorIs(t, err, ErrChecksumMismatch)
+	})
+}
+
 func TestAck(t *testing.T) {
 	tests := []struct {
 		Status int
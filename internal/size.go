@@ -0,0 +1,62 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// sizeUnits are the units of a size.
+var sizeUnits = []struct {
+	suffix string
+	mult   uint64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40},
+	{"B", 1},
+}
+
+// sizeUnit returns the multiplier of unit, ignoring case.
+func sizeUnit(unit string) (uint64, bool) {
+	for _, u := range sizeUnits {
+		if strings.EqualFold(unit, u.suffix) {
+			return u.mult, true
+		}
+	}
+	return 0, false
+}
+
+// IsSizeUnit returns true if unit is one of the units accepted by ParseSize.
+func IsSizeUnit(unit string) bool {
+	_, ok := sizeUnit(unit)
+	return ok
+}
+
+// ParseSize parses a byte size such as 500M, 2GB or 1.5TiB, as used by the size
+// flags and filter expressions. Units KB, MB, GB and TB are decimal, while K,
+// M, G, T and KiB, MiB, GiB, TiB are binary, and are case-insensitive. A value
+// with no unit is a number of bytes.
+func ParseSize(s string) (uint64, error) {
+	str := strings.TrimSpace(s)
+	mult := uint64(1)
+	if _, err := strconv.ParseFloat(str, 64); err != nil {
+		i := max(strings.IndexFunc(str, unicode.IsLetter), 0)
+		m, ok := sizeUnit(str[i:])
+		if !ok {
+			return 0, fmt.Errorf("invalid size %q", s)
+		}
+		str, mult = strings.TrimSpace(str[:i]), m
+	}
+	val, err := strconv.ParseFloat(str, 64)
+	if err != nil || val < 0 || math.IsNaN(val) || math.IsInf(val, 0) {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	size := val * float64(mult)
+	if size >= math.MaxUint64 {
+		return 0, fmt.Errorf("size %q is too large", s)
+	}
+	return uint64(size), nil
+}
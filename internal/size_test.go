@@ -0,0 +1,38 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		In   string
+		Want uint64
+	}{
+		{"0", 0},
+		{"1234", 1234},
+		{"100B", 100},
+		{"100b", 100},
+		{"10K", 10 << 10},
+		{"2GB", 2e9},
+		{"2 GiB", 2 << 30},
+		{"2gib", 2 << 30},
+		{"1.5T", 3 << 39},
+		{"500mb", 500e6},
+		{"10g", 10 << 30},
+		{"500m", 500 << 20},
+	}
+	for _, tt := range tests {
+		got, err := ParseSize(tt.In)
+		if assert.NoError(t, err, tt.In) {
+			assert.Equal(t, tt.Want, got, tt.In)
+		}
+	}
+
+	for _, in := range []string{"lots", "-1G", "1h30m", "GB", "inf", "NaN", "-Inf", "1e30TB"} {
+		_, err := ParseSize(in)
+		assert.Error(t, err, in)
+	}
+}
@@ -0,0 +1,186 @@
+package internal
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// TLSProfile are the TLS negotiation settings used to connect to a provider.
+type TLSProfile struct {
+	MinVersion    uint16
+	MaxVersion    uint16
+	Renegotiation tls.RenegotiationSupport
+	// CipherSuites, if set, limits the cipher suites offered for TLS 1.2 and
+	// earlier. TLS 1.3 cipher suites are not configurable.
+	CipherSuites []uint16
+}
+
+// DefaultTLSProfile is the profile used when none is configured.
+const DefaultTLSProfile = "apache-renegotiate"
+
+// TLSProfiles are the named starting points for a TLSProfile.
+var TLSProfiles = map[string]TLSProfile{
+	// For Apache providers that renegotiate to request the client certificate
+	// once the request path is known.
+	//
+	// TLS 1.3 is disabled to avoid Apache SSL error "Re-negotiation handshake failed"
+	// and renegotiation is allowed to avoid Apache SSL error
+	// "SSL Library Error: error:0A000153:SSL routines::no renegotiation".
+	"apache-renegotiate": {
+		MinVersion:    tls.VersionTLS12,
+		MaxVersion:    tls.VersionTLS12,
+		Renegotiation: tls.RenegotiateOnceAsClient,
+	},
+	// For providers that support TLS 1.3 and forbid renegotiation.
+	"modern": {
+		MinVersion:    tls.VersionTLS12,
+		MaxVersion:    tls.VersionTLS13,
+		Renegotiation: tls.RenegotiateNever,
+	},
+	"tls13": {
+		MinVersion:    tls.VersionTLS13,
+		MaxVersion:    tls.VersionTLS13,
+		Renegotiation: tls.RenegotiateNever,
+	},
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion parses a TLS version such as 1.2 or 1.3.
+func ParseTLSVersion(s string) (uint16, error) {
+	if v, ok := tlsVersions[strings.TrimPrefix(strings.ToLower(s), "tls")]; ok {
+		return v, nil
+	}
+	return 0, fmt.Errorf("invalid TLS version %q; must be one of 1.0, 1.1, 1.2 or 1.3", s)
+}
+
+var renegotiations = map[string]tls.RenegotiationSupport{
+	"never":  tls.RenegotiateNever,
+	"once":   tls.RenegotiateOnceAsClient,
+	"freely": tls.RenegotiateFreelyAsClient,
+}
+
+// ParseRenegotiation parses a renegotiation setting: never, once or freely.
+func ParseRenegotiation(s string) (tls.RenegotiationSupport, error) {
+	if r, ok := renegotiations[s]; ok {
+		return r, nil
+	}
+	return 0, fmt.Errorf("invalid renegotiation %q; must be one of never, once or freely", s)
+}
+
+func renegotiationName(r tls.RenegotiationSupport) string {
+	for name, val := range renegotiations {
+		if val == r {
+			return name
+		}
+	}
+	return fmt.Sprint(r)
+}
+
+// ParseCipherSuites parses cipher suite names, as given by tls.CipherSuiteName,
+// e.g., TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384.
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	known := map[string]uint16{}
+	for _, cs := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[cs.Name] = cs.ID
+	}
+	ids := []uint16{}
+	for _, name := range names {
+		id, ok := known[strings.ToUpper(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// Validate returns an error if the profile can never negotiate a connection.
+func (p TLSProfile) Validate() error {
+	if p.MinVersion != 0 && p.MaxVersion != 0 && p.MinVersion > p.MaxVersion {
+		return fmt.Errorf("TLS min version %s is greater than max version %s", tls.VersionName(p.MinVersion), tls.VersionName(p.MaxVersion))
+	}
+	return nil
+}
+
+func (p TLSProfile) String() string {
+	ciphers := "default"
+	if len(p.CipherSuites) > 0 {
+		names := []string{}
+		for _, id := range p.CipherSuites {
+			names = append(names, tls.CipherSuiteName(id))
+		}
+		ciphers = strings.Join(names, ",")
+	}
+	return fmt.Sprintf("min=%s max=%s renegotiation=%s ciphers=%s",
+		tls.VersionName(p.MinVersion), tls.VersionName(p.MaxVersion), renegotiationName(p.Renegotiation), ciphers)
+}
+
+func (p TLSProfile) config() *tls.Config {
+	return &tls.Config{
+		MinVersion:    p.MinVersion,
+		MaxVersion:    p.MaxVersion,
+		Renegotiation: p.Renegotiation,
+		CipherSuites:  slices.Clone(p.CipherSuites),
+	}
+}
+
+// TLS alerts, see RFC 8446 section 6.
+const (
+	alertHandshakeFailure    tls.AlertError = 40
+	alertBadCertificate      tls.AlertError = 42
+	alertCertificateExpired  tls.AlertError = 45
+	alertUnknownCA           tls.AlertError = 48
+	alertProtocolVersion     tls.AlertError = 70
+	alertInsufficientSec     tls.AlertError = 71
+	alertNoRenegotiation     tls.AlertError = 100
+	alertCertificateRequired tls.AlertError = 116
+)
+
+// DiagnoseTLSError returns an explanation of a failed handshake in terms of
+// the profile settings, or an empty string if err does not look like a TLS
+// negotiation failure.
+func DiagnoseTLSError(err error, p TLSProfile) string {
+	if err == nil {
+		return ""
+	}
+	var alert tls.AlertError
+	if errors.As(err, &alert) {
+		switch alert {
+		case alertProtocolVersion:
+			return fmt.Sprintf("the server does not support TLS %s to %s; adjust --tls-min-version/--tls-max-version",
+				tls.VersionName(p.MinVersion), tls.VersionName(p.MaxVersion))
+		case alertHandshakeFailure, alertInsufficientSec:
+			return "the server rejected the handshake; there may be no cipher suite in common, check --tls-ciphers " +
+				"and --tls-max-version, or the server may require a client certificate it did not receive"
+		case alertNoRenegotiation:
+			return "the server refused to renegotiate; try --tls-renegotiation=never or --tls-max-version=1.3"
+		case alertBadCertificate, alertCertificateExpired, alertUnknownCA, alertCertificateRequired:
+			return "the server rejected the client certificate; make sure it is valid, registered and signed by a CA the server trusts"
+		}
+	}
+
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "tls: no renegotiation"):
+		return "the server requested renegotiation, which is disabled; use --tls-renegotiation=once or --tls-profile=apache-renegotiate"
+	case strings.Contains(msg, "renegotiation"):
+		return "renegotiation failed; servers that renegotiate usually need --tls-max-version=1.2 and --tls-renegotiation=once"
+	case strings.Contains(msg, "protocol version not supported"), strings.Contains(msg, "server selected unsupported protocol version"):
+		return fmt.Sprintf("no TLS version in common with the server; the client allows %s to %s, adjust --tls-min-version/--tls-max-version",
+			tls.VersionName(p.MinVersion), tls.VersionName(p.MaxVersion))
+	case strings.Contains(msg, "no cipher suite supported"), strings.Contains(msg, "server chose an unconfigured cipher suite"):
+		return "no cipher suite in common with the server; check --tls-ciphers"
+	case strings.Contains(msg, "x509:"):
+		return "the server certificate could not be verified"
+	}
+	return ""
+}
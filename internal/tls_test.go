@@ -0,0 +1,81 @@
+package internal
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTLSSettings(t *testing.T) {
+	v, err := ParseTLSVersion("1.3")
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS13), v)
+	_, err = ParseTLSVersion("1.4")
+	assert.Error(t, err)
+
+	r, err := ParseRenegotiation("once")
+	assert.NoError(t, err)
+	assert.Equal(t, tls.RenegotiateOnceAsClient, r)
+	_, err = ParseRenegotiation("sometimes")
+	assert.Error(t, err)
+
+	ids, err := ParseCipherSuites([]string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"})
+	assert.NoError(t, err)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}, ids)
+	_, err = ParseCipherSuites([]string{"TLS_BOGUS"})
+	assert.Error(t, err)
+
+	assert.Error(t, TLSProfile{MinVersion: tls.VersionTLS13, MaxVersion: tls.VersionTLS12}.Validate())
+	assert.NoError(t, TLSProfiles[DefaultTLSProfile].Validate())
+}
+
+func TestDiagnoseTLSError(t *testing.T) {
+	profile := TLSProfiles["modern"]
+
+	assert.Contains(t, DiagnoseTLSError(fmt.Errorf("wrapped: %w", alertProtocolVersion), profile), "--tls-min-version")
+	assert.Contains(t, DiagnoseTLSError(alertHandshakeFailure, profile), "--tls-ciphers")
+	assert.Contains(t, DiagnoseTLSError(fmt.Errorf("local error: tls: no renegotiation"), profile), "--tls-renegotiation=once")
+	assert.Equal(t, "", DiagnoseTLSError(fmt.Errorf("connection refused"), profile))
+	assert.Equal(t, "", DiagnoseTLSError(nil, profile))
+}
+
+func TestCheckTLS(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	server.StartTLS()
+	defer server.Close()
+
+	newClient := func(profile TLSProfile) *DefaultSDTPClient {
+		roots := x509.NewCertPool()
+		roots.AddCert(server.Certificate())
+		cfg := profile.config()
+		cfg.RootCAs = roots
+		apiUrl, _ := url.Parse(server.URL)
+		return &DefaultSDTPClient{
+			apiUrl:     apiUrl,
+			tlsProfile: profile,
+			client:     &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}},
+		}
+	}
+
+	t.Run("negotiated", func(t *testing.T) {
+		state, err := newClient(TLSProfiles["modern"]).CheckTLS(t.Context())
+		assert.NoError(t, err)
+		if assert.NotNil(t, state) {
+			assert.Equal(t, uint16(tls.VersionTLS12), state.Version)
+		}
+	})
+
+	t.Run("version mismatch", func(t *testing.T) {
+		_, err := newClient(TLSProfiles["tls13"]).CheckTLS(t.Context())
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "--tls-max-version")
+		}
+	})
+}
@@ -0,0 +1,332 @@
+// Package trace provides minimal OpenTelemetry compatible tracing: spans with
+// attributes and events, W3C trace-context propagation, and export in the OTLP
+// JSON encoding to a collector or a file.
+//
+// Tracing is disabled until Init is called, in which case Start returns a nil
+// *Span, on which all methods are no-ops.
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type TraceID [16]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+
+type SpanID [8]byte
+
+func (s SpanID) String() string { return hex.EncodeToString(s[:]) }
+
+// SpanContext identifies a span, possibly in another process.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// TraceParent returns the W3C traceparent header value for sc.
+func (sc SpanContext) TraceParent() string {
+	return fmt.Sprintf("00-%s-%s-01", sc.TraceID, sc.SpanID)
+}
+
+// ParseTraceParent parses a W3C traceparent header value, e.g.,
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01.
+func ParseTraceParent(s string) (SpanContext, error) {
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return SpanContext{}, fmt.Errorf("invalid traceparent %q", s)
+	}
+	var sc SpanContext
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return SpanContext{}, fmt.Errorf("invalid traceparent %q: %w", s, err)
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return SpanContext{}, fmt.Errorf("invalid traceparent %q: %w", s, err)
+	}
+	if !sc.IsValid() {
+		return SpanContext{}, fmt.Errorf("invalid traceparent %q", s)
+	}
+	return sc, nil
+}
+
+// Attribute is a key/value pair describing a span or event.
+type Attribute struct {
+	Key   string
+	Value any
+}
+
+func String(key, val string) Attribute          { return Attribute{key, val} }
+func Int64(key string, val int64) Attribute     { return Attribute{key, val} }
+func Int(key string, val int) Attribute         { return Attribute{key, int64(val)} }
+func Bool(key string, val bool) Attribute       { return Attribute{key, val} }
+func Float64(key string, val float64) Attribute { return Attribute{key, val} }
+
+// SpanKind is the OTLP span kind.
+type SpanKind int
+
+const (
+	KindInternal SpanKind = 1
+	KindClient   SpanKind = 3
+)
+
+// Event is a timestamped annotation on a span.
+type Event struct {
+	Name  string
+	Time  time.Time
+	Attrs []Attribute
+}
+
+// Span is a timed operation. Methods are safe for concurrent use and on a nil
+// *Span.
+type Span struct {
+	mu       sync.Mutex
+	sc       SpanContext
+	parent   SpanID
+	name     string
+	kind     SpanKind
+	start    time.Time
+	end      time.Time
+	attrs    []Attribute
+	events   []Event
+	errorMsg string
+	failed   bool
+	ended    bool
+}
+
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+func (s *Span) SetAttributes(attrs ...Attribute) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs = append(s.attrs, attrs...)
+}
+
+func (s *Span) AddEvent(name string, attrs ...Attribute) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, Event{Name: name, Time: time.Now(), Attrs: attrs})
+}
+
+// RecordError marks the span as failed with err, if err is not nil.
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.AddEvent("exception", String("exception.message", err.Error()))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failed = true
+	s.errorMsg = err.Error()
+}
+
+// End completes the span and queues it for export. Only the first call has
+// any effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+	enqueue(s)
+}
+
+type spanKey struct{}
+type remoteKey struct{}
+
+// SpanFromContext returns the current span in ctx, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// ContextWithRemoteParent returns a context whose spans are children of sc,
+// e.g., from a traceparent received from another process.
+func ContextWithRemoteParent(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// Start starts a span named name, a child of the current span in ctx, if any,
+// returning a context containing the new span. If tracing is not enabled the
+// span is nil and ctx is returned as is.
+func Start(ctx context.Context, name string, kind SpanKind, attrs ...Attribute) (context.Context, *Span) {
+	if !Enabled() {
+		return ctx, nil
+	}
+	span := &Span{name: name, kind: kind, start: time.Now(), attrs: attrs}
+	if parent := SpanFromContext(ctx); parent != nil {
+		span.sc.TraceID = parent.sc.TraceID
+		span.parent = parent.sc.SpanID
+	} else if remote, ok := ctx.Value(remoteKey{}).(SpanContext); ok && remote.IsValid() {
+		span.sc.TraceID = remote.TraceID
+		span.parent = remote.SpanID
+	} else {
+		rand.Read(span.sc.TraceID[:])
+	}
+	rand.Read(span.sc.SpanID[:])
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// Inject sets the W3C traceparent header for the current span in ctx.
+func Inject(ctx context.Context, h http.Header) {
+	if span := SpanFromContext(ctx); span != nil {
+		h.Set("traceparent", span.sc.TraceParent())
+	}
+}
+
+// Exporter sends completed spans somewhere.
+type Exporter interface {
+	Export(ctx context.Context, resource []Attribute, spans []*Span) error
+	Shutdown(ctx context.Context) error
+}
+
+const (
+	queueSize     = 2048
+	batchSize     = 256
+	flushInterval = 5 * time.Second
+)
+
+var (
+	mu       sync.Mutex
+	exporter Exporter
+	queue    chan *Span
+	done     chan struct{}
+	dropped  int
+)
+
+// Init enables tracing, exporting spans in batches with exp. Resource
+// attributes, e.g., service.name, describe the process. Call Shutdown to
+// export remaining spans before exiting.
+func Init(exp Exporter, res ...Attribute) {
+	mu.Lock()
+	defer mu.Unlock()
+	exporter = exp
+	queue = make(chan *Span, queueSize)
+	done = make(chan struct{})
+	go export(exp, res, queue, done)
+}
+
+// Enabled returns true if Init has been called.
+func Enabled() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return exporter != nil
+}
+
+func enqueue(span *Span) {
+	mu.Lock()
+	defer mu.Unlock()
+	if queue == nil {
+		return
+	}
+	select {
+	case queue <- span:
+	default:
+		// never block the traced operation on export
+		dropped++
+	}
+}
+
+func export(exp Exporter, res []Attribute, queue <-chan *Span, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	batch := []*Span{}
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		// errors are reported by Shutdown, the last chance to do so
+		if err := exp.Export(ctx, res, batch); err != nil {
+			recordExportError(err)
+		}
+		batch = []*Span{}
+	}
+	for {
+		select {
+		case span, ok := <-queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, span)
+			if len(batch) >= batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+var (
+	exportErrMu sync.Mutex
+	exportErr   error
+)
+
+func recordExportError(err error) {
+	exportErrMu.Lock()
+	defer exportErrMu.Unlock()
+	if exportErr == nil {
+		exportErr = err
+	}
+}
+
+// Shutdown exports any remaining spans and disables tracing. It returns the
+// first export error, if any.
+func Shutdown(ctx context.Context) error {
+	mu.Lock()
+	exp, q, d, n := exporter, queue, done, dropped
+	exporter, queue, done, dropped = nil, nil, nil, 0
+	mu.Unlock()
+	if exp == nil {
+		return nil
+	}
+
+	close(q)
+	select {
+	case <-d:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	exportErrMu.Lock()
+	err := exportErr
+	exportErr = nil
+	exportErrMu.Unlock()
+	if n > 0 {
+		err = errors.Join(err, fmt.Errorf("dropped %d spans; export queue full", n))
+	}
+	return errors.Join(err, exp.Shutdown(ctx))
+}
@@ -0,0 +1,147 @@
+package trace
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type memoryExporter struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+func (e *memoryExporter) Export(ctx context.Context, resource []Attribute, spans []*Span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func (e *memoryExporter) Shutdown(ctx context.Context) error { return nil }
+
+func TestParseTraceParent(t *testing.T) {
+	sc, err := ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	require.NoError(t, err)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+	assert.Equal(t, "00f067aa0ba902b7", sc.SpanID.String())
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", sc.TraceParent())
+
+	for _, s := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-zzf067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	} {
+		_, err := ParseTraceParent(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	ctx, span := Start(t.Context(), "op", KindInternal)
+	assert.Nil(t, span)
+	assert.Equal(t, t.Context(), ctx)
+	// methods are no-ops on a nil span
+	span.SetAttributes(String("k", "v"))
+	span.RecordError(errors.New("failed"))
+	span.End()
+
+	h := http.Header{}
+	Inject(ctx, h)
+	assert.Empty(t, h.Get("traceparent"))
+	assert.NoError(t, Shutdown(t.Context()))
+}
+
+func TestStart(t *testing.T) {
+	exp := &memoryExporter{}
+	Init(exp)
+
+	remote, err := ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	require.NoError(t, err)
+	ctx, parent := Start(ContextWithRemoteParent(t.Context(), remote), "parent", KindInternal)
+	childCtx, child := Start(ctx, "child", KindClient, Int("n", 1))
+	child.RecordError(errors.New("failed"))
+
+	h := http.Header{}
+	Inject(childCtx, h)
+	assert.Equal(t, child.SpanContext().TraceParent(), h.Get("traceparent"))
+
+	child.End()
+	parent.End()
+	parent.End()
+	require.NoError(t, Shutdown(t.Context()))
+	assert.False(t, Enabled())
+
+	require.Len(t, exp.spans, 2)
+	assert.Equal(t, remote.TraceID, exp.spans[1].sc.TraceID)
+	assert.Equal(t, remote.SpanID, exp.spans[1].parent)
+	assert.Equal(t, remote.TraceID, exp.spans[0].sc.TraceID)
+	assert.Equal(t, parent.sc.SpanID, exp.spans[0].parent)
+	assert.True(t, exp.spans[0].failed)
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var got otlpRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/traces", r.URL.Path)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+	}))
+	defer srv.Close()
+
+	Init(NewOTLPExporter(srv.URL), String("service.name", "test"))
+	_, span := Start(t.Context(), "op", KindInternal, String("s", "v"), Int64("i", 42), Bool("b", true))
+	span.AddEvent("event")
+	span.End()
+	require.NoError(t, Shutdown(t.Context()))
+
+	require.Len(t, got.ResourceSpans, 1)
+	assert.Equal(t, "service.name", got.ResourceSpans[0].Resource.Attributes[0].Key)
+	spans := got.ResourceSpans[0].ScopeSpans[0].Spans
+	require.Len(t, spans, 1)
+	assert.Equal(t, "op", spans[0].Name)
+	assert.Equal(t, span.sc.TraceID.String(), spans[0].TraceID)
+	assert.Equal(t, "42", *spans[0].Attributes[1].Value.IntValue)
+	assert.True(t, *spans[0].Attributes[2].Value.BoolValue)
+	assert.Equal(t, "event", spans[0].Events[0].Name)
+}
+
+func TestOTLPExporter_Error(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	Init(NewOTLPExporter(srv.URL + "/v1/traces"))
+	_, span := Start(t.Context(), "op", KindInternal)
+	span.End()
+	assert.ErrorContains(t, Shutdown(t.Context()), "503")
+}
+
+func TestFileExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traces.json")
+	exp, err := NewFileExporter(path)
+	require.NoError(t, err)
+
+	Init(exp)
+	_, span := Start(t.Context(), "op", KindInternal)
+	span.End()
+	require.NoError(t, Shutdown(t.Context()))
+
+	dat, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var req otlpRequest
+	require.NoError(t, json.Unmarshal(dat, &req))
+	assert.Equal(t, "op", req.ResourceSpans[0].ScopeSpans[0].Spans[0].Name)
+}
@@ -0,0 +1,185 @@
+package internal
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/asips/sdtp-client/internal/trace"
+)
+
+// send sends req, recording it as a client span, a child of the span in the
+// request context, with the connection timings from httptrace and a W3C
+// traceparent header. The span ends when the response body is closed so it
+// includes the body transfer. attempt is the number of times req has already
+// been sent.
+func (s *DefaultSDTPClient) send(req *http.Request, attempt int) (*http.Response, error) {
+	ctx, span := trace.Start(req.Context(), "HTTP "+req.Method, trace.KindClient,
+		trace.String("http.request.method", req.Method),
+		trace.String("url.full", req.URL.String()),
+		trace.String("server.address", req.URL.Hostname()),
+	)
+	if span == nil {
+		return s.client.Do(req)
+	}
+	if attempt > 0 {
+		span.SetAttributes(trace.Int("http.request.resend_count", attempt))
+	}
+
+	timings := &httpTimings{span: span}
+	req = req.WithContext(httptrace.WithClientTrace(ctx, timings.clientTrace()))
+	trace.Inject(ctx, req.Header)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		span.RecordError(err)
+		span.End()
+		return nil, err
+	}
+	span.SetAttributes(trace.Int("http.response.status_code", resp.StatusCode))
+	if resp.TLS != nil {
+		span.SetAttributes(
+			trace.String("tls.protocol.version", tls.VersionName(resp.TLS.Version)),
+			trace.String("tls.cipher", tls.CipherSuiteName(resp.TLS.CipherSuite)),
+		)
+	}
+	if resp.StatusCode >= 400 {
+		span.RecordError(fmt.Errorf("request failed: %s", resp.Status))
+	}
+	resp.Body = &tracedBody{ReadCloser: resp.Body, timings: timings}
+	return resp, nil
+}
+
+// httpTimings records the phases of a request as span events and durations.
+// httptrace hooks may be called concurrently, e.g., when dialing several
+// addresses.
+type httpTimings struct {
+	span *trace.Span
+
+	mu                                     sync.Mutex
+	dnsStart, connectStart, handshakeStart time.Time
+	wroteRequest, firstByte                time.Time
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+func (t *httpTimings) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			t.mu.Lock()
+			t.dnsStart = time.Now()
+			t.mu.Unlock()
+			t.span.AddEvent("dns.start", trace.String("host", info.Host))
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			t.mu.Lock()
+			d := time.Since(t.dnsStart)
+			t.mu.Unlock()
+			t.span.AddEvent("dns.done", trace.Int("addresses", len(info.Addrs)))
+			t.span.SetAttributes(trace.Float64("http.dns_ms", ms(d)))
+		},
+		ConnectStart: func(network, addr string) {
+			t.mu.Lock()
+			t.connectStart = time.Now()
+			t.mu.Unlock()
+			t.span.AddEvent("connect.start", trace.String("network.peer.address", addr))
+		},
+		ConnectDone: func(network, addr string, err error) {
+			t.mu.Lock()
+			d := time.Since(t.connectStart)
+			t.mu.Unlock()
+			if err != nil {
+				t.span.AddEvent("connect.error", trace.String("network.peer.address", addr), trace.String("error", err.Error()))
+				return
+			}
+			t.span.AddEvent("connect.done", trace.String("network.peer.address", addr))
+			t.span.SetAttributes(trace.Float64("http.connect_ms", ms(d)))
+		},
+		TLSHandshakeStart: func() {
+			t.mu.Lock()
+			t.handshakeStart = time.Now()
+			t.mu.Unlock()
+			t.span.AddEvent("tls.handshake.start")
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			t.mu.Lock()
+			d := time.Since(t.handshakeStart)
+			t.mu.Unlock()
+			if err != nil {
+				t.span.AddEvent("tls.handshake.error", trace.String("error", err.Error()))
+				return
+			}
+			t.span.AddEvent("tls.handshake.done", trace.String("tls.protocol.version", tls.VersionName(state.Version)))
+			t.span.SetAttributes(trace.Float64("http.tls_handshake_ms", ms(d)))
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.span.AddEvent("got_conn", trace.Bool("reused", info.Reused))
+		},
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			t.mu.Lock()
+			t.wroteRequest = time.Now()
+			t.mu.Unlock()
+			t.span.AddEvent("wrote_request")
+		},
+		// Any renegotiation happens after the request is written, so it is
+		// included in the time to first byte.
+		GotFirstResponseByte: func() {
+			t.mu.Lock()
+			t.firstByte = time.Now()
+			d := t.firstByte.Sub(t.wroteRequest)
+			t.mu.Unlock()
+			t.span.AddEvent("got_first_response_byte")
+			t.span.SetAttributes(trace.Float64("http.time_to_first_byte_ms", ms(d)))
+		},
+	}
+}
+
+// tracedBody ends the request span once the body has been read and closed,
+// recording the body transfer size and duration.
+type tracedBody struct {
+	io.ReadCloser
+	timings *httpTimings
+	n       int64
+}
+
+func (b *tracedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+func (b *tracedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.timings.mu.Lock()
+	firstByte := b.timings.firstByte
+	b.timings.mu.Unlock()
+
+	span := b.timings.span
+	span.SetAttributes(trace.Int64("http.response.body.size", b.n))
+	if !firstByte.IsZero() {
+		span.SetAttributes(trace.Float64("http.body_transfer_ms", ms(time.Since(firstByte))))
+	}
+	span.End()
+	return err
+}
+
+// fileAttrs are the span attributes describing file.
+func fileAttrs(file FileInfo) []trace.Attribute {
+	attrs := []trace.Attribute{
+		trace.Int64("sdtp.file.id", file.ID),
+		trace.String("sdtp.file.name", file.Name),
+		trace.Int64("sdtp.file.size", file.Size),
+		trace.String("sdtp.file.checksum", file.Checksum),
+		trace.String("sdtp.file.expires", file.Expires),
+	}
+	for k, v := range file.Tags {
+		attrs = append(attrs, trace.String("sdtp.file.tags."+k, v))
+	}
+	return attrs
+}
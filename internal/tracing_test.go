@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/asips/sdtp-client/internal/trace"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTracing(t *testing.T) {
+	var traceparent string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		w.Write([]byte(`{"files": [{"fileid": 1, "name": "file1.txt"}]}`))
+	}))
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	apiUrl, _ := url.Parse(server.URL)
+	client := &DefaultSDTPClient{
+		apiUrl: apiUrl,
+		client: &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}},
+	}
+
+	path := filepath.Join(t.TempDir(), "traces.json")
+	exp, err := trace.NewFileExporter(path)
+	require.NoError(t, err)
+	trace.Init(exp)
+
+	files, err := client.List(t.Context(), map[string]string{"stream": "test"})
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+	require.NoError(t, trace.Shutdown(t.Context()))
+
+	dat, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var req struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceID      string `json:"traceId"`
+					SpanID       string `json:"spanId"`
+					ParentSpanID string `json:"parentSpanId"`
+					Name         string `json:"name"`
+					Attributes   []struct {
+						Key string `json:"key"`
+					} `json:"attributes"`
+					Events []struct {
+						Name string `json:"name"`
+					} `json:"events"`
+				} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	require.NoError(t, json.Unmarshal(dat, &req))
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	require.Len(t, spans, 2)
+
+	// the request span ends when the body is closed, before the List span
+	httpSpan, listSpan := spans[0], spans[1]
+	assert.Equal(t, "HTTP GET", httpSpan.Name)
+	assert.Equal(t, "sdtp.List", listSpan.Name)
+	assert.Equal(t, listSpan.TraceID, httpSpan.TraceID)
+	assert.Equal(t, listSpan.SpanID, httpSpan.ParentSpanID)
+	assert.Equal(t, "00-"+httpSpan.TraceID+"-"+httpSpan.SpanID+"-01", traceparent)
+
+	events := []string{}
+	for _, event := range httpSpan.Events {
+		events = append(events, event.Name)
+	}
+	assert.Subset(t, events, []string{"connect.done", "tls.handshake.done", "wrote_request", "got_first_response_byte"})
+	attrs := []string{}
+	for _, attr := range httpSpan.Attributes {
+		attrs = append(attrs, attr.Key)
+	}
+	assert.Subset(t, attrs, []string{"http.response.status_code", "http.tls_handshake_ms", "http.time_to_first_byte_ms", "http.response.body.size"})
+}